@@ -0,0 +1,157 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"github.com/juju/charmstore-client/internal/ingest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// aclConfig holds the contents of an ACL policy file.
+type aclConfig struct {
+	// Owner holds the user given write access by default.
+	Owner string `yaml:"owner"`
+
+	// Read and Write hold the default ACLs.
+	Read  []string `yaml:"read"`
+	Write []string `yaml:"write"`
+
+	// Channels holds ACLs for particular channels.
+	Channels map[params.Channel]yamlACL `yaml:"channels"`
+
+	// Rules holds ACLs for base entities matching patterns.
+	Rules []yamlACLRule `yaml:"rules"`
+
+	// CopySource specifies that ACLs are copied from the source.
+	CopySource bool `yaml:"copy-source"`
+
+	// Renames maps user and group names in the source
+	// to the names used in the destination.
+	Renames map[string]string `yaml:"renames"`
+}
+
+// yamlACL holds the ACLs for a channel.
+type yamlACL struct {
+	Read  []string `yaml:"read"`
+	Write []string `yaml:"write"`
+}
+
+// yamlACLRule holds an entry in the rules of an ACL policy file.
+type yamlACLRule struct {
+	Pattern  string                     `yaml:"pattern"`
+	Read     []string                   `yaml:"read"`
+	Write    []string                   `yaml:"write"`
+	Channels map[params.Channel]yamlACL `yaml:"channels"`
+}
+
+// parseACLFile parses the ACL policy file with the given name.
+// See parseACLConfig.
+func parseACLFile(fileName string) (*aclConfig, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseACLConfig(fileName, f)
+}
+
+// parseACLConfig parses an ACL policy file read from r.
+// For example:
+//
+//	owner: ingest-admin
+//	read: [staff]
+//	channels:
+//	  edge:
+//	    read: [developers]
+//	rules:
+//	- pattern: cs:~partner/*
+//	  read: [partners, staff]
+//	copy-source: true
+//	renames:
+//	  everyone: staff
+func parseACLConfig(filename string, r io.Reader) (*aclConfig, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var cfg aclConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %s", filename)
+	}
+	if err := cfg.check(); err != nil {
+		return nil, errgo.Notef(err, "%s", filename)
+	}
+	return &cfg, nil
+}
+
+// check checks that the ACL policy is valid.
+func (cfg *aclConfig) check() error {
+	if err := checkACLChannels(cfg.Channels); err != nil {
+		return errgo.Mask(err)
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Pattern == "" {
+			return errgo.Newf("rule %d has no pattern", i+1)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return errgo.Newf("invalid pattern %q", rule.Pattern)
+		}
+		if err := checkACLChannels(rule.Channels); err != nil {
+			return errgo.Notef(err, "rule %q", rule.Pattern)
+		}
+	}
+	return nil
+}
+
+func checkACLChannels(chans map[params.Channel]yamlACL) error {
+	for ch := range chans {
+		if !params.ValidChannels[ch] {
+			return errgo.Newf("invalid channel %q", ch)
+		}
+	}
+	return nil
+}
+
+// policy returns the ACL policy specified by cfg.
+func (cfg *aclConfig) policy() *ingest.ACLPolicy {
+	p := &ingest.ACLPolicy{
+		Read:       cfg.Read,
+		Write:      cfg.Write,
+		Channels:   aclChannels(cfg.Channels),
+		CopySource: cfg.CopySource,
+		Renames:    cfg.Renames,
+	}
+	for _, rule := range cfg.Rules {
+		p.Rules = append(p.Rules, ingest.ACLRule{
+			Pattern: rule.Pattern,
+			ACL: ingest.ACL{
+				Read:  rule.Read,
+				Write: rule.Write,
+			},
+			Channels: aclChannels(rule.Channels),
+		})
+	}
+	return p
+}
+
+func aclChannels(chans map[params.Channel]yamlACL) map[params.Channel]ingest.ACL {
+	if len(chans) == 0 {
+		return nil
+	}
+	m := make(map[params.Channel]ingest.ACL)
+	for ch, acl := range chans {
+		m[ch] = ingest.ACL{
+			Read:  acl.Read,
+			Write: acl.Write,
+		}
+	}
+	return m
+}
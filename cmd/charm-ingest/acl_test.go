@@ -0,0 +1,113 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"github.com/juju/charmstore-client/internal/ingest"
+)
+
+var aclConfigTests = []struct {
+	testName     string
+	config       string
+	expectOwner  string
+	expectPolicy *ingest.ACLPolicy
+	expectError  string
+}{{
+	testName: "full",
+	config: `
+owner: ingest-admin
+read: [staff]
+write: [ingest-admin, ops]
+channels:
+  edge:
+    read: [developers]
+rules:
+- pattern: cs:~partner/*
+  read: [partners, staff]
+  channels:
+    stable:
+      write: [partner-admin]
+copy-source: true
+renames:
+  everyone: staff
+`,
+	expectOwner: "ingest-admin",
+	expectPolicy: &ingest.ACLPolicy{
+		Read:  []string{"staff"},
+		Write: []string{"ingest-admin", "ops"},
+		Channels: map[params.Channel]ingest.ACL{
+			params.EdgeChannel: {
+				Read: []string{"developers"},
+			},
+		},
+		Rules: []ingest.ACLRule{{
+			Pattern: "cs:~partner/*",
+			ACL: ingest.ACL{
+				Read: []string{"partners", "staff"},
+			},
+			Channels: map[params.Channel]ingest.ACL{
+				params.StableChannel: {
+					Write: []string{"partner-admin"},
+				},
+			},
+		}},
+		CopySource: true,
+		Renames: map[string]string{
+			"everyone": "staff",
+		},
+	},
+}, {
+	testName:     "empty",
+	config:       ``,
+	expectPolicy: &ingest.ACLPolicy{},
+}, {
+	testName: "invalid_channel",
+	config: `
+channels:
+  nightly:
+    read: [developers]
+`,
+	expectError: `invalid_channel: invalid channel "nightly"`,
+}, {
+	testName: "rule_without_pattern",
+	config: `
+rules:
+- read: [staff]
+`,
+	expectError: `rule_without_pattern: rule 1 has no pattern`,
+}, {
+	testName: "bad_pattern",
+	config: `
+rules:
+- pattern: "cs:~bob/[x"
+`,
+	expectError: `bad_pattern: invalid pattern "cs:~bob/\[x"`,
+}, {
+	testName: "unknown_field",
+	config: `
+reed: [staff]
+`,
+	expectError: `cannot parse unknown_field: (.|\n)*field reed not found in type main.aclConfig`,
+}}
+
+func TestParseACLConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range aclConfigTests {
+		c.Run(test.testName, func(c *qt.C) {
+			cfg, err := parseACLConfig(test.testName, strings.NewReader(test.config))
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Check(cfg.Owner, qt.Equals, test.expectOwner)
+			c.Check(cfg.policy(), qt.DeepEquals, test.expectPolicy)
+		})
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/charmstore-client/internal/ingest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// config holds the contents of a configuration file. Relative
+// file names in it are interpreted relative to the directory
+// holding the file.
+type config struct {
+	// Source and Destination hold the charm stores to copy
+	// from and to.
+	Source      storeConfig `yaml:"source"`
+	Destination storeConfig `yaml:"destination"`
+
+	// Sources holds several charm stores to copy from, in
+	// priority order, instead of Source.
+	Sources []namedStoreConfig `yaml:"sources"`
+
+	// Destinations holds several charm stores to copy to
+	// at once, instead of Destination.
+	Destinations []namedStoreConfig `yaml:"destinations"`
+
+	// Whitelist holds the name of the whitelist file.
+	Whitelist string `yaml:"whitelist"`
+
+	// Concurrency, SourceConcurrency and DestinationConcurrency
+	// correspond to the concurrency, src-concurrency and
+	// dest-concurrency flags.
+	Concurrency            int `yaml:"concurrency"`
+	SourceConcurrency      int `yaml:"source-concurrency"`
+	DestinationConcurrency int `yaml:"destination-concurrency"`
+
+	// DownloadLimit and UploadLimit correspond to the
+	// download-limit and upload-limit flags.
+	DownloadLimit byteRate `yaml:"download-limit"`
+	UploadLimit   byteRate `yaml:"upload-limit"`
+
+	// MaxDisk and HardDiskLimit correspond to the maxdisk
+	// and hardlimit flags.
+	MaxDisk       int64 `yaml:"max-disk"`
+	HardDiskLimit bool  `yaml:"hard-disk-limit"`
+
+	// Retries corresponds to the retries flag. It's a pointer
+	// so that zero, which turns off retries, can be told
+	// apart from no setting.
+	Retries *int `yaml:"retries"`
+
+	// TempDir holds the directory to store temporary files in.
+	TempDir string `yaml:"temp-dir"`
+
+	// Timeout corresponds to the timeout flag.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// CacheDir and CacheSize correspond to the cache-dir
+	// and cache-size flags.
+	CacheDir  string    `yaml:"cache-dir"`
+	CacheSize byteCount `yaml:"cache-size"`
+
+	// ACL holds the ACL policy, in the same form as the file
+	// named by the acl flag.
+	ACL *aclConfig `yaml:"acl"`
+
+	// Rewrites holds the rewrite rules, in the same form as the
+	// file named by the rewrite flag.
+	Rewrites []yamlRewriteRule `yaml:"rewrites"`
+
+	// Log holds logging and reporting settings.
+	Log logConfig `yaml:"log"`
+}
+
+// storeConfig holds the location of a charm store and
+// the credentials to use for it.
+type storeConfig struct {
+	// URL holds the URL of the charm store.
+	URL string `yaml:"url"`
+
+	// Auth holds a username and password in user:passwd form
+	// for basic HTTP authentication.
+	Auth string `yaml:"auth"`
+
+	// Agent holds the name of a file holding agent login details.
+	Agent string `yaml:"agent"`
+}
+
+// namedStoreConfig holds one of several source or destination
+// charm stores. The fields other than Name are as for storeConfig.
+type namedStoreConfig struct {
+	// Name identifies the charm store in reports. If it's
+	// empty, the URL is used.
+	Name string `yaml:"name"`
+
+	URL   string `yaml:"url"`
+	Auth  string `yaml:"auth"`
+	Agent string `yaml:"agent"`
+}
+
+// logConfig holds the logging settings in a configuration file.
+type logConfig struct {
+	// Debug, EventLog and Report correspond to the debug,
+	// event-log and report flags.
+	Debug    bool   `yaml:"debug"`
+	EventLog string `yaml:"event-log"`
+	Report   string `yaml:"report"`
+}
+
+// parseConfigFile parses the configuration file with the given name.
+// See parseConfig.
+func parseConfigFile(fileName string) (*config, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := parseConfig(fileName, f)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cfg.resolvePaths(filepath.Dir(fileName))
+	return cfg, nil
+}
+
+// parseConfig parses a configuration file read from r.
+// For example:
+//
+//	source:
+//	  url: https://api.jujucharms.com/charmstore
+//	  agent: source-agent.json
+//	destination:
+//	  url: https://charmstore.internal/charmstore
+//	  auth: admin:secret
+//	whitelist: whitelist.yaml
+//	concurrency: 20
+//	upload-limit: 10M
+//	max-disk: 10737418240
+//	temp-dir: /var/tmp/charm-ingest
+//	acl:
+//	  owner: ingest-admin
+//	  read: [staff]
+//	log:
+//	  event-log: /var/log/charm-ingest/events.json
+func parseConfig(filename string, r io.Reader) (*config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var cfg config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %s", filename)
+	}
+	if len(cfg.Sources) > 0 && cfg.Source != (storeConfig{}) {
+		return nil, errgo.Newf("%s: cannot give both source and sources", filename)
+	}
+	if len(cfg.Destinations) > 0 && cfg.Destination != (storeConfig{}) {
+		return nil, errgo.Newf("%s: cannot give both destination and destinations", filename)
+	}
+	auths := []string{cfg.Source.Auth, cfg.Destination.Auth}
+	for _, stores := range []struct {
+		what string
+		list []namedStoreConfig
+	}{{"source", cfg.Sources}, {"destination", cfg.Destinations}} {
+		names := make(map[string]bool)
+		for i := range stores.list {
+			s := &stores.list[i]
+			if s.URL == "" {
+				return nil, errgo.Newf("%s: %s %d has no URL", filename, stores.what, i+1)
+			}
+			if s.Name == "" {
+				s.Name = s.URL
+			}
+			if names[s.Name] {
+				return nil, errgo.Newf("%s: more than one %s named %q", filename, stores.what, s.Name)
+			}
+			names[s.Name] = true
+			auths = append(auths, s.Auth)
+		}
+	}
+	for _, auth := range auths {
+		if auth != "" {
+			if err := new(authInfo).Set(auth); err != nil {
+				return nil, errgo.Notef(err, "%s", filename)
+			}
+		}
+	}
+	if r := cfg.Log.Report; r != "" && r != "text" && r != "json" {
+		return nil, errgo.Newf("%s: unknown report format %q", filename, r)
+	}
+	if cfg.ACL != nil {
+		if err := cfg.ACL.check(); err != nil {
+			return nil, errgo.Notef(err, "%s: acl", filename)
+		}
+	}
+	if _, err := rewriteRules(cfg.Rewrites); err != nil {
+		return nil, errgo.Notef(err, "%s: rewrites", filename)
+	}
+	return &cfg, nil
+}
+
+// resolvePaths makes the relative file names in cfg
+// relative to the given directory.
+func (cfg *config) resolvePaths(dir string) {
+	paths := []*string{
+		&cfg.Whitelist,
+		&cfg.Source.Agent,
+		&cfg.Destination.Agent,
+		&cfg.TempDir,
+		&cfg.CacheDir,
+		&cfg.Log.EventLog,
+	}
+	for i := range cfg.Sources {
+		paths = append(paths, &cfg.Sources[i].Agent)
+	}
+	for i := range cfg.Destinations {
+		paths = append(paths, &cfg.Destinations[i].Agent)
+	}
+	for _, p := range paths {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+}
+
+// flagValues holds the values of the flags that can also be
+// set in a configuration file.
+type flagValues struct {
+	debug           *bool
+	maxDisk         *int64
+	hardDiskLimit   *bool
+	report          *string
+	eventLog        *string
+	retries         *int
+	tempDir         *string
+	timeout         *time.Duration
+	cacheDir        *string
+	cacheSize       *byteCount
+	concurrency     *int
+	srcConcurrency  *int
+	destConcurrency *int
+	downloadLimit   *byteRate
+	uploadLimit     *byteRate
+	auth            *authInfo
+	srcAuth         *authInfo
+}
+
+// apply sets each of the values in v that has a setting in cfg,
+// except for those whose flags are in the given set, which
+// have been given on the command line.
+func (cfg *config) apply(v flagValues, set map[string]bool) {
+	if cfg.Log.Debug && !set["debug"] {
+		*v.debug = true
+	}
+	if cfg.MaxDisk != 0 && !set["maxdisk"] {
+		*v.maxDisk = cfg.MaxDisk
+	}
+	if cfg.HardDiskLimit && !set["hardlimit"] {
+		*v.hardDiskLimit = true
+	}
+	if cfg.Log.Report != "" && !set["report"] {
+		*v.report = cfg.Log.Report
+	}
+	if cfg.Log.EventLog != "" && !set["event-log"] {
+		*v.eventLog = cfg.Log.EventLog
+	}
+	if cfg.Retries != nil && !set["retries"] {
+		*v.retries = *cfg.Retries
+	}
+	if cfg.TempDir != "" && !set["temp-dir"] {
+		*v.tempDir = cfg.TempDir
+	}
+	if cfg.Timeout != 0 && !set["timeout"] {
+		*v.timeout = cfg.Timeout
+	}
+	if cfg.CacheDir != "" && !set["cache-dir"] {
+		*v.cacheDir = cfg.CacheDir
+	}
+	if cfg.CacheSize != 0 && !set["cache-size"] {
+		*v.cacheSize = cfg.CacheSize
+	}
+	if cfg.Concurrency != 0 && !set["concurrency"] {
+		*v.concurrency = cfg.Concurrency
+	}
+	if cfg.SourceConcurrency != 0 && !set["src-concurrency"] {
+		*v.srcConcurrency = cfg.SourceConcurrency
+	}
+	if cfg.DestinationConcurrency != 0 && !set["dest-concurrency"] {
+		*v.destConcurrency = cfg.DestinationConcurrency
+	}
+	if cfg.DownloadLimit != 0 && !set["download-limit"] {
+		*v.downloadLimit = cfg.DownloadLimit
+	}
+	if cfg.UploadLimit != 0 && !set["upload-limit"] {
+		*v.uploadLimit = cfg.UploadLimit
+	}
+	// The credentials have already been checked by parseConfig.
+	if cfg.Destination.Auth != "" && !set["auth"] {
+		v.auth.Set(cfg.Destination.Auth)
+	}
+	if cfg.Destination.Agent != "" {
+		v.auth.agentFile = cfg.Destination.Agent
+	}
+	if cfg.Source.Auth != "" && !set["src-auth"] {
+		v.srcAuth.Set(cfg.Source.Auth)
+	}
+	if cfg.Source.Agent != "" && !set["src-agent"] {
+		v.srcAuth.agentFile = cfg.Source.Agent
+	}
+}
+
+// destinations returns the destination charm stores given by cfg.
+// Those that have no credentials of their own use auth.
+func (cfg *config) destinations(auth authInfo) []namedStore {
+	if cfg.Destination.URL != "" {
+		return []namedStore{{
+			url:  cfg.Destination.URL,
+			auth: auth,
+		}}
+	}
+	return namedStores(cfg.Destinations, auth)
+}
+
+// sources returns the source charm stores given by the sources
+// list in cfg, or nil if there isn't one. Those that have no
+// credentials of their own use auth.
+func (cfg *config) sources(auth authInfo) []namedStore {
+	return namedStores(cfg.Sources, auth)
+}
+
+// namedStores returns the charm stores in the given list.
+// Those that have no credentials of their own use auth.
+func namedStores(list []namedStoreConfig, auth authInfo) []namedStore {
+	var stores []namedStore
+	for _, s := range list {
+		store := namedStore{
+			name: s.Name,
+			url:  s.URL,
+			auth: auth,
+		}
+		if s.Auth != "" || s.Agent != "" {
+			// The credentials have already been checked by parseConfig.
+			store.auth = authInfo{
+				agentFile: s.Agent,
+			}
+			store.auth.Set(s.Auth)
+		}
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+// rewrites returns the rewrite rules given by cfg.
+func (cfg *config) rewrites() []ingest.RewriteRule {
+	// The rules have already been checked by parseConfig.
+	rules, _ := rewriteRules(cfg.Rewrites)
+	return rules
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler by
+// parsing the rate in the same form as the flags.
+func (r *byteRate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return r.Set(s)
+}
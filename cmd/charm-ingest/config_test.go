@@ -0,0 +1,424 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charmstore-client/internal/ingest"
+)
+
+var parseConfigTests = []struct {
+	testName     string
+	config       string
+	expectConfig *config
+	expectError  string
+}{{
+	testName: "full",
+	config: `
+source:
+  url: https://src.example.com
+  agent: agent.json
+destination:
+  url: https://dest.example.com
+  auth: admin:secret
+whitelist: whitelist.yaml
+concurrency: 20
+source-concurrency: 10
+destination-concurrency: 5
+download-limit: 20M
+upload-limit: 1024
+max-disk: 1000
+hard-disk-limit: true
+retries: 0
+temp-dir: /var/tmp/charm-ingest
+timeout: 2h
+cache-dir: /var/cache/charm-ingest
+cache-size: 50G
+acl:
+  owner: ingest-admin
+  read: [staff]
+rewrites:
+- owner: upstream
+  to-owner: ourteam
+log:
+  debug: true
+  event-log: events.json
+  report: json
+`,
+	expectConfig: &config{
+		Source: storeConfig{
+			URL:   "https://src.example.com",
+			Agent: "agent.json",
+		},
+		Destination: storeConfig{
+			URL:  "https://dest.example.com",
+			Auth: "admin:secret",
+		},
+		Whitelist:              "whitelist.yaml",
+		Concurrency:            20,
+		SourceConcurrency:      10,
+		DestinationConcurrency: 5,
+		DownloadLimit:          20 << 20,
+		UploadLimit:            1024,
+		MaxDisk:                1000,
+		HardDiskLimit:          true,
+		Retries:                new(int),
+		TempDir:                "/var/tmp/charm-ingest",
+		Timeout:                2 * time.Hour,
+		CacheDir:               "/var/cache/charm-ingest",
+		CacheSize:              50 << 30,
+		ACL: &aclConfig{
+			Owner: "ingest-admin",
+			Read:  []string{"staff"},
+		},
+		Rewrites: []yamlRewriteRule{{
+			Owner:   "upstream",
+			ToOwner: "ourteam",
+		}},
+		Log: logConfig{
+			Debug:    true,
+			EventLog: "events.json",
+			Report:   "json",
+		},
+	},
+}, {
+	testName:     "empty",
+	config:       ``,
+	expectConfig: &config{},
+}, {
+	testName: "destinations",
+	config: `
+destinations:
+- name: eu
+  url: https://eu.example.com
+  agent: eu-agent.json
+- url: https://us.example.com
+`,
+	expectConfig: &config{
+		Destinations: []namedStoreConfig{{
+			Name:  "eu",
+			URL:   "https://eu.example.com",
+			Agent: "eu-agent.json",
+		}, {
+			Name: "https://us.example.com",
+			URL:  "https://us.example.com",
+		}},
+	},
+}, {
+	testName: "sources",
+	config: `
+sources:
+- name: partner
+  url: https://partner.example.com
+  agent: partner-agent.json
+- url: https://api.example.com
+`,
+	expectConfig: &config{
+		Sources: []namedStoreConfig{{
+			Name:  "partner",
+			URL:   "https://partner.example.com",
+			Agent: "partner-agent.json",
+		}, {
+			Name: "https://api.example.com",
+			URL:  "https://api.example.com",
+		}},
+	},
+}, {
+	testName: "source_and_sources",
+	config: `
+source:
+  url: https://src.example.com
+sources:
+- url: https://partner.example.com
+`,
+	expectError: `source_and_sources: cannot give both source and sources`,
+}, {
+	testName: "duplicate_sources",
+	config: `
+sources:
+- name: partner
+  url: https://partner.example.com
+- name: partner
+  url: https://partner2.example.com
+`,
+	expectError: `duplicate_sources: more than one source named "partner"`,
+}, {
+	testName: "source_without_url",
+	config: `
+sources:
+- name: partner
+`,
+	expectError: `source_without_url: source 1 has no URL`,
+}, {
+	testName: "destination_and_destinations",
+	config: `
+destination:
+  url: https://dest.example.com
+destinations:
+- url: https://eu.example.com
+`,
+	expectError: `destination_and_destinations: cannot give both destination and destinations`,
+}, {
+	testName: "duplicate_destinations",
+	config: `
+destinations:
+- name: eu
+  url: https://eu.example.com
+- name: eu
+  url: https://eu2.example.com
+`,
+	expectError: `duplicate_destinations: more than one destination named "eu"`,
+}, {
+	testName: "destination_without_url",
+	config: `
+destinations:
+- name: eu
+`,
+	expectError: `destination_without_url: destination 1 has no URL`,
+}, {
+	testName: "bad_destinations_auth",
+	config: `
+destinations:
+- url: https://eu.example.com
+  auth: admin
+`,
+	expectError: `bad_destinations_auth: invalid auth credentials: expected "user:passwd"`,
+}, {
+	testName: "bad_auth",
+	config: `
+destination:
+  auth: admin
+`,
+	expectError: `bad_auth: invalid auth credentials: expected "user:passwd"`,
+}, {
+	testName: "bad_rate",
+	config: `
+download-limit: 10MB
+`,
+	expectError: `cannot parse bad_rate: invalid byte rate "10MB"`,
+}, {
+	testName: "bad_report",
+	config: `
+log:
+  report: xml
+`,
+	expectError: `bad_report: unknown report format "xml"`,
+}, {
+	testName: "bad_acl",
+	config: `
+acl:
+  rules:
+  - read: [staff]
+`,
+	expectError: `bad_acl: acl: rule 1 has no pattern`,
+}, {
+	testName: "bad_rewrite",
+	config: `
+rewrites:
+- owner: upstream
+`,
+	expectError: `bad_rewrite: rewrites: rule 1 does not change anything`,
+}, {
+	testName: "unknown_field",
+	config: `
+sauce:
+  url: https://src.example.com
+`,
+	expectError: `cannot parse unknown_field: (.|\n)*field sauce not found in type main.config`,
+}}
+
+func TestParseConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseConfigTests {
+		c.Run(test.testName, func(c *qt.C) {
+			cfg, err := parseConfig(test.testName, strings.NewReader(test.config))
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Check(cfg, qt.DeepEquals, test.expectConfig)
+		})
+	}
+}
+
+func TestParseConfigFileResolvesPaths(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	path := filepath.Join(dir, "config.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+source:
+  agent: agent.json
+whitelist: whitelist.yaml
+temp-dir: /var/tmp/charm-ingest
+cache-dir: cache
+log:
+  event-log: logs/events.json
+`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	cfg, err := parseConfigFile(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(cfg.Source.Agent, qt.Equals, filepath.Join(dir, "agent.json"))
+	c.Check(cfg.Whitelist, qt.Equals, filepath.Join(dir, "whitelist.yaml"))
+	c.Check(cfg.TempDir, qt.Equals, "/var/tmp/charm-ingest")
+	c.Check(cfg.CacheDir, qt.Equals, filepath.Join(dir, "cache"))
+	c.Check(cfg.Log.EventLog, qt.Equals, filepath.Join(dir, "logs/events.json"))
+}
+
+func TestConfigDestinations(t *testing.T) {
+	c := qt.New(t)
+	cfg, err := parseConfig("config", strings.NewReader(`
+destinations:
+- name: eu
+  url: https://eu.example.com
+  auth: eu:pw
+- url: https://us.example.com
+`))
+	c.Assert(err, qt.Equals, nil)
+	auth := authInfo{username: "root", password: "pw"}
+	dests := cfg.destinations(auth)
+	c.Assert(dests, qt.HasLen, 2)
+	c.Check(dests[0], qt.Equals, namedStore{
+		name: "eu",
+		url:  "https://eu.example.com",
+		auth: authInfo{username: "eu", password: "pw"},
+	})
+	c.Check(dests[1], qt.Equals, namedStore{
+		name: "https://us.example.com",
+		url:  "https://us.example.com",
+		auth: auth,
+	})
+
+	cfg, err = parseConfig("config", strings.NewReader(`
+destination:
+  url: https://dest.example.com
+`))
+	c.Assert(err, qt.Equals, nil)
+	dests = cfg.destinations(auth)
+	c.Assert(dests, qt.HasLen, 1)
+	c.Check(dests[0], qt.Equals, namedStore{
+		url:  "https://dest.example.com",
+		auth: auth,
+	})
+}
+
+func TestConfigSources(t *testing.T) {
+	c := qt.New(t)
+	cfg, err := parseConfig("config", strings.NewReader(`
+sources:
+- name: partner
+  url: https://partner.example.com
+  auth: partner:pw
+- name: public
+  url: https://api.example.com
+`))
+	c.Assert(err, qt.Equals, nil)
+	auth := authInfo{agentFile: "agent.json"}
+	srcs := cfg.sources(auth)
+	c.Assert(srcs, qt.HasLen, 2)
+	c.Check(srcs[0], qt.Equals, namedStore{
+		name: "partner",
+		url:  "https://partner.example.com",
+		auth: authInfo{username: "partner", password: "pw"},
+	})
+	c.Check(srcs[1], qt.Equals, namedStore{
+		name: "public",
+		url:  "https://api.example.com",
+		auth: auth,
+	})
+
+	cfg, err = parseConfig("config", strings.NewReader(`
+source:
+  url: https://src.example.com
+`))
+	c.Assert(err, qt.Equals, nil)
+	c.Check(cfg.sources(auth), qt.HasLen, 0)
+}
+
+func TestConfigApply(t *testing.T) {
+	c := qt.New(t)
+	cfg, err := parseConfig("config", strings.NewReader(`
+source:
+  auth: bob:pw
+  agent: agent.json
+destination:
+  auth: admin:secret
+concurrency: 20
+source-concurrency: 10
+upload-limit: 1K
+retries: 0
+temp-dir: /tmp/x
+timeout: 30m
+cache-size: 1G
+log:
+  debug: true
+  report: json
+`))
+	c.Assert(err, qt.Equals, nil)
+	var (
+		debug           bool
+		maxDisk         int64 = 5
+		hardDiskLimit   bool
+		report          = "text"
+		eventLog        string
+		retries         = ingest.DefaultMaxRetries
+		tempDir         string
+		timeout         time.Duration
+		cacheDir        = "/tmp/cache"
+		cacheSize       byteCount
+		concurrency     = 30
+		srcConcurrency  int
+		destConcurrency int
+		downloadLimit   byteRate
+		uploadLimit     byteRate
+		auth, srcAuth   authInfo
+	)
+	// The concurrency and auth flags were given on the command line.
+	auth.Set("root:pw")
+	cfg.apply(flagValues{
+		debug:           &debug,
+		maxDisk:         &maxDisk,
+		hardDiskLimit:   &hardDiskLimit,
+		report:          &report,
+		eventLog:        &eventLog,
+		retries:         &retries,
+		tempDir:         &tempDir,
+		timeout:         &timeout,
+		cacheDir:        &cacheDir,
+		cacheSize:       &cacheSize,
+		concurrency:     &concurrency,
+		srcConcurrency:  &srcConcurrency,
+		destConcurrency: &destConcurrency,
+		downloadLimit:   &downloadLimit,
+		uploadLimit:     &uploadLimit,
+		auth:            &auth,
+		srcAuth:         &srcAuth,
+	}, map[string]bool{
+		"concurrency": true,
+		"auth":        true,
+	})
+	c.Check(debug, qt.Equals, true)
+	c.Check(maxDisk, qt.Equals, int64(5))
+	c.Check(hardDiskLimit, qt.Equals, false)
+	c.Check(report, qt.Equals, "json")
+	c.Check(eventLog, qt.Equals, "")
+	c.Check(retries, qt.Equals, 0)
+	c.Check(tempDir, qt.Equals, "/tmp/x")
+	c.Check(timeout, qt.Equals, 30*time.Minute)
+	c.Check(cacheDir, qt.Equals, "/tmp/cache")
+	c.Check(cacheSize, qt.Equals, byteCount(1<<30))
+	c.Check(concurrency, qt.Equals, 30)
+	c.Check(srcConcurrency, qt.Equals, 10)
+	c.Check(destConcurrency, qt.Equals, 0)
+	c.Check(downloadLimit, qt.Equals, byteRate(0))
+	c.Check(uploadLimit, qt.Equals, byteRate(1024))
+	c.Check(auth, qt.Equals, authInfo{username: "root", password: "pw"})
+	c.Check(srcAuth, qt.Equals, authInfo{username: "bob", password: "pw", agentFile: "agent.json"})
+}
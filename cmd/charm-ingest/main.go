@@ -4,10 +4,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/juju/charmrepo/v6/csclient"
 	"github.com/juju/charmstore-client/internal/ingest"
@@ -15,10 +26,18 @@ import (
 	"github.com/juju/persistent-cookiejar"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 )
 
 var printCmdUsage = func() {
-	fmt.Printf("usage: charm-ingest [flags] whitelist destination\n\n")
+	fmt.Printf("usage: charm-ingest [flags] whitelist destination...\n")
+	fmt.Printf("       charm-ingest [flags] export whitelist directory\n")
+	fmt.Printf("       charm-ingest [flags] import directory destination...\n")
+	fmt.Printf("       charm-ingest [flags] serve whitelist destination...\n")
+	fmt.Printf("       charm-ingest [flags] verify whitelist destination\n")
+	fmt.Printf("       charm-ingest -config file [flags] [serve|verify]\n")
+	fmt.Printf("       charm-ingest -config file [flags] export directory\n")
+	fmt.Printf("       charm-ingest -config file [flags] import directory\n\n")
 	gnuflag.PrintDefaults()
 	fmt.Println(`
 Charm-ingest copies a set of charms and bundles from one charmstore to another.
@@ -28,7 +47,9 @@ id (for example cs:~bob/mycharm) followed by an optional space-separated set of
 to consider for copying. If no channels are provided for an entity, the stable channel
 will be used. If no revision is given, the latest revision for the specified channel
 will be copied. If a bundle is specified, all charms mentioned by the bundle will also
-be transferred.
+be transferred. Each of those charms is taken from the bundle's channel if it's published
+there, and otherwise from the first of the stable, candidate, beta and edge channels that
+it's published in; the channel used is printed as the charm is found.
 
 For example, the following whitelist specifies that the latest stable revision
 of the wordpress charm should be transferred, and revision 254 of the
@@ -38,105 +59,962 @@ be made available in the beta and stable channels.
 	wordpress
 	cs:bundle/canonical-kubernetes-254 beta stable
 
+An id can also be a pattern that names an owner, such as cs:~partner/* or
+cs:~partner/k8s-*, in which case the latest revision of every matching charm
+and bundle owned by that user in each of the channels is copied. Only the
+name part of a pattern can hold wildcards.
+
+A whitelist file with a .yaml or .yml extension is read as YAML instead.
+As well as the id and channels of each entity, a YAML whitelist can list
+extra resource revisions to copy, and specify that no resources should be
+copied for an entity because they are already in the destination. Pattern
+entries can be restricted to some series, and can exclude names matching
+other patterns. A YAML whitelist can also include other whitelist files, in
+either format, relative to its own directory. For example:
+
+	# Extra charms for the web team.
+	include:
+	- base.txt
+	entities:
+	- id: wordpress
+	  channels: [stable, edge]
+	  resources:
+	    website: [3, 4]
+	- id: cs:~bob/bigdata
+	  skip-resources: true
+	- id: cs:~partner/k8s-*
+	  series: [kubernetes]
+	  exclude: ["*-test"]
+	- id: cs:~bob/database
+	  history: 5
+	  since: 2020-01-01
+	  max-history-size: 10G
+	- id: cs:~partner/app
+	  source: partner
+
+Normally only the current revision of an entity in each channel is copied.
+The history field gives the number of revisions to copy for each channel,
+counting back from the current one, so that the destination can roll back
+to them. Revisions uploaded before the since date are left out, and earlier
+revisions are left out so that the size of the archives and resources of
+those copied in each channel is no more than max-history-size, with an
+optional K, M or G suffix. When since is given without history, every
+revision uploaded since then is copied. The current revision is always
+copied.
+
+The source field names the charm store to take an entity from when the
+configuration file gives several sources, as described below.
+
 By default, entities will be copied from the global charm store (https://api.jujucharms.com/charmstore);
-this can be overridden by setting the JUJU_CHARMSTORE environment variable.
+this can be overridden by the configuration file or by setting the JUJU_CHARMSTORE
+environment variable.
 
 The destination argument holds the URL of the charm store to copy charms into.
 The auth flag can be used to specify the admin username and password for the destination;
 if not specified, the user will be authenticated with the Candid identity service.
-Currently there is no way to specify username/password for the source charmstore.`)
+
+More than one destination can be given to copy the same charms into several
+charm stores, such as regional mirrors, in one pass. Each archive and resource
+is only downloaded from the source once, however many destinations need it,
+and the report shows what happened in each destination. All the destinations
+on the command line use the credentials given by the auth flag.
+
+Private charms and bundles can be copied from a source charm store that the
+user has credentials for. The src-auth flag specifies a username and password
+for basic HTTP authentication to the source, and the src-agent flag names a
+file holding agent login details to use instead. Authorization macaroons for
+the source are kept in the default cookie file (see the GOCOOKIES environment
+variable), so a login made with the charm command is used too; macaroons for
+the destination are kept in a separate file alongside it with a
+".charm-ingest-dest" suffix, so that macaroons for the two stores do not
+collide. When a sources list is given, the macaroons for each source are
+kept in their own file alongside it, with a ".charm-ingest-src-" suffix
+followed by the source name.
+
+Container image (oci-image) resources are copied directly from the source
+charm store's image registry to the destination charm store's registry, so
+no local Docker daemon is needed. Images held in external registries are not
+copied; the destination refers to the same image. Images held in the source
+registry cannot be exported to a directory.
+
+By default, the copied charms and bundles can be read by everyone and
+written by the destination admin user. The acl flag names a YAML file that
+sets a different policy. The owner field gives the user with write access
+instead of admin, and the read and write fields give the default ACLs. The
+channels field sets ACLs for particular channels, and the rules field sets
+ACLs for base entities that match patterns, of which the first matching rule
+is used. With copy-source set, the ACLs are copied from the source, with the
+users and groups in them renamed as given by the renames field; rules still
+take precedence. Fields that are not given keep the value they would
+otherwise have. For example:
+
+	owner: ingest-admin
+	read: [staff]
+	channels:
+	  edge:
+	    read: [developers]
+	rules:
+	- pattern: cs:~partner/*
+	  read: [partners, staff]
+	copy-source: true
+	renames:
+	  everyone: staff
+
+The rewrite flag names a YAML file holding a list of rules that change the
+ids that entities have in the destination, for example to copy
+cs:~upstream/foo to cs:~ourteam/foo, or to move charms between users in
+the same charm store. Each rule selects entities by any of owner, name and
+series, and replaces any of them with to-owner, to-name and to-series. The
+first rule that matches an entity is used. Bundles refer to the rewritten
+charms, so their archives and hashes change. Rewritten entities are not
+promulgated unless the rule sets keep-promulgated. For example:
+
+	- owner: upstream
+	  to-owner: ourteam
+	- owner: charmers
+	  name: mysql
+	  to-name: mariadb
+	  keep-promulgated: true
+
+The config flag names a YAML file that holds the settings for a site, so
+that they can be kept under version control. It can give the source and
+destination charm stores, the whitelist, credentials, limits, the ACL policy,
+rewrite rules and logging. Flags given on the command line take precedence
+over it, and the whitelist and destination arguments can be left out when it
+gives them. Relative file names in it are relative to the directory holding
+it. For example:
+
+	source:
+	  url: https://api.jujucharms.com/charmstore
+	  agent: source-agent.json
+	destination:
+	  url: https://charmstore.internal/charmstore
+	  auth: admin:secret
+	whitelist: whitelist.yaml
+	concurrency: 20
+	source-concurrency: 10
+	destination-concurrency: 5
+	download-limit: 20M
+	upload-limit: 10M
+	max-disk: 10737418240
+	hard-disk-limit: false
+	retries: 3
+	temp-dir: /var/tmp/charm-ingest
+	timeout: 6h
+	cache-dir: /var/cache/charm-ingest
+	cache-size: 50G
+	acl:
+	  owner: ingest-admin
+	  read: [staff]
+	rewrites:
+	- owner: upstream
+	  to-owner: ourteam
+	log:
+	  debug: false
+	  event-log: /var/log/charm-ingest/events.json
+	  report: text
+
+The acl and rewrites fields have the same form as the files named by the acl
+and rewrite flags, which replace them when given. The destination may give an
+agent file instead of auth credentials. To copy into several charm stores, give
+a destinations list instead of destination, in which each entry may also have
+a name to identify it in the report; entries without credentials use those
+given by the auth flag. For example:
+
+	destinations:
+	- name: eu
+	  url: https://charmstore.eu.internal/charmstore
+	  agent: eu-agent.json
+	- name: us
+	  url: https://charmstore.us.internal/charmstore
+
+Similarly, a sources list can be given instead of source to copy from
+several charm stores, for example a partner store, the public store and
+a staging store. Each whitelist entry is taken from the first source that
+has it, unless a YAML whitelist entry names a source with its source field,
+in which case only that source is used. The charms in a bundle are looked
+for in the bundle's source first. The report records the source that each
+entity was taken from. Entries without credentials use those given by the
+src-auth and src-agent flags. For example:
+
+	sources:
+	- name: partner
+	  url: https://charmstore.partner.example.com/charmstore
+	  agent: partner-agent.json
+	- name: public
+	  url: https://api.jujucharms.com/charmstore
+	- name: staging
+	  url: https://charmstore.staging.internal/charmstore
+
+The export and import forms can be used when the destination charm store
+has no network access to the source. The export form copies the whitelisted
+entities, including their resources, published channels and permissions, into
+the given directory instead of a charm store. The directory can then be moved
+to the destination site, where the import form copies everything in it
+into the destination charm store.
+
+The dry-run flag can be used to find out what would be copied without
+changing anything in the destination charm store.
+
+Progress is printed as each entity is copied. The event-log flag can be used
+to append a record of each step, one JSON object per line, to the given file,
+so that long runs can be monitored and audited afterwards.
+
+The report flag selects the format of the summary printed when the ingest
+completes. With "-report json", progress is not printed and the summary is
+written to the standard output as a JSON object holding the number of archives
+and resources copied or already present, the bytes copied, and the outcome
+for each entity, including any errors classified by kind (not-found,
+permission-denied, hash-mismatch, disk-limit or other).
+
+The concurrency flag limits the number of remote operations in progress at
+once. The src-concurrency and dest-concurrency flags set separate, smaller
+limits on the source and the destination, and the download-limit and
+upload-limit flags limit the total bandwidth used to read archives,
+resources and images from the source and to write them to the destination.
+The limits in use are printed when the ingest starts. For example, to
+download at no more than 10MiB a second with at most 4 source operations
+at once:
+
+	charm-ingest -download-limit 10M -src-concurrency 4 whitelist https://charmstore.example.com
+
+Operations that fail with temporary errors, such as network timeouts or
+server errors, are retried with an increasing delay between attempts.
+The retries flag specifies how many times each operation is retried;
+zero disables retries.
+
+The resume flag names a journal file that records each step of the ingest as it
+is completed. If the ingest is interrupted, running it again with the same
+journal skips the archives and resources already uploaded, entities already
+published and permissions already set, and continues where it stopped.
+Container image layers are uploaded to the destination registry in chunks,
+and an interrupted layer upload continues from the last chunk received.
+For example:
+
+	charm-ingest -resume journal.db whitelist.yaml https://charmstore.example.com
+
+An ingest can be interrupted with SIGINT (for example by typing ^C) or
+SIGTERM. No more operations are started, uploads and downloads in progress
+are abandoned, temporary files are removed, and the summary of what was
+copied before then is printed, after which charm-ingest exits with a
+non-zero status. Nothing is pruned. A second signal exits straight away.
+The timeout flag stops an ingest or verification in the same way if it
+takes longer than the given time; when serving, it applies to each sync,
+and an interrupt stops the server once the current sync has stopped.
+For example:
+
+	charm-ingest -timeout 2h -resume journal.db whitelist.yaml https://charmstore.example.com
+
+The cache-dir flag names a directory in which the archives and resources
+read from the source are kept, named by their SHA-384 hash. Later ingests
+that use the same directory, including each sync when serving, read an
+archive or resource from there instead of the source when the source
+reports the same hash, so that large resources are only downloaded once
+however many times they are copied. The cache-size flag limits the total
+size of the directory; when it would be exceeded, the least recently used
+archives and resources are removed. For example:
+
+	charm-ingest -cache-dir /var/cache/charm-ingest -cache-size 50G whitelist.yaml https://charmstore.example.com
+
+The prune flag checks the destination for charms and bundles that are no
+longer whitelisted, for example because an entry has been removed from the
+whitelist. Only entities owned by the users given by the prune-owners flag
+are checked; by default, the owners of the whitelisted entities are used.
+With "-prune report", the entities found are only reported. With
+"-prune revoke", read access to them is also restricted to the users that
+can write them, so that they are no longer visible. Owners given by the
+protect-owners flag, and ids matching the protect flag, are never touched.
+Access is not revoked if any of the whitelist could not be found in the
+source, because the missing entities would look like they had been removed.
+For example:
+
+	charm-ingest -prune revoke -protect 'cs:~bob/keep-*' whitelist.yaml https://charmstore.example.com
+
+The serve form runs continuously, syncing the whitelisted entities into the
+destination, waiting for the time given by the interval flag, and then
+syncing again. The whitelist file is checked for changes every few seconds,
+and a sync starts as soon as it changes. After the first sync, entities
+whose metadata in the source has not changed since they were last synced
+are skipped without looking at the destination. Progress is not printed;
+instead a summary of each sync is logged.
+
+While serving, an HTTP API is available on the address given by the listen
+flag:
+
+	POST /sync
+		Start a sync now. With the query parameter full=true,
+		everything is checked in the destination again, which
+		is useful if the destination has been changed by
+		something other than charm-ingest.
+	GET /stats
+		Return the result of the last sync, in the same form as
+		"-report json" with its start and end times.
+	GET /metrics
+		Return counters in the Prometheus text format.
+
+For example:
+
+	charm-ingest -interval 30m -listen :8079 serve whitelist.yaml https://charmstore.example.com
+
+The verify form checks that the destination matches the source without
+changing anything. It resolves the whitelist in the same way as an ingest
+and compares the archive hashes and sizes, resource fingerprints and sizes,
+extra-info and common-info of each entity, the revisions published in each
+channel with their resource revisions, and the ACLs, which should be those
+given by the ACL policy. Container
+images are compared by digest. A diff is printed for each entity that
+differs, and charm-ingest exits with a non-zero status if anything differs
+or could not be checked. For example:
+
+	charm-ingest verify whitelist.yaml https://charmstore.example.com`)
 }
 
 func main() {
+	configFile := gnuflag.String("config", "", "read settings from this YAML file; flags take precedence over it")
 	debug := gnuflag.Bool("debug", false, "show debugging messages")
 	maxDisk := gnuflag.Int64("maxdisk", 0, "max disk space to use (0 means unlimited)")
 	hardDiskLimit := gnuflag.Bool("hardlimit", false, "do not transfer any resources larger than the disk limit")
-	var auth authInfo
+	tempDir := gnuflag.String("temp-dir", "", "directory to store temporary files in (default: the system temporary directory)")
+	cacheDir := gnuflag.String("cache-dir", "", "keep archives and resources read from the source in this directory for later ingests")
+	var cacheSize byteCount
+	gnuflag.Var(&cacheSize, "cache-size", "maximum size of the cache directory, with optional K, M or G suffix (0 means unlimited)")
+	dryRun := gnuflag.Bool("dry-run", false, "report what would be copied without changing the destination")
+	report := gnuflag.String("report", "text", "format of the final report (text or json)")
+	eventLog := gnuflag.String("event-log", "", "append a JSON-lines log of ingest events to this file")
+	retries := gnuflag.Int("retries", ingest.DefaultMaxRetries, "number of times to retry operations that fail with temporary errors")
+	resume := gnuflag.String("resume", "", "record completed steps in this journal file, skipping any already recorded there")
+	interval := gnuflag.Duration("interval", time.Hour, "time to wait between syncs when serving")
+	timeout := gnuflag.Duration("timeout", 0, "stop an ingest or verification that takes longer than this, reporting what was done (0 means no limit)")
+	listen := gnuflag.String("listen", "localhost:8079", "address to serve the HTTP API on when serving")
+	prune := gnuflag.String("prune", "", "what to do with destination entities that are not whitelisted (report or revoke)")
+	pruneOwners := gnuflag.String("prune-owners", "", "comma-separated owners whose destination entities are pruned (default: owners of whitelisted entities)")
+	protectOwners := gnuflag.String("protect-owners", "", "comma-separated owners whose entities are never pruned")
+	protectIds := gnuflag.String("protect", "", "comma-separated base entity ids, which may contain wildcards, that are never pruned")
+	rewriteFile := gnuflag.String("rewrite", "", "read rules that change the ids of entities in the destination from this YAML file")
+	aclFile := gnuflag.String("acl", "", "read the owner and ACL policy for the destination from this YAML file")
+	concurrency := gnuflag.Int("concurrency", ingest.DefaultConcurrency, "maximum number of operations in progress at once")
+	srcConcurrency := gnuflag.Int("src-concurrency", 0, "maximum number of source operations in progress at once (0 means no separate limit)")
+	destConcurrency := gnuflag.Int("dest-concurrency", 0, "maximum number of destination operations in progress at once (0 means no separate limit)")
+	var downloadLimit, uploadLimit byteRate
+	gnuflag.Var(&downloadLimit, "download-limit", "maximum bytes per second to download from the source, with optional K, M or G suffix (0 means unlimited)")
+	gnuflag.Var(&uploadLimit, "upload-limit", "maximum bytes per second to upload to the destination, with optional K, M or G suffix (0 means unlimited)")
+	var auth, srcAuth authInfo
 	gnuflag.Var(&auth, "auth", "user:passwd to use for basic HTTP authentication to destination URL")
+	gnuflag.Var(&srcAuth, "src-auth", "user:passwd to use for basic HTTP authentication to the source charm store")
+	gnuflag.StringVar(&srcAuth.agentFile, "src-agent", "", "name of file containing agent login details for the source charm store")
 	gnuflag.Usage = func() {
 		printCmdUsage()
 		os.Exit(2)
 	}
 
 	gnuflag.Parse(true)
-	if gnuflag.NArg() != 2 {
+
+	cfg := new(config)
+	if *configFile != "" {
+		var err error
+		cfg, err = parseConfigFile(*configFile)
+		if err != nil {
+			fatalf("unable to read configuration: %v", err)
+		}
+		set := make(map[string]bool)
+		gnuflag.Visit(func(f *gnuflag.Flag) {
+			set[f.Name] = true
+		})
+		cfg.apply(flagValues{
+			debug:           debug,
+			maxDisk:         maxDisk,
+			hardDiskLimit:   hardDiskLimit,
+			report:          report,
+			eventLog:        eventLog,
+			retries:         retries,
+			tempDir:         tempDir,
+			timeout:         timeout,
+			cacheDir:        cacheDir,
+			cacheSize:       &cacheSize,
+			concurrency:     concurrency,
+			srcConcurrency:  srcConcurrency,
+			destConcurrency: destConcurrency,
+			downloadLimit:   &downloadLimit,
+			uploadLimit:     &uploadLimit,
+			auth:            &auth,
+			srcAuth:         &srcAuth,
+		}, set)
+	}
+
+	var p ingest.IngestParams
+	var srcURL, whitelistFile string
+	var dests []namedStore
+	args := gnuflag.Args()
+	mode := ""
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve", "verify", "export", "import":
+			mode, args = args[0], args[1:]
+		}
+	}
+	// The whitelist and destination can be left out
+	// when the configuration file gives them.
+	cfgDests := cfg.destinations(auth)
+	switch {
+	case mode == "import" && len(args) >= 2:
+		p.SrcDir, dests = args[0], urlDests(args[1:], auth)
+	case mode == "import" && len(args) == 1 && len(cfgDests) > 0:
+		p.SrcDir, dests = args[0], cfgDests
+	case mode == "export" && len(args) == 2:
+		srcURL, whitelistFile, p.DestDir = sourceURL(cfg), args[0], args[1]
+	case mode == "export" && len(args) == 1 && cfg.Whitelist != "":
+		srcURL, whitelistFile, p.DestDir = sourceURL(cfg), cfg.Whitelist, args[0]
+	case mode == "export" || mode == "import":
+		gnuflag.Usage()
+	case len(args) >= 2:
+		srcURL, whitelistFile, dests = sourceURL(cfg), args[0], urlDests(args[1:], auth)
+	case len(args) == 0 && cfg.Whitelist != "" && len(cfgDests) > 0:
+		srcURL, whitelistFile, dests = sourceURL(cfg), cfg.Whitelist, cfgDests
+	default:
 		gnuflag.Usage()
 	}
+	serve, verify := mode == "serve", mode == "verify"
 
-	if auth.username == "" {
-		fatalf("required -auth flag is missing")
+	if *report != "text" && *report != "json" {
+		fatalf("unknown report format %q", *report)
 	}
-	fileName := gnuflag.Arg(0)
-	destURL := gnuflag.Arg(1)
 
-	whitelist, err := parseWhitelistFile(fileName)
-	if err != nil {
-		fatalf("unable to parse whitelist: %v", err)
+	switch ingest.PruneMode(*prune) {
+	case ingest.PruneNone, ingest.PruneReport, ingest.PruneRevoke:
+	default:
+		fatalf("unknown prune mode %q", *prune)
 	}
 
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		fatalf("unable to create cookie jar: %v", err)
+	for _, d := range dests {
+		if d.auth.username == "" && d.auth.agentFile == "" {
+			fatalf("required -auth flag is missing")
+		}
+	}
+
+	if serve && *dryRun {
+		fatalf("cannot use -dry-run with serve")
+	}
+	if verify && (*dryRun || *resume != "" || *prune != "") {
+		fatalf("cannot use -dry-run, -resume or -prune with verify")
 	}
-	defer func() {
-		err := jar.Save()
+	if verify && len(dests) > 1 {
+		fatalf("cannot verify more than one destination at once")
+	}
+
+	aclCfg := cfg.ACL
+	if *aclFile != "" {
+		var err error
+		aclCfg, err = parseACLFile(*aclFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "warning: unable to save cookie jar: %v\n", err)
+			fatalf("unable to parse ACL policy: %v", err)
 		}
-	}()
+	}
+	if aclCfg != nil {
+		p.Owner = aclCfg.Owner
+		p.ACLPolicy = aclCfg.policy()
+	}
 
-	bakeryClient := httpbakery.NewClient()
-	bakeryClient.Jar = jar
+	p.Rewrites = cfg.rewrites()
+	if *rewriteFile != "" {
+		rules, err := parseRewriteFile(*rewriteFile)
+		if err != nil {
+			fatalf("unable to parse rewrite rules: %v", err)
+		}
+		p.Rewrites = rules
+	}
+
+	if whitelistFile != "" && !serve {
+		whitelist, err := parseWhitelistFile(whitelistFile)
+		if err != nil {
+			fatalf("unable to parse whitelist: %v", err)
+		}
+		p.Whitelist = whitelist
+	}
 
 	// Note: we could add a web browser interactor to the bakery
-	// client but we don't really want that, because:
+	// clients but we don't really want that, because:
 	// a) ingesting to a destination charmstore won't work properly unless you're admin,
 	// which can only be done with basic auth.
-	// b) we're probably only wanting to transfer public charms, because
-	// the charms are made public in the destination charmstore, so
-	// we'll want to fail for private charms.
+	// b) private charms can only be read from the source by
+	// non-interactive means (basic auth, an agent or an existing
+	// login), because the ingest is usually run unattended.
 
-	p := ingest.IngestParams{
-		Src:           newCharmStoreClient(sourceURL(), bakeryClient, nil),
-		Dest:          newCharmStoreClient(destURL, bakeryClient, &auth),
-		Whitelist:     whitelist,
-		MaxDisk:       *maxDisk,
-		SoftDiskLimit: !*hardDiskLimit,
+	var jars []*cookiejar.Jar
+	if srcURL != "" {
+		srcs := cfg.sources(srcAuth)
+		if len(srcs) == 0 {
+			srcs = []namedStore{{
+				url:  srcURL,
+				auth: srcAuth,
+			}}
+		}
+		for _, s := range srcs {
+			s := s
+			// The cookie jar keeps the macaroons for each
+			// named source separately.
+			jar := openCookieJar(sourceCookieFile(s.name))
+			defer saveCookieJar(jar)
+			jars = append(jars, jar)
+			bakeryClient, err := newBakeryClient(jar, &s.auth)
+			if err != nil {
+				fatalf("cannot set up source authentication: %v", err)
+			}
+			client := newCharmStoreClient(s.url, bakeryClient, &s.auth)
+			if s.name == "" {
+				p.Src = client
+				break
+			}
+			p.Sources = append(p.Sources, ingest.Source{
+				Name:   s.name,
+				Client: client,
+			})
+		}
+	}
+	if len(dests) > 0 {
+		// The cookie jar keeps the macaroons for each
+		// destination separately.
+		jar := openCookieJar(cookiejar.DefaultCookieFile() + ".charm-ingest-dest")
+		defer saveCookieJar(jar)
+		jars = append(jars, jar)
+		for _, d := range dests {
+			d := d
+			bakeryClient, err := newBakeryClient(jar, &d.auth)
+			if err != nil {
+				fatalf("cannot set up destination authentication: %v", err)
+			}
+			client := newCharmStoreClient(d.url, bakeryClient, &d.auth)
+			if len(dests) == 1 {
+				p.Dest = client
+				break
+			}
+			p.Dests = append(p.Dests, ingest.Destination{
+				Name:   d.name,
+				Client: client,
+			})
+		}
+	}
+	p.MaxDisk = *maxDisk
+	p.TempDir = *tempDir
+	p.CacheDir = *cacheDir
+	p.MaxCacheSize = int64(cacheSize)
+	p.Concurrency = *concurrency
+	p.SrcConcurrency = *srcConcurrency
+	p.DestConcurrency = *destConcurrency
+	p.MaxDownloadRate = int64(downloadLimit)
+	p.MaxUploadRate = int64(uploadLimit)
+	p.SoftDiskLimit = !*hardDiskLimit
+	p.DryRun = *dryRun
+	p.Journal = *resume
+	p.Prune = ingest.PruneMode(*prune)
+	p.PruneOwners = splitList(*pruneOwners)
+	p.ProtectedOwners = splitList(*protectOwners)
+	p.ProtectedIds = splitList(*protectIds)
+	p.MaxRetries = *retries
+	if p.MaxRetries == 0 {
+		p.MaxRetries = -1
 	}
 	if *debug {
 		p.Log = func(s string) {
 			log.Println(s)
 		}
 	}
-	stats := ingest.Ingest(p)
+	var logEncoder *json.Encoder
+	if *eventLog != "" {
+		f, err := os.OpenFile(*eventLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			fatalf("cannot open event log: %v", err)
+		}
+		defer f.Close()
+		logEncoder = json.NewEncoder(f)
+	}
+	logFailed := false
+	p.Notify = func(e ingest.Event) {
+		if logEncoder != nil && !logFailed {
+			if err := logEncoder.Encode(e); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: cannot write event log: %v\n", err)
+				logFailed = true
+			}
+		}
+		// In a dry run, the plan is printed at the end instead.
+		// When serving, only a summary of each sync is logged.
+		// When verifying, the differences are printed at the end.
+		printEvent(e, *dryRun || *report == "json" || serve || verify)
+	}
+	if *report != "json" {
+		fmt.Printf("concurrency %s (source %s, destination %s); download limit %s; upload limit %s\n",
+			formatLimit(int64(p.Concurrency), ""),
+			formatLimit(int64(p.SrcConcurrency), ""),
+			formatLimit(int64(p.DestConcurrency), ""),
+			formatLimit(p.MaxDownloadRate, "/s"),
+			formatLimit(p.MaxUploadRate, "/s"),
+		)
+	}
+	ctx := interruptContext()
+	if serve {
+		runServer(ctx, p, whitelistFile, *interval, *timeout, *listen, func() {
+			for _, jar := range jars {
+				saveCookieJar(jar)
+			}
+		})
+		return
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if verify {
+		stats := ingest.Verify(ctx, p)
+		if *report == "json" {
+			data, err := json.MarshalIndent(stats, "", "\t")
+			if err != nil {
+				fatalf("cannot marshal report: %v", err)
+			}
+			fmt.Printf("%s\n", data)
+		} else {
+			printDrift(os.Stdout, stats)
+		}
+		if !stats.OK() {
+			for _, jar := range jars {
+				saveCookieJar(jar)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	stats := ingest.Ingest(ctx, p)
+	printReport(stats, *report, *dryRun)
+	if ctx.Err() != nil {
+		// The ingest was interrupted, so only part
+		// of the report above has been done.
+		for _, jar := range jars {
+			saveCookieJar(jar)
+		}
+		os.Exit(1)
+	}
+}
+
+// interruptContext returns a context that is cancelled when
+// charm-ingest receives SIGINT or SIGTERM, so that the ingest stops
+// cleanly and reports what it has done. A second signal exits
+// straight away.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		fmt.Fprintf(os.Stderr, "received %v; stopping (send it again to exit now)\n", sig)
+		cancel()
+		<-sigc
+		os.Exit(1)
+	}()
+	return ctx
+}
 
-	for _, e := range stats.Errors {
-		// TODO add a callback to IngestParams so that we can print these as they happen?
-		fmt.Fprintf(os.Stderr, "error: %v\n", e)
+// printReport prints the result of an ingest in the given
+// format, with a summary for each destination if there
+// are several.
+func printReport(stats ingest.IngestStats, format string, dryRun bool) {
+	if format == "json" {
+		data, err := json.MarshalIndent(stats, "", "\t")
+		if err != nil {
+			fatalf("cannot marshal report: %v", err)
+		}
+		fmt.Printf("%s\n", data)
+		return
 	}
 
+	if len(stats.Destinations) == 0 {
+		printSummary(stats, dryRun)
+		return
+	}
+	for _, d := range stats.Destinations {
+		fmt.Printf("destination %s:\n", d.Name)
+		printSummary(d.IngestStats, dryRun)
+	}
+}
+
+// printSummary prints a summary of the result of an ingest into
+// one destination, or the plan for it in a dry run.
+func printSummary(stats ingest.IngestStats, dryRun bool) {
+	if dryRun {
+		printPlan(stats)
+		return
+	}
 	fmt.Printf("total %d revisions of %d entities\n", stats.EntityCount, stats.BaseEntityCount)
 	if stats.ArchivesCopiedCount > 0 {
 		fmt.Printf("copied %d revisions\n", stats.ArchivesCopiedCount)
 	} else {
 		fmt.Println("no revisions copied")
 	}
+	if stats.ArchivesPresentCount > 0 {
+		fmt.Printf("%d revisions already present\n", stats.ArchivesPresentCount)
+	}
+	fmt.Printf("copied %d of %d resources (%d already present)\n", stats.ResourcesCopiedCount, stats.ResourceCount, stats.ResourcesPresentCount)
+	fmt.Printf("copied %d bytes\n", stats.BytesCopied)
 	if stats.FailedEntityCount > 0 {
 		fmt.Printf("failed to copy %d revisions\n", stats.FailedEntityCount)
 	}
+	if stats.RetryCount > 0 {
+		fmt.Printf("retried %d operations\n", stats.RetryCount)
+	}
+	printOrphans(stats, false)
+}
+
+// printOrphans prints the entities found in the destination
+// that are not whitelisted.
+func printOrphans(stats ingest.IngestStats, dryRun bool) {
+	for _, o := range stats.Orphans {
+		action := "not whitelisted"
+		switch {
+		case o.Revoked && dryRun:
+			action = "not whitelisted; would revoke read access"
+		case o.Revoked:
+			action = "not whitelisted; read access revoked"
+		}
+		chans := make([]string, len(o.Channels))
+		for i, ch := range o.Channels {
+			chans[i] = string(ch)
+		}
+		fmt.Printf("%s (%s): %s\n", o.Id, strings.Join(chans, ", "), action)
+	}
+}
+
+// printDrift prints a summary of the result of a verification
+// and the differences found for each entity.
+func printDrift(w io.Writer, stats ingest.VerifyStats) {
+	fmt.Fprintf(w, "verified %d revisions of %d entities and %d resources\n", stats.EntityCount, stats.BaseEntityCount, stats.ResourceCount)
+	for _, d := range stats.Drift {
+		fmt.Fprintf(w, "%s\n", d.Id)
+		for _, diff := range d.Differences {
+			fmt.Fprintf(w, "\t- %s: %s\n", diff.What, formatValue(diff.Want))
+			fmt.Fprintf(w, "\t+ %s: %s\n", diff.What, formatValue(diff.Got))
+		}
+	}
+	switch {
+	case len(stats.Drift) > 0:
+		fmt.Fprintf(w, "%d entities differ from the source\n", len(stats.Drift))
+	case len(stats.Errors) > 0:
+		fmt.Fprintf(w, "could not check everything; %d errors\n", len(stats.Errors))
+	default:
+		fmt.Fprintf(w, "destination matches source\n")
+	}
+}
+
+// formatValue formats a value from an ingest.Difference,
+// which is empty if there is no value.
+func formatValue(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	return v
+}
+
+// splitList splits a comma-separated list,
+// ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runServer runs ingests with the given parameters until ctx is done,
+// serving the HTTP API on the given address. Each ingest is stopped
+// if it takes longer than timeout, unless timeout is zero.
+func runServer(ctx context.Context, p ingest.IngestParams, whitelistFile string, interval, timeout time.Duration, addr string, afterSync func()) {
+	srv, err := newSyncServer(p, whitelistFile, interval)
+	if err != nil {
+		fatalf("unable to parse whitelist: %v", err)
+	}
+	srv.afterSync = afterSync
+	srv.timeout = timeout
+	go func() {
+		if err := http.ListenAndServe(addr, srv); err != nil {
+			fatalf("cannot serve HTTP API: %v", err)
+		}
+	}()
+	log.Printf("serving HTTP API on %s", addr)
+	srv.run(ctx)
+}
+
+// printEvent prints a line describing the given event. Errors are
+// printed to stderr; if quiet is true, nothing else is printed.
+// Events that relate to one of several destinations are prefixed
+// with its name.
+func printEvent(e ingest.Event, quiet bool) {
+	prefix := ""
+	if e.Dest != "" {
+		prefix = e.Dest + ": "
+	}
+	if e.Kind == ingest.EventError {
+		fmt.Fprintf(os.Stderr, "%serror: %v\n", prefix, e.Error)
+		return
+	}
+	if quiet {
+		return
+	}
+	switch e.Kind {
+	case ingest.EventEntityResolved:
+		chans := make([]string, len(e.Channels))
+		for i, ch := range e.Channels {
+			chans[i] = string(ch)
+		}
+		from := ""
+		if e.Source != "" {
+			from = " from " + e.Source
+		}
+		fmt.Printf("%sfound %s in %s%s\n", prefix, e.Id, strings.Join(chans, ", "), from)
+	case ingest.EventBundleCharmResolved:
+		fmt.Printf("%sfound %s in %s for bundle %s\n", prefix, e.Id, e.Channel, e.Bundle)
+	case ingest.EventArchiveDownloadStarted:
+		fmt.Printf("%scopying %s\n", prefix, e.Id)
+	case ingest.EventArchiveDownloadFinished:
+		fmt.Printf("%scopied %s (%d bytes)\n", prefix, e.Id, e.Bytes)
+	case ingest.EventResourceTransferred:
+		for name, rev := range e.Resources {
+			fmt.Printf("%scopied resource %s/%d for %s (%d bytes)\n", prefix, name, rev, e.Id, e.Bytes)
+		}
+	case ingest.EventPublished:
+		fmt.Printf("%spublished %s to %s%s\n", prefix, e.Id, e.Channel, formatResources(e.Resources))
+	case ingest.EventOrphanFound:
+		fmt.Printf("%sfound %s, which is not whitelisted\n", prefix, e.Id)
+	case ingest.EventPermissionsSet:
+		fmt.Printf("%sset %s permissions on %s read: %s; write: %s\n", prefix, e.Channel, e.Id, strings.Join(e.Read, ","), strings.Join(e.Write, ","))
+	}
+}
+
+// printPlan prints the changes that a dry run found would be made
+// to the destination charmstore.
+func printPlan(stats ingest.IngestStats) {
+	for _, p := range stats.Plan {
+		fmt.Println(p.Id)
+		if p.IsEmpty() {
+			fmt.Println("\tup to date")
+			continue
+		}
+		if p.UploadArchive {
+			fmt.Println("\tupload archive")
+		}
+		names := make([]string, 0, len(p.Resources))
+		for name := range p.Resources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, rev := range p.Resources[name] {
+				fmt.Printf("\tupload resource %s/%d\n", name, rev)
+			}
+		}
+		for _, pub := range p.Publish {
+			fmt.Printf("\tpublish to %s%s\n", pub.Channel, formatResources(pub.Resources))
+		}
+		if len(p.ExtraInfo) > 0 {
+			fmt.Printf("\tset extra-info %s\n", strings.Join(p.ExtraInfo, ", "))
+		}
+		if len(p.CommonInfo) > 0 {
+			fmt.Printf("\tset common-info %s\n", strings.Join(p.CommonInfo, ", "))
+		}
+		for _, perm := range p.Perms {
+			fmt.Printf("\tset %s permissions read: %s; write: %s\n", perm.Channel, strings.Join(perm.Read, ","), strings.Join(perm.Write, ","))
+		}
+	}
+	fmt.Printf("total %d revisions of %d entities\n", stats.EntityCount, stats.BaseEntityCount)
+	fmt.Printf("would copy %d revisions\n", stats.ArchivesCopiedCount)
+	if stats.FailedEntityCount > 0 {
+		fmt.Printf("would fail to copy %d revisions\n", stats.FailedEntityCount)
+	}
+	printOrphans(stats, true)
+}
+
+// formatResources returns a description of the given
+// resource revisions suitable for appending to a line of output.
+func formatResources(resources map[string]int) string {
+	if len(resources) == 0 {
+		return ""
+	}
+	revs := make([]string, 0, len(resources))
+	for name, rev := range resources {
+		revs = append(revs, fmt.Sprintf("%s/%d", name, rev))
+	}
+	sort.Strings(revs)
+	return " with resources " + strings.Join(revs, " ")
 }
 
 // parseWhitelistFile takes a file name, and parses the whitelist from that file
 // returning whitelist entities. An error is returned if a file is unable to be
 // opened from the provided path, or the file is not a valid whitelist.
+// Files with a .yaml or .yml extension are parsed as YAML whitelists;
+// any other file is parsed in the line-based format.
 func parseWhitelistFile(fileName string) ([]ingest.WhitelistEntity, error) {
-	file, err := os.Open(fileName)
+	return readWhitelistFile(fileName, make(map[string]bool))
+}
+
+// openCookieJar opens the cookie jar stored in the given file.
+func openCookieJar(fileName string) *cookiejar.Jar {
+	jar, err := cookiejar.New(&cookiejar.Options{
+		Filename: fileName,
+	})
+	if err != nil {
+		fatalf("unable to create cookie jar: %v", err)
+	}
+	return jar
+}
+
+// sourceCookieFile returns the name of the file holding the cookie jar
+// for the source with the given name. An unnamed source uses the
+// default cookie file, so that a login made with the charm command
+// is used too.
+func sourceCookieFile(name string) string {
+	if name == "" {
+		return cookiejar.DefaultCookieFile()
+	}
+	return cookiejar.DefaultCookieFile() + ".charm-ingest-src-" + url.PathEscape(name)
+}
+
+// saveCookieJar saves the given cookie jar, printing
+// a warning if that fails.
+func saveCookieJar(jar *cookiejar.Jar) {
+	if err := jar.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: unable to save cookie jar: %v\n", err)
+	}
+}
+
+// newBakeryClient returns a bakery client that stores macaroons in the
+// given cookie jar and retries requests that fail with temporary
+// errors. If auth holds an agent file, the client will authenticate
+// as the agent.
+func newBakeryClient(jar *cookiejar.Jar, auth *authInfo) (*httpbakery.Client, error) {
+	bakeryClient := httpbakery.NewClient()
+	bakeryClient.Jar = jar
+	bakeryClient.Client.Transport = ingest.NewTransport(bakeryClient.Client.Transport)
+	if auth.agentFile == "" {
+		return bakeryClient, nil
+	}
+	agentInfo, err := readAgentFile(auth.agentFile)
 	if err != nil {
-		return nil, err
+		return nil, errgo.Notef(err, "cannot load agent information")
 	}
-	defer file.Close()
+	if err := agent.SetUpAuth(bakeryClient, agentInfo); err != nil {
+		return nil, errgo.Notef(err, "cannot set up agent authentication")
+	}
+	return bakeryClient, nil
+}
 
-	return parseWhitelist(fileName, file)
+func readAgentFile(f string) (*agent.AuthInfo, error) {
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, errgo.Mask(err, os.IsNotExist)
+	}
+	var v agent.AuthInfo
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, errgo.Notef(err, "cannot parse agent data from %q", f)
+	}
+	return &v, nil
 }
 
 // newCharmStoreClient creates a new client to connect at the given url, with the
@@ -153,26 +1031,142 @@ func newCharmStoreClient(url string, bakeryClient *httpbakery.Client, auth *auth
 	return csclient.New(p)
 }
 
+// namedStore holds a source or destination charm store.
+type namedStore struct {
+	// name identifies the charm store in reports
+	// when there's more than one.
+	name string
+	url  string
+	auth authInfo
+}
+
+// urlDests returns the destinations with the given URLs,
+// which all use the given credentials.
+func urlDests(urls []string, auth authInfo) []namedStore {
+	dests := make([]namedStore, len(urls))
+	for i, url := range urls {
+		dests[i] = namedStore{
+			name: url,
+			url:  url,
+			auth: auth,
+		}
+	}
+	return dests
+}
+
 // sourceURL returns the charm store server URL.
-// The returned value can be overridden by setting the JUJU_CHARMSTORE
-// environment variable.
-func sourceURL() string {
+// The returned value can be overridden by the configuration
+// file or by setting the JUJU_CHARMSTORE environment variable.
+func sourceURL(cfg *config) string {
+	if cfg.Source.URL != "" {
+		return cfg.Source.URL
+	}
 	if url := os.Getenv("JUJU_CHARMSTORE"); url != "" {
 		return url
 	}
 	return csclient.ServerURL
 }
 
+// byteRate implements gnuflag.Value for a number of
+// bytes per second, with an optional K, M or G suffix
+// for multiples of 1024.
+type byteRate int64
+
+// Set implements gnuflag.Value.Set.
+func (r *byteRate) Set(s string) error {
+	n, ok := parseByteCount(s)
+	if !ok {
+		return errgo.Newf("invalid byte rate %q", s)
+	}
+	*r = byteRate(n)
+	return nil
+}
+
+// String implements gnuflag.Value.String.
+func (r *byteRate) String() string {
+	return strconv.FormatInt(int64(*r), 10)
+}
+
+// byteCount holds a number of bytes. It's parsed from YAML
+// and flags in the same form as byteRate.
+type byteCount int64
+
+// Set implements gnuflag.Value.Set.
+func (n *byteCount) Set(s string) error {
+	n1, ok := parseByteCount(s)
+	if !ok {
+		return errgo.Newf("invalid byte count %q", s)
+	}
+	*n = byteCount(n1)
+	return nil
+}
+
+// String implements gnuflag.Value.String.
+func (n *byteCount) String() string {
+	return strconv.FormatInt(int64(*n), 10)
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (n *byteCount) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return n.Set(s)
+}
+
+// parseByteCount parses a non-negative number of bytes with
+// an optional K, M or G suffix for multiples of 1024.
+func parseByteCount(s0 string) (int64, bool) {
+	s := s0
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n * mult, true
+}
+
+// formatLimit returns a description of the given limit
+// in the given units, where zero means unlimited.
+func formatLimit(n int64, units string) string {
+	switch {
+	case n == 0:
+		return "unlimited"
+	case units == "":
+		return strconv.FormatInt(n, 10)
+	case n%(1<<30) == 0:
+		return fmt.Sprintf("%dG%s", n>>30, units)
+	case n%(1<<20) == 0:
+		return fmt.Sprintf("%dM%s", n>>20, units)
+	case n%(1<<10) == 0:
+		return fmt.Sprintf("%dK%s", n>>10, units)
+	}
+	return fmt.Sprintf("%d%s", n, units)
+}
+
 type authInfo struct {
-	username string
-	password string
+	agentFile string
+	username  string
+	password  string
 }
 
 // Set implements gnuflag.Value.Set by validating
 // the authentication flag.
 func (a *authInfo) Set(s string) error {
 	if s == "" {
-		*a = authInfo{}
+		a.username, a.password = "", ""
 		return nil
 	}
 	parts := strings.SplitN(s, ":", 2)
@@ -0,0 +1,108 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charmstore-client/internal/ingest"
+	"github.com/juju/persistent-cookiejar"
+)
+
+var byteRateTests = []struct {
+	s           string
+	expect      byteRate
+	expectLimit string
+	expectError string
+}{{
+	s:           "0",
+	expectLimit: "unlimited",
+}, {
+	s:           "1500",
+	expect:      1500,
+	expectLimit: "1500/s",
+}, {
+	s:           "512K",
+	expect:      512 * 1024,
+	expectLimit: "512K/s",
+}, {
+	s:           "10M",
+	expect:      10 * 1024 * 1024,
+	expectLimit: "10M/s",
+}, {
+	s:           "2G",
+	expect:      2 * 1024 * 1024 * 1024,
+	expectLimit: "2G/s",
+}, {
+	s:           "10MB",
+	expectError: `invalid byte rate "10MB"`,
+}, {
+	s:           "-1",
+	expectError: `invalid byte rate "-1"`,
+}}
+
+func TestByteRate(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range byteRateTests {
+		c.Run(test.s, func(c *qt.C) {
+			var r byteRate
+			err := r.Set(test.s)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(r, qt.Equals, test.expect)
+			c.Assert(formatLimit(int64(r), "/s"), qt.Equals, test.expectLimit)
+		})
+	}
+}
+
+func TestSourceCookieFile(t *testing.T) {
+	c := qt.New(t)
+	def := cookiejar.DefaultCookieFile()
+	c.Assert(sourceCookieFile(""), qt.Equals, def)
+	c.Assert(sourceCookieFile("partner"), qt.Equals, def+".charm-ingest-src-partner")
+	c.Assert(sourceCookieFile("https://api.jujucharms.com/charmstore"), qt.Equals, def+".charm-ingest-src-https:%2F%2Fapi.jujucharms.com%2Fcharmstore")
+}
+
+func TestPrintDrift(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	printDrift(&buf, ingest.VerifyStats{
+		BaseEntityCount: 1,
+		EntityCount:     2,
+		ResourceCount:   1,
+		Drift: []ingest.EntityDrift{{
+			Id: "cs:~bob/foo-1",
+			Differences: []ingest.Difference{{
+				What: "archive hash",
+				Want: "1234",
+				Got:  "5678",
+			}, {
+				What: "extra-info x",
+				Want: "45",
+			}},
+		}},
+	})
+	c.Assert(buf.String(), qt.Equals, `verified 2 revisions of 1 entities and 1 resources
+cs:~bob/foo-1
+	- archive hash: 1234
+	+ archive hash: 5678
+	- extra-info x: 45
+	+ extra-info x: (none)
+1 entities differ from the source
+`)
+
+	buf.Reset()
+	printDrift(&buf, ingest.VerifyStats{
+		BaseEntityCount: 1,
+		EntityCount:     1,
+	})
+	c.Assert(buf.String(), qt.Equals, `verified 1 revisions of 1 entities and 0 resources
+destination matches source
+`)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/juju/charmstore-client/internal/ingest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// yamlRewriteRule holds an entry in a rewrite rules file.
+type yamlRewriteRule struct {
+	Owner           string `yaml:"owner"`
+	Name            string `yaml:"name"`
+	Series          string `yaml:"series"`
+	ToOwner         string `yaml:"to-owner"`
+	ToName          string `yaml:"to-name"`
+	ToSeries        string `yaml:"to-series"`
+	KeepPromulgated bool   `yaml:"keep-promulgated"`
+}
+
+// parseRewriteFile parses the rewrite rules file with the given name.
+// See parseRewriteConfig.
+func parseRewriteFile(fileName string) ([]ingest.RewriteRule, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRewriteConfig(fileName, f)
+}
+
+// parseRewriteConfig parses a list of rewrite rules read from r.
+// For example:
+//
+//	# Copy cs:~upstream/foo to cs:~ourteam/foo.
+//	- owner: upstream
+//	  to-owner: ourteam
+//	# Copy cs:~charmers/mysql to cs:~charmers/mariadb.
+//	- owner: charmers
+//	  name: mysql
+//	  to-name: mariadb
+//	  keep-promulgated: true
+func parseRewriteConfig(filename string, r io.Reader) ([]ingest.RewriteRule, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var rules []yamlRewriteRule
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %s", filename)
+	}
+	result, err := rewriteRules(rules)
+	if err != nil {
+		return nil, errgo.Notef(err, "%s", filename)
+	}
+	return result, nil
+}
+
+// rewriteRules checks the given rules and converts
+// them to the form used by the ingest package.
+func rewriteRules(rules []yamlRewriteRule) ([]ingest.RewriteRule, error) {
+	var result []ingest.RewriteRule
+	for i, rule := range rules {
+		if rule.ToOwner == "" && rule.ToName == "" && rule.ToSeries == "" {
+			return nil, errgo.Newf("rule %d does not change anything", i+1)
+		}
+		if rule.Series == "bundle" || rule.ToSeries == "bundle" {
+			return nil, errgo.Newf("rule %d: cannot rewrite the series of bundles", i+1)
+		}
+		result = append(result, ingest.RewriteRule{
+			Owner:           rule.Owner,
+			Name:            rule.Name,
+			Series:          rule.Series,
+			ToOwner:         rule.ToOwner,
+			ToName:          rule.ToName,
+			ToSeries:        rule.ToSeries,
+			KeepPromulgated: rule.KeepPromulgated,
+		})
+	}
+	return result, nil
+}
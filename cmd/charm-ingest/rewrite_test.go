@@ -0,0 +1,80 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charmstore-client/internal/ingest"
+)
+
+var rewriteConfigTests = []struct {
+	testName    string
+	config      string
+	expectRules []ingest.RewriteRule
+	expectError string
+}{{
+	testName: "full",
+	config: `
+- owner: upstream
+  to-owner: ourteam
+- owner: charmers
+  name: mysql
+  series: xenial
+  to-name: mariadb
+  to-series: bionic
+  keep-promulgated: true
+`,
+	expectRules: []ingest.RewriteRule{{
+		Owner:   "upstream",
+		ToOwner: "ourteam",
+	}, {
+		Owner:           "charmers",
+		Name:            "mysql",
+		Series:          "xenial",
+		ToName:          "mariadb",
+		ToSeries:        "bionic",
+		KeepPromulgated: true,
+	}},
+}, {
+	testName: "empty",
+	config:   ``,
+}, {
+	testName: "no_change",
+	config: `
+- owner: upstream
+`,
+	expectError: `no_change: rule 1 does not change anything`,
+}, {
+	testName: "bundle_series",
+	config: `
+- series: bundle
+  to-series: xenial
+`,
+	expectError: `bundle_series: rule 1: cannot rewrite the series of bundles`,
+}, {
+	testName: "unknown_field",
+	config: `
+- owner: upstream
+  to-user: ourteam
+`,
+	expectError: `cannot parse unknown_field: (.|\n)*field to-user not found in type main.yamlRewriteRule`,
+}}
+
+func TestParseRewriteConfig(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range rewriteConfigTests {
+		c.Run(test.testName, func(c *qt.C) {
+			rules, err := parseRewriteConfig(test.testName, strings.NewReader(test.config))
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Check(rules, qt.DeepEquals, test.expectRules)
+		})
+	}
+}
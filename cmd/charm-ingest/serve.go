@@ -0,0 +1,311 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/juju/charmstore-client/internal/ingest"
+)
+
+// whitelistPollInterval holds how often the whitelist
+// file is checked for changes when serving.
+var whitelistPollInterval = 10 * time.Second
+
+// syncServer runs an ingest at regular intervals and serves
+// information about the ingests over HTTP.
+type syncServer struct {
+	// params holds the parameters for each ingest.
+	// Its Whitelist and SyncCache fields are set
+	// by the server.
+	params ingest.IngestParams
+
+	// whitelistFile holds the name of the whitelist file.
+	whitelistFile string
+
+	// interval holds the time between the end of one
+	// ingest and the start of the next.
+	interval time.Duration
+
+	// timeout holds the longest time that each ingest
+	// may take, or zero if there's no limit.
+	timeout time.Duration
+
+	// ingest is used to run an ingest. It's
+	// a variable so that it can be replaced in tests.
+	ingest func(context.Context, ingest.IngestParams) ingest.IngestStats
+
+	// afterSync is called after each ingest if it's not nil.
+	afterSync func()
+
+	// trigger is used to start an ingest before the interval
+	// has elapsed. The value is true if the ingest should
+	// check everything in the destination.
+	trigger chan bool
+
+	// mu guards the fields below it.
+	mu        sync.Mutex
+	whitelist []ingest.WhitelistEntity
+	cache     *ingest.SyncCache
+	running   bool
+	last      *syncResult
+	metrics   syncMetrics
+}
+
+// syncResult holds the result of an ingest run by a syncServer.
+type syncResult struct {
+	Start time.Time
+	End   time.Time
+	Full  bool
+	Stats ingest.IngestStats
+}
+
+// syncMetrics holds counters reported by a syncServer.
+// All the counts are cumulative over all ingests.
+type syncMetrics struct {
+	syncs            int
+	failedSyncs      int
+	whitelistReloads int
+	whitelistErrors  int
+	archivesCopied   int
+	archivesPresent  int
+	resourcesCopied  int
+	resourcesPresent int
+	bytesCopied      int64
+	errors           int
+	retries          int
+}
+
+// newSyncServer returns a server that runs ingests with the given
+// parameters, reading the whitelist from the given file.
+func newSyncServer(p ingest.IngestParams, whitelistFile string, interval time.Duration) (*syncServer, error) {
+	whitelist, err := parseWhitelistFile(whitelistFile)
+	if err != nil {
+		return nil, err
+	}
+	return &syncServer{
+		params:        p,
+		whitelistFile: whitelistFile,
+		interval:      interval,
+		ingest:        ingest.Ingest,
+		trigger:       make(chan bool, 1),
+		whitelist:     whitelist,
+		cache:         ingest.NewSyncCache(),
+	}, nil
+}
+
+// run runs ingests until ctx is done, starting with one straight
+// away. It also watches the whitelist file, running an ingest when
+// it changes. An ingest in progress when ctx is done is interrupted.
+func (s *syncServer) run(ctx context.Context) {
+	go s.watchWhitelist(ctx)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		full := false
+		select {
+		case <-timer.C:
+		case full = <-s.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-ctx.Done():
+			return
+		}
+		s.sync(ctx, full)
+		timer.Reset(s.interval)
+	}
+}
+
+// watchWhitelist polls the whitelist file, triggering
+// an ingest whenever the whitelist changes, until
+// ctx is done.
+func (s *syncServer) watchWhitelist(ctx context.Context) {
+	ticker := time.NewTicker(whitelistPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if s.reloadWhitelist() {
+			s.triggerSync(false)
+		}
+	}
+}
+
+// reloadWhitelist reads the whitelist file again and reports whether
+// the whitelist has changed. If the file can't be read, the previous
+// whitelist continues to be used.
+func (s *syncServer) reloadWhitelist() bool {
+	whitelist, err := parseWhitelistFile(s.whitelistFile)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("cannot reload whitelist: %v", err)
+		s.metrics.whitelistErrors++
+		return false
+	}
+	if reflect.DeepEqual(whitelist, s.whitelist) {
+		return false
+	}
+	log.Printf("whitelist changed; now %d entries", len(whitelist))
+	s.whitelist = whitelist
+	s.metrics.whitelistReloads++
+	return true
+}
+
+// triggerSync arranges for an ingest to start as soon as possible.
+// If full is true, the ingest checks everything in the destination,
+// not just the entities that have changed since they were last synced.
+// It reports whether the ingest was queued; it won't be if another
+// has already been queued.
+func (s *syncServer) triggerSync(full bool) bool {
+	select {
+	case s.trigger <- full:
+		return true
+	default:
+		return false
+	}
+}
+
+// sync runs a single ingest and records its result.
+func (s *syncServer) sync(ctx context.Context, full bool) {
+	s.mu.Lock()
+	if full {
+		s.cache = ingest.NewSyncCache()
+	}
+	p := s.params
+	p.Whitelist = s.whitelist
+	p.SyncCache = s.cache
+	s.running = true
+	s.mu.Unlock()
+
+	result := &syncResult{
+		Start: time.Now(),
+		Full:  full,
+	}
+	log.Printf("starting sync of %d whitelist entries", len(p.Whitelist))
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	result.Stats = s.ingest(ctx, p)
+	result.End = time.Now()
+	if s.afterSync != nil {
+		s.afterSync()
+	}
+	stats := &result.Stats
+	log.Printf("sync finished in %v: copied %d revisions and %d resources (%d bytes); %d failed, %d errors",
+		result.End.Sub(result.Start).Round(time.Millisecond),
+		stats.ArchivesCopiedCount,
+		stats.ResourcesCopiedCount,
+		stats.BytesCopied,
+		stats.FailedEntityCount,
+		len(stats.Errors),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.last = result
+	m := &s.metrics
+	m.syncs++
+	if stats.FailedEntityCount > 0 || len(stats.Errors) > 0 {
+		m.failedSyncs++
+	}
+	m.archivesCopied += stats.ArchivesCopiedCount
+	m.archivesPresent += stats.ArchivesPresentCount
+	m.resourcesCopied += stats.ResourcesCopiedCount
+	m.resourcesPresent += stats.ResourcesPresentCount
+	m.bytesCopied += stats.BytesCopied
+	m.errors += len(stats.Errors)
+	m.retries += stats.RetryCount
+}
+
+// ServeHTTP implements http.Handler. It serves the following endpoints:
+//
+//	POST /sync - start an ingest; with full=true, check everything
+//	GET /stats - the result of the last ingest, as JSON
+//	GET /metrics - counters in the Prometheus text format
+func (s *syncServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/sync":
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		queued := s.triggerSync(req.FormValue("full") == "true")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]bool{
+			"queued": queued,
+		})
+	case "/stats":
+		s.mu.Lock()
+		last := s.last
+		s.mu.Unlock()
+		if last == nil {
+			http.Error(w, "no sync has completed yet", http.StatusNotFound)
+			return
+		}
+		data, err := json.MarshalIndent(last, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// writeMetrics writes the server's metrics to w
+// in the Prometheus text exposition format.
+func (s *syncServer) writeMetrics(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.metrics
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP charm_ingest_%s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE charm_ingest_%s %s\n", name, kind)
+		fmt.Fprintf(w, "charm_ingest_%s %v\n", name, value)
+	}
+	metric("syncs_total", "counter", "Number of completed syncs.", m.syncs)
+	metric("failed_syncs_total", "counter", "Number of syncs that had errors or failed entities.", m.failedSyncs)
+	metric("whitelist_reloads_total", "counter", "Number of times a changed whitelist was loaded.", m.whitelistReloads)
+	metric("whitelist_errors_total", "counter", "Number of times the whitelist could not be reloaded.", m.whitelistErrors)
+	metric("archives_copied_total", "counter", "Number of archives copied.", m.archivesCopied)
+	metric("archives_present_total", "counter", "Number of archives found in the destination.", m.archivesPresent)
+	metric("resources_copied_total", "counter", "Number of resource revisions copied.", m.resourcesCopied)
+	metric("resources_present_total", "counter", "Number of resource revisions found in the destination.", m.resourcesPresent)
+	metric("bytes_copied_total", "counter", "Number of bytes of archives and resources copied.", m.bytesCopied)
+	metric("errors_total", "counter", "Number of errors encountered.", m.errors)
+	metric("retries_total", "counter", "Number of operations retried after temporary failures.", m.retries)
+	running := 0
+	if s.running {
+		running = 1
+	}
+	metric("sync_running", "gauge", "Whether a sync is in progress.", running)
+	metric("whitelist_entries", "gauge", "Number of entries in the whitelist.", len(s.whitelist))
+	if s.last != nil {
+		metric("last_sync_timestamp_seconds", "gauge", "Time that the last sync finished.", s.last.End.Unix())
+		metric("last_sync_duration_seconds", "gauge", "Duration of the last sync.", s.last.End.Sub(s.last.Start).Seconds())
+		metric("last_sync_entities", "gauge", "Number of entities in the last sync.", s.last.Stats.EntityCount)
+		metric("last_sync_failed_entities", "gauge", "Number of entities that failed in the last sync.", s.last.Stats.FailedEntityCount)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the GPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/charmstore-client/internal/ingest"
+)
+
+func TestSyncServer(t *testing.T) {
+	c := qt.New(t)
+	whitelistFile := filepath.Join(c.Mkdir(), "whitelist")
+	err := ioutil.WriteFile(whitelistFile, []byte("wordpress\n"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	srv, err := newSyncServer(ingest.IngestParams{}, whitelistFile, time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	var synced []ingest.IngestParams
+	srv.ingest = func(ctx context.Context, p ingest.IngestParams) ingest.IngestStats {
+		synced = append(synced, p)
+		return ingest.IngestStats{
+			EntityCount:          1,
+			ArchivesCopiedCount:  1,
+			ResourcesCopiedCount: 2,
+			BytesCopied:          1000,
+		}
+	}
+	hsrv := httptest.NewServer(srv)
+	defer hsrv.Close()
+
+	// There are no stats until a sync has run.
+	resp, err := http.Get(hsrv.URL + "/stats")
+	c.Assert(err, qt.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+
+	// Trigger a sync, which is run by srv.run.
+	resp, err = http.Post(hsrv.URL+"/sync", "", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusAccepted)
+	srv.sync(context.Background(), <-srv.trigger)
+	c.Assert(synced, qt.HasLen, 1)
+	c.Assert(synced[0].Whitelist, qt.HasLen, 1)
+	c.Assert(synced[0].Whitelist[0].EntityId, qt.Equals, "wordpress")
+	c.Assert(synced[0].SyncCache, qt.Not(qt.IsNil))
+
+	resp, err = http.Get(hsrv.URL + "/stats")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var result syncResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(result.Stats.ArchivesCopiedCount, qt.Equals, 1)
+	c.Assert(result.Full, qt.Equals, false)
+
+	// A full sync uses a new cache.
+	resp, err = http.Post(hsrv.URL+"/sync?full=true", "", nil)
+	c.Assert(err, qt.Equals, nil)
+	resp.Body.Close()
+	srv.sync(context.Background(), <-srv.trigger)
+	c.Assert(synced, qt.HasLen, 2)
+	c.Assert(synced[1].SyncCache != synced[0].SyncCache, qt.Equals, true)
+
+	// A changed whitelist is picked up by the next sync.
+	c.Assert(srv.reloadWhitelist(), qt.Equals, false)
+	err = ioutil.WriteFile(whitelistFile, []byte("wordpress\nmysql edge\n"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.reloadWhitelist(), qt.Equals, true)
+	srv.sync(context.Background(), false)
+	c.Assert(synced[2].Whitelist, qt.HasLen, 2)
+
+	// An invalid whitelist is ignored.
+	err = ioutil.WriteFile(whitelistFile, []byte("wordpress bad-channel\n"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.reloadWhitelist(), qt.Equals, false)
+
+	resp, err = http.Get(hsrv.URL + "/metrics")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.Equals, nil)
+	metrics := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		c.Assert(fields, qt.HasLen, 2)
+		metrics[fields[0]] = fields[1]
+	}
+	c.Check(metrics["charm_ingest_syncs_total"], qt.Equals, "3")
+	c.Check(metrics["charm_ingest_archives_copied_total"], qt.Equals, "3")
+	c.Check(metrics["charm_ingest_resources_copied_total"], qt.Equals, "6")
+	c.Check(metrics["charm_ingest_bytes_copied_total"], qt.Equals, "3000")
+	c.Check(metrics["charm_ingest_whitelist_reloads_total"], qt.Equals, "1")
+	c.Check(metrics["charm_ingest_whitelist_errors_total"], qt.Equals, "1")
+	c.Check(metrics["charm_ingest_whitelist_entries"], qt.Equals, "2")
+	c.Check(metrics["charm_ingest_sync_running"], qt.Equals, "0")
+	c.Check(metrics["charm_ingest_last_sync_entities"], qt.Equals, "1")
+}
+
+func TestSyncServerTimeoutAndCancel(t *testing.T) {
+	c := qt.New(t)
+	whitelistFile := filepath.Join(c.Mkdir(), "whitelist")
+	err := ioutil.WriteFile(whitelistFile, []byte("wordpress\n"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	srv, err := newSyncServer(ingest.IngestParams{}, whitelistFile, time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	srv.timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	synced := make(chan bool)
+	srv.ingest = func(ctx context.Context, p ingest.IngestParams) ingest.IngestStats {
+		// Each ingest is given the timeout.
+		deadline, ok := ctx.Deadline()
+		c.Check(ok, qt.Equals, true)
+		c.Check(time.Until(deadline) <= time.Minute, qt.Equals, true)
+		synced <- true
+		return ingest.IngestStats{}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.run(ctx)
+	}()
+	// The first sync starts straight away.
+	<-synced
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("server did not stop when its context was cancelled")
+	}
+}
+
+func TestWatchWhitelistStopsWhenCancelled(t *testing.T) {
+	c := qt.New(t)
+	whitelistFile := filepath.Join(c.Mkdir(), "whitelist")
+	err := ioutil.WriteFile(whitelistFile, []byte("wordpress\n"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	srv, err := newSyncServer(ingest.IngestParams{}, whitelistFile, time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.watchWhitelist(ctx)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("whitelist watcher did not stop when its context was cancelled")
+	}
+}
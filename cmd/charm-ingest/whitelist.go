@@ -7,11 +7,16 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/charmstore-client/internal/ingest"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
 )
 
 // parseError is the error returned when a whitelist cannot be parsed.
@@ -88,3 +93,146 @@ func parseLine(line string) (ingest.WhitelistEntity, error) {
 
 	return entity, nil
 }
+
+// yamlWhitelist holds the contents of a YAML whitelist file.
+type yamlWhitelist struct {
+	// Include holds the names of other whitelist files to
+	// include, relative to the directory holding the file.
+	Include []string `yaml:"include"`
+
+	// Entities holds the entities to ingest.
+	Entities []yamlWhitelistEntity `yaml:"entities"`
+}
+
+// yamlWhitelistEntity holds an entry in a YAML whitelist.
+type yamlWhitelistEntity struct {
+	Id            string           `yaml:"id"`
+	Channels      []params.Channel `yaml:"channels"`
+	Resources     map[string][]int `yaml:"resources"`
+	SkipResources bool             `yaml:"skip-resources"`
+	Series        []string         `yaml:"series"`
+	Exclude       []string         `yaml:"exclude"`
+	Source        string           `yaml:"source"`
+
+	History        int       `yaml:"history"`
+	Since          time.Time `yaml:"since"`
+	MaxHistorySize byteCount `yaml:"max-history-size"`
+}
+
+// isYAMLWhitelist reports whether the file with the given
+// name holds a YAML whitelist rather than one in the
+// line-based format.
+func isYAMLWhitelist(fileName string) bool {
+	switch filepath.Ext(fileName) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// parseYAMLWhitelist parses a YAML whitelist read from r.
+// Included files are not read; their names are returned in
+// the Include field. For example:
+//
+//	# Everything needed for the kubernetes deployment.
+//	include:
+//	- kubernetes.yaml
+//	entities:
+//	- id: cs:~bob/wordpress
+//	  channels: [stable, edge]
+//	  resources:
+//	    website: [3, 4]
+//	- id: cs:~bob/bigdata
+//	  skip-resources: true
+//	- id: cs:~partner/k8s-*
+//	  series: [kubernetes]
+//	  exclude: ["*-test"]
+//	- id: cs:~bob/database
+//	  history: 5
+//	  since: 2020-01-01
+//	  max-history-size: 10G
+func parseYAMLWhitelist(filename string, r io.Reader) (*yamlWhitelist, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var wl yamlWhitelist
+	if err := yaml.UnmarshalStrict(data, &wl); err != nil {
+		return nil, errgo.Notef(err, "cannot parse %s", filename)
+	}
+	for i, e := range wl.Entities {
+		if e.Id == "" {
+			return nil, errgo.Newf("%s: entity %d has no id", filename, i+1)
+		}
+		for _, ch := range e.Channels {
+			if !params.ValidChannels[ch] {
+				return nil, errgo.Newf("%s: invalid channel %q for entity %q", filename, ch, e.Id)
+			}
+		}
+		if e.History < 0 {
+			return nil, errgo.Newf("%s: invalid history %d for entity %q", filename, e.History, e.Id)
+		}
+		for name, revs := range e.Resources {
+			for _, rev := range revs {
+				if rev < 0 {
+					return nil, errgo.Newf("%s: invalid revision %d for resource %q of entity %q", filename, rev, name, e.Id)
+				}
+			}
+		}
+	}
+	return &wl, nil
+}
+
+// readWhitelistFile reads the whitelist file with the given name,
+// in either format, along with any files that it includes.
+// The including parameter holds the files that are currently
+// being read so that include cycles can be detected.
+func readWhitelistFile(fileName string, including map[string]bool) ([]ingest.WhitelistEntity, error) {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if including[path] {
+		return nil, errgo.Newf("%s: include cycle", fileName)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if !isYAMLWhitelist(fileName) {
+		return parseWhitelist(fileName, file)
+	}
+	wl, err := parseYAMLWhitelist(fileName, file)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	including[path] = true
+	defer delete(including, path)
+	var entities []ingest.WhitelistEntity
+	for _, inc := range wl.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(fileName), inc)
+		}
+		incEntities, err := readWhitelistFile(inc, including)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot include %q from %s", inc, fileName)
+		}
+		entities = append(entities, incEntities...)
+	}
+	for _, e := range wl.Entities {
+		entities = append(entities, ingest.WhitelistEntity{
+			EntityId:       e.Id,
+			Channels:       e.Channels,
+			Resources:      e.Resources,
+			SkipResources:  e.SkipResources,
+			Series:         e.Series,
+			Exclude:        e.Exclude,
+			Source:         e.Source,
+			History:        e.History,
+			Since:          e.Since,
+			MaxHistorySize: int64(e.MaxHistorySize),
+		})
+	}
+	return entities, nil
+}
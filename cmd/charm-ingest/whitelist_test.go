@@ -4,8 +4,12 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/juju/charmrepo/v6/csclient/params"
@@ -62,3 +66,195 @@ func TestParseWhitelist(t *testing.T) {
 		})
 	}
 }
+
+var yamlWhitelistTests = []struct {
+	testName    string
+	whitelist   string
+	expect      *yamlWhitelist
+	expectError string
+}{{
+	testName: "valid_whitelist",
+	whitelist: `
+# A comment.
+include:
+- other.yaml
+entities:
+- id: wordpress
+  channels: [stable, edge] # Another comment.
+  resources:
+    website: [3, 4]
+- id: cs:~bob/bigdata
+  skip-resources: true
+- id: cs:~partner/k8s-*
+  series: [kubernetes]
+  exclude: ["*-test"]
+`,
+	expect: &yamlWhitelist{
+		Include: []string{"other.yaml"},
+		Entities: []yamlWhitelistEntity{{
+			Id:       "wordpress",
+			Channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+			Resources: map[string][]int{
+				"website": {3, 4},
+			},
+		}, {
+			Id:            "cs:~bob/bigdata",
+			SkipResources: true,
+		}, {
+			Id:      "cs:~partner/k8s-*",
+			Series:  []string{"kubernetes"},
+			Exclude: []string{"*-test"},
+		}},
+	},
+}, {
+	testName: "history",
+	whitelist: `
+entities:
+- id: cs:~bob/database
+  history: 5
+  since: 2020-01-02
+  max-history-size: 10G
+- id: cs:~bob/web
+  since: 2020-01-02T15:04:05Z
+  max-history-size: 1024
+`,
+	expect: &yamlWhitelist{
+		Entities: []yamlWhitelistEntity{{
+			Id:             "cs:~bob/database",
+			History:        5,
+			Since:          time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+			MaxHistorySize: 10 << 30,
+		}, {
+			Id:             "cs:~bob/web",
+			Since:          time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC),
+			MaxHistorySize: 1024,
+		}},
+	},
+}, {
+	testName: "source",
+	whitelist: `
+entities:
+- id: cs:~partner/app
+  source: partner
+`,
+	expect: &yamlWhitelist{
+		Entities: []yamlWhitelistEntity{{
+			Id:     "cs:~partner/app",
+			Source: "partner",
+		}},
+	},
+}, {
+	testName: "negative_history",
+	whitelist: `
+entities:
+- id: wordpress
+  history: -1
+`,
+	expectError: `negative_history: invalid history -1 for entity "wordpress"`,
+}, {
+	testName: "invalid_history_size",
+	whitelist: `
+entities:
+- id: wordpress
+  max-history-size: 10GB
+`,
+	expectError: `cannot parse invalid_history_size: invalid byte count "10GB"`,
+}, {
+	testName: "invalid_channel",
+	whitelist: `
+entities:
+- id: wordpress
+  channels: [badchannel]
+`,
+	expectError: `invalid_channel: invalid channel "badchannel" for entity "wordpress"`,
+}, {
+	testName: "missing_id",
+	whitelist: `
+entities:
+- channels: [stable]
+`,
+	expectError: `missing_id: entity 1 has no id`,
+}, {
+	testName: "negative_revision",
+	whitelist: `
+entities:
+- id: wordpress
+  resources:
+    website: [-1]
+`,
+	expectError: `negative_revision: invalid revision -1 for resource "website" of entity "wordpress"`,
+}, {
+	testName: "unknown_field",
+	whitelist: `
+entities:
+- id: wordpress
+  chanels: [stable]
+`,
+	expectError: `(?s)cannot parse unknown_field: yaml: unmarshal errors:.*field chanels not found.*`,
+}}
+
+func TestParseYAMLWhitelist(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range yamlWhitelistTests {
+		c.Run(test.testName, func(c *qt.C) {
+			got, err := parseYAMLWhitelist(test.testName, strings.NewReader(test.whitelist))
+			if test.expectError == "" {
+				c.Assert(err, qt.Equals, nil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+			}
+			c.Assert(got, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func TestParseWhitelistFileWithIncludes(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	writeFile(c, filepath.Join(dir, "main.yaml"), `
+include:
+- sub/other.yml
+- lines.txt
+entities:
+- id: wordpress
+`)
+	writeFile(c, filepath.Join(dir, "sub", "other.yml"), `
+entities:
+- id: mysql
+  channels: [edge]
+`)
+	writeFile(c, filepath.Join(dir, "lines.txt"), `
+mongodb beta
+`)
+	got, err := parseWhitelistFile(filepath.Join(dir, "main.yaml"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.DeepEquals, []ingest.WhitelistEntity{{
+		EntityId: "mysql",
+		Channels: []params.Channel{params.EdgeChannel},
+	}, {
+		EntityId: "mongodb",
+		Channels: []params.Channel{params.BetaChannel},
+	}, {
+		EntityId: "wordpress",
+	}})
+}
+
+func TestParseWhitelistFileIncludeCycle(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	writeFile(c, filepath.Join(dir, "a.yaml"), `
+include: [b.yaml]
+`)
+	writeFile(c, filepath.Join(dir, "b.yaml"), `
+include: [a.yaml]
+`)
+	_, err := parseWhitelistFile(filepath.Join(dir, "a.yaml"))
+	c.Assert(err, qt.ErrorMatches, `cannot include ".*/b.yaml" from .*/a.yaml: cannot include ".*/a.yaml" from .*/b.yaml: .*/a.yaml: include cycle`)
+}
+
+func writeFile(c *qt.C, path, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	c.Assert(err, qt.Equals, nil)
+	err = ioutil.WriteFile(path, []byte(content), 0666)
+	c.Assert(err, qt.Equals, nil)
+}
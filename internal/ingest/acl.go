@@ -0,0 +1,134 @@
+package ingest
+
+import (
+	"github.com/juju/charmrepo/v6/csclient/params"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// ACLPolicy specifies the permissions that an ingest sets on each
+// channel of the entities that it transfers.
+//
+// The ACLs for a channel are worked out by starting with read access
+// for everyone and write access for IngestParams.Owner, and then
+// applying each of the following in turn. Each step replaces the
+// read or write ACL only if it specifies one.
+//
+//   - Read and Write
+//   - the entry in Channels for the channel
+//   - the ACLs in the source, if CopySource is true
+//   - the first rule in Rules that matches the base entity,
+//     then that rule's entry in Channels for the channel
+type ACLPolicy struct {
+	// Read and Write hold the default read and write ACLs.
+	Read  []string
+	Write []string
+
+	// Channels holds ACLs for particular channels.
+	Channels map[params.Channel]ACL
+
+	// Rules holds ACLs for base entities that match patterns.
+	Rules []ACLRule
+
+	// CopySource specifies that the ACLs for each channel should
+	// be copied from the source, with the users and groups in
+	// them renamed according to Renames.
+	CopySource bool
+
+	// Renames maps from user or group names in the source to
+	// the names that should be used instead in the destination,
+	// for example from "everyone" to an internal group.
+	Renames map[string]string
+}
+
+// ACL holds the read and write ACLs for a channel.
+type ACL struct {
+	Read  []string
+	Write []string
+}
+
+// ACLRule holds the ACLs for base entities that match a pattern.
+type ACLRule struct {
+	// Pattern holds a base entity id that may contain wildcards
+	// as interpreted by path.Match, for example cs:~partner/*.
+	Pattern string
+
+	// ACL holds the ACLs for all channels.
+	ACL
+
+	// Channels holds ACLs for particular channels.
+	Channels map[params.Channel]ACL
+}
+
+// perm returns the permissions that the ingest should set on
+// the given channel of the base entity with the given id.
+// The srcPerms parameter holds the permissions of the base
+// entity in the source; it is only used if the policy copies them.
+func (ing *ingester) perm(baseId *charm.URL, ch params.Channel, srcPerms map[params.Channel]permission) permission {
+	perm := permission{
+		read:  []string{"everyone"},
+		write: []string{ing.params.owner},
+	}
+	p := ing.params.aclPolicy
+	if p == nil {
+		return perm
+	}
+	perm = perm.with(ACL{Read: p.Read, Write: p.Write})
+	perm = perm.with(p.Channels[ch])
+	if sp, ok := srcPerms[ch]; ok && p.CopySource {
+		perm = perm.with(ACL{
+			Read:  p.rename(sp.read),
+			Write: p.rename(sp.write),
+		})
+	}
+	for _, r := range p.Rules {
+		if matchIdPattern(r.Pattern, baseId) {
+			perm = perm.with(r.ACL).with(r.Channels[ch])
+			break
+		}
+	}
+	return perm
+}
+
+// sourcePerms returns the permissions of the base entity with the
+// given id in the source if the ACL policy copies them. Otherwise
+// it returns nil.
+func (ing *ingester) sourcePerms(baseId *charm.URL) (map[params.Channel]permission, error) {
+	if p := ing.params.aclPolicy; p == nil || !p.CopySource {
+		return nil, nil
+	}
+	be, err := ing.params.src.getBaseEntity(ing.params.ctx, baseId)
+	if err != nil {
+		return nil, err
+	}
+	return be.perms, nil
+}
+
+// with returns perm with the ACLs specified by acl replacing
+// those in perm.
+func (perm permission) with(acl ACL) permission {
+	if len(acl.Read) > 0 {
+		perm.read = acl.Read
+	}
+	if len(acl.Write) > 0 {
+		perm.write = acl.Write
+	}
+	return perm
+}
+
+// rename returns the given ACL with its names renamed
+// according to p.Renames.
+func (p *ACLPolicy) rename(acl []string) []string {
+	renamed := make([]string, 0, len(acl))
+	found := make(map[string]bool)
+	for _, name := range acl {
+		if newName, ok := p.Renames[name]; ok {
+			name = newName
+		}
+		if !found[name] {
+			found[name] = true
+			renamed = append(renamed, name)
+		}
+	}
+	return renamed
+}
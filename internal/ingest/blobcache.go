@@ -0,0 +1,377 @@
+package ingest
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// blobTempPrefix is the prefix of the names of the files in a
+// blobCache directory that are still being written.
+const blobTempPrefix = ".tmp-"
+
+// blobTempMaxAge holds how long a file that's being written to a
+// blobCache directory can go without being changed before it's
+// assumed to have been left behind by an ingest that didn't finish.
+// Files that are newer might still be being written by another
+// ingest that uses the same directory.
+const blobTempMaxAge = 24 * time.Hour
+
+// blobCache holds archive and resource content in a directory,
+// keyed by its hex-encoded SHA-384 hash, so that later ingests
+// don't need to read it from the source again. When the total
+// size of the content would be more than maxSize, the least
+// recently used content is removed.
+//
+// The modification time of each file records when it was last
+// used, so that the order is kept between ingests.
+type blobCache struct {
+	dir     string
+	maxSize int64
+
+	// mu guards the fields below it.
+	mu   sync.Mutex
+	size int64
+	// lru holds a *cachedBlob for each file in the cache,
+	// most recently used first.
+	lru *list.List
+	// blobs maps from hash to the element of lru
+	// holding that blob.
+	blobs map[string]*list.Element
+}
+
+// cachedBlob holds information on a file in a blobCache.
+type cachedBlob struct {
+	hash string
+	size int64
+}
+
+// openBlobCache opens the cache in the given directory, creating it
+// if needed. If maxSize is greater than zero, content is removed
+// so that the total size of the cache is no more than that.
+// Any files left half-written by a previous ingest, as shown by
+// their not having changed for blobTempMaxAge, are removed.
+func openBlobCache(dir string, maxSize int64) (*blobCache, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	c := &blobCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		blobs:   make(map[string]*list.Element),
+	}
+	// Add the least recently used first, so that
+	// it ends up at the back of the list.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		name := info.Name()
+		switch {
+		case strings.HasPrefix(name, blobTempPrefix):
+			if time.Since(info.ModTime()) > blobTempMaxAge {
+				os.Remove(filepath.Join(dir, name))
+			}
+		case info.Mode().IsRegular() && isBlobHash(name):
+			c.blobs[name] = c.lru.PushFront(&cachedBlob{
+				hash: name,
+				size: info.Size(),
+			})
+			c.size += info.Size()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// isBlobHash reports whether s is a hex-encoded SHA-384 hash.
+func isBlobHash(s string) bool {
+	if len(s) != sha512.Size384*2 {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// open returns the content with the given hash and its size,
+// and marks it as used. It returns false if the content
+// isn't in the cache.
+func (c *blobCache) open(hash string) (*os.File, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.blobs[hash]
+	if !ok {
+		return nil, 0, false
+	}
+	path := filepath.Join(c.dir, hash)
+	f, err := os.Open(path)
+	if err != nil {
+		// The file has gone, so forget about it.
+		c.remove(elem)
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f, elem.Value.(*cachedBlob).size, true
+}
+
+// add adds the file with the given name, which must be in the
+// cache directory, to the cache as the content with the given
+// hash and size. Content that's larger than the cache can hold
+// is removed instead.
+func (c *blobCache) add(name, hash string, size int64) error {
+	if c.maxSize > 0 && size > c.maxSize {
+		os.Remove(name)
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(name, filepath.Join(c.dir, hash)); err != nil {
+		os.Remove(name)
+		return errgo.Mask(err)
+	}
+	if elem, ok := c.blobs[hash]; ok {
+		// The same content has been added concurrently.
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	c.blobs[hash] = c.lru.PushFront(&cachedBlob{
+		hash: hash,
+		size: size,
+	})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used content until the
+// cache is within its size limit. It must be called with
+// c.mu held.
+func (c *blobCache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	for c.size > c.maxSize {
+		elem := c.lru.Back()
+		os.Remove(filepath.Join(c.dir, elem.Value.(*cachedBlob).hash))
+		c.remove(elem)
+	}
+}
+
+// remove forgets about the given content. It must be
+// called with c.mu held.
+func (c *blobCache) remove(elem *list.Element) {
+	b := c.lru.Remove(elem).(*cachedBlob)
+	delete(c.blobs, b.hash)
+	c.size -= b.size
+}
+
+// reader returns a reader that reads from r, which should hold the
+// content with the given hash, and adds the content to the cache
+// once it has been read to the end and closed, if it has that hash.
+// If the cache can't be written to, r is returned unchanged.
+func (c *blobCache) reader(r io.ReadCloser, hash string) io.ReadCloser {
+	f, err := ioutil.TempFile(c.dir, blobTempPrefix)
+	if err != nil {
+		return r
+	}
+	return &cachingReader{
+		r:     r,
+		cache: c,
+		hash:  hash,
+		file:  f,
+		h:     sha512.New384(),
+	}
+}
+
+// cachingReader copies what it reads into a new cache file.
+type cachingReader struct {
+	r     io.ReadCloser
+	cache *blobCache
+	hash  string
+
+	// file holds the file that the content is written to.
+	// It's nil if the content won't be cached after all.
+	file *os.File
+	h    hash.Hash
+	n    int64
+	eof  bool
+}
+
+func (r *cachingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if n > 0 && r.file != nil {
+		if _, werr := r.file.Write(buf[:n]); werr != nil {
+			r.discard()
+		} else {
+			r.h.Write(buf[:n])
+			r.n += int64(n)
+		}
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close closes the underlying reader and adds the content to the
+// cache if it was all read and has the expected hash.
+func (r *cachingReader) Close() error {
+	err := r.r.Close()
+	if r.file == nil {
+		return err
+	}
+	if !r.eof || fmt.Sprintf("%x", r.h.Sum(nil)) != r.hash {
+		r.discard()
+		return err
+	}
+	if cerr := r.file.Close(); cerr != nil {
+		os.Remove(r.file.Name())
+	} else {
+		r.cache.add(r.file.Name(), r.hash, r.n)
+	}
+	r.file = nil
+	return err
+}
+
+// discard removes the cache file, so that
+// the content isn't cached.
+func (r *cachingReader) discard() {
+	r.file.Close()
+	os.Remove(r.file.Name())
+	r.file = nil
+}
+
+// cacheClient is a csClient that reads archives and resources
+// from a blobCache when the source reports a hash for them that's
+// in the cache, and adds those that aren't to the cache as they're
+// read from the source.
+type cacheClient struct {
+	csClient
+	cache *blobCache
+	logf  func(string, ...interface{})
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+	// archiveHashes maps from entity id to the
+	// archive hash reported by entityInfo.
+	archiveHashes map[charm.URL]string
+	// resourceHashes maps from resource revision to the
+	// hash reported by resourceInfo.
+	resourceHashes map[cachedResource]string
+}
+
+// cachedResource identifies a resource revision in a cacheClient.
+type cachedResource struct {
+	id   charm.URL
+	name string
+	rev  int
+}
+
+func newCacheClient(c csClient, cache *blobCache, logf func(string, ...interface{})) *cacheClient {
+	return &cacheClient{
+		csClient:       c,
+		cache:          cache,
+		logf:           logf,
+		archiveHashes:  make(map[charm.URL]string),
+		resourceHashes: make(map[cachedResource]string),
+	}
+}
+
+func (c *cacheClient) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	e, err := c.csClient.entityInfo(ctx, ch, id)
+	if err != nil {
+		return nil, err
+	}
+	if e.hash != "" {
+		c.mu.Lock()
+		c.archiveHashes[*e.id] = e.hash
+		c.mu.Unlock()
+	}
+	return e, nil
+}
+
+func (c *cacheClient) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	c.mu.Lock()
+	hash, ok := c.archiveHashes[*id]
+	c.mu.Unlock()
+	if !ok {
+		return c.csClient.getArchive(ctx, id)
+	}
+	if f, _, ok := c.cache.open(hash); ok {
+		c.logf("reading archive for %v from cache", id)
+		return f, nil
+	}
+	r, err := c.csClient.getArchive(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.cache.reader(r, hash), nil
+}
+
+func (c *cacheClient) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	info, err := c.csClient.resourceInfo(ctx, id, name, rev)
+	if err != nil {
+		return nil, err
+	}
+	if info.hash != "" {
+		c.mu.Lock()
+		c.resourceHashes[cachedResource{*id, name, rev}] = info.hash
+		c.mu.Unlock()
+	}
+	return info, nil
+}
+
+func (c *cacheClient) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	c.mu.Lock()
+	hash, ok := c.resourceHashes[cachedResource{*id, name, rev}]
+	c.mu.Unlock()
+	if !ok {
+		// The hash is needed to find the resource
+		// in the cache, so ask the source for it.
+		info, err := c.resourceInfo(ctx, id, name, rev)
+		if err != nil {
+			return nil, 0, err
+		}
+		hash = info.hash
+	}
+	if hash == "" {
+		return c.csClient.getResource(ctx, id, name, rev)
+	}
+	if f, size, ok := c.cache.open(hash); ok {
+		c.logf("reading resource %v/%s/%d from cache", id, name, rev)
+		return f, size, nil
+	}
+	r, size, err := c.csClient.getResource(ctx, id, name, rev)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.cache.reader(r, hash), size, nil
+}
@@ -0,0 +1,823 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/charm/v8/resource"
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// dirClient implements csClient by storing entities in a local
+// directory. This makes it possible to ingest into a directory
+// from a charmstore and later ingest from that directory into
+// a charmstore that has no network route to the original one.
+//
+// The directory has the following layout:
+//
+//	whitelist.json
+//	entities/<id path>/meta.json
+//	entities/<id path>/archive
+//	base-entities/<base id path>/meta.json
+//	base-entities/<base id path>/resources/<name>/<revision>
+//	base-entities/<base id path>/resources/<name>/<revision>.json
+//
+// where whitelist.json holds a whitelist that, when used to
+// ingest from the directory, transfers everything it holds.
+type dirClient struct {
+	dir string
+
+	mu           sync.Mutex
+	entities     map[string]*dirEntity
+	baseEntities map[string]*dirBaseEntity
+}
+
+var _ csClient = (*dirClient)(nil)
+
+// dirEntity holds the metadata stored for an entity.
+type dirEntity struct {
+	Id            string
+	PromulgatedId string                     `json:",omitempty"`
+	Channels      map[params.Channel]bool    `json:",omitempty"`
+	ArchiveSize   int64                      `json:",omitempty"`
+	Hash          string                     `json:",omitempty"`
+	ExtraInfo     map[string]json.RawMessage `json:",omitempty"`
+
+	// UploadTime holds the time that the archive was uploaded
+	// to the charm store it was exported from. It's zero for
+	// entities exported before it was recorded.
+	UploadTime time.Time
+
+	// SupportedSeries holds the series supported by a
+	// multi-series charm, as found in its metadata.
+	SupportedSeries []string `json:",omitempty"`
+
+	// Resources holds all the resource revisions that have
+	// been stored for the entity.
+	Resources map[string][]int `json:",omitempty"`
+}
+
+// dirBaseEntity holds the metadata stored for a base entity.
+type dirBaseEntity struct {
+	Id string
+
+	// Published holds the resource revisions published
+	// with the current entity in each channel.
+	Published map[params.Channel]map[string]int `json:",omitempty"`
+
+	// Perms holds the ACLs for each channel.
+	Perms map[params.Channel]dirPerm `json:",omitempty"`
+
+	// CommonInfo holds the common-info metadata.
+	CommonInfo map[string]json.RawMessage `json:",omitempty"`
+}
+
+type dirPerm struct {
+	Read  []string
+	Write []string
+}
+
+// dirResource holds the metadata stored for a resource revision.
+type dirResource struct {
+	Size int64
+	Hash string
+
+	// Image holds the name and digest of a container image
+	// held in an external registry. Only external images can
+	// be stored; the image itself is not stored in the directory.
+	Image string `json:",omitempty"`
+}
+
+// openDirClient returns a dirClient that stores entities in the
+// given directory, creating it if needed.
+func openDirClient(dir string) (*dirClient, error) {
+	c := &dirClient{
+		dir:          dir,
+		entities:     make(map[string]*dirEntity),
+		baseEntities: make(map[string]*dirBaseEntity),
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := c.load("entities", func(data []byte) error {
+		var e dirEntity
+		if err := json.Unmarshal(data, &e); err != nil {
+			return errgo.Mask(err)
+		}
+		// Empty maps aren't stored, but they're
+		// assumed to be there once loaded.
+		if e.Channels == nil {
+			e.Channels = make(map[params.Channel]bool)
+		}
+		c.entities[e.Id] = &e
+		return nil
+	}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := c.load("base-entities", func(data []byte) error {
+		var be dirBaseEntity
+		if err := json.Unmarshal(data, &be); err != nil {
+			return errgo.Mask(err)
+		}
+		if be.Published == nil {
+			be.Published = make(map[params.Channel]map[string]int)
+		}
+		if be.Perms == nil {
+			be.Perms = make(map[params.Channel]dirPerm)
+		}
+		c.baseEntities[be.Id] = &be
+		return nil
+	}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return c, nil
+}
+
+// load calls f with the contents of every meta.json file
+// found under the given subdirectory.
+func (c *dirClient) load(subdir string, f func([]byte) error) error {
+	root := filepath.Join(c.dir, subdir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || info.Name() != "meta.json" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := f(data); err != nil {
+			return errgo.Notef(err, "cannot load %q", path)
+		}
+		return nil
+	})
+	return errgo.Mask(err)
+}
+
+// entityInfo implements csClient.entityInfo.
+func (c *dirClient) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.bestEntity(ch, id)
+	if e == nil {
+		return nil, errgo.WithCausef(nil, errNotFound, "")
+	}
+	info := &entityInfo{
+		id:          charm.MustParseURL(e.Id),
+		channels:    make(map[params.Channel]bool),
+		archiveSize: e.ArchiveSize,
+		hash:        e.Hash,
+		extraInfo:   copyMetadata(e.ExtraInfo),
+		uploadTime:  e.UploadTime,
+	}
+	if len(e.SupportedSeries) > 0 {
+		info.supportedSeries = append([]string(nil), e.SupportedSeries...)
+	}
+	if e.PromulgatedId != "" {
+		info.promulgatedId = charm.MustParseURL(e.PromulgatedId)
+	}
+	for ch, current := range e.Channels {
+		info.channels[ch] = current
+	}
+	be := c.baseEntities[baseEntityId(info.id).String()]
+	if be != nil {
+		info.commonInfo = copyMetadata(be.CommonInfo)
+	}
+	if be != nil && e.Channels[ch] {
+		for name, rev := range be.Published[ch] {
+			if info.resources == nil {
+				info.resources = make(map[string][]int)
+			}
+			info.resources[name] = []int{rev}
+		}
+	}
+	return info, nil
+}
+
+// bestEntity returns the entity corresponding to the given id,
+// resolving an id without a revision to the current entity
+// in the given channel. It returns nil if there's no such entity.
+// When more than one entity matches, such as when the id has no
+// series, the one with the highest revision is chosen, and then
+// the one whose id sorts first, so that the choice doesn't
+// depend on the order of the map.
+// It must be called with c.mu held.
+func (c *dirClient) bestEntity(ch params.Channel, id *charm.URL) *dirEntity {
+	var best *dirEntity
+	var bestId *charm.URL
+	for _, e := range c.matchingEntities(ch, id) {
+		eid := charm.MustParseURL(e.Id)
+		if best == nil || eid.Revision > bestId.Revision || (eid.Revision == bestId.Revision && e.Id < best.Id) {
+			best, bestId = e, eid
+		}
+	}
+	return best
+}
+
+// matchingEntities returns all the entities that match the given id
+// as described in bestEntity. It must be called with c.mu held.
+func (c *dirClient) matchingEntities(ch params.Channel, id *charm.URL) []*dirEntity {
+	if ch == params.NoChannel {
+		ch = params.StableChannel
+	}
+	var matches []*dirEntity
+	for _, e := range c.entities {
+		eid := charm.MustParseURL(e.Id)
+		if id.User == "" {
+			if e.PromulgatedId == "" {
+				continue
+			}
+			eid = charm.MustParseURL(e.PromulgatedId)
+		}
+		if id.Series != "" && eid.Series != id.Series {
+			continue
+		}
+		if eid.User != id.User || eid.Name != id.Name {
+			continue
+		}
+		if id.Revision == -1 {
+			if e.Channels[ch] {
+				matches = append(matches, e)
+			}
+			continue
+		}
+		if eid.Revision == id.Revision {
+			matches = append(matches, e)
+		}
+	}
+	return matches
+}
+
+// getBaseEntity implements csClient.getBaseEntity.
+func (c *dirClient) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	be := c.baseEntities[baseEntityId(id).String()]
+	if be == nil {
+		return nil, errgo.WithCausef(nil, errNotFound, "")
+	}
+	perms := make(map[params.Channel]permission)
+	for ch, p := range be.Perms {
+		perms[ch] = permission{
+			read:  p.Read,
+			write: p.Write,
+		}
+	}
+	return &baseEntityInfo{
+		perms:      perms,
+		commonInfo: copyMetadata(be.CommonInfo),
+	}, nil
+}
+
+// copyMetadata returns a copy of the given metadata, so that
+// it can be used after c.mu is released without being changed
+// by putExtraInfo or putCommonInfo.
+func copyMetadata(m map[string]json.RawMessage) map[string]json.RawMessage {
+	if m == nil {
+		return nil
+	}
+	m1 := make(map[string]json.RawMessage, len(m))
+	for k, v := range m {
+		m1[k] = v
+	}
+	return m1
+}
+
+// setPerm implements csClient.setPerm.
+func (c *dirClient) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	be := c.baseEntities[baseEntityId(id).String()]
+	if be == nil {
+		return errgo.WithCausef(nil, errNotFound, "no base entity for %q", id)
+	}
+	be.Perms[ch] = dirPerm{
+		Read:  perm.read,
+		Write: perm.write,
+	}
+	return errgo.Mask(c.writeBaseEntity(be))
+}
+
+// getArchive implements csClient.getArchive.
+func (c *dirClient) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	f, err := os.Open(c.entityPath(id, "archive"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errgo.WithCausef(nil, errNotFound, "no archive for %q", id)
+		}
+		return nil, errgo.Mask(err)
+	}
+	return f, nil
+}
+
+// putArchive implements csClient.putArchive.
+func (c *dirClient) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	c.mu.Lock()
+	if c.entities[id.String()] != nil {
+		c.mu.Unlock()
+		return errgo.Newf("entity %v already exists", id)
+	}
+	c.mu.Unlock()
+	path := c.entityPath(id, "archive")
+	h := sha512.New384()
+	n, err := writeFile(path, io.TeeReader(r, h))
+	if err != nil {
+		return errgo.Notef(err, "cannot write archive for %v", id)
+	}
+	if n != size {
+		os.Remove(path)
+		return errgo.WithCausef(nil, errHashMismatch, "size mismatch when putting archive (got %d want %d)", n, size)
+	}
+	if h := fmt.Sprintf("%x", h.Sum(nil)); h != hash {
+		os.Remove(path)
+		return errgo.WithCausef(nil, errHashMismatch, "hash mismatch when putting archive (got %s want %s)", h, hash)
+	}
+	e := &dirEntity{
+		Id:          id.String(),
+		Channels:    make(map[params.Channel]bool),
+		ArchiveSize: size,
+		Hash:        hash,
+		UploadTime:  uploadTime,
+	}
+	if id.Series == "" {
+		// The supported series are only used to filter
+		// whitelist patterns, so an archive that can't be
+		// read as a charm is still stored, without them.
+		if ch, err := charm.ReadCharmArchive(path); err == nil {
+			e.SupportedSeries = ch.Meta().Series
+		}
+	}
+	if promulgatedRevision != -1 {
+		pid := *id
+		pid.User = ""
+		pid.Revision = promulgatedRevision
+		e.PromulgatedId = pid.String()
+	}
+	for _, ch := range channels {
+		e.Channels[ch] = false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entities[e.Id] = e
+	if err := c.writeEntity(e); err != nil {
+		return errgo.Mask(err)
+	}
+	baseId := baseEntityId(id)
+	if c.baseEntities[baseId.String()] == nil {
+		// Newly uploaded entities in the charmstore are
+		// only accessible by their owner.
+		be := &dirBaseEntity{
+			Id:        baseId.String(),
+			Published: make(map[params.Channel]map[string]int),
+			Perms:     make(map[params.Channel]dirPerm),
+		}
+		for ch := range params.ValidChannels {
+			be.Perms[ch] = dirPerm{
+				Read:  []string{id.User},
+				Write: []string{id.User},
+			}
+		}
+		c.baseEntities[be.Id] = be
+		if err := c.writeBaseEntity(be); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// putExtraInfo implements csClient.putExtraInfo.
+func (c *dirClient) putExtraInfo(ctx context.Context, id *charm.URL, extraInfo map[string]json.RawMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entities[id.String()]
+	if e == nil {
+		return errgo.WithCausef(nil, errNotFound, "putExtraInfo on non-existent id %q", id)
+	}
+	if e.ExtraInfo == nil {
+		e.ExtraInfo = make(map[string]json.RawMessage)
+	}
+	for k, v := range extraInfo {
+		if v == nil {
+			delete(e.ExtraInfo, k)
+			continue
+		}
+		e.ExtraInfo[k] = v
+	}
+	return errgo.Mask(c.writeEntity(e))
+}
+
+// putCommonInfo implements csClient.putCommonInfo.
+func (c *dirClient) putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	be := c.baseEntities[baseEntityId(id).String()]
+	if be == nil {
+		return errgo.WithCausef(nil, errNotFound, "no base entity for %q", id)
+	}
+	if be.CommonInfo == nil {
+		be.CommonInfo = make(map[string]json.RawMessage)
+	}
+	for k, v := range commonInfo {
+		if v == nil {
+			delete(be.CommonInfo, k)
+			continue
+		}
+		be.CommonInfo[k] = v
+	}
+	return errgo.Mask(c.writeBaseEntity(be))
+}
+
+// publish implements csClient.publish.
+func (c *dirClient) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entities[id.String()]
+	if e == nil {
+		return errgo.WithCausef(nil, errNotFound, "publish to non-existent id %q", id)
+	}
+	baseId := baseEntityId(id)
+	for _, other := range c.entities {
+		if other == e || *baseEntityId(charm.MustParseURL(other.Id)) != *baseId {
+			continue
+		}
+		changed := false
+		for _, ch := range channels {
+			if other.Channels[ch] {
+				other.Channels[ch] = false
+				changed = true
+			}
+		}
+		if changed {
+			if err := c.writeEntity(other); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	for _, ch := range channels {
+		e.Channels[ch] = true
+	}
+	if err := c.writeEntity(e); err != nil {
+		return errgo.Mask(err)
+	}
+	be := c.baseEntities[baseId.String()]
+	if be == nil {
+		return errgo.WithCausef(nil, errNotFound, "no base entity for %q", id)
+	}
+	for _, ch := range channels {
+		be.Published[ch] = resources
+	}
+	return errgo.Mask(c.writeBaseEntity(be))
+}
+
+// resourceInfo implements csClient.resourceInfo.
+func (c *dirClient) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	data, err := ioutil.ReadFile(c.resourcePath(id, name, rev) + ".json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errgo.WithCausef(nil, errNotFound, "")
+		}
+		return nil, errgo.Mask(err)
+	}
+	var r dirResource
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal resource info")
+	}
+	info := &resourceInfo{
+		kind: resource.TypeFile,
+		size: r.Size,
+		hash: r.Hash,
+	}
+	if r.Image != "" {
+		info.kind = resource.TypeContainerImage
+	}
+	return info, nil
+}
+
+// getResource implements csClient.getResource.
+func (c *dirClient) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	info, err := c.resourceInfo(ctx, id, name, rev)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(errNotFound))
+	}
+	f, err := os.Open(c.resourcePath(id, name, rev))
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	return f, info.size, nil
+}
+
+// putResource implements csClient.putResource.
+func (c *dirClient) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+	c.mu.Lock()
+	e := c.entities[id.String()]
+	c.mu.Unlock()
+	if e == nil {
+		return errgo.Newf("charm %q not found", id)
+	}
+	path := c.resourcePath(id, name, rev)
+	if _, err := os.Stat(path + ".json"); err == nil {
+		return errgo.Newf("resource %s/%d in %q already exists", name, rev, id)
+	}
+	h := sha512.New384()
+	n, err := writeFile(path, io.TeeReader(io.NewSectionReader(r, 0, size), h))
+	if err != nil {
+		return errgo.Notef(err, "cannot write resource")
+	}
+	return errgo.Mask(c.addResource(e, id, name, rev, dirResource{
+		Size: n,
+		Hash: fmt.Sprintf("%x", h.Sum(nil)),
+	}))
+}
+
+// dockerResourceDownloadInfo implements csClient.dockerResourceDownloadInfo.
+func (c *dirClient) dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error) {
+	data, err := ioutil.ReadFile(c.resourcePath(id, name, rev) + ".json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errgo.WithCausef(nil, errNotFound, "")
+		}
+		return nil, errgo.Mask(err)
+	}
+	var r dirResource
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal resource info")
+	}
+	if r.Image == "" {
+		return nil, errgo.Newf("resource %s/%d of %v is not a container image", name, rev, id)
+	}
+	return &imageInfo{
+		imageName: r.Image,
+		external:  true,
+	}, nil
+}
+
+// dockerResourceUploadInfo implements csClient.dockerResourceUploadInfo.
+// Images can't be stored in a directory, so it always returns an error.
+func (c *dirClient) dockerResourceUploadInfo(ctx context.Context, id *charm.URL, name string) (*imageInfo, error) {
+	return nil, errgo.Newf("cannot store container image for resource %s of %v in a directory", name, id)
+}
+
+// putDockerResource implements csClient.putDockerResource.
+// Only references to images in external registries can be stored.
+func (c *dirClient) putDockerResource(ctx context.Context, id *charm.URL, name string, rev int, imageName, digest string) error {
+	if imageName == "" {
+		return errgo.Newf("cannot store container image for resource %s/%d of %v in a directory", name, rev, id)
+	}
+	c.mu.Lock()
+	e := c.entities[id.String()]
+	c.mu.Unlock()
+	if e == nil {
+		return errgo.Newf("charm %q not found", id)
+	}
+	if _, err := os.Stat(c.resourcePath(id, name, rev) + ".json"); err == nil {
+		return errgo.Newf("resource %s/%d in %q already exists", name, rev, id)
+	}
+	return errgo.Mask(c.addResource(e, id, name, rev, dirResource{
+		Image: imageName + "@" + digest,
+	}))
+}
+
+// addResource writes the metadata for the given resource
+// revision and records it in e.
+func (c *dirClient) addResource(e *dirEntity, id *charm.URL, name string, rev int, r dirResource) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := writeFile(c.resourcePath(id, name, rev)+".json", bytes.NewReader(data)); err != nil {
+		return errgo.Mask(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.Resources == nil {
+		e.Resources = make(map[string][]int)
+	}
+	e.Resources[name] = append(e.Resources[name], rev)
+	sort.Ints(e.Resources[name])
+	return errgo.Mask(c.writeEntity(e))
+}
+
+// listEntities implements csClient.listEntities.
+func (c *dirClient) listEntities(ctx context.Context, ch params.Channel, owner string) ([]*charm.URL, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []*charm.URL
+	for _, e := range c.entities {
+		id := charm.MustParseURL(e.Id)
+		if _, ok := e.Channels[ch]; ok && id.User == owner {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	return ids, nil
+}
+
+func (c *dirClient) revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []*charm.URL
+	for _, e := range c.entities {
+		eid := charm.MustParseURL(e.Id)
+		if _, ok := e.Channels[ch]; !ok {
+			continue
+		}
+		if eid.User == id.User && eid.Name == id.Name && (id.Series == "" || eid.Series == id.Series) {
+			ids = append(ids, eid)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errgo.WithCausef(nil, errNotFound, "")
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Revision > ids[j].Revision
+	})
+	return ids, nil
+}
+
+// whitelist returns a whitelist that can be used to ingest all
+// the entities held in the directory, published to the same
+// channels with the same resources.
+func (c *dirClient) whitelist() []WhitelistEntity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var wl []WhitelistEntity
+	for _, e := range c.entities {
+		id := charm.MustParseURL(e.Id)
+		var current, other []params.Channel
+		for ch, isCurrent := range e.Channels {
+			if isCurrent {
+				current = append(current, ch)
+			} else {
+				other = append(other, ch)
+			}
+		}
+		// If the entity was exported without some of its
+		// published resources, they can't be imported either.
+		skipResources := c.missingResources(e)
+		// Using an id without a revision makes sure that
+		// the entity will be published as current.
+		if len(current) > 0 {
+			wl = append(wl, WhitelistEntity{
+				EntityId:      id.WithRevision(-1).String(),
+				Channels:      sortedChannels(current),
+				Resources:     e.Resources,
+				SkipResources: skipResources,
+			})
+		}
+		if len(other) > 0 {
+			wl = append(wl, WhitelistEntity{
+				EntityId:      id.String(),
+				Channels:      sortedChannels(other),
+				Resources:     e.Resources,
+				SkipResources: skipResources,
+			})
+		}
+	}
+	sort.Slice(wl, func(i, j int) bool {
+		if wl[i].EntityId != wl[j].EntityId {
+			return wl[i].EntityId < wl[j].EntityId
+		}
+		// The same id can only appear twice when an entity
+		// is current in some channels but not others.
+		return wl[i].Channels[0] < wl[j].Channels[0]
+	})
+	return wl
+}
+
+// missingResources reports whether any of the resources published
+// with e in its current channels have not been stored.
+// It must be called with c.mu held.
+func (c *dirClient) missingResources(e *dirEntity) bool {
+	be := c.baseEntities[baseEntityId(charm.MustParseURL(e.Id)).String()]
+	if be == nil {
+		return false
+	}
+	for ch, current := range e.Channels {
+		if !current {
+			continue
+		}
+	published:
+		for name, rev := range be.Published[ch] {
+			for _, storedRev := range e.Resources[name] {
+				if storedRev == rev {
+					continue published
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// readWhitelist reads the whitelist previously written
+// with writeWhitelist.
+func (c *dirClient) readWhitelist() ([]WhitelistEntity, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, "whitelist.json"))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var wl []WhitelistEntity
+	if err := json.Unmarshal(data, &wl); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal whitelist")
+	}
+	return wl, nil
+}
+
+// writeWhitelist writes the whitelist for all the entities
+// in the directory to whitelist.json.
+func (c *dirClient) writeWhitelist() error {
+	data, err := json.MarshalIndent(c.whitelist(), "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = writeFile(filepath.Join(c.dir, "whitelist.json"), bytes.NewReader(data))
+	return errgo.Mask(err)
+}
+
+// writeEntity writes the metadata for the given entity.
+// It must be called with c.mu held.
+func (c *dirClient) writeEntity(e *dirEntity) error {
+	return c.writeJSON(c.entityPath(charm.MustParseURL(e.Id), "meta.json"), e)
+}
+
+// writeBaseEntity writes the metadata for the given base entity.
+// It must be called with c.mu held.
+func (c *dirClient) writeBaseEntity(be *dirBaseEntity) error {
+	return c.writeJSON(c.baseEntityPath(charm.MustParseURL(be.Id), "meta.json"), be)
+}
+
+func (c *dirClient) writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = writeFile(path, bytes.NewReader(data))
+	return errgo.Mask(err)
+}
+
+func (c *dirClient) entityPath(id *charm.URL, name string) string {
+	return filepath.Join(c.dir, "entities", filepath.FromSlash(id.Path()), name)
+}
+
+func (c *dirClient) baseEntityPath(id *charm.URL, name string) string {
+	return filepath.Join(c.dir, "base-entities", filepath.FromSlash(baseEntityId(id).Path()), name)
+}
+
+func (c *dirClient) resourcePath(id *charm.URL, name string, rev int) string {
+	return c.baseEntityPath(id, filepath.Join("resources", name, strconv.Itoa(rev)))
+}
+
+// writeFile writes the contents of r to the file with the given
+// path, creating any directories needed, and returns the number
+// of bytes written. The file is written under a temporary
+// name and renamed into place so that a partially written
+// file will never be seen.
+func writeFile(path string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, errgo.Mask(err)
+	}
+	return n, nil
+}
+
+func sortedChannels(chans []params.Channel) []params.Channel {
+	sort.Slice(chans, func(i, j int) bool {
+		return chans[i] < chans[j]
+	})
+	return chans
+}
@@ -0,0 +1,98 @@
+package ingest
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+)
+
+// EventKind identifies the kind of an Event.
+type EventKind string
+
+const (
+	// EventEntityResolved is sent for each charm or bundle revision
+	// found when resolving the whitelist. Channels holds the channels
+	// it will be published to, and when there are several sources,
+	// Source holds the name of the one it was found in.
+	EventEntityResolved EventKind = "entity-resolved"
+
+	// EventBundleCharmResolved is sent for each charm found when
+	// resolving the charms required by a bundle. Bundle holds
+	// the id of the bundle and Channel holds the source channel
+	// that the charm was found in.
+	EventBundleCharmResolved EventKind = "bundle-charm-resolved"
+
+	// EventArchiveDownloadStarted is sent when the archive
+	// for an entity starts to be read from the source.
+	EventArchiveDownloadStarted EventKind = "archive-download-started"
+
+	// EventArchiveDownloadFinished is sent when an archive has
+	// been copied to the destination. Bytes holds the size
+	// of the archive.
+	EventArchiveDownloadFinished EventKind = "archive-download-finished"
+
+	// EventResourceTransferred is sent when a resource has
+	// been copied to the destination. Resources holds the
+	// name and revision of the resource and Bytes holds
+	// its size.
+	EventResourceTransferred EventKind = "resource-transferred"
+
+	// EventPublished is sent when an entity has been published
+	// to a channel. Resources holds the resource revisions
+	// it was published with.
+	EventPublished EventKind = "published"
+
+	// EventPermissionsSet is sent when the permissions for
+	// a channel have been set. Id holds the entity that
+	// the permissions were set through.
+	EventPermissionsSet EventKind = "permissions-set"
+
+	// EventOrphanFound is sent for each base entity found in
+	// the destination that isn't whitelisted when pruning.
+	// Channels holds the channels it's published to.
+	EventOrphanFound EventKind = "orphan-found"
+
+	// EventError is sent when an error is encountered.
+	// Error holds the error message, which is also
+	// included in IngestStats.Errors, and Id holds
+	// the id that the error relates to, if any
+	// (see IngestError.Id).
+	EventError EventKind = "error"
+)
+
+// Event describes something that happened during an ingest.
+// Only the fields relevant to the kind of event are set.
+// When an ingest has several destinations, Dest holds the
+// name of the destination that the event relates to; it's
+// empty for events that relate to the source.
+type Event struct {
+	Time      time.Time        `json:"time"`
+	Kind      EventKind        `json:"kind"`
+	Id        string           `json:"id,omitempty"`
+	Channel   params.Channel   `json:"channel,omitempty"`
+	Channels  []params.Channel `json:"channels,omitempty"`
+	Resources map[string]int   `json:"resources,omitempty"`
+	Bytes     int64            `json:"bytes,omitempty"`
+	Read      []string         `json:"read,omitempty"`
+	Write     []string         `json:"write,omitempty"`
+	Bundle    string           `json:"bundle,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Dest      string           `json:"dest,omitempty"`
+	Source    string           `json:"source,omitempty"`
+}
+
+// notify sends the given event to the event callback if there is one.
+// Calls to the callback are serialized, so it does not need to be
+// safe to call concurrently.
+func (ing *ingester) notify(e Event) {
+	if ing.params.notify == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Dest = ing.params.destName
+	ing.notifyMu.Lock()
+	defer ing.notifyMu.Unlock()
+	ing.params.notify(e)
+}
@@ -2,15 +2,19 @@ package ingest
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/charm/v8/resource"
 	"github.com/juju/charmrepo/v6/csclient/params"
@@ -27,6 +31,10 @@ type baseEntitySpec struct {
 	// with. It should have a username but no revision id.
 	id string
 	// resources holds a map from resourcename:revision to content.
+	// Content of the form "oci-image:name@digest" holds a container
+	// image in the charmstore's registry; content of the form
+	// "oci-image:external::name@digest" holds an image in an
+	// external registry.
 	resources map[string]string
 	// published holds information about which resources are published
 	// to which channels, in a similar to syntax to that parsed by parseBundleCharms,
@@ -40,6 +48,11 @@ type baseEntitySpec struct {
 	// e.g. "stable reader1,reader2 writer1,writer2"
 	// use - for no permissions, e.g. "stable - writer1,writer2"
 	perms []string
+
+	// commonInfo holds the JSON-marshaled common-info
+	// metadata for the base entity. If there are no entries,
+	// it should be empty, not "{}".
+	commonInfo string
 }
 
 func (rs baseEntitySpec) baseEntity() *fakeBaseEntity {
@@ -72,11 +85,18 @@ func (rs baseEntitySpec) baseEntity() *fakeBaseEntity {
 	for _, bc := range bcs {
 		published[params.Channel(bc.charm)] = bc.resources
 	}
+	var commonInfo map[string]json.RawMessage
+	if rs.commonInfo != "" {
+		if err := json.Unmarshal([]byte(rs.commonInfo), &commonInfo); err != nil {
+			panic(err)
+		}
+	}
 	return &fakeBaseEntity{
 		id:                 curl,
 		resources:          resources,
 		publishedResources: published,
 		perms:              parsePerms(rs.perms),
+		commonInfo:         commonInfo,
 	}
 }
 
@@ -132,6 +152,12 @@ type entitySpec struct {
 	// If it's a bundle, it holds the list of charms used by
 	// the bundle, in alphabetical order.
 	content string
+	// uploadTime holds the date that the entity was uploaded,
+	// in 2006-01-02 form, if it's not empty.
+	uploadTime string
+	// supportedSeries holds a whitespace-separated set of
+	// series supported by a multi-series charm.
+	supportedSeries string
 }
 
 func (es entitySpec) isBundle() bool {
@@ -174,6 +200,13 @@ func (es entitySpec) entity() *fakeEntity {
 			panic(err)
 		}
 	}
+	var uploadTime time.Time
+	if es.uploadTime != "" {
+		uploadTime, err = time.Parse("2006-01-02", es.uploadTime)
+		if err != nil {
+			panic(err)
+		}
+	}
 	e := &fakeEntity{
 		entityInfo: &entityInfo{
 			id:            id,
@@ -181,11 +214,15 @@ func (es entitySpec) entity() *fakeEntity {
 			channels:      pchans,
 			archiveSize:   int64(len(es.content)),
 			hash:          hashOf(es.content),
+			uploadTime:    uploadTime,
 			extraInfo:     extraInfo,
 		},
 		content:            es.content,
 		supportedResources: supportedResources,
 	}
+	if es.supportedSeries != "" {
+		e.supportedSeries = strings.Fields(es.supportedSeries)
+	}
 	if id.Series == "bundle" {
 		bundleCharms, err := parseBundleCharms(es.content)
 		if err != nil {
@@ -280,24 +317,32 @@ func entityInfoToSpec(e *entityInfo) entitySpec {
 		r = append(r, []byte(ch)...)
 	}
 	es.chans = string(r)
-	if len(e.extraInfo) != 0 {
-		data, err := json.Marshal(e.extraInfo)
-		if err != nil {
-			panic(err)
-		}
-		es.extraInfo = string(data)
-	}
+	es.extraInfo = metadataSpec(e.extraInfo)
 	return es
 }
 
+// metadataSpec returns the JSON-marshaled form of the given
+// metadata, or the empty string if there are no entries.
+func metadataSpec(m map[string]json.RawMessage) string {
+	if len(m) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
 // baseEntityInfo returns a baseEntitySpec from the info
-// in e. It only fills out the perms field because the
-// baseEntityInfo struct has no information on the other
-// resource-related fields.
+// in e. It only fills out the perms and commonInfo fields
+// because the baseEntityInfo struct has no information on
+// the other resource-related fields.
 func baseEntityInfoToSpec(id *charm.URL, e *baseEntityInfo) baseEntitySpec {
 	return baseEntitySpec{
-		id:    id.String(),
-		perms: permMapToSpec(id, e.perms),
+		id:         id.String(),
+		perms:      permMapToSpec(id, e.perms),
+		commonInfo: metadataSpec(e.commonInfo),
 	}
 }
 
@@ -341,13 +386,17 @@ type fakeBaseEntity struct {
 	// perms holds the permissions for the entities
 	// associated with the entity.
 	perms map[params.Channel]permission
+	// commonInfo holds the common-info metadata
+	// for the base entity.
+	commonInfo map[string]json.RawMessage
 }
 
 func (e *fakeBaseEntity) spec() baseEntitySpec {
 	fe := baseEntitySpec{
-		id:        e.id.String(),
-		published: publishedSpec(e.publishedResources),
-		perms:     permMapToSpec(e.id, e.perms),
+		id:         e.id.String(),
+		published:  publishedSpec(e.publishedResources),
+		perms:      permMapToSpec(e.id, e.perms),
+		commonInfo: metadataSpec(e.commonInfo),
 	}
 	for rname, revs := range e.resources {
 		for rev, content := range revs {
@@ -436,9 +485,13 @@ type fakeCharmStore struct {
 	// that have associated resources or permissions. If an entry doesn't
 	// exist, it's assumed to have no resources.
 	baseEntities []*fakeBaseEntity
+	// registry holds the host of the registry that container
+	// images are uploaded to. If it's empty, images
+	// cannot be uploaded.
+	registry string
 }
 
-func (s *fakeCharmStore) entityInfo(ch params.Channel, id *charm.URL) (*entityInfo, error) {
+func (s *fakeCharmStore) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if ch == params.NoChannel {
@@ -453,6 +506,7 @@ func (s *fakeCharmStore) entityInfo(ch params.Channel, id *charm.URL) (*entityIn
 	if be == nil {
 		return info, nil
 	}
+	info.commonInfo = copyExtraInfo(be.commonInfo)
 	if ch == params.UnpublishedChannel {
 		panic("unimplemented: unpublished channel should get latest rev of all resources")
 	}
@@ -481,13 +535,14 @@ func defaultPerms(user string) map[params.Channel]permission {
 	return m
 }
 
-func (s *fakeCharmStore) getBaseEntity(id *charm.URL) (*baseEntityInfo, error) {
+func (s *fakeCharmStore) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	be := s.baseEntity(id)
 	if be != nil {
 		return &baseEntityInfo{
-			perms: be.perms,
+			perms:      be.perms,
+			commonInfo: copyExtraInfo(be.commonInfo),
 		}, nil
 	}
 	// If there's no explicit base entity entry, return
@@ -503,7 +558,7 @@ func (s *fakeCharmStore) getBaseEntity(id *charm.URL) (*baseEntityInfo, error) {
 	return nil, errNotFound
 }
 
-func (s *fakeCharmStore) setPerm(id *charm.URL, ch params.Channel, perm permission) error {
+func (s *fakeCharmStore) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	e := s.get(id)
@@ -565,18 +620,18 @@ func (s *fakeCharmStore) baseEntityContents() []baseEntitySpec {
 	var specs []baseEntitySpec
 	for _, e := range s.baseEntities {
 		spec := e.spec()
-		if len(spec.resources) == 0 && len(spec.published) == 0 && len(spec.perms) == 0 {
+		if len(spec.resources) == 0 && len(spec.published) == 0 && len(spec.perms) == 0 && spec.commonInfo == "" {
 			continue
 		}
 		specs = append(specs, spec)
 	}
 	sort.Slice(specs, func(i, j int) bool {
-		return specs[i].id < specs[i].id
+		return specs[i].id < specs[j].id
 	})
 	return specs
 }
 
-func (s *fakeCharmStore) getArchive(id *charm.URL) (io.ReadCloser, error) {
+func (s *fakeCharmStore) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// Technically the actual charmstore endpoint allows non-canonical
@@ -589,7 +644,7 @@ func (s *fakeCharmStore) getArchive(id *charm.URL) (io.ReadCloser, error) {
 	return ioutil.NopCloser(strings.NewReader(e.content)), nil
 }
 
-func (s *fakeCharmStore) putArchive(id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel) error {
+func (s *fakeCharmStore) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.get(id) != nil {
@@ -640,7 +695,7 @@ func (s *fakeCharmStore) putArchive(id *charm.URL, r io.ReadSeeker, hash string,
 	return nil
 }
 
-func (s *fakeCharmStore) publish(id *charm.URL, channels []params.Channel, resources map[string]int) error {
+func (s *fakeCharmStore) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	e := s.get(id)
@@ -675,6 +730,14 @@ func (s *fakeCharmStore) publish(id *charm.URL, channels []params.Channel, resou
 			e.channels[ch] = true
 		}
 	}
+	// An entity can only be published with resources
+	// that its charm supports.
+	if e.supportedResources == nil {
+		e.supportedResources = make(map[string]bool)
+	}
+	for name := range resources {
+		e.supportedResources[name] = true
+	}
 	// Update the published resource revisions in the base entity.
 	be := s.ensureBaseEntity(id)
 	for _, ch := range channels {
@@ -683,7 +746,7 @@ func (s *fakeCharmStore) publish(id *charm.URL, channels []params.Channel, resou
 	return nil
 }
 
-func (s *fakeCharmStore) putExtraInfo(id *charm.URL, extraInfo map[string]json.RawMessage) error {
+func (s *fakeCharmStore) putExtraInfo(ctx context.Context, id *charm.URL, extraInfo map[string]json.RawMessage) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	e := s.get(id)
@@ -703,21 +766,107 @@ func (s *fakeCharmStore) putExtraInfo(id *charm.URL, extraInfo map[string]json.R
 	return nil
 }
 
-func (s *fakeCharmStore) resourceInfo(id *charm.URL, name string, rev int) (*resourceInfo, error) {
+func (s *fakeCharmStore) putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.get(id) == nil {
+		return errgo.WithCausef(nil, errNotFound, "putCommonInfo on non-existent id %q", id)
+	}
+	be := s.ensureBaseEntity(id)
+	if be.commonInfo == nil {
+		be.commonInfo = make(map[string]json.RawMessage)
+	}
+	for k, v := range commonInfo {
+		if v == nil {
+			delete(be.commonInfo, k)
+			continue
+		}
+		be.commonInfo[k] = v
+	}
+	return nil
+}
+
+func (s *fakeCharmStore) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	content, err := s.resourceContent(id, name, rev)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(errNotFound))
 	}
+	kind := resource.TypeFile
+	if strings.HasPrefix(content, imageResourcePrefix) {
+		kind = resource.TypeContainerImage
+	}
 	return &resourceInfo{
-		kind: resource.TypeFile,
+		kind: kind,
 		size: int64(len(content)),
 		hash: hashOf(content),
 	}, nil
 }
 
-func (s *fakeCharmStore) getResource(id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+const (
+	imageResourcePrefix    = "oci-image:"
+	externalResourcePrefix = "external::"
+)
+
+func (s *fakeCharmStore) dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, err := s.resourceContent(id, name, rev)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errNotFound))
+	}
+	if !strings.HasPrefix(content, imageResourcePrefix) {
+		return nil, errgo.Newf("resource %s/%d in %q is not a container image", name, rev, id)
+	}
+	imageName := strings.TrimPrefix(content, imageResourcePrefix)
+	if strings.HasPrefix(imageName, externalResourcePrefix) {
+		return &imageInfo{
+			imageName: strings.TrimPrefix(imageName, externalResourcePrefix),
+			external:  true,
+		}, nil
+	}
+	return &imageInfo{
+		imageName: imageName,
+		username:  "docker-registry",
+		password:  "download-token",
+	}, nil
+}
+
+func (s *fakeCharmStore) dockerResourceUploadInfo(ctx context.Context, id *charm.URL, name string) (*imageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registry == "" {
+		return nil, errgo.Newf("no registry")
+	}
+	if s.get(id) == nil {
+		return nil, errgo.WithCausef(nil, errNotFound, "charm %q not found", id)
+	}
+	return &imageInfo{
+		imageName: s.uploadImageName(id, name),
+		username:  "docker-registry",
+		password:  "upload-token",
+	}, nil
+}
+
+func (s *fakeCharmStore) uploadImageName(id *charm.URL, name string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", s.registry, id.User, id.Name, name)
+}
+
+func (s *fakeCharmStore) putDockerResource(ctx context.Context, id *charm.URL, name string, rev int, imageName, digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.get(id) == nil {
+		return errgo.Newf("charm %q not found", id)
+	}
+	content := imageResourcePrefix + externalResourcePrefix + imageName + "@" + digest
+	if imageName == "" {
+		content = imageResourcePrefix + s.uploadImageName(id, name) + "@" + digest
+	}
+	return s.addResource(id, name, rev, content)
+}
+
+func (s *fakeCharmStore) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	content, err := s.resourceContent(id, name, rev)
@@ -727,28 +876,67 @@ func (s *fakeCharmStore) getResource(id *charm.URL, name string, rev int) (io.Re
 	return ioutil.NopCloser(strings.NewReader(content)), int64(len(content)), nil
 }
 
-func (s *fakeCharmStore) putResource(id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+func (s *fakeCharmStore) listEntities(ctx context.Context, ch params.Channel, owner string) ([]*charm.URL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []*charm.URL
+	for _, e := range s.entities {
+		if _, ok := e.channels[ch]; ok && e.id.User == owner {
+			ids = append(ids, e.id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *fakeCharmStore) revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []*charm.URL
+	for _, e := range s.entities {
+		if _, ok := e.channels[ch]; !ok {
+			continue
+		}
+		if e.id.User == id.User && e.id.Name == id.Name && (id.Series == "" || e.id.Series == id.Series) {
+			ids = append(ids, e.id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errgo.WithCausef(nil, errNotFound, "")
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Revision > ids[j].Revision
+	})
+	return ids, nil
+}
+
+func (s *fakeCharmStore) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	e := s.get(id)
 	if e == nil {
 		return errgo.Newf("charm %q not found", id)
 	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return s.addResource(id, name, rev, string(data))
+}
+
+// addResource adds a resource with the given content to the
+// base entity of id. It should be called with s.mu held.
+func (s *fakeCharmStore) addResource(id *charm.URL, name string, rev int, content string) error {
 	// TODO check that the resource exists in the given entity?
 	be := s.ensureBaseEntity(id)
 	if _, ok := be.resources[name][rev]; ok {
 		return errgo.Newf("resource %s/%d in %q already exists", name, rev, id)
 	}
-	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
-	if err != nil {
-		return errgo.Mask(err)
-	}
 	resMap := be.resources[name]
 	if resMap == nil {
 		resMap = make(map[int]string)
 		be.resources[name] = resMap
 	}
-	resMap[rev] = string(data)
+	resMap[rev] = content
 	return nil
 }
 
@@ -824,6 +1012,9 @@ func copyEntity(e *entityInfo) *entityInfo {
 		e1.bundleCharms = make([]bundleCharm, len(e.bundleCharms))
 		copy(e1.bundleCharms, e.bundleCharms)
 	}
+	if e.supportedSeries != nil {
+		e1.supportedSeries = append([]string(nil), e.supportedSeries...)
+	}
 
 	e1.extraInfo = copyExtraInfo(e.extraInfo)
 	e1.commonInfo = copyExtraInfo(e.commonInfo)
@@ -858,3 +1049,672 @@ func hashOfBytes(x []byte) string {
 	h.Write(x)
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
+
+// flakyCharmStore wraps a fakeCharmStore so that the first attempt
+// at each operation on each entity fails with a temporary error.
+type flakyCharmStore struct {
+	*fakeCharmStore
+
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+func newFlakyCharmStore(s *fakeCharmStore) *flakyCharmStore {
+	return &flakyCharmStore{
+		fakeCharmStore: s,
+		failed:         make(map[string]bool),
+	}
+}
+
+// fail returns a temporary error if the given operation
+// has not previously failed.
+func (s *flakyCharmStore) fail(op string, id *charm.URL) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := op + " " + id.String()
+	if s.failed[key] {
+		return nil
+	}
+	s.failed[key] = true
+	return errgo.Notef(&httpStatusError{
+		status: "502 Bad Gateway",
+	}, "cannot %s %v", op, id)
+}
+
+func (s *flakyCharmStore) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	if err := s.fail("get entity info in "+string(ch), id); err != nil {
+		return nil, err
+	}
+	return s.fakeCharmStore.entityInfo(ctx, ch, id)
+}
+
+func (s *flakyCharmStore) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	if err := s.fail("get archive", id); err != nil {
+		return nil, err
+	}
+	return s.fakeCharmStore.getArchive(ctx, id)
+}
+
+func (s *flakyCharmStore) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	if err := s.fail("put archive", id); err != nil {
+		// Read some of the archive so that we know
+		// that it's read from the start when retried.
+		r.Read(make([]byte, 2))
+		return err
+	}
+	return s.fakeCharmStore.putArchive(ctx, id, r, hash, size, promulgatedRevision, channels, uploadTime)
+}
+
+func (s *flakyCharmStore) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	if err := s.fail("publish", id); err != nil {
+		return err
+	}
+	return s.fakeCharmStore.publish(ctx, id, channels, resources)
+}
+
+func (s *flakyCharmStore) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	if err := s.fail(fmt.Sprintf("get resource %s/%d", name, rev), id); err != nil {
+		return nil, 0, err
+	}
+	return s.fakeCharmStore.getResource(ctx, id, name, rev)
+}
+
+func (s *flakyCharmStore) putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error {
+	if err := s.fail("put common-info", id); err != nil {
+		return err
+	}
+	return s.fakeCharmStore.putCommonInfo(ctx, id, commonInfo)
+}
+
+func (s *flakyCharmStore) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
+	if err := s.fail("set perm in "+string(ch), id); err != nil {
+		return err
+	}
+	return s.fakeCharmStore.setPerm(ctx, id, ch, perm)
+}
+
+// lostResponseCharmStore wraps a fakeCharmStore so that the first
+// attempt at each upload succeeds but returns a temporary error,
+// as happens when a proxy times out before the upload completes.
+type lostResponseCharmStore struct {
+	*fakeCharmStore
+
+	mu   sync.Mutex
+	lost map[string]bool
+}
+
+func newLostResponseCharmStore(s *fakeCharmStore) *lostResponseCharmStore {
+	return &lostResponseCharmStore{
+		fakeCharmStore: s,
+		lost:           make(map[string]bool),
+	}
+}
+
+// loseResponse returns err if it's not nil; otherwise it returns
+// a temporary error if the given operation has not previously
+// had its response lost.
+func (s *lostResponseCharmStore) loseResponse(op string, id *charm.URL, err error) error {
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := op + " " + id.String()
+	if s.lost[key] {
+		return nil
+	}
+	s.lost[key] = true
+	return errgo.Notef(&httpStatusError{
+		code:   http.StatusGatewayTimeout,
+		status: "504 Gateway Timeout",
+	}, "cannot %s %v", op, id)
+}
+
+func (s *lostResponseCharmStore) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	err := s.fakeCharmStore.putArchive(ctx, id, r, hash, size, promulgatedRevision, channels, uploadTime)
+	return s.loseResponse("put archive", id, err)
+}
+
+func (s *lostResponseCharmStore) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+	err := s.fakeCharmStore.putResource(ctx, id, name, rev, r, size)
+	return s.loseResponse(fmt.Sprintf("put resource %s/%d", name, rev), id, err)
+}
+
+// concurrencyCheckingCharmStore wraps a fakeCharmStore, recording
+// the maximum number of operations in progress at once. Operations
+// that read archives or resources last until the reader is closed.
+type concurrencyCheckingCharmStore struct {
+	*fakeCharmStore
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+// start records the start of an operation and returns
+// a function that records its end.
+func (s *concurrencyCheckingCharmStore) start() func() {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.mu.Unlock()
+	// Give other operations a chance to start.
+	time.Sleep(time.Millisecond)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.active--
+			s.mu.Unlock()
+		})
+	}
+}
+
+func (s *concurrencyCheckingCharmStore) max() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxActive
+}
+
+func (s *concurrencyCheckingCharmStore) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	defer s.start()()
+	return s.fakeCharmStore.entityInfo(ctx, ch, id)
+}
+
+func (s *concurrencyCheckingCharmStore) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	stop := s.start()
+	r, err := s.fakeCharmStore.getArchive(ctx, id)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return &throttledReadCloser{Reader: r, c: r, stop: stop}, nil
+}
+
+func (s *concurrencyCheckingCharmStore) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	defer s.start()()
+	return s.fakeCharmStore.putArchive(ctx, id, r, hash, size, promulgatedRevision, channels, uploadTime)
+}
+
+func (s *concurrencyCheckingCharmStore) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	defer s.start()()
+	return s.fakeCharmStore.resourceInfo(ctx, id, name, rev)
+}
+
+func (s *concurrencyCheckingCharmStore) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	stop := s.start()
+	r, size, err := s.fakeCharmStore.getResource(ctx, id, name, rev)
+	if err != nil {
+		stop()
+		return nil, 0, err
+	}
+	return &throttledReadCloser{Reader: r, c: r, stop: stop}, size, nil
+}
+
+func (s *concurrencyCheckingCharmStore) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+	defer s.start()()
+	return s.fakeCharmStore.putResource(ctx, id, name, rev, r, size)
+}
+
+func (s *concurrencyCheckingCharmStore) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	defer s.start()()
+	return s.fakeCharmStore.publish(ctx, id, channels, resources)
+}
+
+// blockingCharmStore wraps a fakeCharmStore so that reading a
+// resource blocks until unblock is closed or a timeout passes.
+type blockingCharmStore struct {
+	*fakeCharmStore
+	unblock chan struct{}
+}
+
+func (s *blockingCharmStore) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	select {
+	case <-s.unblock:
+	case <-time.After(5 * time.Second):
+		return nil, 0, errgo.Newf("timed out waiting to read resource %v/%s/%d", id, name, rev)
+	}
+	return s.fakeCharmStore.getResource(ctx, id, name, rev)
+}
+
+// recordingCharmStore wraps a fakeCharmStore, recording the
+// destination operations made on it. Operations listed in
+// fail fail with a permanent error.
+type recordingCharmStore struct {
+	*fakeCharmStore
+	fail map[string]bool
+
+	mu  sync.Mutex
+	ops []string
+}
+
+// op records the given operation, returning an error if it should fail.
+func (s *recordingCharmStore) op(op string, id *charm.URL) error {
+	key := op + " " + id.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, key)
+	if s.fail[key] {
+		return errgo.Newf("cannot %s", key)
+	}
+	return nil
+}
+
+// recordedOps returns the recorded operations in sorted order.
+func (s *recordingCharmStore) recordedOps() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops := append([]string(nil), s.ops...)
+	sort.Strings(ops)
+	return ops
+}
+
+func (s *recordingCharmStore) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	if err := s.op("get entity info", id); err != nil {
+		return nil, err
+	}
+	return s.fakeCharmStore.entityInfo(ctx, ch, id)
+}
+
+func (s *recordingCharmStore) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	if err := s.op("put archive", id); err != nil {
+		return err
+	}
+	return s.fakeCharmStore.putArchive(ctx, id, r, hash, size, promulgatedRevision, channels, uploadTime)
+}
+
+func (s *recordingCharmStore) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	if err := s.op(fmt.Sprintf("get resource info %s/%d", name, rev), id); err != nil {
+		return nil, err
+	}
+	return s.fakeCharmStore.resourceInfo(ctx, id, name, rev)
+}
+
+func (s *recordingCharmStore) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+	if err := s.op(fmt.Sprintf("put resource %s/%d", name, rev), id); err != nil {
+		return err
+	}
+	return s.fakeCharmStore.putResource(ctx, id, name, rev, r, size)
+}
+
+func (s *recordingCharmStore) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	if err := s.op("publish", id); err != nil {
+		return err
+	}
+	return s.fakeCharmStore.publish(ctx, id, channels, resources)
+}
+
+func (s *recordingCharmStore) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
+	if err := s.op("set perm in "+string(ch), id); err != nil {
+		return err
+	}
+	return s.fakeCharmStore.setPerm(ctx, id, ch, perm)
+}
+
+// downloadCountingCharmStore wraps a fakeCharmStore, counting
+// the archives and resources read from it.
+type downloadCountingCharmStore struct {
+	*fakeCharmStore
+
+	mu        sync.Mutex
+	downloads map[string]int
+}
+
+func (s *downloadCountingCharmStore) count(what string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downloads == nil {
+		s.downloads = make(map[string]int)
+	}
+	s.downloads[what]++
+}
+
+func (s *downloadCountingCharmStore) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	s.count("archive " + id.String())
+	return s.fakeCharmStore.getArchive(ctx, id)
+}
+
+func (s *downloadCountingCharmStore) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	s.count(fmt.Sprintf("resource %s %s/%d", id, name, rev))
+	return s.fakeCharmStore.getResource(ctx, id, name, rev)
+}
+
+// fakeRegistry implements enough of the Docker registry HTTP API
+// to test copying images. Clients must authenticate with a
+// bearer token obtained from its token endpoint.
+type fakeRegistry struct {
+	srv *httptest.Server
+
+	mu sync.Mutex
+	// blobs maps from repository to digest to content.
+	blobs map[string]map[string]string
+	// manifests maps from repository to reference
+	// (tag or digest) to manifest content.
+	manifests map[string]map[string]string
+	// blobsCopied holds the number of blobs that have been uploaded.
+	blobsCopied int
+	// uploads holds the blob uploads in progress, keyed by id.
+	uploads map[string]*fakeUpload
+	// nextUpload holds the id of the next upload.
+	nextUpload int
+	// bytesUploaded holds the number of bytes of blob
+	// content that have been received.
+	bytesUploaded int
+	// patches holds the number of chunks of blob
+	// content that have been accepted.
+	patches int
+	// maxPatches, if not zero, holds the number of chunks
+	// accepted before any more are rejected.
+	maxPatches int
+}
+
+// fakeUpload holds a blob upload in progress.
+type fakeUpload struct {
+	repo string
+	data []byte
+}
+
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     make(map[string]map[string]string),
+		manifests: make(map[string]map[string]string),
+		uploads:   make(map[string]*fakeUpload),
+	}
+	r.srv = httptest.NewTLSServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+func (r *fakeRegistry) Close() {
+	r.srv.Close()
+}
+
+// host returns the host of the registry.
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.srv.URL, "https://")
+}
+
+// client returns an HTTP client that trusts the registry.
+func (r *fakeRegistry) client() *http.Client {
+	return r.srv.Client()
+}
+
+// addImage adds an image with the given layers to the given
+// repository and returns the name of the image, including
+// its digest.
+func (r *fakeRegistry) addImage(repo string, layers ...string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config := r.addBlob(repo, `{"architecture":"amd64"}`)
+	m := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeManifest,
+		Config:        config,
+	}
+	for _, layer := range layers {
+		m.Layers = append(m.Layers, r.addBlob(repo, layer))
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	digest := digestOf(data)
+	r.addManifest(repo, digest, string(data))
+	return r.host() + "/" + repo + "@" + digest
+}
+
+func (r *fakeRegistry) addBlob(repo, content string) descriptor {
+	digest := digestOf([]byte(content))
+	if r.blobs[repo] == nil {
+		r.blobs[repo] = make(map[string]string)
+	}
+	r.blobs[repo][digest] = content
+	return descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest,
+		Size:      int64(len(content)),
+	}
+}
+
+func (r *fakeRegistry) addManifest(repo, ref, content string) {
+	if r.manifests[repo] == nil {
+		r.manifests[repo] = make(map[string]string)
+	}
+	r.manifests[repo][ref] = content
+}
+
+// manifest returns the manifest stored in the given
+// repository under the given reference.
+func (r *fakeRegistry) manifest(repo, ref string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.manifests[repo][ref]
+}
+
+// copiedCount returns the number of blobs that have been uploaded.
+func (r *fakeRegistry) copiedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.blobsCopied
+}
+
+// uploadedBytes returns the number of bytes of blob
+// content that have been received.
+func (r *fakeRegistry) uploadedBytes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bytesUploaded
+}
+
+// setMaxPatches sets the number of chunks of blob content
+// that will be accepted from now on before any more are
+// rejected. If n is zero, there's no limit.
+func (r *fakeRegistry) setMaxPatches(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patches = 0
+	r.maxPatches = n
+}
+
+func (r *fakeRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, r.srv.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path == "/v2/" {
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	for _, kind := range []string{"/blobs/uploads/", "/blobs/", "/manifests/"} {
+		i := strings.LastIndex(path, kind)
+		if i == -1 {
+			continue
+		}
+		repo, ref := path[:i], path[i+len(kind):]
+		// The token holds the scope it was issued for.
+		scope := strings.TrimPrefix(auth, "Bearer ")
+		actions := strings.TrimPrefix(scope, "repository:"+repo+":")
+		if actions == scope || req.Method != "GET" && req.Method != "HEAD" && !strings.Contains(actions, "push") {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		switch kind {
+		case "/blobs/uploads/":
+			r.serveUpload(w, req, repo, ref)
+		case "/blobs/":
+			r.serveBlob(w, req, repo, ref)
+		case "/manifests/":
+			r.serveManifest(w, req, repo, ref)
+		}
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if user, _, ok := req.BasicAuth(); !ok || user != "docker-registry" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// Use the scope as the token so that it
+	// can be checked when the token is used.
+	json.NewEncoder(w).Encode(map[string]string{
+		"token": req.URL.Query().Get("scope"),
+	})
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	if req.Method == "POST" && id == "" {
+		r.nextUpload++
+		id := strconv.Itoa(r.nextUpload)
+		r.uploads[id] = &fakeUpload{
+			repo: repo,
+		}
+		r.setUploadHeaders(w, repo, id, 0)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	u := r.uploads[id]
+	if u == nil || u.repo != repo {
+		http.NotFound(w, req)
+		return
+	}
+	// Like a real registry, the location holds the offset
+	// that the upload is expected to continue from.
+	if state := req.URL.Query().Get("_state"); state != strconv.Itoa(len(u.data)) {
+		delete(r.uploads, id)
+		http.Error(w, "upload resumed at wrong offset", http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		r.setUploadHeaders(w, repo, id, len(u.data))
+		w.WriteHeader(http.StatusNoContent)
+	case "PATCH":
+		if r.maxPatches > 0 && r.patches >= r.maxPatches {
+			http.Error(w, "upload failed", http.StatusInternalServerError)
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != len(u.data) {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil || len(data) != end-start+1 {
+			http.Error(w, "bad chunk", http.StatusBadRequest)
+			return
+		}
+		u.data = append(u.data, data...)
+		r.bytesUploaded += len(data)
+		r.patches++
+		r.setUploadHeaders(w, repo, id, len(u.data))
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.bytesUploaded += len(data)
+		data = append(u.data, data...)
+		delete(r.uploads, id)
+		if digest := req.URL.Query().Get("digest"); digestOf(data) != digest {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		r.addBlob(repo, string(data))
+		r.blobsCopied++
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "bad upload request", http.StatusBadRequest)
+	}
+}
+
+// setUploadHeaders sets the headers that describe the
+// progress of an upload that has received n bytes.
+func (r *fakeRegistry) setUploadHeaders(w http.ResponseWriter, repo, id string, n int) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s?_state=%d", repo, id, n))
+	end := n - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, repo, digest string) {
+	content, ok := r.blobs[repo][digest]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	var offset int
+	if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &offset); err == nil && offset < len(content) {
+		content = content[offset:]
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	}
+	if req.Method == "GET" {
+		io.WriteString(w, content)
+	}
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	switch req.Method {
+	case "GET":
+		content, ok := r.manifests[repo][ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeManifest)
+		io.WriteString(w, content)
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m struct {
+			Config descriptor   `json:"config"`
+			Layers []descriptor `json:"layers"`
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, d := range append(m.Layers, m.Config) {
+			if _, ok := r.blobs[repo][d.Digest]; !ok {
+				http.Error(w, "blob unknown", http.StatusBadRequest)
+				return
+			}
+		}
+		digest := digestOf(data)
+		r.addManifest(repo, ref, string(data))
+		r.addManifest(repo, digest, string(data))
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "bad manifest request", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,602 @@
+package ingest
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/juju/charm/v8/resource"
+	"golang.org/x/sync/semaphore"
+	"gopkg.in/errgo.v1"
+)
+
+// fanout runs an ingest into one or more destinations at once.
+// Each destination has an ingester of its own, which holds the
+// errors and counts for that destination, and its own copy of
+// each resolved entity. The ingesters share the source client,
+// the concurrency limit and the disk space, so each archive and
+// resource only needs to be read from the source once.
+type fanout struct {
+	// src is used to resolve the whitelist and to read from
+	// the source. When there's only one destination and it
+	// has no name, it's the ingester for that destination.
+	src *ingester
+
+	// dests holds the state of each destination.
+	dests []*destRun
+
+	// resolveErrors holds the number of errors found when
+	// resolving the whitelist.
+	resolveErrors int
+
+	// rewrites holds the client that rewrites the ids in
+	// the source, or nil if there are no rewrite rules.
+	rewrites *rewriteClient
+}
+
+// destRun holds the state of the ingest into one destination.
+type destRun struct {
+	ing *ingester
+
+	// resolved holds the destination's copy of the
+	// resolved entities.
+	resolved map[string]*whitelistBaseEntity
+
+	// changed holds the base entities in resolved that
+	// need to be transferred.
+	changed map[string]*whitelistBaseEntity
+
+	// unchangedResources holds the number of resources
+	// in the base entities that don't need to be transferred.
+	unchangedResources int
+
+	// resourceCount holds the number of resources
+	// for all the base entities.
+	resourceCount int
+
+	// planner is used to record the changes that would
+	// be made to the destination in a dry run.
+	planner *planClient
+}
+
+// destEntity holds one destination's copy of an entity.
+type destEntity struct {
+	ing *ingester
+	e   *entityInfo
+}
+
+// newFanout returns a fanout that uses the given parameters,
+// with defaults filled in and the source and destination clients
+// wrapped to limit and retry operations.
+func newFanout(p ingestParams) *fanout {
+	if p.ctx == nil {
+		p.ctx = context.Background()
+	}
+	if p.concurrency <= 0 {
+		p.concurrency = DefaultConcurrency
+	}
+	if p.owner == "" {
+		p.owner = "admin"
+	}
+	if p.maxRetries == 0 {
+		p.maxRetries = DefaultMaxRetries
+	} else if p.maxRetries < 0 {
+		p.maxRetries = 0
+	}
+	if p.retryDelay == 0 {
+		p.retryDelay = defaultRetryDelay
+	}
+	if p.registry == nil {
+		p.registry = &http.Client{
+			Transport: NewTransport(nil),
+		}
+	}
+	var diskLimiter *semaphore.Weighted
+	if p.maxDisk > 0 {
+		diskLimiter = semaphore.NewWeighted(p.maxDisk)
+	}
+	limiter := newLimiter(p.concurrency)
+	download := newRateLimiter(p.downloadRate)
+	notifyMu := new(sync.Mutex)
+	newIngester := func(name string, dest csClient) *ingester {
+		p := p
+		p.destName = name
+		p.extraDests = nil
+		p.journal = p.journal.forDest(name)
+		upload := newRateLimiter(p.uploadRate)
+		ing := &ingester{
+			params:      p,
+			diskLimiter: diskLimiter,
+			limiter:     limiter,
+			notifyMu:    notifyMu,
+			registry: &registryClient{
+				client:   p.registry,
+				download: download,
+				upload:   upload,
+				journal:  p.journal,
+			},
+		}
+		if dest != nil {
+			ing.params.dest = retryClient{newThrottleClient(dest, p.destConcurrency, nil, upload), ing}
+		}
+		return ing
+	}
+	f := &fanout{
+		dests: []*destRun{{
+			ing: newIngester(p.destName, p.dest),
+		}},
+	}
+	for _, d := range p.extraDests {
+		f.dests = append(f.dests, &destRun{
+			ing: newIngester(d.name, d.client),
+		})
+	}
+	f.src = f.dests[0].ing
+	if p.destName != "" {
+		// The source doesn't belong to any of the
+		// destinations, so it has an ingester of its own.
+		f.src = newIngester("", nil)
+	}
+	var src csClient
+	var sources *sourceClient
+	if len(p.sources) > 0 {
+		// Each source has its own concurrency limit,
+		// but they share the download rate.
+		wrapped := make([]namedClient, len(p.sources))
+		for i, s := range p.sources {
+			wrapped[i] = namedClient{
+				name:   s.name,
+				client: retryClient{newThrottleClient(s.client, p.srcConcurrency, download, nil), f.src},
+			}
+		}
+		sources = newSourceClient(wrapped)
+		src = sources
+	} else {
+		src = retryClient{newThrottleClient(p.src, p.srcConcurrency, download, nil), f.src}
+	}
+	if p.blobCache != nil {
+		// The cache is keyed by the hashes in the source,
+		// so it's used before any rewrites.
+		src = newCacheClient(src, p.blobCache, f.src.logf)
+	}
+	if len(p.rewrites) > 0 {
+		f.rewrites = newRewriteClient(src, p.rewrites, p.rewriteBundle, p.tempDir, f.src.logf)
+		src = f.rewrites
+	}
+	f.src.params.src = src
+	f.src.sources = sources
+	for _, d := range f.dests {
+		d.ing.params.src = src
+		d.ing.sources = sources
+	}
+	return f
+}
+
+// close removes any temporary files that are
+// kept for the duration of the ingest.
+func (f *fanout) close() {
+	if f.rewrites != nil {
+		f.rewrites.close()
+	}
+}
+
+// setResolved gives each destination its own copy of the
+// given resolved entities, along with the errors found when
+// resolving them.
+func (f *fanout) setResolved(es map[string]*whitelistBaseEntity) {
+	f.src.mu.Lock()
+	defer f.src.mu.Unlock()
+	f.resolveErrors = len(f.src.errors)
+	for _, d := range f.dests {
+		if d.ing == f.src {
+			d.resolved = es
+			continue
+		}
+		d.resolved = copyResolved(es)
+		d.ing.errors = append([]string(nil), f.src.errors...)
+		for id, errs := range f.src.entityErrors {
+			if d.ing.entityErrors == nil {
+				d.ing.entityErrors = make(map[string][]IngestError)
+			}
+			d.ing.entityErrors[id] = append([]IngestError(nil), errs...)
+		}
+	}
+}
+
+// copyResolved returns a copy of es in which the entities can
+// be changed independently of those in es.
+func copyResolved(es map[string]*whitelistBaseEntity) map[string]*whitelistBaseEntity {
+	es1 := make(map[string]*whitelistBaseEntity)
+	for key, be := range es {
+		be1 := &whitelistBaseEntity{
+			baseId:   be.baseId,
+			entities: make(map[string]*entityInfo),
+		}
+		for id, e := range be.entities {
+			e1 := *e
+			be1.entities[id] = &e1
+		}
+		es1[key] = be1
+	}
+	return es1
+}
+
+// entities returns the changed bundles, or the changed charms if
+// bundles is false, in all the destinations. Each is returned as
+// the group of the destinations' copies of it.
+func (f *fanout) entities(bundles bool) [][]destEntity {
+	groups := make(map[string][]destEntity)
+	var ids []string
+	for _, d := range f.dests {
+		for _, be := range d.changed {
+			for id, e := range be.entities {
+				if (e.id.Series == "bundle") != bundles {
+					continue
+				}
+				if groups[id] == nil {
+					ids = append(ids, id)
+				}
+				groups[id] = append(groups[id], destEntity{d.ing, e})
+			}
+		}
+	}
+	sort.Strings(ids)
+	result := make([][]destEntity, len(ids))
+	for i, id := range ids {
+		result[i] = groups[id]
+	}
+	return result
+}
+
+// transferEntity transfers an entity to each of the destinations
+// in group. When more than one of them needs the archive, it's
+// read from the source into a temporary file first.
+func (f *fanout) transferEntity(group []destEntity) {
+	var need []destEntity
+	for _, de := range group {
+		if de.ing.needArchive(de.e) {
+			need = append(need, de)
+		}
+	}
+	if len(need) == 0 {
+		return
+	}
+	e := need[0].e
+	var file *tempFile
+	if len(need) > 1 && !f.src.params.dryRun {
+		var err error
+		file, err = f.src.downloadArchive(e)
+		if err != nil && errgo.Cause(err) != errDiskLimit {
+			groupErrorf(need, err, "cannot read archive for %v: %v", e.id, err)
+			return
+		}
+		// When the archive is too large for the disk limit,
+		// it's read again for each destination instead.
+	}
+	if file != nil {
+		defer file.Close()
+	}
+	each(f.src.limiter, need, func(de destEntity) {
+		de.ing.putArchive(de.e, func() (io.ReadCloser, error) {
+			if file != nil {
+				return ioutil.NopCloser(io.NewSectionReader(file, 0, e.archiveSize)), nil
+			}
+			return de.ing.params.src.getArchive(f.src.params.ctx, de.e.id)
+		})
+	})
+}
+
+// downloadArchive reads the archive for e from the source
+// into a temporary file, which must be closed after use.
+func (ing *ingester) downloadArchive(e *entityInfo) (*tempFile, error) {
+	f, err := ing.getDisk(e.archiveSize)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errDiskLimit))
+	}
+	ing.logf("reading archive for %v", e.id)
+	r, err := ing.params.src.getArchive(ing.params.ctx, e.id)
+	if err != nil {
+		f.Close()
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	// Allow one extra byte so that we know if the size is too big for some reason.
+	n, err := io.Copy(f, io.LimitReader(r, e.archiveSize+1))
+	r.Close()
+	if err != nil {
+		f.Close()
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if n != e.archiveSize {
+		f.Close()
+		return nil, errgo.WithCausef(nil, errHashMismatch, "%v", io.ErrUnexpectedEOF)
+	}
+	return f, nil
+}
+
+// resourceId uniquely identifies a specific revision of a specific resource in the store.
+type resourceId struct {
+	// id holds the base URL associated with the resource.
+	id           string
+	resourceName string
+	rev          int
+}
+
+// resourceGroup holds a resource revision to transfer and the
+// destinations' copies of the entity to transfer it with.
+type resourceGroup struct {
+	rid   resourceId
+	group []destEntity
+}
+
+// resourceGroups returns the resources specified in the changed
+// base entities in each destination, so that each resource revision
+// is read from the source only once. It also sets the resource
+// count for each destination.
+func (f *fanout) resourceGroups() []resourceGroup {
+	groups := make(map[resourceId][]destEntity)
+	var rids []resourceId
+	for _, d := range f.dests {
+		done := make(map[resourceId]bool)
+		for _, be := range d.changed {
+			for _, e := range be.entities {
+				d.ing.logf("base entity %v has resources %#v", e.id, e.resources)
+				if e.skipResources {
+					continue
+				}
+				for name, revs := range e.resources {
+					for _, rev := range revs {
+						rid := resourceId{
+							id:           baseEntityId(e.id).String(),
+							resourceName: name,
+							rev:          rev,
+						}
+						if done[rid] {
+							continue
+						}
+						done[rid] = true
+						if groups[rid] == nil {
+							rids = append(rids, rid)
+						}
+						groups[rid] = append(groups[rid], destEntity{d.ing, e})
+					}
+				}
+			}
+		}
+		d.resourceCount = len(done) + d.unchangedResources
+	}
+	result := make([]resourceGroup, len(rids))
+	for i, rid := range rids {
+		result[i] = resourceGroup{
+			rid:   rid,
+			group: groups[rid],
+		}
+	}
+	return result
+}
+
+// transfer transfers the changed entities and their resources to
+// all the destinations, and then sets the permissions on their base
+// entities. Each step is a task that starts as soon as the steps
+// that it depends on are done; see ingest for the dependencies.
+func (f *fanout) transfer() {
+	s := newScheduler(f.src.params.ctx, f.src.limiter)
+	charms := f.entities(false)
+	// archives holds the task that transfers the archive
+	// of each charm, keyed by id.
+	archives := make(map[string]*task)
+	for _, group := range charms {
+		group := group
+		archives[group[0].e.id.String()] = s.add(func() {
+			f.transferEntity(group)
+		})
+	}
+	// A resource is transferred once the archive of the
+	// charm that it's transferred with has been.
+	resources := make(map[resourceId]*task)
+	for _, rg := range f.resourceGroups() {
+		rg := rg
+		var deps []*task
+		for _, de := range rg.group {
+			deps = append(deps, archives[de.e.id.String()])
+		}
+		resources[rg.rid] = s.add(func() {
+			f.transferResource(rg.group, rg.rid.resourceName, rg.rid.rev)
+		}, deps...)
+	}
+	// A charm is published once its archive and all its
+	// resources have been transferred.
+	published := make(map[*entityInfo]*task)
+	bundleDeps := make(map[string][]*task)
+	for _, group := range charms {
+		for _, de := range group {
+			de := de
+			deps := []*task{archives[de.e.id.String()]}
+			if !de.e.skipResources {
+				for name, revs := range de.e.resources {
+					for _, rev := range revs {
+						deps = append(deps, resources[resourceId{
+							id:           baseEntityId(de.e.id).String(),
+							resourceName: name,
+							rev:          rev,
+						}])
+					}
+				}
+			}
+			t := s.add(func() {
+				de.ing.publishSynced(de.e)
+			}, deps...)
+			published[de.e] = t
+			for _, b := range de.e.requiredBy {
+				bundleDeps[b.Bundle] = append(bundleDeps[b.Bundle], t)
+			}
+		}
+	}
+	// A bundle is transferred and published once
+	// all its charms have been published.
+	for _, group := range f.entities(true) {
+		group := group
+		t := s.add(func() {
+			f.transferEntity(group)
+			for _, de := range group {
+				de.ing.publishSynced(de.e)
+			}
+		}, bundleDeps[group[0].e.id.String()]...)
+		for _, de := range group {
+			published[de.e] = t
+		}
+	}
+	// The permissions of a base entity are set once all
+	// its entities have been published.
+	for _, d := range f.dests {
+		for _, be := range d.changed {
+			ing, be := d.ing, be
+			var deps []*task
+			for _, e := range be.entities {
+				deps = append(deps, published[e])
+			}
+			s.add(func() {
+				ing.transferBaseEntity(be)
+			}, deps...)
+		}
+	}
+	s.run()
+}
+
+// transferResource transfers the given resource revision to each of
+// the destinations in group that needs it. It's read from the source
+// into a temporary file, which is uploaded to all of them.
+func (f *fanout) transferResource(group []destEntity, resourceName string, rev int) {
+	var need []destEntity
+	for _, de := range group {
+		if de.ing.needResource(de.e, resourceName, rev) {
+			need = append(need, de)
+		}
+	}
+	if len(need) == 0 {
+		return
+	}
+	if f.src.params.dryRun {
+		// There's no need to download the content when
+		// we're only recording what would be transferred.
+		each(f.src.limiter, need, func(de destEntity) {
+			de.ing.putResource(de.e, resourceName, rev, nil, 0)
+		})
+		return
+	}
+	id := need[0].e.id
+	info, err := f.src.params.src.resourceInfo(f.src.params.ctx, id, resourceName, rev)
+	if err != nil {
+		groupErrorf(need, err, "cannot get resource %v/%v-%d: %v", id, resourceName, rev, err)
+		return
+	}
+	if info.kind == resource.TypeContainerImage {
+		each(f.src.limiter, need, func(de destEntity) {
+			de.ing.transferImageResource(de.e, resourceName, rev, resourceStep(id, resourceName, rev))
+		})
+		return
+	}
+	r, size, err := f.src.params.src.getResource(f.src.params.ctx, id, resourceName, rev)
+	if err != nil {
+		groupErrorf(need, err, "cannot get resource %v/%v-%d: %v", id, resourceName, rev, err)
+		return
+	}
+	file, err := f.src.getDisk(size)
+	if err != nil {
+		r.Close()
+		groupErrorf(need, err, "cannot make temp file for resource %v/%v/%d: %v", id, resourceName, rev, err)
+		return
+	}
+	defer file.Close()
+	f.src.logf("transferring resource %v %v/%d", id, resourceName, rev)
+	// Allow one extra byte so that we know if the size is too big for some reason.
+	n, err := io.Copy(file, io.LimitReader(r, size+1))
+	// Close the source resource before putting it to the
+	// destinations, so that we aren't holding on to a source
+	// operation while making destination operations.
+	r.Close()
+	if err != nil {
+		groupErrorf(need, err, "failed to copy resource %v/%v/%v: %v", id, resourceName, rev, err)
+		return
+	}
+	if n != size {
+		groupErrorf(need, errHashMismatch, "%v/%v/%v: %v", id, resourceName, rev, io.ErrUnexpectedEOF)
+		return
+	}
+	each(f.src.limiter, need, func(de destEntity) {
+		de.ing.putResource(de.e, resourceName, rev, file, size)
+	})
+}
+
+// stats returns the statistics for the whole ingest, given the
+// statistics for each destination.
+func (f *fanout) stats(destStats []IngestStats) IngestStats {
+	if f.src == f.dests[0].ing {
+		return destStats[0]
+	}
+	f.src.mu.Lock()
+	defer f.src.mu.Unlock()
+	stats := IngestStats{
+		BaseEntityCount: destStats[0].BaseEntityCount,
+		EntityCount:     destStats[0].EntityCount,
+		ResourceCount:   destStats[0].ResourceCount,
+		Errors:          append([]string(nil), f.src.errors...),
+		RetryCount:      f.src.retryCount,
+	}
+	for i, d := range f.dests {
+		ds := destStats[i]
+		stats.FailedEntityCount += ds.FailedEntityCount
+		stats.ArchivesCopiedCount += ds.ArchivesCopiedCount
+		stats.ResourcesCopiedCount += ds.ResourcesCopiedCount
+		stats.ArchivesPresentCount += ds.ArchivesPresentCount
+		stats.ResourcesPresentCount += ds.ResourcesPresentCount
+		stats.BytesCopied += ds.BytesCopied
+		stats.RetryCount += ds.RetryCount
+		// The errors found when resolving the whitelist
+		// are already included.
+		for _, msg := range ds.Errors[f.resolveErrors:] {
+			stats.Errors = append(stats.Errors, d.ing.params.destName+": "+msg)
+		}
+		stats.Destinations = append(stats.Destinations, DestinationStats{
+			Name:        d.ing.params.destName,
+			IngestStats: ds,
+		})
+	}
+	return stats
+}
+
+// groupErrorf records an error against each of the
+// destinations' copies of an entity.
+func groupErrorf(group []destEntity, err error, f string, a ...interface{}) {
+	for _, de := range group {
+		de.ing.entityErrorf(de.e.id.String(), err, f, a...)
+	}
+}
+
+// each calls fn for each of the entities in group concurrently,
+// and returns when all the calls have returned. It must be called
+// while holding a slot in l. Each call is made holding its own slot,
+// and the caller's slot is released while they run, so that a call
+// waiting to retry doesn't hold up the others.
+func each(l *limiter, group []destEntity, fn func(destEntity)) {
+	if len(group) == 1 {
+		fn(group[0])
+		return
+	}
+	l.stop()
+	defer l.start()
+	var wg sync.WaitGroup
+	for _, de := range group {
+		de := de
+		l.start()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer l.stop()
+			fn(de)
+		}()
+	}
+	wg.Wait()
+}
@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/charm/v8/resource"
 	"github.com/juju/charmrepo/v6/csclient"
@@ -28,6 +31,43 @@ type IngestParams struct {
 	// Dest holds the charmstore client to ingest into.
 	Dest *csclient.Client
 
+	// SrcDir holds a directory to ingest from instead of Src.
+	// It should have been written by a previous ingest with
+	// DestDir set. If Whitelist is empty, everything in the
+	// directory will be ingested.
+	SrcDir string
+
+	// DestDir holds a directory to ingest into instead of Dest.
+	// The directory can later be used as SrcDir, which makes it
+	// possible to transfer entities to a charmstore that has no
+	// network access to the source charmstore.
+	DestDir string
+
+	// Dests holds several destinations to ingest into at once,
+	// instead of Dest or DestDir. Each archive and resource is only
+	// read from the source once, however many of the destinations
+	// need it, and is then uploaded to each of them. The statistics
+	// for each destination are returned in IngestStats.Destinations.
+	//
+	// DestConcurrency and MaxUploadRate apply to each destination
+	// separately, and the journal and sync cache keep the steps
+	// and entities of each destination apart.
+	Dests []Destination
+
+	// Sources holds several sources to ingest from, in priority
+	// order, instead of Src or SrcDir. Each whitelist entry is
+	// looked up in the source named by its Source field, or if
+	// that's empty, in each source in turn until one of them has
+	// it. Everything else for an entity, including its earlier
+	// revisions and its resources, is read from the source that
+	// it was found in, and the charms of a bundle are looked up
+	// in the bundle's source first. The source that supplied each
+	// entity is recorded in its EntityReport.
+	//
+	// SrcConcurrency applies to each source separately;
+	// MaxDownloadRate is shared between them.
+	Sources []Source
+
 	// Whitelist holds a slice of entities to ingest.
 	Whitelist []WhitelistEntity
 
@@ -37,6 +77,24 @@ type IngestParams struct {
 	// be used.
 	Concurrency int
 
+	// SrcConcurrency and DestConcurrency hold the maximum
+	// number of operations that will be allowed to proceed
+	// at once on the source and destination respectively,
+	// within the overall limit set by Concurrency. An
+	// operation that reads an archive or resource lasts until
+	// all of it has been read. If either is zero, only the
+	// overall limit applies.
+	SrcConcurrency  int
+	DestConcurrency int
+
+	// MaxDownloadRate and MaxUploadRate hold the maximum number
+	// of bytes per second that will be read from the source
+	// and written to the destination respectively, shared between
+	// all the archives, resources and container images being
+	// transferred. If either is zero, there is no limit.
+	MaxDownloadRate int64
+	MaxUploadRate   int64
+
 	// MaxDisk holds the maximum amount of disk space that
 	// can be used when transferring resources. If SoftDiskLimit
 	// is true, then the true upper bound is the maximum of
@@ -50,16 +108,124 @@ type IngestParams struct {
 	SoftDiskLimit bool
 
 	// Owner holds the name of the user that will be
-	// given write permission on the transferred entities.
-	// If this is empty, no-one will be given write permission.
+	// given write permission on the transferred entities
+	// unless ACLPolicy says otherwise. If this is empty,
+	// "admin" is used.
 	Owner string
 
+	// ACLPolicy holds the permissions to set on the transferred
+	// entities. If it's nil, everyone is given read permission
+	// and Owner is given write permission.
+	ACLPolicy *ACLPolicy
+
+	// Rewrites holds rules that change the ids of entities from
+	// the source when they're put into the destination. The first
+	// rule that matches an entity is used. Entities that no rule
+	// matches keep their ids. Reports, events and the journal all
+	// refer to entities by their ids in the destination.
+	Rewrites []RewriteRule
+
 	// TempDir holds the directory to store temporary files in.
 	// If blank the default system temporary directory will be used.
 	TempDir string
 
+	// CacheDir, if not empty, holds a directory in which archives
+	// and resources read from the source are kept, keyed by their
+	// SHA-384 hash, so that later ingests that use the same
+	// directory read them from there instead when the source
+	// reports the same hash. It's created if it doesn't exist.
+	// The directory shouldn't be used by more than one ingest at
+	// once.
+	CacheDir string
+
+	// MaxCacheSize holds the maximum total size of the archives
+	// and resources kept in CacheDir. When it would be exceeded,
+	// the least recently used are removed. If it's zero, there is
+	// no limit.
+	MaxCacheSize int64
+
 	// Log is used to send logging messages if it's not nil.
 	Log func(string)
+
+	// Notify is called with an Event for each significant step
+	// of the ingest if it's not nil. It is never called concurrently.
+	// When DryRun is true, the events describe the changes that
+	// would have been made to the destination.
+	Notify func(Event)
+
+	// MaxRetries holds the maximum number of times that a remote
+	// operation will be retried when it fails with a temporary-looking
+	// error. If this is zero, DefaultMaxRetries will be used. If it's
+	// negative, operations won't be retried.
+	//
+	// Failed HTTP requests can only be recognised as temporary if
+	// the charmstore clients use a transport returned by NewTransport.
+	MaxRetries int
+
+	// DryRun specifies that no changes should be made to the
+	// destination charmstore. Instead, the changes that would
+	// have been made are returned in IngestStats.Plan.
+	DryRun bool
+
+	// RegistryClient holds the HTTP client used to copy container
+	// image resources between the registries associated with the
+	// source and destination charmstores. If it's nil, a client
+	// with a transport returned by NewTransport will be used.
+	RegistryClient *http.Client
+
+	// Journal holds the name of a file in which to record each
+	// completed step of the ingest: archives and resource revisions
+	// uploaded, entities published and permissions set. If the file
+	// already exists, the steps recorded in it are not repeated,
+	// so an interrupted ingest can be resumed by running it again
+	// with the same journal. Steps are keyed by entity and archive
+	// hash, so entities that have changed in the source are
+	// transferred again. Nothing is recorded in a dry run.
+	//
+	// Container image blobs are uploaded to the destination
+	// registry in chunks, and the location of each upload is
+	// recorded after every chunk, so an interrupted blob upload
+	// is continued from the last chunk that the registry received.
+	// Archives and file resources are uploaded again from the
+	// start, because charmstore uploads can't be resumed.
+	Journal string
+
+	// SyncCache, if not nil, is used to skip base entities that
+	// have not changed in the source since they were last synced
+	// by an ingest that used the same cache. Such entities are
+	// reported with OutcomeUnchanged and are not checked in the
+	// destination at all, so ingests that are repeated
+	// regularly only need to look at what has changed.
+	SyncCache *SyncCache
+
+	// Prune specifies what to do with base entities in the
+	// destination that aren't included by the whitelist.
+	// Only entities owned by the users in PruneOwners
+	// are considered; if that's empty, the owners of
+	// the whitelisted entities are used.
+	Prune       PruneMode
+	PruneOwners []string
+
+	// ProtectedOwners and ProtectedIds hold owners and base
+	// entity ids that are never pruned. Ids may contain
+	// wildcards as interpreted by path.Match, for example
+	// cs:~bob/k8s-*.
+	ProtectedOwners []string
+	ProtectedIds    []string
+}
+
+// Destination holds one of several destinations to ingest into.
+type Destination struct {
+	// Name identifies the destination in statistics, events
+	// and the journal. Each destination must have a different name.
+	Name string
+
+	// Client holds the charmstore client for the destination.
+	Client *csclient.Client
+
+	// Dir holds a directory to ingest into instead of Client.
+	// See IngestParams.DestDir.
+	Dir string
 }
 
 type permission struct {
@@ -68,15 +234,51 @@ type permission struct {
 }
 
 type ingestParams struct {
-	src           csClient
-	dest          csClient
-	whitelist     []WhitelistEntity
-	concurrency   int
-	maxDisk       int64
-	softDiskLimit bool
-	owner         string
-	tempDir       string
-	log           func(string)
+	// ctx is used for all the operations of the ingest.
+	// If it's nil, context.Background() is used.
+	ctx             context.Context
+	src             csClient
+	sources         []namedClient
+	dest            csClient
+	destName        string
+	extraDests      []namedClient
+	whitelist       []WhitelistEntity
+	concurrency     int
+	srcConcurrency  int
+	destConcurrency int
+	downloadRate    int64
+	uploadRate      int64
+	maxDisk         int64
+	softDiskLimit   bool
+	owner           string
+	aclPolicy       *ACLPolicy
+	rewrites        []RewriteRule
+	tempDir         string
+	blobCache       *blobCache
+	log             func(string)
+	notify          func(Event)
+	dryRun          bool
+	maxRetries      int
+	retryDelay      time.Duration
+	journal         *journal
+	registry        *http.Client
+	syncCache       *SyncCache
+	prune           PruneMode
+	pruneOwners     []string
+	protectedOwners []string
+	protectedIds    []string
+
+	// rewriteBundle is used to rewrite the charms in bundle
+	// archives. If it's nil, rewriteBundleArchive is used.
+	rewriteBundle func(data []byte, rewrite func(string) string) ([]byte, error)
+}
+
+// namedClient holds one of several source or destination clients.
+// Only the sources or destinations of an ingest with several
+// have names.
+type namedClient struct {
+	name   string
+	client csClient
 }
 
 var errNotFound = errgo.New("entity not found")
@@ -85,36 +287,60 @@ type csClient interface {
 	// entityInfo looks up information on the charmstore entity with the
 	// given id. If the id is not found, it returns an error with a errNotFound
 	// cause.
-	entityInfo(ch params.Channel, id *charm.URL) (*entityInfo, error)
+	entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error)
 	// getBaseEntity finds out information on the base entity for
 	// the given charm id. If there is no base entity for the id,
 	// it returns an error with an errNotFound cause.
-	getBaseEntity(id *charm.URL) (*baseEntityInfo, error)
+	getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error)
 	// getArchive reads the charm or bundle archive specified by id, which will
 	// always be the canonical id for the entity.
-	getArchive(id *charm.URL) (io.ReadCloser, error)
+	getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error)
 	// putArchive puts an archive to the entity with the given id, reading the content
 	// from r, which should have the given hash and size. The entity
 	// will be associated with the given promulgated revision and made available
-	// in all the specified channels.
-	putArchive(id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel) error
+	// in all the specified channels. The uploadTime parameter holds the time
+	// that the archive was uploaded to the source; a charm store records
+	// its own upload time instead.
+	putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error
 	// putExtraInfo sets the extra-info metadata associated with the given id. Entries that are
 	// nil will be removed.
-	putExtraInfo(id *charm.URL, extraInfo map[string]json.RawMessage) error
+	putExtraInfo(ctx context.Context, id *charm.URL, extraInfo map[string]json.RawMessage) error
+	// putCommonInfo sets the common-info metadata associated with the base entity
+	// of the given id. Entries that are nil will be removed.
+	putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error
 	// setPerm sets the permissions for the given id on the given channel.
-	setPerm(id *charm.URL, ch params.Channel, perm permission) error
+	setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error
 	// publish releases the given id to the given channels.
-	publish(id *charm.URL, channels []params.Channel, resources map[string]int) error
+	publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error
 	// resourceInfo returns information on the resource with the given name
 	// and revision for the charm with given id.
 	// If the resource is not found, it returns an error with an errNotFound cause.
-	resourceInfo(id *charm.URL, name string, rev int) (*resourceInfo, error)
+	resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error)
 	// getResource reads the resource with the given name and revision
 	// associated with the entity with the given id.
-	getResource(id *charm.URL, name string, rev int) (io.ReadCloser, int64, error)
+	getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error)
 	// putResource uploads a resource to the given charm id with the given
 	// name and resource revision, reading its content from r.
-	putResource(id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error
+	putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error
+	// dockerResourceDownloadInfo returns information on where to find
+	// the container image for the given resource revision.
+	dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error)
+	// dockerResourceUploadInfo returns information on where to push
+	// a container image for the given resource.
+	dockerResourceUploadInfo(ctx context.Context, id *charm.URL, name string) (*imageInfo, error)
+	// putDockerResource adds the container image with the given digest
+	// as the given revision of a resource. If imageName is empty, the image
+	// must have been pushed to the location returned by dockerResourceUploadInfo;
+	// otherwise it names an image held in an external registry.
+	putDockerResource(ctx context.Context, id *charm.URL, name string, rev int, imageName, digest string) error
+	// listEntities returns the ids of all the entities owned by the
+	// given user that are published in the given channel.
+	listEntities(ctx context.Context, ch params.Channel, owner string) ([]*charm.URL, error)
+	// revisions returns the ids of all the revisions of the entity with
+	// the given id that have been published in the given channel,
+	// most recent first. The revision in id is ignored. If the entity
+	// is not found, it returns an error with an errNotFound cause.
+	revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error)
 }
 
 // resourceInfo holds information on a resource.
@@ -147,6 +373,57 @@ type WhitelistEntity struct {
 	// Resources holds a map from resource name to the resource
 	// revisions of that resource to include for this entity.
 	Resources map[string][]int
+
+	// SkipResources specifies that no resources should be
+	// copied for the entity (or for the charms in it, if it's
+	// a bundle). The entity is still published with its
+	// resources, so they must already be in the destination,
+	// for example because they have been copied by other means.
+	SkipResources bool
+
+	// History, Since and MaxHistorySize specify that earlier
+	// revisions of the entity are copied as well as the current
+	// one, so that the destination can roll back to them. They
+	// are only used when EntityId has no revision. The earlier
+	// revisions in each channel are published to it but are not
+	// made current.
+	//
+	// History holds the maximum number of revisions to copy for
+	// each channel, including the current one. Revisions uploaded
+	// before Since are left out, and if MaxHistorySize is non-zero,
+	// the earlier revisions are limited so that the total size
+	// of their archives and resources in each channel is no more
+	// than that. If History is zero and Since is set, all the
+	// revisions uploaded since then are copied; otherwise only
+	// the current revision is copied. When the source is a
+	// directory, the upload times in the charm store that it was
+	// exported from are used; revisions exported without one
+	// are never left out because of Since.
+	History        int
+	Since          time.Time
+	MaxHistorySize int64
+
+	// Series and Exclude are only used when EntityId is a pattern
+	// that can match many entities, such as cs:~partner/* or
+	// cs:~partner/k8s-*. The pattern must name an owner and may
+	// name a series; only the name may contain wildcards, as
+	// interpreted by path.Match. Every entity owned by the owner
+	// in the source charmstore that matches the pattern in any of
+	// the channels is included, as if it had been whitelisted with
+	// no revision in the channels it was found in.
+	//
+	// If Series is non-empty, only entities with one of the given
+	// series are included. A multi-series charm is included
+	// if it supports any of the series. Entities with a name that matches
+	// any of the patterns in Exclude are left out. Resources
+	// is ignored for patterns.
+	Series  []string
+	Exclude []string
+
+	// Source holds the name of the source to take the entity
+	// from when IngestParams.Sources is used. If it's empty,
+	// the entity is taken from the first source that has it.
+	Source string
 }
 
 // bundleCharm holds information on a charm used by a bundle
@@ -179,10 +456,23 @@ type entityInfo struct {
 	// archiveSize holds the size of the charm or bundle archive.
 	archiveSize int64
 
+	// source holds the name of the source that the entity
+	// was found in when there are several sources.
+	source string
+
 	// hash holds the hex-encoded SHA-384 hash of the
 	// archive.
 	hash string
 
+	// uploadTime holds the time that the archive was uploaded.
+	// It is zero if the time isn't known.
+	uploadTime time.Time
+
+	// supportedSeries holds the series supported by a
+	// multi-series charm. It's empty for bundles and
+	// single-series charms.
+	supportedSeries []string
+
 	// extraInfo holds any extra metadata stored with the entity.
 	extraInfo map[string]json.RawMessage
 
@@ -208,11 +498,41 @@ type entityInfo struct {
 	// archiveCopied is set to true when the entity's archive
 	// has been copied.
 	archiveCopied bool
+
+	// requiredBy holds the bundles that the entity
+	// was resolved for, if any.
+	requiredBy []BundleDependency
+
+	// skipResources is set to true when none of the
+	// whitelist entries that include the entity
+	// want its resources to be copied.
+	skipResources bool
+
+	// archivePresent is set to true when the entity's archive
+	// was found to be in the destination already.
+	archivePresent bool
+
+	// unchanged is set to true when the entity was
+	// not transferred because it has not changed since
+	// it was last synced.
+	unchanged bool
+
+	// resourcesCopied holds the number of resources
+	// copied for the entity.
+	resourcesCopied int
+
+	// bytesCopied holds the number of bytes copied
+	// for the entity.
+	bytesCopied int64
 }
 
 // baseEntityInfo holds information on the base entity.
 type baseEntityInfo struct {
 	perms map[params.Channel]permission
+
+	// commonInfo holds the common-info metadata
+	// stored on the base entity.
+	commonInfo map[string]json.RawMessage
 }
 
 // whitelistBaseEntity holds information about a base entity and
@@ -223,6 +543,21 @@ type whitelistBaseEntity struct {
 	// entities holds a map from canonical entity URL
 	// to information on that entity.
 	entities map[string]*entityInfo
+	// srcPerms holds the permissions of the base entity in the
+	// source, as returned by sourcePerms, once they're known.
+	srcPerms map[params.Channel]permission
+}
+
+// firstEntity returns the entity with the lowest id,
+// or nil if there are none.
+func (e *whitelistBaseEntity) firstEntity() *entityInfo {
+	var first *entityInfo
+	for _, e := range e.entities {
+		if first == nil || e.id.String() < first.id.String() {
+			first = e
+		}
+	}
+	return first
 }
 
 func (e *whitelistBaseEntity) isBundle() bool {
@@ -233,58 +568,300 @@ func (e *whitelistBaseEntity) isBundle() bool {
 }
 
 type IngestStats struct {
-	BaseEntityCount     int
-	EntityCount         int
-	FailedEntityCount   int
-	ResourceCount       int
-	ArchivesCopiedCount int
-	// ResourcesCopiedCount int // TODO
+	BaseEntityCount      int
+	EntityCount          int
+	FailedEntityCount    int
+	ResourceCount        int
+	ArchivesCopiedCount  int
+	ResourcesCopiedCount int
+
+	// ArchivesPresentCount and ResourcesPresentCount hold
+	// the number of archives and resources that did not need
+	// to be copied because they were already in the destination.
+	ArchivesPresentCount  int
+	ResourcesPresentCount int
+
+	// BytesCopied holds the total size of all the archives
+	// and resources copied.
+	BytesCopied int64
+
 	Errors []string
+
+	// Entities holds the outcome for each entity, sorted by id.
+	// Errors that relate to an entity are included in its report.
+	Entities []EntityReport
+
+	// RetryCount holds the number of times that remote
+	// operations were retried after temporary failures.
+	RetryCount int
+
+	// Orphans holds the base entities found in the destination
+	// that aren't whitelisted, sorted by id. It is only set
+	// when IngestParams.Prune is not PruneNone.
+	Orphans []Orphan
+
+	// Plan holds the changes that would be made to each
+	// entity. It is only set when IngestParams.DryRun is true,
+	// in which case the other counts also reflect what
+	// would have been done.
+	Plan []EntityPlan
+
+	// Destinations holds the statistics for each destination,
+	// in order, when IngestParams.Dests is used. The other
+	// fields then hold totals over all the destinations, except
+	// that Entities, Orphans and Plan are only set for each
+	// destination. Errors that relate to a single destination
+	// are prefixed with its name.
+	Destinations []DestinationStats `json:",omitempty"`
+}
+
+// DestinationStats holds the statistics for one of the
+// destinations of an ingest.
+type DestinationStats struct {
+	Name string
+	IngestStats
 }
 
 type ingester struct {
 	params      ingestParams
-	mu          sync.Mutex
-	errors      []string
 	diskLimiter *semaphore.Weighted
 	limiter     *limiter
+	registry    *registryClient
+	// sources holds the source client when there are
+	// several sources. It is nil otherwise.
+	sources *sourceClient
+	// notifyMu is shared between the ingesters
+	// for all the destinations.
+	notifyMu *sync.Mutex
+
+	// mu guards the fields below it and the
+	// resourcesCopied and bytesCopied fields
+	// of entityInfo.
+	mu               sync.Mutex
+	errors           []string
+	entityErrors     map[string][]IngestError
+	retryCount       int
+	resourcesCopied  int
+	resourcesPresent int
 }
 
 // Ingest retrieves whitelisted entities from one charmstore and adds them to another,
 // returning statistics on this operation.
-func Ingest(params IngestParams) IngestStats {
-	return ingest(ingestParams{
-		src:           charmstoreShim{params.Src},
-		dest:          charmstoreShim{params.Dest},
-		whitelist:     params.Whitelist,
-		concurrency:   params.Concurrency,
-		maxDisk:       params.MaxDisk,
-		softDiskLimit: params.SoftDiskLimit,
-		owner:         params.Owner,
-		tempDir:       params.TempDir,
-		log:           params.Log,
-	})
+//
+// If ctx is cancelled or its deadline passes, no more operations
+// are started, any transfers in progress are abandoned and
+// their temporary files are removed. The statistics for what was
+// done before then are returned along with an error saying that
+// the ingest was interrupted, and nothing is pruned.
+func Ingest(ctx context.Context, params IngestParams) IngestStats {
+	srcs, dests, destDirs, whitelist, err := params.clients()
+	if err != nil {
+		return errorStats(params.Notify, "%v", err)
+	}
+	var j *journal
+	if params.Journal != "" {
+		var err error
+		j, err = openJournal(params.Journal)
+		if err != nil {
+			return errorStats(params.Notify, "cannot open journal: %v", err)
+		}
+		defer j.Close()
+	}
+	var cache *blobCache
+	if params.CacheDir != "" {
+		var err error
+		cache, err = openBlobCache(params.CacheDir, params.MaxCacheSize)
+		if err != nil {
+			return errorStats(params.Notify, "cannot open cache: %v", err)
+		}
+	}
+	p := ingestParams{
+		ctx:             ctx,
+		dest:            dests[0].client,
+		destName:        dests[0].name,
+		extraDests:      dests[1:],
+		whitelist:       whitelist,
+		concurrency:     params.Concurrency,
+		srcConcurrency:  params.SrcConcurrency,
+		destConcurrency: params.DestConcurrency,
+		downloadRate:    params.MaxDownloadRate,
+		uploadRate:      params.MaxUploadRate,
+		maxDisk:         params.MaxDisk,
+		softDiskLimit:   params.SoftDiskLimit,
+		owner:           params.Owner,
+		aclPolicy:       params.ACLPolicy,
+		rewrites:        params.Rewrites,
+		tempDir:         params.TempDir,
+		blobCache:       cache,
+		log:             params.Log,
+		notify:          params.Notify,
+		dryRun:          params.DryRun,
+		maxRetries:      params.MaxRetries,
+		journal:         j,
+		registry:        params.RegistryClient,
+		syncCache:       params.SyncCache,
+		prune:           params.Prune,
+		pruneOwners:     params.PruneOwners,
+		protectedOwners: params.ProtectedOwners,
+		protectedIds:    params.ProtectedIds,
+	}
+	p.setSources(srcs)
+	stats := ingest(p)
+	if !params.DryRun {
+		for _, destDir := range destDirs {
+			if err := destDir.writeWhitelist(); err != nil {
+				stats.Errors = append(stats.Errors, errorStats(params.Notify, "cannot write whitelist to destination directory: %v", err).Errors...)
+			}
+		}
+	}
+	return stats
+}
+
+// clients returns the clients to use for the sources and the
+// destinations and the whitelist to use, which is read from the
+// source directory if there's one and the whitelist is empty. Any
+// destinations that are directories are also returned in destDirs.
+//
+// Unless params.Sources or params.Dests is used, there's only one
+// source or destination, and it has no name.
+func (params IngestParams) clients() (srcs, dests []namedClient, destDirs []*dirClient, whitelist []WhitelistEntity, err error) {
+	whitelist = params.Whitelist
+	if len(params.Sources) == 0 {
+		var src csClient = charmstoreShim{params.Src}
+		if params.SrcDir != "" {
+			srcDir, err := openDirClient(params.SrcDir)
+			if err != nil {
+				return nil, nil, nil, nil, errgo.Notef(err, "cannot open source directory")
+			}
+			if len(whitelist) == 0 {
+				whitelist, err = srcDir.readWhitelist()
+				if err != nil {
+					return nil, nil, nil, nil, errgo.Notef(err, "cannot read whitelist from source directory")
+				}
+			}
+			src = srcDir
+		}
+		srcs = []namedClient{{
+			client: src,
+		}}
+	} else if params.Src != nil || params.SrcDir != "" {
+		return nil, nil, nil, nil, errgo.Newf("cannot use Sources with Src or SrcDir")
+	}
+	srcNames := make(map[string]bool)
+	for _, s := range params.Sources {
+		if s.Name == "" {
+			return nil, nil, nil, nil, errgo.Newf("source has no name")
+		}
+		if srcNames[s.Name] {
+			return nil, nil, nil, nil, errgo.Newf("more than one source named %q", s.Name)
+		}
+		srcNames[s.Name] = true
+		var src csClient = charmstoreShim{s.Client}
+		if s.Dir != "" {
+			srcDir, err := openDirClient(s.Dir)
+			if err != nil {
+				return nil, nil, nil, nil, errgo.Notef(err, "cannot open source directory")
+			}
+			src = srcDir
+		}
+		srcs = append(srcs, namedClient{
+			name:   s.Name,
+			client: src,
+		})
+	}
+	if len(params.Dests) == 0 {
+		params.Dests = []Destination{{
+			Client: params.Dest,
+			Dir:    params.DestDir,
+		}}
+	} else if params.Dest != nil || params.DestDir != "" {
+		return nil, nil, nil, nil, errgo.Newf("cannot use Dests with Dest or DestDir")
+	}
+	names := make(map[string]bool)
+	for _, d := range params.Dests {
+		if len(params.Dests) > 1 || d.Name != "" {
+			if d.Name == "" {
+				return nil, nil, nil, nil, errgo.Newf("destination has no name")
+			}
+			if names[d.Name] {
+				return nil, nil, nil, nil, errgo.Newf("more than one destination named %q", d.Name)
+			}
+			names[d.Name] = true
+		}
+		var dest csClient = charmstoreShim{d.Client}
+		if d.Dir != "" {
+			destDir, err := openDirClient(d.Dir)
+			if err != nil {
+				return nil, nil, nil, nil, errgo.Notef(err, "cannot open destination directory")
+			}
+			destDirs = append(destDirs, destDir)
+			dest = destDir
+		}
+		dests = append(dests, namedClient{
+			name:   d.Name,
+			client: dest,
+		})
+	}
+	return srcs, dests, destDirs, whitelist, nil
+}
+
+// setSources sets the source clients in p from those
+// returned by IngestParams.clients.
+func (p *ingestParams) setSources(srcs []namedClient) {
+	if len(srcs) == 1 && srcs[0].name == "" {
+		p.src = srcs[0].client
+		return
+	}
+	p.sources = srcs
+}
+
+// errorStats returns the stats for an ingest
+// that failed before anything was transferred,
+// also sending the error to notify if it's not nil.
+func errorStats(notify func(Event), f string, a ...interface{}) IngestStats {
+	msg := fmt.Sprintf(f, a...)
+	if notify != nil {
+		notify(Event{
+			Time:  time.Now(),
+			Kind:  EventError,
+			Error: msg,
+		})
+	}
+	return IngestStats{
+		Errors: []string{msg},
+	}
 }
 
 const DefaultConcurrency = 20
 
+// newIngester returns an ingester for the first destination
+// in the given parameters. See newFanout.
+func newIngester(p ingestParams) *ingester {
+	return newFanout(p).dests[0].ing
+}
+
 // ingest is the internal version of Ingest. It uses interfaces
 // that can be faked out for tests.
 func ingest(p ingestParams) IngestStats {
-	if p.concurrency <= 0 {
-		p.concurrency = DefaultConcurrency
-	}
-	if p.owner == "" {
-		p.owner = "admin"
-	}
-	ing := &ingester{
-		params:  p,
-		limiter: newLimiter(p.concurrency),
+	f := newFanout(p)
+	defer f.close()
+	if p.dryRun {
+		// Record changes to the destinations rather than making them.
+		for _, d := range f.dests {
+			d.planner = newPlanClient(d.ing.params.dest)
+			d.ing.params.dest = d.planner
+		}
 	}
-	if p.maxDisk > 0 {
-		ing.diskLimiter = semaphore.NewWeighted(p.maxDisk)
+	resolvedEntities := f.src.resolveWhitelist(p.whitelist)
+	f.src.mu.Lock()
+	resolveFailed := len(f.src.errors) > 0
+	f.src.mu.Unlock()
+	f.setResolved(resolvedEntities)
+	// Only the entities that have changed since they were
+	// last synced need to be transferred.
+	for _, d := range f.dests {
+		d.changed, d.unchangedResources = d.ing.skipUnchanged(d.resolved)
 	}
-	resolvedEntities := ing.resolveWhitelist(p.whitelist)
 
 	// Upload dependencies.
 	//
@@ -305,88 +882,59 @@ func ingest(p ingestParams) IngestStats {
 	// - We can only set permissions on a charm or bundle when it
 	// has at least one existing uploaded revision.
 	//
-	// To respect these requirements, we use the following ordering:
-	//	- transfer charms
-	//	- transfer resources
-	//	- publish charms
-	//	- transfer bundles
-	//	- set permissions
-
-	// First transfer all charms.
-	for _, baseInfo := range resolvedEntities {
-		for _, entity := range baseInfo.entities {
-			entity := entity
-			if entity.id.Series == "bundle" {
-				continue
-			}
-			ing.limiter.do(func() {
-				ing.transferEntity(entity)
-			})
-		}
-	}
-	ing.limiter.wait()
-
-	// Now transfer resources.
-	resourceCount := ing.transferResources(resolvedEntities)
-
-	// Then publish all charms (we have to do this after transferring
-	// resources, as we can't publish a charm without its resources).
-	for _, baseInfo := range resolvedEntities {
-		for _, entity := range baseInfo.entities {
-			entity := entity
-			if entity.id.Series == "bundle" {
-				continue
-			}
-			ing.limiter.do(func() {
-				if err := ing.publishEntity(entity); err != nil {
-					ing.errorf("%v", err)
-					return
-				}
-				entity.synced = true
-			})
+	// To respect these requirements, each step is done as soon as
+	// the steps that it depends on are done, so that a slow step
+	// only holds up the entities that need it:
+	//	- each charm is transferred straight away
+	//	- each resource is transferred once the charm that it's
+	//	  transferred with has been
+	//	- each charm is published once it and all its resources
+	//	  have been transferred
+	//	- each bundle is transferred and published once all its
+	//	  charms have been published
+	//	- the permissions of each base entity are set once all
+	//	  its entities have been published
+	//
+	// A step is done even if a step that it depends on failed,
+	// so that all the errors are reported. Each step is done for
+	// all the destinations at once, so that each archive and
+	// resource only needs to be read once.
+	f.transfer()
+
+	interrupted := f.src.params.ctx.Err()
+	if interrupted != nil {
+		f.src.addError("", nil, fmt.Sprintf("ingest interrupted: %v", interrupted))
+	}
+	destStats := make([]IngestStats, len(f.dests))
+	for i, d := range f.dests {
+		// Finally deal with anything in the destination
+		// that's no longer whitelisted, unless we didn't get
+		// as far as transferring everything that is.
+		var orphans []Orphan
+		if interrupted == nil {
+			orphans = d.ing.prune(d.resolved, resolveFailed)
 		}
-	}
-	ing.limiter.wait()
 
-	// Then transfer all bundles (we have to do this after transferring
-	// charms, as we can't upload a bundle without uploading its
-	// charms first).
-	for _, baseInfo := range resolvedEntities {
-		for _, entity := range baseInfo.entities {
-			entity := entity
-			if entity.id.Series != "bundle" {
-				continue
-			}
-			ing.limiter.do(func() {
-				ing.transferEntity(entity)
-				if err := ing.publishEntity(entity); err != nil {
-					ing.errorf("%v", err)
-					return
-				}
-				entity.synced = true
-			})
+		stats := d.ing.stats(d.resolved)
+		stats.ResourceCount = d.resourceCount
+		stats.Orphans = orphans
+		d.ing.recordSynced(d.changed)
+		if d.planner != nil {
+			stats.Plan = d.planner.entityPlans(d.resolved)
 		}
+		destStats[i] = stats
 	}
-	ing.limiter.wait()
-
-	// Now we've transferred all the entities, make sure
-	// they've got the right permissions.
-	ing.transferBaseEntities(resolvedEntities)
-
-	stats := ing.stats(resolvedEntities)
-	stats.ResourceCount = resourceCount
-	return stats
+	return f.stats(destStats)
 }
 
-func (ing *ingester) transferBaseEntities(resolvedEntities map[string]*whitelistBaseEntity) {
-	ing.logf("transferring base entities")
-	for _, baseInfo := range resolvedEntities {
-		baseInfo := baseInfo
-		ing.limiter.do(func() {
-			ing.transferBaseEntity(baseInfo)
-		})
+// publishSynced publishes e, and marks it as synced
+// if that succeeds.
+func (ing *ingester) publishSynced(e *entityInfo) {
+	if err := ing.publishEntity(e); err != nil {
+		ing.entityErrorf(e.id.String(), err, "%v", err)
+		return
 	}
-	ing.limiter.wait()
+	e.synced = true
 }
 
 func (ing *ingester) transferBaseEntity(e *whitelistBaseEntity) {
@@ -394,28 +942,36 @@ func (ing *ingester) transferBaseEntity(e *whitelistBaseEntity) {
 	// Get the base entity in the destination, which should
 	// definitely exist because we've transferred all the entities
 	// for this base entity.
-	be, err := ing.params.dest.getBaseEntity(e.baseId)
+	be, err := ing.params.dest.getBaseEntity(ing.params.ctx, e.baseId)
 	if err != nil && errgo.Cause(err) != errNotFound {
-		ing.errorf("cannot get base entity for %q: %v", e.baseId, err)
+		ing.entityErrorf(e.baseId.String(), err, "cannot get base entity for %q: %v", e.baseId, err)
+		return
+	}
+	if err != nil {
+		ing.entityErrorf(e.baseId.String(), err, "no base entity found for %v after transferring entities", e.baseId)
 		return
 	}
+	ing.transferCommonInfo(e, be)
+	srcPerms, err := ing.sourcePerms(e.baseId)
 	if err != nil {
-		ing.errorf("no base entity found for %v after transferring entities", e.baseId)
+		ing.entityErrorf(e.baseId.String(), err, "cannot get base entity for %q from source: %v", e.baseId, err)
 		return
 	}
+	e.srcPerms = srcPerms
 	ing.logf("got base entity perms: %#v", be.perms)
 	// Check whether all the permissions are the same as the default
 	// permissions. If they are, then change them to the usual starting
 	// permissions.
 	for ch, perms := range be.perms {
-		if !ing.isDefaultPerm(e.baseId, perms) {
+		// Permissions that we've already set in an
+		// interrupted ingest don't count as changed.
+		if !ing.isDefaultPerm(e.baseId, perms) && !ing.params.journal.isDone(permsStep(e.baseId, ch, perms)) {
 			ing.logf("%s permissions for %s have been changed (currently %#v); leaving alone", e.baseId, ch, perms)
 			// Someone has manually changed the permissions
 			// so leave 'em be.
 			return
 		}
 	}
-	writeACL := []string{ing.params.owner}
 	// In general, we can only set permissions on channels that the charm has been
 	// published to already
 	doneChannels := make(map[params.Channel]bool)
@@ -425,18 +981,47 @@ func (ing *ingester) transferBaseEntity(e *whitelistBaseEntity) {
 			if doneChannels[ch] {
 				continue
 			}
-			ing.logf("granting %s (channel %s) read permissions to everyone; write: %s", e.id, ch, writeACL)
-			if err := ing.params.dest.setPerm(e.id, ch, permission{
-				read:  []string{"everyone"},
-				write: writeACL,
-			}); err != nil {
-				ing.errorf("cannot set perm on %v (channel %s): %v", e.id, ch, err)
+			perm := ing.perm(baseEntityId(e.id), ch, srcPerms)
+			step := permsStep(baseEntityId(e.id), ch, perm)
+			if ing.params.journal.isDone(step) {
+				doneChannels[ch] = true
+				continue
+			}
+			ing.logf("setting %s (channel %s) permissions; read: %s; write: %s", e.id, ch, perm.read, perm.write)
+			if err := ing.params.dest.setPerm(ing.params.ctx, e.id, ch, perm); err != nil {
+				ing.entityErrorf(e.id.String(), err, "cannot set perm on %v (channel %s): %v", e.id, ch, err)
 				continue
 			}
+			ing.notify(Event{
+				Kind:    EventPermissionsSet,
+				Id:      e.id.String(),
+				Channel: ch,
+				Read:    perm.read,
+				Write:   perm.write,
+			})
+			ing.stepDone(step)
 			doneChannels[ch] = true
 		}
 	}
-	// TODO transfer common-info too.
+}
+
+// transferCommonInfo updates the common-info of the base entity in the
+// destination, which is currently destBaseEntity, to match the source.
+func (ing *ingester) transferCommonInfo(e *whitelistBaseEntity, destBaseEntity *baseEntityInfo) {
+	// All the entities share the same common-info, so
+	// any of them will do.
+	entity := e.firstEntity()
+	if entity == nil {
+		return
+	}
+	commonInfo := metadataChanges(entity.commonInfo, destBaseEntity.commonInfo)
+	if len(commonInfo) == 0 {
+		return
+	}
+	ing.logf("updating common-info for %v", e.baseId)
+	if err := ing.params.dest.putCommonInfo(ing.params.ctx, entity.id, commonInfo); err != nil {
+		ing.entityErrorf(e.baseId.String(), err, "failed to set common-info for %q: %v", e.baseId, err)
+	}
 }
 
 // isDefaultPerm reports whether the permissions are the default
@@ -448,89 +1033,120 @@ func (ing *ingester) isDefaultPerm(id *charm.URL, perm permission) bool {
 		perm.write[0] == id.User
 }
 
-// transferResources transfers all the resources specified in the base entities.
-func (ing *ingester) transferResources(bes map[string]*whitelistBaseEntity) int {
-	// resourceId uniquely identifies a specific revision of a specific resource in the store.
-	type resourceId struct {
-		// id holds the base URL associated with the resource.
-		id           string
-		resourceName string
-		rev          int
-	}
-	done := make(map[resourceId]bool)
-	for _, be := range bes {
-		be := be
-		for _, e := range be.entities {
-			ing.logf("base entity %v has resources %#v", e.id, e.resources)
-			e := e
-			for name, revs := range e.resources {
-				name, revs := name, revs
-				for _, rev := range revs {
-					rev := rev
-					rid := resourceId{
-						id:           baseEntityId(e.id).String(),
-						resourceName: name,
-						rev:          rev,
-					}
-					if done[rid] {
-						continue
-					}
-					done[rid] = true
-					ing.limiter.do(func() {
-						ing.transferResource(e.id, name, rev)
-					})
-				}
-			}
+// needResource reports whether the given resource revision for e
+// needs to be copied to the destination.
+func (ing *ingester) needResource(e *entityInfo, resourceName string, rev int) bool {
+	id := e.id
+	step := resourceStep(id, resourceName, rev)
+	done := ing.params.journal.isDone(step)
+	if !done {
+		_, err := ing.params.dest.resourceInfo(ing.params.ctx, id, resourceName, rev)
+		if err != nil && errgo.Cause(err) != errNotFound {
+			ing.entityErrorf(id.String(), err, "%v", err)
+			return false
 		}
+		done = err == nil
 	}
-	ing.limiter.wait()
-	return len(done)
-}
-
-func (ing *ingester) transferResource(id *charm.URL, resourceName string, rev int) {
-	_, err := ing.params.dest.resourceInfo(id, resourceName, rev)
-	if err == nil {
+	if done {
 		ing.logf("resource %v %v-%v has already been transferred", id, resourceName, rev)
 		// The resource has already been transferred.
-		return
+		ing.mu.Lock()
+		ing.resourcesPresent++
+		ing.mu.Unlock()
+		ing.stepDone(step)
+		return false
 	}
-	if errgo.Cause(err) != errNotFound {
-		ing.errorf("%v", err)
+	return true
+}
+
+// putResource uploads the given resource revision for e to the
+// destination, reading its content from r. In a dry run,
+// r is nil and nothing is read.
+func (ing *ingester) putResource(e *entityInfo, resourceName string, rev int, r io.ReaderAt, size int64) {
+	id := e.id
+	ing.logf("putResource %v/%v/%v: size %v", id, resourceName, rev, size)
+	if err := ing.params.dest.putResource(ing.params.ctx, id, resourceName, rev, r, size); err != nil {
+		ing.entityErrorf(id.String(), err, "cannot put resource %v/%v-%d: %v", id, resourceName, rev, err)
 		return
 	}
-	r, size, err := ing.params.src.getResource(id, resourceName, rev)
+	ing.stepDone(resourceStep(id, resourceName, rev))
+	ing.resourceCopied(e, resourceName, rev, size)
+}
+
+// transferImageResource transfers a container image resource. Images held
+// in the source charmstore's registry are copied directly to the destination
+// charmstore's registry; images held in external registries are not copied,
+// and the destination refers to the same image.
+func (ing *ingester) transferImageResource(e *entityInfo, resourceName string, rev int, step journalEntry) {
+	id := e.id
+	src, err := ing.params.src.dockerResourceDownloadInfo(ing.params.ctx, id, resourceName, rev)
 	if err != nil {
-		ing.errorf("cannot get resource %v/%v-%d: %v", id, resourceName, rev, err)
+		ing.entityErrorf(id.String(), err, "cannot get download info for resource %v/%v-%d: %v", id, resourceName, rev, err)
 		return
 	}
-	f, err := ing.getDisk(size)
-	if err != nil {
-		ing.errorf("cannot make temp file for resource %v/%v/%d: %v", id, resourceName, rev, err)
+	imageName, digest := splitDigest(src.imageName)
+	if digest == "" {
+		ing.entityErrorf(id.String(), nil, "no digest for resource %v/%v-%d in image name %q", id, resourceName, rev, src.imageName)
 		return
 	}
-	defer f.Close()
-	ing.logf("transferring resource %v %v/%d", id, resourceName, rev)
-	// Allow one extra byte so that we know if the size is too big for some reason.
-	n, err := io.Copy(f, io.LimitReader(r, size+1))
-	if err != nil {
-		ing.errorf("failed to copy resource %v/%v/%v: %v", id, resourceName, rev, err)
-		return
+	var size int64
+	if src.external {
+		ing.logf("resource %v %v/%d refers to external image %s", id, resourceName, rev, src.imageName)
+	} else {
+		dest, err := ing.params.dest.dockerResourceUploadInfo(ing.params.ctx, id, resourceName)
+		if err != nil {
+			ing.entityErrorf(id.String(), err, "cannot get upload info for resource %v/%v-%d: %v", id, resourceName, rev, err)
+			return
+		}
+		ing.logf("copying image for resource %v %v/%d from %s to %s", id, resourceName, rev, src.imageName, dest.imageName)
+		// Blobs that have already been copied are skipped,
+		// so it's OK to retry the whole copy.
+		err = ing.retry(ing.params.ctx, fmt.Sprintf("copy image for resource %v/%s/%d", id, resourceName, rev), func() error {
+			var err error
+			_, size, err = ing.registry.copyImage(ing.params.ctx, src, dest)
+			return err
+		})
+		if err != nil {
+			ing.entityErrorf(id.String(), err, "cannot copy image for resource %v/%v-%d: %v", id, resourceName, rev, err)
+			return
+		}
+		// The image has been pushed to the location given
+		// by the destination, so no name is needed.
+		imageName = ""
 	}
-	if n != size {
-		ing.errorf("%v/%v/%v: %v", id, resourceName, rev, io.ErrUnexpectedEOF)
+	if err := ing.params.dest.putDockerResource(ing.params.ctx, id, resourceName, rev, imageName, digest); err != nil {
+		ing.entityErrorf(id.String(), err, "cannot put resource %v/%v-%d: %v", id, resourceName, rev, err)
 		return
 	}
-	ing.logf("putResource %v/%v/%v: size %v", id, resourceName, rev, size)
-	if err := ing.params.dest.putResource(id, resourceName, rev, f, size); err != nil {
-		ing.errorf("cannot put resource %v/%v-%d: %v", id, resourceName, rev, err)
-	}
+	ing.stepDone(step)
+	ing.resourceCopied(e, resourceName, rev, size)
+}
+
+// resourceCopied records that the given resource has been
+// copied for the entity e.
+func (ing *ingester) resourceCopied(e *entityInfo, resourceName string, rev int, size int64) {
+	ing.mu.Lock()
+	ing.resourcesCopied++
+	e.resourcesCopied++
+	e.bytesCopied += size
+	ing.mu.Unlock()
+	ing.notify(Event{
+		Kind:      EventResourceTransferred,
+		Id:        e.id.String(),
+		Resources: map[string]int{resourceName: rev},
+		Bytes:     size,
+	})
 }
 
 // stats returns statistics about transferred charmstore entities.
 func (ing *ingester) stats(es map[string]*whitelistBaseEntity) IngestStats {
 	stats := IngestStats{
-		BaseEntityCount: len(es),
-		Errors:          ing.errors,
+		BaseEntityCount:       len(es),
+		ResourcesCopiedCount:  ing.resourcesCopied,
+		ResourcesPresentCount: ing.resourcesPresent,
+		Errors:                ing.errors,
+		RetryCount:            ing.retryCount,
+		Entities:              ing.entityReports(es),
 	}
 	for _, baseEntity := range es {
 		stats.EntityCount += len(baseEntity.entities)
@@ -542,36 +1158,60 @@ func (ing *ingester) stats(es map[string]*whitelistBaseEntity) IngestStats {
 			if e.archiveCopied {
 				stats.ArchivesCopiedCount++
 			}
+			if e.archivePresent {
+				stats.ArchivesPresentCount++
+			}
+			stats.BytesCopied += e.bytesCopied
 		}
 	}
 	return stats
 }
 
-func (ing *ingester) transferEntity(e *entityInfo) {
+// needArchive reports whether the archive for e needs to be
+// copied to the destination. If the entity is already there,
+// the rest of it is transferred instead.
+func (ing *ingester) needArchive(e *entityInfo) bool {
 	ing.logf("transferring entity %v", e.id)
-
-	// TODO retry a couple of times if this fails with a temporary-looking error?
+	if ing.params.journal.isDone(archiveStep(e)) {
+		// The entity was transferred by an earlier ingest;
+		// it only remains to publish it.
+		ing.logf("archive for %v has already been transferred", e.id)
+		e.archivePresent = true
+		return false
+	}
 
 	// First find out whether the entity already exists in the destination charmstore.
 	// If so, we only need to transfer metadata.
 
 	// Use NoChannel which picks an appropriate published channel to use
 	// for ACL checking.
-	destEntity, err := ing.params.dest.entityInfo(params.NoChannel, e.id)
+	destEntity, err := ing.params.dest.entityInfo(ing.params.ctx, params.NoChannel, e.id)
 	if err == nil {
 		ing.transferExistingEntity(e, destEntity)
-		return
+		return false
 	}
 	if errgo.Cause(err) != errNotFound {
-		ing.errorf("failed to get information from destination charmstore on %q: %v", e.id, err)
-		return
+		ing.entityErrorf(e.id.String(), err, "failed to get information from destination charmstore on %q: %v", e.id, err)
+		return false
 	}
+	return true
+}
 
-	// The entity doesn't exist in the destination, so copy it.
-
+// putArchive uploads the archive for e to the destination along
+// with its extra-info, reading the archive from the reader
+// returned by open.
+func (ing *ingester) putArchive(e *entityInfo, open func() (io.ReadCloser, error)) {
+	downloading := false
 	sr := &seekReopener{
 		open: func() (io.ReadCloser, error) {
-			return ing.params.src.getArchive(e.id)
+			if !downloading {
+				downloading = true
+				ing.notify(Event{
+					Kind: EventArchiveDownloadStarted,
+					Id:   e.id.String(),
+				})
+			}
+			return open()
 		},
 	}
 	defer sr.Close()
@@ -586,14 +1226,31 @@ func (ing *ingester) transferEntity(e *entityInfo) {
 	for ch, _ := range e.channels {
 		chans = append(chans, ch)
 	}
-	if err := ing.params.dest.putArchive(e.id, sr, e.hash, e.archiveSize, promulgatedRevision, chans); err != nil {
-		ing.errorf("failed to upload archive for %v: %v", e.id, err)
+	archiveErr := ing.params.dest.putArchive(ing.params.ctx, e.id, sr, e.hash, e.archiveSize, promulgatedRevision, chans, e.uploadTime)
+	// Close the source archive now so that we aren't holding
+	// on to a source operation while making destination
+	// operations.
+	sr.Close()
+	if archiveErr != nil {
+		ing.entityErrorf(e.id.String(), archiveErr, "failed to upload archive for %v: %v", e.id, archiveErr)
+		return
+	}
+	if downloading {
+		ing.mu.Lock()
+		e.bytesCopied += sr.n
+		ing.mu.Unlock()
+		ing.notify(Event{
+			Kind:  EventArchiveDownloadFinished,
+			Id:    e.id.String(),
+			Bytes: sr.n,
+		})
 	}
 	e.archiveCopied = true
-	if err := ing.params.dest.putExtraInfo(e.id, e.extraInfo); err != nil {
-		ing.errorf("failed to set extra-info for %q: %v", e.id, err)
+	if err := ing.params.dest.putExtraInfo(ing.params.ctx, e.id, e.extraInfo); err != nil {
+		ing.entityErrorf(e.id.String(), err, "failed to set extra-info for %q: %v", e.id, err)
 		return
 	}
+	ing.stepDone(archiveStep(e))
 }
 
 func (ing *ingester) publishEntity(e *entityInfo) error {
@@ -604,9 +1261,20 @@ func (ing *ingester) publishEntity(e *entityInfo) error {
 		if !current {
 			continue
 		}
-		if err := ing.params.dest.publish(e.id, []params.Channel{ch}, e.publishedResources[ch]); err != nil {
+		step := publishStep(e, ch, e.publishedResources[ch])
+		if ing.params.journal.isDone(step) {
+			continue
+		}
+		if err := ing.params.dest.publish(ing.params.ctx, e.id, []params.Channel{ch}, e.publishedResources[ch]); err != nil {
 			return errgo.Notef(err, "cannot publish %q to %v", e.id, ch)
 		}
+		ing.stepDone(step)
+		ing.notify(Event{
+			Kind:      EventPublished,
+			Id:        e.id.String(),
+			Channel:   ch,
+			Resources: e.publishedResources[ch],
+		})
 	}
 	return nil
 }
@@ -616,33 +1284,23 @@ func (ing *ingester) publishEntity(e *entityInfo) error {
 func (ing *ingester) transferExistingEntity(e, destEntity *entityInfo) {
 	// The destination entity already exists. Make sure that it looks like what we want to transfer.
 	if destEntity.archiveSize != e.archiveSize {
-		ing.errorf("%q already exists with different size (want %v got %v)", e.id, e.archiveSize, destEntity.archiveSize)
+		ing.entityErrorf(e.id.String(), errHashMismatch, "%q already exists with different size (want %v got %v)", e.id, e.archiveSize, destEntity.archiveSize)
 		return
 	}
 	if destEntity.hash != e.hash {
-		ing.errorf("%q already exists with different hash (want %v got %v)", e.id, e.hash, destEntity.hash)
+		ing.entityErrorf(e.id.String(), errHashMismatch, "%q already exists with different hash (want %v got %v)", e.id, e.hash, destEntity.hash)
 		return
 	}
+	e.archivePresent = true
 	// Archive content looks good. Now check metadata.
-	extraInfo := make(map[string]json.RawMessage)
-	// Add fields that have changed.
-	for k, v := range e.extraInfo {
-		if !bytes.Equal(destEntity.extraInfo[k], v) {
-			extraInfo[k] = v
-		}
-	}
-	// Add nil entries for fields that exist in destination but not in source.
-	for k := range destEntity.extraInfo {
-		if _, ok := e.extraInfo[k]; !ok {
-			extraInfo[k] = nil
-		}
-	}
+	extraInfo := metadataChanges(e.extraInfo, destEntity.extraInfo)
 	if len(extraInfo) > 0 {
-		if err := ing.params.dest.putExtraInfo(e.id, extraInfo); err != nil {
-			ing.errorf("failed to set extra-info for %q: %v", e.id, err)
+		if err := ing.params.dest.putExtraInfo(ing.params.ctx, e.id, extraInfo); err != nil {
+			ing.entityErrorf(e.id.String(), err, "failed to set extra-info for %q: %v", e.id, err)
 			return
 		}
 	}
+	ing.stepDone(archiveStep(e))
 
 	// Now publish the entity to its required channels if necessary.
 	// Note that the charm store API doesn't provide any way to
@@ -650,28 +1308,91 @@ func (ing *ingester) transferExistingEntity(e, destEntity *entityInfo) {
 	// charmstore having moved the published entity for a channel to a new
 	// revision.
 	if err := ing.publishEntity(e); err != nil {
-		ing.errorf("%v", err)
+		ing.entityErrorf(e.id.String(), err, "%v", err)
 		return
 	}
 	e.synced = true
 	return
 }
 
+// metadataChanges returns the changes needed to make the metadata
+// in dest the same as that in src, suitable for passing to
+// csClient.putExtraInfo or csClient.putCommonInfo.
+func metadataChanges(src, dest map[string]json.RawMessage) map[string]json.RawMessage {
+	changes := make(map[string]json.RawMessage)
+	// Add fields that have changed.
+	for k, v := range src {
+		if !bytes.Equal(dest[k], v) {
+			changes[k] = v
+		}
+	}
+	// Add nil entries for fields that exist in destination but not in source.
+	for k := range dest {
+		if _, ok := src[k]; !ok {
+			changes[k] = nil
+		}
+	}
+	return changes
+}
+
 func (ing *ingester) logf(f string, a ...interface{}) {
 	if ing.params.log != nil {
 		ing.params.log(fmt.Sprintf(f, a...))
 	}
 }
 
+// errorf records an error that doesn't relate to any
+// particular entity.
 func (ing *ingester) errorf(f string, a ...interface{}) {
+	ing.entityErrorf("", nil, f, a...)
+}
+
+// entityErrorf records an error relating to the entity with the
+// given id. The kind of the error is determined from err, which
+// may be nil.
+//
+// Errors found once the ingest has been interrupted are almost
+// certainly caused by the interruption, which is reported on its
+// own, so they're only logged.
+func (ing *ingester) entityErrorf(id string, err error, f string, a ...interface{}) {
+	msg := fmt.Sprintf(f, a...)
+	if ing.params.ctx.Err() != nil {
+		ing.logf("%s", msg)
+		return
+	}
+	ing.addError(id, err, msg)
+}
+
+// addError records the given error message.
+// See entityErrorf.
+func (ing *ingester) addError(id string, err error, msg string) {
 	ing.mu.Lock()
-	defer ing.mu.Unlock()
-	ing.errors = append(ing.errors, fmt.Sprintf(f, a...))
+	ing.errors = append(ing.errors, msg)
+	if id != "" {
+		if ing.entityErrors == nil {
+			ing.entityErrors = make(map[string][]IngestError)
+		}
+		ing.entityErrors[id] = append(ing.entityErrors[id], IngestError{
+			Id:      id,
+			Kind:    errorKind(err),
+			Message: msg,
+		})
+	}
+	ing.mu.Unlock()
+	ing.notify(Event{
+		Kind:  EventError,
+		Id:    id,
+		Error: msg,
+	})
 }
 
 // resolveWhitelist resolves all the whitelisted entities into a
 // map from base entity URL to the revisions to sync for that entity.
 func (ing *ingester) resolveWhitelist(entities []WhitelistEntity) map[string]*whitelistBaseEntity {
+	// Pin the entities that name a source before resolving
+	// anything, so that they aren't found in another source
+	// first by way of another entry or a bundle.
+	entities = ing.pinSources(entities)
 	c := make(chan *entityInfo)
 	go func() {
 		defer close(c)
@@ -714,19 +1435,39 @@ func (ing *ingester) resolveWhitelist(entities []WhitelistEntity) map[string]*wh
 			for ch, current := range e.channels {
 				entity.channels[ch] = current || entity.channels[ch]
 			}
+			entity.skipResources = entity.skipResources && e.skipResources
+			entity.requiredBy = append(entity.requiredBy, e.requiredBy...)
 			// Add information about any more resource revisions.
 			entity.resources = appendResources(entity.resources, e.resources)
 			entity.publishedResources = addPublishedResources(entity.publishedResources, e.publishedResources)
 		}
 	}
 	// Sort all resource revisions so that we're deterministic.
+	var resolved []*entityInfo
 	for _, be := range baseEntities {
 		for _, e := range be.entities {
 			for _, revs := range e.resources {
 				sort.Ints(revs)
 			}
+			sortBundleDependencies(e.requiredBy)
+			resolved = append(resolved, e)
 		}
 	}
+	sort.Slice(resolved, func(i, j int) bool {
+		return resolved[i].id.String() < resolved[j].id.String()
+	})
+	for _, e := range resolved {
+		chans := make([]params.Channel, 0, len(e.channels))
+		for ch := range e.channels {
+			chans = append(chans, ch)
+		}
+		ing.notify(Event{
+			Kind:     EventEntityResolved,
+			Id:       e.id.String(),
+			Channels: sortedChannels(chans),
+			Source:   e.source,
+		})
+	}
 	return baseEntities
 }
 
@@ -776,8 +1517,21 @@ func (ing *ingester) sendResolvedURLs(e WhitelistEntity, c chan<- *entityInfo) {
 		// Default to the stable channel when none is specified.
 		e.Channels = []params.Channel{params.StableChannel}
 	}
-	if err := ing.sendResolvedURLs1(e, false, c); err != nil {
-		ing.errorf("%v", err)
+	if !isPattern(e.EntityId) {
+		if err := ing.sendResolvedURLs1(e, false, c); err != nil {
+			ing.entityErrorf(e.EntityId, err, "%v", err)
+		}
+		return
+	}
+	entities, err := ing.expandPattern(e)
+	if err != nil {
+		ing.entityErrorf(e.EntityId, err, "%v", err)
+		return
+	}
+	for _, e := range entities {
+		if err := ing.sendResolvedURLs1(e, false, c); err != nil {
+			ing.entityErrorf(e.EntityId, err, "%v", err)
+		}
 	}
 }
 
@@ -788,14 +1542,12 @@ func (ing *ingester) sendResolvedURLs1(e WhitelistEntity, mustBeCharm bool, c ch
 		return errgo.Mask(err)
 	}
 	if len(e.Channels) == 0 {
-		// TODO we'll need to find the most appropriate channel
-		// for the entity. This happens when the entity is a charm referred to
-		// by a bundle.
 		return errgo.Newf("no channels for entity %q", e.EntityId)
 	}
-	needChannels := make(map[params.Channel]bool)
-	for _, ch := range e.Channels {
-		needChannels[ch] = true
+	if e.Source != "" {
+		if err := ing.pinSource(e.Source, curl); err != nil {
+			return errgo.Mask(err)
+		}
 	}
 	// Go through all the requested channels, trying to look up the entity
 	// (if the entity has never been published in a channel, we won't
@@ -803,97 +1555,277 @@ func (ing *ingester) sendResolvedURLs1(e WhitelistEntity, mustBeCharm bool, c ch
 	// revision number).
 	for _, ch := range e.Channels {
 		ing.limiter.start()
-		result, err := ing.params.src.entityInfo(ch, curl)
+		result, err := ing.params.src.entityInfo(ing.params.ctx, ch, curl)
 		ing.limiter.stop()
 		if err != nil {
 			if errgo.Cause(err) == errNotFound {
 				// The user has tried to whitelist a charm that's not in
 				// the channel they mentioned.
-				ing.errorf("entity %q is not available in %v channel", e.EntityId, ch)
+				ing.entityErrorf(e.EntityId, err, "entity %q is not available in %v channel", e.EntityId, ch)
 				continue
 			}
 			return errgo.Mask(err)
 		}
-		// Go through the published channels, finding out if any of them
-		// are mentioned on the requested channels. If so, we'll include the
-		// entity in that channel.
-		for pch := range result.channels {
-			if !needChannels[pch] {
-				delete(result.channels, pch)
-				continue
+		id := result.id
+		if err := ing.sendResolvedURL(e, curl, ch, result, mustBeCharm, c); err != nil {
+			return errgo.Mask(err)
+		}
+		if curl.Revision == -1 && (e.History > 1 || !e.Since.IsZero()) {
+			if err := ing.sendHistory(e, ch, id, mustBeCharm, c); err != nil {
+				return errgo.Mask(err)
 			}
-			if curl.Revision != -1 {
-				// We only release a charm as the current version for a channel
-				// when the revision hasn't been explicitly specified.
-				result.channels[pch] = false
+		}
+	}
+	return nil
+}
+
+// sendHistory sends the revisions of the entity with the given id
+// that were published in the given channel before it to c, as
+// selected by the History, Since and MaxHistorySize fields of e.
+func (ing *ingester) sendHistory(e WhitelistEntity, ch params.Channel, id *charm.URL, mustBeCharm bool, c chan<- *entityInfo) error {
+	ing.limiter.start()
+	revs, err := ing.params.src.revisions(ing.params.ctx, ch, id)
+	ing.limiter.stop()
+	if err != nil {
+		return errgo.Notef(err, "cannot get revisions of %v in %v channel", id, ch)
+	}
+	count := 1
+	var size int64
+	seenResources := make(map[string]bool)
+	for _, rev := range revs {
+		if e.History > 0 && count >= e.History {
+			break
+		}
+		if rev.Revision >= id.Revision {
+			continue
+		}
+		ing.limiter.start()
+		result, err := ing.params.src.entityInfo(ing.params.ctx, ch, rev)
+		ing.limiter.stop()
+		if err != nil {
+			return errgo.Notef(err, "cannot get info on %v", rev)
+		}
+		if !e.Since.IsZero() && !result.uploadTime.IsZero() && result.uploadTime.Before(e.Since) {
+			// The revisions are in upload order, so all the
+			// rest are older too.
+			break
+		}
+		if e.MaxHistorySize > 0 {
+			revSize, err := ing.revisionSize(result, e.SkipResources, seenResources)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if size+revSize > e.MaxHistorySize {
+				ing.logf("not copying %v or earlier revisions in %v channel: history would be larger than %d bytes", result.id, ch, e.MaxHistorySize)
+				break
 			}
+			size += revSize
 		}
-		// All the resources returned by entityInfo are current for their channel,
-		// so add them to publishedResources.
-		if len(result.resources) > 0 {
-			currentResources := make(map[string]int)
-			for resourceName, revs := range result.resources {
-				if len(revs) > 0 {
-					currentResources[resourceName] = revs[0]
-				}
+		ing.logf("copying %v as history for %v in %v channel", result.id, id, ch)
+		if err := ing.sendResolvedURL(e, rev, ch, result, mustBeCharm, c); err != nil {
+			return errgo.Mask(err)
+		}
+		count++
+	}
+	return nil
+}
+
+// revisionSize returns the total size of the archive and resources
+// of the given entity. Resources that are in seen are not counted,
+// and the resources that are counted are added to it.
+func (ing *ingester) revisionSize(e *entityInfo, skipResources bool, seen map[string]bool) (int64, error) {
+	size := e.archiveSize
+	if skipResources {
+		return size, nil
+	}
+	for name, revs := range e.resources {
+		for _, rev := range revs {
+			key := fmt.Sprintf("%s/%d", name, rev)
+			if seen[key] {
+				continue
 			}
-			result.publishedResources = map[params.Channel]map[string]int{
-				ch: currentResources,
+			ing.limiter.start()
+			info, err := ing.params.src.resourceInfo(ing.params.ctx, e.id, name, rev)
+			ing.limiter.stop()
+			if err != nil {
+				return 0, errgo.Notef(err, "cannot get info on resource %s of %v", key, e.id)
 			}
+			seen[key] = true
+			size += info.size
 		}
-		// Add any extra resources required by the whitelisting (or by a bundle).
-		result.resources = appendResources(result.resources, e.Resources)
-		c <- result
-		if result.id.Series == "bundle" {
-			if mustBeCharm {
-				return errgo.Newf("charm URL in bundle refers to bundle (%q) not charm", curl)
+	}
+	return size, nil
+}
+
+// sendResolvedURL sends the entity in result, which has been found by
+// looking up curl in the given channel, to c, along with any charms
+// it requires if it's a bundle.
+func (ing *ingester) sendResolvedURL(e WhitelistEntity, curl *charm.URL, ch params.Channel, result *entityInfo, mustBeCharm bool, c chan<- *entityInfo) error {
+	needChannels := make(map[params.Channel]bool)
+	for _, ch := range e.Channels {
+		needChannels[ch] = true
+	}
+	// Go through the published channels, finding out if any of them
+	// are mentioned on the requested channels. If so, we'll include the
+	// entity in that channel.
+	for pch := range result.channels {
+		if !needChannels[pch] {
+			delete(result.channels, pch)
+			continue
+		}
+		if curl.Revision != -1 {
+			// We only release a charm as the current version for a channel
+			// when the revision hasn't been explicitly specified.
+			result.channels[pch] = false
+		}
+	}
+	// All the resources returned by entityInfo are current for their channel,
+	// so add them to publishedResources.
+	if len(result.resources) > 0 {
+		currentResources := make(map[string]int)
+		for resourceName, revs := range result.resources {
+			if len(revs) > 0 {
+				currentResources[resourceName] = revs[0]
 			}
-			ing.sendResolvedURLsForBundle(curl, result.bundleCharms, c)
+		}
+		result.publishedResources = map[params.Channel]map[string]int{
+			ch: currentResources,
 		}
 	}
+	// Add any extra resources required by the whitelisting (or by a bundle).
+	result.resources = appendResources(result.resources, e.Resources)
+	result.skipResources = e.SkipResources
+	c <- result
+	if result.id.Series == "bundle" {
+		if mustBeCharm {
+			return errgo.Newf("charm URL in bundle refers to bundle (%q) not charm", curl)
+		}
+		ing.sendResolvedURLsForBundle(result.id, ch, result.bundleCharms, e.SkipResources, c)
+	}
 	return nil
 }
 
-func (ing *ingester) sendResolvedURLsForBundle(curl *charm.URL, bundleCharms []bundleCharm, c chan<- *entityInfo) {
+// sendResolvedURLsForBundle sends the charms required by the bundle
+// with the given id, which was found in the given channel, to c.
+// Each charm is looked up in the bundle's channel first, and then
+// in each of the other channels in params.OrderedChannels order.
+func (ing *ingester) sendResolvedURLsForBundle(bundleId *charm.URL, bundleChannel params.Channel, bundleCharms []bundleCharm, skipResources bool, c chan<- *entityInfo) {
+	chans := bundleCharmChannels(bundleChannel)
 	for _, bc := range bundleCharms {
 		resources := make(map[string][]int)
 		for name, rev := range bc.resources {
 			resources[name] = []int{rev}
 		}
-		if err := ing.sendResolvedURLs1(WhitelistEntity{
-			EntityId: bc.charm,
-			// TODO when sendResolvedURLs supports it, send an empty
-			// Channels slice here and let it be resolved to the correct channel.
-			// For now, stable seems a reasonable compromise.
-			Channels:  []params.Channel{params.StableChannel},
-			Resources: resources,
-		}, true, c); err != nil {
-			ing.errorf("invalid charm %q in bundle %q", bc.charm, curl)
+		curl, err := charm.ParseURL(bc.charm)
+		if err != nil {
+			ing.entityErrorf(bundleId.String(), err, "invalid charm %q in bundle %q: %v", bc.charm, bundleId, err)
+			continue
+		}
+		ch, result, err := ing.findBundleCharm(curl, chans)
+		if err != nil {
+			ing.entityErrorf(bundleId.String(), err, "cannot find charm %q in bundle %q: %v", bc.charm, bundleId, err)
+			continue
+		}
+		ing.logf("found charm %v for bundle %v (%s) in %s channel", result.id, bundleId, bundleChannel, ch)
+		result.requiredBy = []BundleDependency{{
+			Bundle:        bundleId.String(),
+			BundleChannel: bundleChannel,
+			Channel:       ch,
+		}}
+		ing.notify(Event{
+			Kind:    EventBundleCharmResolved,
+			Id:      result.id.String(),
+			Channel: ch,
+			Bundle:  bundleId.String(),
+		})
+		if err := ing.sendResolvedURL(WhitelistEntity{
+			EntityId:      bc.charm,
+			Channels:      []params.Channel{ch},
+			Resources:     resources,
+			SkipResources: skipResources,
+		}, curl, ch, result, true, c); err != nil {
+			ing.entityErrorf(bundleId.String(), err, "invalid charm %q in bundle %q", bc.charm, bundleId)
+		}
+	}
+}
+
+// findBundleCharm looks up the charm with the given id in each of the
+// given channels in turn, and returns the first channel that it's
+// published in with the information on it found there.
+func (ing *ingester) findBundleCharm(curl *charm.URL, chans []params.Channel) (params.Channel, *entityInfo, error) {
+	for _, ch := range chans {
+		ing.limiter.start()
+		result, err := ing.params.src.entityInfo(ing.params.ctx, ch, curl)
+		ing.limiter.stop()
+		if errgo.Cause(err) == errNotFound {
+			continue
+		}
+		if err != nil {
+			return "", nil, errgo.Mask(err)
+		}
+		// A charm with an explicit revision can sometimes be
+		// found in channels that it's not published in.
+		if _, ok := result.channels[ch]; !ok {
+			continue
 		}
+		return ch, result, nil
+	}
+	names := make([]string, len(chans))
+	for i, ch := range chans {
+		names[i] = string(ch)
 	}
+	return "", nil, errgo.WithCausef(nil, errNotFound, "not found in any of %s", strings.Join(names, ", "))
+}
+
+// bundleCharmChannels returns the channels to look for the charms
+// of a bundle found in the given channel, in order of preference.
+func bundleCharmChannels(bundleChannel params.Channel) []params.Channel {
+	chans := []params.Channel{bundleChannel}
+	for _, ch := range params.OrderedChannels {
+		if ch != bundleChannel {
+			chans = append(chans, ch)
+		}
+	}
+	return chans
 }
 
 // getDisk waits for the given amount of disk space to become available,
-// then returns a temporary file that can be used to write that amount
+// or for the ingest to be cancelled, then returns a temporary file that can be used to write that amount
 // of data to. It is the responsibility of the caller to check that the actual
 // amount of data written is within the limit.
 //
 // The returned tempFile must be closed after use.
 //
+// It must be called while holding a limiter slot, which is
+// released while waiting for the disk space.
+//
 // At most one tempFile instance should be acquired by any
 // one goroutine at a time, otherwise deadlock might result.
 func (ing *ingester) getDisk(size int64) (*tempFile, error) {
 	if ing.diskLimiter != nil {
 		if size > ing.params.maxDisk {
 			if !ing.params.softDiskLimit {
-				return nil, errgo.Newf("too much space required (need %d, max %d)", size, ing.params.maxDisk)
+				return nil, errgo.WithCausef(nil, errDiskLimit, "too much space required (need %d, max %d)", size, ing.params.maxDisk)
 			}
 			size = ing.params.maxDisk
 		}
-		ing.diskLimiter.Acquire(context.TODO(), size)
+		if !ing.diskLimiter.TryAcquire(size) {
+			// Release the limiter slot while waiting, because
+			// the operations that are using the disk space
+			// might need a slot to finish (see each).
+			ing.limiter.stop()
+			err := ing.diskLimiter.Acquire(ing.params.ctx, size)
+			ing.limiter.start()
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
 	}
 	file, err := ioutil.TempFile(ing.params.tempDir, "")
 	if err != nil {
+		if ing.diskLimiter != nil {
+			ing.diskLimiter.Release(size)
+		}
 		return nil, errgo.Mask(err)
 	}
 	return &tempFile{
@@ -982,6 +1914,9 @@ func baseEntityId(url *charm.URL) *charm.URL {
 type seekReopener struct {
 	open func() (io.ReadCloser, error)
 	r    io.ReadCloser
+	// n holds the number of bytes read since
+	// the reader was last opened.
+	n int64
 }
 
 func (sr *seekReopener) Seek(offset int64, whence int) (int64, error) {
@@ -997,6 +1932,7 @@ func (sr *seekReopener) Seek(offset int64, whence int) (int64, error) {
 		return 0, errgo.Mask(err)
 	}
 	sr.r = r
+	sr.n = 0
 	return 0, nil
 }
 
@@ -1007,8 +1943,11 @@ func (sr *seekReopener) Read(buf []byte) (int, error) {
 			return 0, errgo.Mask(err)
 		}
 		sr.r = r
+		sr.n = 0
 	}
-	return sr.r.Read(buf)
+	n, err := sr.r.Read(buf)
+	sr.n += int64(n)
+	return n, err
 }
 
 func (sr *seekReopener) Close() error {
@@ -1,9 +1,19 @@
 package ingest
 
 import (
+	"context"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// realStatsEquals compares ingest statistics, ignoring the byte
+// counts, because the expected values in ingestTests are the sizes
+// of the fake store's archives, not those of a real charmstore.
+var realStatsEquals = qt.CmpEquals(
+	cmpopts.IgnoreFields(IngestStats{}, "BytesCopied"),
+	cmpopts.IgnoreFields(EntityReport{}, "BytesCopied"),
 )
 
 func TestIngestWithRealCharmstore(t *testing.T) {
@@ -18,24 +28,36 @@ func TestIngestWithRealCharmstore(t *testing.T) {
 			destStore := newTestCharmstore(c)
 			destStore.addEntities(c, test.dest, test.destBaseEntities)
 
-			stats := Ingest(IngestParams{
+			stats := Ingest(context.Background(), IngestParams{
 				Src:       srcStore.client,
 				Dest:      destStore.client,
 				Whitelist: test.whitelist,
 				Log:       testLogFunc(c),
 			})
-			c.Check(stats, qt.DeepEquals, test.expectStats)
+			c.Check(stats, realStatsEquals, test.expectStats)
 			destStore.assertContents(c, test.expectContents, test.expectBaseEntityContents)
 
 			// Try again; we should transfer nothing and the contents should
 			// remain the same.
-			stats = Ingest(IngestParams{
+			stats = Ingest(context.Background(), IngestParams{
 				Src:       srcStore.client,
 				Dest:      destStore.client,
 				Whitelist: test.whitelist,
 			})
 			expectStats := test.expectStats
+			expectStats.ArchivesPresentCount += expectStats.ArchivesCopiedCount
 			expectStats.ArchivesCopiedCount = 0
+			expectStats.ResourcesPresentCount += expectStats.ResourcesCopiedCount
+			expectStats.ResourcesCopiedCount = 0
+			expectStats.BytesCopied = 0
+			expectStats.Entities = nil
+			for _, r := range test.expectStats.Entities {
+				expectStats.Entities = append(expectStats.Entities, EntityReport{
+					Id:         r.Id,
+					Outcome:    OutcomePresent,
+					RequiredBy: r.RequiredBy,
+				})
+			}
 			c.Check(stats, qt.DeepEquals, expectStats)
 			destStore.assertContents(c, test.expectContents, test.expectBaseEntityContents)
 		})
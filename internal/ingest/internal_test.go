@@ -1,11 +1,30 @@
 package ingest
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp"
 	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/charmstore-client/internal/charm"
 )
@@ -321,6 +340,11 @@ var resolveWhitelistTests = []struct {
 						params.StableChannel: true,
 					},
 					hash: hashOf(""),
+					requiredBy: []BundleDependency{{
+						Bundle:        "cs:~charmers/bundle/fun-3",
+						BundleChannel: params.StableChannel,
+						Channel:       params.StableChannel,
+					}},
 				},
 			},
 		},
@@ -333,6 +357,11 @@ var resolveWhitelistTests = []struct {
 						params.StableChannel: false,
 					},
 					hash: hashOf(""),
+					requiredBy: []BundleDependency{{
+						Bundle:        "cs:~charmers/bundle/fun-3",
+						BundleChannel: params.StableChannel,
+						Channel:       params.StableChannel,
+					}},
 				},
 			},
 		},
@@ -402,6 +431,11 @@ var resolveWhitelistTests = []struct {
 						params.StableChannel: true,
 					},
 					hash: hashOf(""),
+					requiredBy: []BundleDependency{{
+						Bundle:        "cs:~charmers/bundle/fun-3",
+						BundleChannel: params.StableChannel,
+						Channel:       params.StableChannel,
+					}},
 					resources: map[string][]int{
 						"w1": {2, 3},
 						"w2": {4, 5},
@@ -424,6 +458,11 @@ var resolveWhitelistTests = []struct {
 						params.StableChannel: false,
 					},
 					hash: hashOf(""),
+					requiredBy: []BundleDependency{{
+						Bundle:        "cs:~charmers/bundle/fun-3",
+						BundleChannel: params.StableChannel,
+						Channel:       params.StableChannel,
+					}},
 					resources: map[string][]int{
 						"f": {12},
 					},
@@ -431,6 +470,235 @@ var resolveWhitelistTests = []struct {
 			},
 		},
 	},
+}, {
+	testName: "bundle_charm_channels",
+	src: []entitySpec{{
+		id:      "cs:~charmers/bundle/fun-3",
+		chans:   "*edge",
+		content: "cs:~charmers/wordpress cs:~other/bar-1 cs:~other/foo-3 cs:~other/missing-1",
+	}, {
+		id:    "cs:~charmers/wordpress-12",
+		chans: "*stable",
+	}, {
+		id:    "cs:~charmers/wordpress-13",
+		chans: "*edge",
+	}, {
+		id:    "cs:~other/foo-3",
+		chans: "stable",
+	}, {
+		id:    "cs:~other/bar-1",
+		chans: "*beta",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/bundle/fun",
+		Channels: []params.Channel{params.EdgeChannel},
+	}},
+	expect: map[string]*whitelistBaseEntity{
+		"cs:~charmers/fun": {
+			baseId: parseURL("cs:~charmers/fun"),
+			entities: map[string]*entityInfo{
+				"cs:~charmers/bundle/fun-3": {
+					id: parseURL("cs:~charmers/bundle/fun-3"),
+					channels: map[params.Channel]bool{
+						params.EdgeChannel: true,
+					},
+					bundleCharms: []bundleCharm{{
+						charm: "cs:~charmers/wordpress",
+					}, {
+						charm: "cs:~other/bar-1",
+					}, {
+						charm: "cs:~other/foo-3",
+					}, {
+						charm: "cs:~other/missing-1",
+					}},
+					archiveSize: int64(len("cs:~charmers/wordpress cs:~other/bar-1 cs:~other/foo-3 cs:~other/missing-1")),
+					hash:        hashOf("cs:~charmers/wordpress cs:~other/bar-1 cs:~other/foo-3 cs:~other/missing-1"),
+				},
+			},
+		},
+		// The bundle's own channel is preferred.
+		"cs:~charmers/wordpress": {
+			baseId: parseURL("cs:~charmers/wordpress"),
+			entities: map[string]*entityInfo{
+				"cs:~charmers/wordpress-13": {
+					id: parseURL("cs:~charmers/wordpress-13"),
+					channels: map[params.Channel]bool{
+						params.EdgeChannel: true,
+					},
+					hash: hashOf(""),
+					requiredBy: []BundleDependency{{
+						Bundle:        "cs:~charmers/bundle/fun-3",
+						BundleChannel: params.EdgeChannel,
+						Channel:       params.EdgeChannel,
+					}},
+				},
+			},
+		},
+		// Other channels are tried in order.
+		"cs:~other/foo": {
+			baseId: parseURL("cs:~other/foo"),
+			entities: map[string]*entityInfo{
+				"cs:~other/foo-3": {
+					id: parseURL("cs:~other/foo-3"),
+					channels: map[params.Channel]bool{
+						params.StableChannel: false,
+					},
+					hash: hashOf(""),
+					requiredBy: []BundleDependency{{
+						Bundle:        "cs:~charmers/bundle/fun-3",
+						BundleChannel: params.EdgeChannel,
+						Channel:       params.StableChannel,
+					}},
+				},
+			},
+		},
+		"cs:~other/bar": {
+			baseId: parseURL("cs:~other/bar"),
+			entities: map[string]*entityInfo{
+				"cs:~other/bar-1": {
+					id: parseURL("cs:~other/bar-1"),
+					channels: map[params.Channel]bool{
+						params.BetaChannel: false,
+					},
+					hash: hashOf(""),
+					requiredBy: []BundleDependency{{
+						Bundle:        "cs:~charmers/bundle/fun-3",
+						BundleChannel: params.EdgeChannel,
+						Channel:       params.BetaChannel,
+					}},
+				},
+			},
+		},
+	},
+	expectErrors: []string{
+		`cannot find charm "cs:~other/missing-1" in bundle "cs:~charmers/bundle/fun-3": not found in any of edge, stable, candidate, beta`,
+	},
+}, {
+	testName: "pattern",
+	src: []entitySpec{{
+		id:    "cs:~partner/k8s-foo-1",
+		chans: "stable",
+	}, {
+		id:    "cs:~partner/k8s-foo-2",
+		chans: "*stable *edge",
+	}, {
+		id:    "cs:~partner/k8s-bar-1",
+		chans: "*beta",
+	}, {
+		id:    "cs:~partner/k8s-test-1",
+		chans: "*stable",
+	}, {
+		id:    "cs:~partner/other-1",
+		chans: "*stable",
+	}, {
+		id:    "cs:~bob/k8s-baz-1",
+		chans: "*stable",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "cs:~partner/k8s-*",
+		Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+		Exclude:  []string{"*-test"},
+	}},
+	expect: map[string]*whitelistBaseEntity{
+		"cs:~partner/k8s-foo": {
+			baseId: parseURL("cs:~partner/k8s-foo"),
+			entities: map[string]*entityInfo{
+				"cs:~partner/k8s-foo-2": {
+					id: parseURL("cs:~partner/k8s-foo-2"),
+					channels: map[params.Channel]bool{
+						params.StableChannel: true,
+						params.EdgeChannel:   true,
+					},
+					hash: hashOf(""),
+				},
+			},
+		},
+	},
+}, {
+	testName: "pattern_with_series",
+	src: []entitySpec{{
+		id:    "cs:~partner/xenial/foo-1",
+		chans: "*stable",
+	}, {
+		id:    "cs:~partner/trusty/foo-1",
+		chans: "*stable",
+	}, {
+		id:    "cs:~partner/bionic/bar-3",
+		chans: "*stable",
+	}, {
+		id:              "cs:~partner/baz-2",
+		chans:           "*stable",
+		supportedSeries: "trusty xenial",
+	}, {
+		id:              "cs:~partner/qux-1",
+		chans:           "*stable",
+		supportedSeries: "trusty",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "cs:~partner/*",
+		Series:   []string{"xenial", "bionic"},
+	}},
+	expect: map[string]*whitelistBaseEntity{
+		"cs:~partner/bar": {
+			baseId: parseURL("cs:~partner/bar"),
+			entities: map[string]*entityInfo{
+				"cs:~partner/bionic/bar-3": {
+					id: parseURL("cs:~partner/bionic/bar-3"),
+					channels: map[params.Channel]bool{
+						params.StableChannel: true,
+					},
+					hash: hashOf(""),
+				},
+			},
+		},
+		"cs:~partner/baz": {
+			baseId: parseURL("cs:~partner/baz"),
+			entities: map[string]*entityInfo{
+				"cs:~partner/baz-2": {
+					id: parseURL("cs:~partner/baz-2"),
+					channels: map[params.Channel]bool{
+						params.StableChannel: true,
+					},
+					hash:            hashOf(""),
+					supportedSeries: []string{"trusty", "xenial"},
+				},
+			},
+		},
+		"cs:~partner/foo": {
+			baseId: parseURL("cs:~partner/foo"),
+			entities: map[string]*entityInfo{
+				"cs:~partner/xenial/foo-1": {
+					id: parseURL("cs:~partner/xenial/foo-1"),
+					channels: map[params.Channel]bool{
+						params.StableChannel: true,
+					},
+					hash: hashOf(""),
+				},
+			},
+		},
+	},
+}, {
+	testName: "pattern_with_no_matches",
+	src: []entitySpec{{
+		id:    "cs:~partner/foo-1",
+		chans: "*stable",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "cs:~partner/k8s-*",
+	}},
+	expect: map[string]*whitelistBaseEntity{},
+	expectErrors: []string{
+		`no entities match "cs:~partner/k8s-*"`,
+	},
+}, {
+	testName: "invalid_pattern",
+	whitelist: []WhitelistEntity{{
+		EntityId: "cs:k8s-*",
+	}},
+	expect: map[string]*whitelistBaseEntity{},
+	expectErrors: []string{
+		`pattern "cs:k8s-*" must specify an owner`,
+	},
 }}
 
 func TestResolveWhitelist(t *testing.T) {
@@ -439,6 +707,7 @@ func TestResolveWhitelist(t *testing.T) {
 		c.Run(test.testName, func(c *qt.C) {
 			ing := &ingester{
 				params: ingestParams{
+					ctx: context.Background(),
 					src: newFakeCharmStore(test.src, test.srcBaseEntities),
 					log: testLogFunc(c),
 				},
@@ -478,6 +747,12 @@ var ingestTests = []struct {
 		BaseEntityCount:     1,
 		EntityCount:         1,
 		ArchivesCopiedCount: 1,
+		BytesCopied:         10,
+		Entities: []EntityReport{{
+			Id:          "cs:~charmers/wordpress-4",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 10,
+		}},
 	},
 	expectContents: []entitySpec{{
 		id:        "cs:~charmers/wordpress-4",
@@ -506,9 +781,14 @@ var ingestTests = []struct {
 		Channels: []params.Channel{params.StableChannel},
 	}},
 	expectStats: IngestStats{
-		BaseEntityCount:     1,
-		EntityCount:         1,
-		ArchivesCopiedCount: 0,
+		BaseEntityCount:      1,
+		EntityCount:          1,
+		ArchivesCopiedCount:  0,
+		ArchivesPresentCount: 1,
+		Entities: []EntityReport{{
+			Id:      "cs:~charmers/wordpress-4",
+			Outcome: OutcomePresent,
+		}},
 	},
 	expectContents: []entitySpec{{
 		id:      "cs:~charmers/wordpress-4",
@@ -536,9 +816,14 @@ var ingestTests = []struct {
 		Channels: []params.Channel{params.StableChannel},
 	}},
 	expectStats: IngestStats{
-		BaseEntityCount:     1,
-		EntityCount:         1,
-		ArchivesCopiedCount: 0,
+		BaseEntityCount:      1,
+		EntityCount:          1,
+		ArchivesCopiedCount:  0,
+		ArchivesPresentCount: 1,
+		Entities: []EntityReport{{
+			Id:      "cs:~charmers/wordpress-4",
+			Outcome: OutcomePresent,
+		}},
 	},
 	expectContents: []entitySpec{{
 		id:      "cs:~charmers/wordpress-4",
@@ -568,9 +853,14 @@ var ingestTests = []struct {
 		Channels: []params.Channel{params.StableChannel},
 	}},
 	expectStats: IngestStats{
-		BaseEntityCount:     1,
-		EntityCount:         1,
-		ArchivesCopiedCount: 0,
+		BaseEntityCount:      1,
+		EntityCount:          1,
+		ArchivesCopiedCount:  0,
+		ArchivesPresentCount: 1,
+		Entities: []EntityReport{{
+			Id:      "cs:~charmers/wordpress-4",
+			Outcome: OutcomePresent,
+		}},
 	},
 	expectContents: []entitySpec{{
 		id:        "cs:~charmers/wordpress-4",
@@ -582,6 +872,85 @@ var ingestTests = []struct {
 		id:    "cs:~charmers/wordpress",
 		perms: []string{"stable everyone admin"},
 	}},
+}, {
+	testName: "copy_common_info",
+	src: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	srcBaseEntities: []baseEntitySpec{{
+		id:         "cs:~charmers/wordpress",
+		commonInfo: `{"bugs-url":"http://bugs.example.com","homepage":"http://example.com"}`,
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectStats: IngestStats{
+		BaseEntityCount:     1,
+		EntityCount:         1,
+		ArchivesCopiedCount: 1,
+		BytesCopied:         10,
+		Entities: []EntityReport{{
+			Id:          "cs:~charmers/wordpress-4",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 10,
+		}},
+	},
+	expectContents: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:         "cs:~charmers/wordpress",
+		perms:      []string{"stable everyone admin"},
+		commonInfo: `{"bugs-url":"http://bugs.example.com","homepage":"http://example.com"}`,
+	}},
+}, {
+	testName: "copy_one_already_exists_with_different_common_info",
+	src: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	srcBaseEntities: []baseEntitySpec{{
+		id:         "cs:~charmers/wordpress",
+		commonInfo: `{"bugs-url":"http://bugs.example.com","homepage":"http://example.com"}`,
+	}},
+	dest: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	destBaseEntities: []baseEntitySpec{{
+		id:         "cs:~charmers/wordpress",
+		commonInfo: `{"homepage":"http://old.example.com","x":"y"}`,
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectStats: IngestStats{
+		BaseEntityCount:      1,
+		EntityCount:          1,
+		ArchivesPresentCount: 1,
+		Entities: []EntityReport{{
+			Id:      "cs:~charmers/wordpress-4",
+			Outcome: OutcomePresent,
+		}},
+	},
+	expectContents: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:         "cs:~charmers/wordpress",
+		perms:      []string{"stable everyone admin"},
+		commonInfo: `{"bugs-url":"http://bugs.example.com","homepage":"http://example.com"}`,
+	}},
 }, {
 	testName: "copy_with_resources",
 	src: []entitySpec{{
@@ -607,11 +976,18 @@ var ingestTests = []struct {
 		Channels: []params.Channel{params.StableChannel},
 	}},
 	expectStats: IngestStats{
-		BaseEntityCount:     1,
-		EntityCount:         1,
-		ArchivesCopiedCount: 1,
-		ResourceCount:       2,
-		// ResourcesCopiedCount: 2, TODO
+		BaseEntityCount:      1,
+		EntityCount:          1,
+		ArchivesCopiedCount:  1,
+		ResourceCount:        2,
+		ResourcesCopiedCount: 2,
+		BytesCopied:          36,
+		Entities: []EntityReport{{
+			Id:              "cs:~charmers/wordpress-4",
+			Outcome:         OutcomeCopied,
+			ResourcesCopied: 2,
+			BytesCopied:     36,
+		}},
 	},
 	expectContents: []entitySpec{{
 		id:      "cs:~charmers/wordpress-4",
@@ -627,6 +1003,48 @@ var ingestTests = []struct {
 		},
 		published: "stable,bar:2,foo:0",
 	}},
+}, {
+	testName: "copy_skipping_resources",
+	src: []entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		content:   "some stuff",
+		resources: "foo bar",
+	}},
+	srcBaseEntities: []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo:0 content",
+			"bar:2": "bar:2 content",
+		},
+		published: "stable,foo:0,bar:2",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId:      "~charmers/wordpress",
+		Channels:      []params.Channel{params.StableChannel},
+		SkipResources: true,
+	}},
+	expectStats: IngestStats{
+		BaseEntityCount:     1,
+		EntityCount:         1,
+		ArchivesCopiedCount: 1,
+		BytesCopied:         10,
+		Entities: []EntityReport{{
+			Id:          "cs:~charmers/wordpress-4",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 10,
+		}},
+	},
+	expectContents: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:        "cs:~charmers/wordpress",
+		perms:     []string{"stable everyone admin"},
+		published: "stable,bar:2,foo:0",
+	}},
 }, {
 	testName: "copy_several",
 	src: []entitySpec{{
@@ -670,6 +1088,20 @@ var ingestTests = []struct {
 		BaseEntityCount:     2,
 		EntityCount:         3,
 		ArchivesCopiedCount: 3,
+		BytesCopied:         45,
+		Entities: []EntityReport{{
+			Id:          "cs:~bob/foo-1",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 7,
+		}, {
+			Id:          "cs:~charmers/wordpress-3",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 19,
+		}, {
+			Id:          "cs:~charmers/wordpress-4",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 19,
+		}},
 	},
 	expectContents: []entitySpec{{
 		id:      "cs:~bob/foo-1",
@@ -687,11 +1119,11 @@ var ingestTests = []struct {
 		content:       "wordpress content 4",
 	}},
 	expectBaseEntityContents: []baseEntitySpec{{
-		id:    "cs:~charmers/wordpress",
-		perms: []string{"beta everyone admin", "edge everyone admin", "stable everyone admin"},
-	}, {
 		id:    "cs:~bob/foo",
 		perms: []string{"stable everyone admin"},
+	}, {
+		id:    "cs:~charmers/wordpress",
+		perms: []string{"beta everyone admin", "edge everyone admin", "stable everyone admin"},
 	}},
 }, {
 	testName: "bundle",
@@ -719,6 +1151,30 @@ var ingestTests = []struct {
 		BaseEntityCount:     3,
 		EntityCount:         3,
 		ArchivesCopiedCount: 3,
+		BytesCopied:         54,
+		Entities: []EntityReport{{
+			Id:          "cs:~bob/foo-3",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 11,
+			RequiredBy: []BundleDependency{{
+				Bundle:        "cs:~charmers/bundle/wordpressbundle-4",
+				BundleChannel: params.StableChannel,
+				Channel:       params.StableChannel,
+			}},
+		}, {
+			Id:          "cs:~charmers/bundle/wordpressbundle-4",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 26,
+		}, {
+			Id:          "cs:~charmers/wordpress-2",
+			Outcome:     OutcomeCopied,
+			BytesCopied: 17,
+			RequiredBy: []BundleDependency{{
+				Bundle:        "cs:~charmers/bundle/wordpressbundle-4",
+				BundleChannel: params.StableChannel,
+				Channel:       params.StableChannel,
+			}},
+		}},
 	},
 	expectContents: []entitySpec{{
 		id:      "cs:~bob/foo-3",
@@ -736,13 +1192,13 @@ var ingestTests = []struct {
 		content:       "wordpress content",
 	}},
 	expectBaseEntityContents: []baseEntitySpec{{
-		id:    "cs:~charmers/wordpress",
+		id:    "cs:~bob/foo",
 		perms: []string{"stable everyone admin"},
 	}, {
-		id:    "cs:~charmers/wordpressbundle",
+		id:    "cs:~charmers/wordpress",
 		perms: []string{"stable everyone admin"},
 	}, {
-		id:    "cs:~bob/foo",
+		id:    "cs:~charmers/wordpressbundle",
 		perms: []string{"stable everyone admin"},
 	}},
 }}
@@ -774,7 +1230,19 @@ func TestIngest(t *testing.T) {
 				whitelist: test.whitelist,
 			})
 			expectStats := test.expectStats
+			expectStats.ArchivesPresentCount += expectStats.ArchivesCopiedCount
 			expectStats.ArchivesCopiedCount = 0
+			expectStats.ResourcesPresentCount += expectStats.ResourcesCopiedCount
+			expectStats.ResourcesCopiedCount = 0
+			expectStats.BytesCopied = 0
+			expectStats.Entities = nil
+			for _, r := range test.expectStats.Entities {
+				expectStats.Entities = append(expectStats.Entities, EntityReport{
+					Id:         r.Id,
+					Outcome:    OutcomePresent,
+					RequiredBy: r.RequiredBy,
+				})
+			}
 			c.Check(stats, qt.DeepEquals, expectStats)
 			c.Check(destStore.entityContents(), deepEquals, test.expectContents)
 			c.Check(destStore.baseEntityContents(), deepEquals, test.expectBaseEntityContents)
@@ -782,6 +1250,3162 @@ func TestIngest(t *testing.T) {
 	}
 }
 
+var dryRunTests = []struct {
+	testName        string
+	src             []entitySpec
+	srcBaseEntities []baseEntitySpec
+	dest            []entitySpec
+	whitelist       []WhitelistEntity
+	expectPlan      []EntityPlan
+}{{
+	testName: "copy_one",
+	src: []entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		content:   "some stuff",
+		extraInfo: `{"x":45,"y":"hello"}`,
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectPlan: []EntityPlan{{
+		Id:            "cs:~charmers/wordpress-4",
+		UploadArchive: true,
+		Publish: []PublishPlan{{
+			Channel: params.StableChannel,
+		}},
+		ExtraInfo: []string{"x", "y"},
+		Perms: []PermPlan{{
+			Channel: params.StableChannel,
+			Read:    []string{"everyone"},
+			Write:   []string{"admin"},
+		}},
+	}},
+}, {
+	testName: "copy_one_already_exists_with_different_extra_info",
+	src: []entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		content:   "some stuff",
+		extraInfo: `{"x":45,"y":"hello"}`,
+	}},
+	dest: []entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		content:   "some stuff",
+		extraInfo: `{"x":10,"z":"other"}`,
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectPlan: []EntityPlan{{
+		Id:        "cs:~charmers/wordpress-4",
+		ExtraInfo: []string{"x", "y", "z"},
+		Perms: []PermPlan{{
+			Channel: params.StableChannel,
+			Read:    []string{"everyone"},
+			Write:   []string{"admin"},
+		}},
+	}},
+}, {
+	testName: "copy_one_already_exists_with_different_common_info",
+	src: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	srcBaseEntities: []baseEntitySpec{{
+		id:         "cs:~charmers/wordpress",
+		commonInfo: `{"homepage":"http://example.com"}`,
+	}},
+	dest: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectPlan: []EntityPlan{{
+		Id:         "cs:~charmers/wordpress-4",
+		CommonInfo: []string{"homepage"},
+		Perms: []PermPlan{{
+			Channel: params.StableChannel,
+			Read:    []string{"everyone"},
+			Write:   []string{"admin"},
+		}},
+	}},
+}, {
+	testName: "copy_with_resources",
+	src: []entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		content:   "some stuff",
+		resources: "foo bar",
+	}},
+	srcBaseEntities: []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo:0 content",
+			"foo:1": "foo:1 content",
+			"bar:2": "bar:2 content",
+			"bar:3": "bar:3 content",
+		},
+		published: "stable,foo:0,bar:2 edge,foo:1,bar:3",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectPlan: []EntityPlan{{
+		Id:            "cs:~charmers/wordpress-4",
+		UploadArchive: true,
+		Resources: map[string][]int{
+			"foo": {0},
+			"bar": {2},
+		},
+		Publish: []PublishPlan{{
+			Channel: params.StableChannel,
+			Resources: map[string]int{
+				"foo": 0,
+				"bar": 2,
+			},
+		}},
+		Perms: []PermPlan{{
+			Channel: params.StableChannel,
+			Read:    []string{"everyone"},
+			Write:   []string{"admin"},
+		}},
+	}},
+}, {
+	testName: "bundle",
+	src: []entitySpec{{
+		id:      "cs:~bob/foo-3",
+		chans:   "*stable",
+		content: "foo content",
+	}, {
+		id:      "cs:~bob/bundle/foobundle-1",
+		chans:   "*stable",
+		content: "cs:~bob/foo-3",
+	}},
+	dest: []entitySpec{{
+		id:      "cs:~bob/foo-3",
+		chans:   "*stable",
+		content: "foo content",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~bob/bundle/foobundle",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectPlan: []EntityPlan{{
+		Id:            "cs:~bob/bundle/foobundle-1",
+		UploadArchive: true,
+		Publish: []PublishPlan{{
+			Channel: params.StableChannel,
+		}},
+		Perms: []PermPlan{{
+			Channel: params.StableChannel,
+			Read:    []string{"everyone"},
+			Write:   []string{"admin"},
+		}},
+	}, {
+		Id: "cs:~bob/foo-3",
+		Perms: []PermPlan{{
+			Channel: params.StableChannel,
+			Read:    []string{"everyone"},
+			Write:   []string{"admin"},
+		}},
+	}},
+}}
+
+func TestIngestDryRun(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range dryRunTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			srcStore := newFakeCharmStore(test.src, test.srcBaseEntities)
+			destStore := newFakeCharmStore(test.dest, nil)
+			expectContents := destStore.entityContents()
+			stats := ingest(ingestParams{
+				src:       srcStore,
+				dest:      destStore,
+				whitelist: test.whitelist,
+				log:       testLogFunc(c),
+				dryRun:    true,
+			})
+			c.Check(stats.Errors, qt.HasLen, 0)
+			c.Check(stats.Plan, qt.DeepEquals, test.expectPlan)
+			// Nothing should have changed in the destination.
+			c.Check(destStore.entityContents(), deepEquals, expectContents)
+			c.Check(destStore.baseEntityContents(), qt.HasLen, 0)
+		})
+	}
+}
+
+func TestIngestViaDirectory(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range ingestTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			dir := c.Mkdir()
+			srcStore := newFakeCharmStore(test.src, test.srcBaseEntities)
+			exportDir, err := openDirClient(dir)
+			c.Assert(err, qt.Equals, nil)
+			stats := ingest(ingestParams{
+				src:       srcStore,
+				dest:      exportDir,
+				whitelist: test.whitelist,
+				log:       testLogFunc(c),
+			})
+			c.Assert(stats.Errors, qt.HasLen, 0)
+			err = exportDir.writeWhitelist()
+			c.Assert(err, qt.Equals, nil)
+
+			// Open the directory again so that we know that
+			// everything has been stored on disk.
+			importDir, err := openDirClient(dir)
+			c.Assert(err, qt.Equals, nil)
+			whitelist, err := importDir.readWhitelist()
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(whitelist, qt.DeepEquals, exportDir.whitelist())
+
+			destStore := newFakeCharmStore(test.dest, test.destBaseEntities)
+			stats = ingest(ingestParams{
+				src:       importDir,
+				dest:      destStore,
+				whitelist: whitelist,
+				log:       testLogFunc(c),
+			})
+			c.Check(stats.Errors, qt.HasLen, 0)
+			c.Check(destStore.entityContents(), deepEquals, test.expectContents)
+			c.Check(destStore.baseEntityContents(), deepEquals, test.expectBaseEntityContents)
+		})
+	}
+}
+
+func TestIngestIntoExistingDirectory(t *testing.T) {
+	c := qt.New(t)
+	srcStore := newFakeCharmStore([]entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}}, nil)
+	dir := c.Mkdir()
+	// Leave the directory as an export that stopped before
+	// anything was published would, with an archive
+	// stored in no channels.
+	d, err := openDirClient(dir)
+	c.Assert(err, qt.Equals, nil)
+	err = d.putArchive(context.Background(), charm.MustParseURL("cs:~charmers/wordpress-4"), strings.NewReader("some stuff"), hashOf("some stuff"), int64(len("some stuff")), -1, nil, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	exportDir, err := openDirClient(dir)
+	c.Assert(err, qt.Equals, nil)
+	stats := ingest(ingestParams{
+		src:  srcStore,
+		dest: exportDir,
+		whitelist: []WhitelistEntity{{
+			EntityId: "~charmers/wordpress",
+		}},
+		log: testLogFunc(c),
+	})
+	c.Assert(stats.Errors, qt.HasLen, 0)
+
+	importDir, err := openDirClient(dir)
+	c.Assert(err, qt.Equals, nil)
+	destStore := newFakeCharmStore(nil, nil)
+	stats = ingest(ingestParams{
+		src:  importDir,
+		dest: destStore,
+		whitelist: []WhitelistEntity{{
+			EntityId: "~charmers/wordpress",
+		}},
+		log: testLogFunc(c),
+	})
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(destStore.entityContents(), deepEquals, []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}})
+}
+
+func TestDirClientResolvesDeterministically(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	dir := c.Mkdir()
+	d, err := openDirClient(dir)
+	c.Assert(err, qt.Equals, nil)
+	for _, id := range []string{
+		"cs:~bob/xenial/foo-1",
+		"cs:~bob/trusty/foo-1",
+		"cs:~bob/bionic/foo-1",
+		"cs:~bob/trusty/foo-2",
+		"cs:~bob/xenial/foo-0",
+	} {
+		content := "content of " + id
+		err := d.putArchive(ctx, parseURL(id), strings.NewReader(content), hashOf(content), int64(len(content)), -1, []params.Channel{params.StableChannel}, time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	tests := []struct {
+		id     string
+		expect string
+	}{{
+		id:     "cs:~bob/foo-1",
+		expect: "cs:~bob/bionic/foo-1",
+	}, {
+		id:     "cs:~bob/foo-2",
+		expect: "cs:~bob/trusty/foo-2",
+	}, {
+		id:     "cs:~bob/xenial/foo-1",
+		expect: "cs:~bob/xenial/foo-1",
+	}}
+	// Each time the directory is opened, the
+	// entities are held in a different order.
+	for i := 0; i < 10; i++ {
+		d, err := openDirClient(dir)
+		c.Assert(err, qt.Equals, nil)
+		for _, test := range tests {
+			e, err := d.entityInfo(ctx, params.StableChannel, parseURL(test.id))
+			c.Assert(err, qt.Equals, nil)
+			c.Check(e.id.String(), qt.Equals, test.expect, qt.Commentf("%s", test.id))
+		}
+	}
+}
+
+func TestDirClientMetadataIsCopied(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	d, err := openDirClient(c.Mkdir())
+	c.Assert(err, qt.Equals, nil)
+	id := parseURL("cs:~bob/xenial/foo-1")
+	err = d.putArchive(ctx, id, strings.NewReader("foo"), hashOf("foo"), 3, -1, []params.Channel{params.StableChannel}, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = d.publish(ctx, id, []params.Channel{params.StableChannel}, nil)
+	c.Assert(err, qt.Equals, nil)
+	err = d.putExtraInfo(ctx, id, map[string]json.RawMessage{"a": json.RawMessage(`1`)})
+	c.Assert(err, qt.Equals, nil)
+	err = d.putCommonInfo(ctx, id, map[string]json.RawMessage{"b": json.RawMessage(`2`)})
+	c.Assert(err, qt.Equals, nil)
+	e, err := d.entityInfo(ctx, params.StableChannel, id)
+	c.Assert(err, qt.Equals, nil)
+	be, err := d.getBaseEntity(ctx, id)
+	c.Assert(err, qt.Equals, nil)
+
+	// Changing the metadata in the directory doesn't change
+	// what has already been returned, so it can be used
+	// without holding the directory's lock.
+	err = d.putExtraInfo(ctx, id, map[string]json.RawMessage{"a": json.RawMessage(`3`)})
+	c.Assert(err, qt.Equals, nil)
+	err = d.putCommonInfo(ctx, id, map[string]json.RawMessage{"b": json.RawMessage(`4`)})
+	c.Assert(err, qt.Equals, nil)
+	c.Check(e.extraInfo, qt.DeepEquals, map[string]json.RawMessage{"a": json.RawMessage(`1`)})
+	c.Check(e.commonInfo, qt.DeepEquals, map[string]json.RawMessage{"b": json.RawMessage(`2`)})
+	c.Check(be.commonInfo, qt.DeepEquals, map[string]json.RawMessage{"b": json.RawMessage(`2`)})
+}
+
+func TestIngestRetriesTemporaryErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range ingestTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			srcStore := newFlakyCharmStore(newFakeCharmStore(test.src, test.srcBaseEntities))
+			destStore := newFlakyCharmStore(newFakeCharmStore(test.dest, test.destBaseEntities))
+			stats := ingest(ingestParams{
+				src:        srcStore,
+				dest:       destStore,
+				whitelist:  test.whitelist,
+				log:        testLogFunc(c),
+				retryDelay: time.Millisecond,
+			})
+			c.Check(stats.Errors, qt.HasLen, 0)
+			c.Check(stats.RetryCount > 0, qt.Equals, true)
+			c.Check(destStore.entityContents(), deepEquals, test.expectContents)
+			c.Check(destStore.baseEntityContents(), deepEquals, test.expectBaseEntityContents)
+		})
+	}
+}
+
+func TestIngestRetriesUploadsWithLostResponses(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range ingestTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			destStore := newLostResponseCharmStore(newFakeCharmStore(test.dest, test.destBaseEntities))
+			stats := ingest(ingestParams{
+				src:        newFakeCharmStore(test.src, test.srcBaseEntities),
+				dest:       destStore,
+				whitelist:  test.whitelist,
+				log:        testLogFunc(c),
+				retryDelay: time.Millisecond,
+			})
+			// The uploads aren't repeated, because the
+			// destination already has them.
+			c.Check(stats.Errors, qt.HasLen, 0)
+			c.Check(destStore.entityContents(), deepEquals, test.expectContents)
+			c.Check(destStore.baseEntityContents(), deepEquals, test.expectBaseEntityContents)
+		})
+	}
+}
+
+func TestIngestRetriesTemporaryErrorsInMultipleDestinations(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range ingestTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			var dests []*flakyCharmStore
+			for i := 0; i < 3; i++ {
+				dests = append(dests, newFlakyCharmStore(newFakeCharmStore(test.dest, test.destBaseEntities)))
+			}
+			done := make(chan IngestStats)
+			go func() {
+				// The operations for all the destinations
+				// share the only limiter slot while they're
+				// retried.
+				done <- ingest(ingestParams{
+					src:      newFlakyCharmStore(newFakeCharmStore(test.src, test.srcBaseEntities)),
+					dest:     dests[0],
+					destName: "a",
+					extraDests: []namedClient{{
+						name:   "b",
+						client: dests[1],
+					}, {
+						name:   "c",
+						client: dests[2],
+					}},
+					whitelist:   test.whitelist,
+					log:         testLogFunc(c),
+					concurrency: 1,
+					retryDelay:  time.Millisecond,
+				})
+			}()
+			var stats IngestStats
+			select {
+			case stats = <-done:
+			case <-time.After(10 * time.Second):
+				c.Fatalf("ingest did not complete")
+			}
+			c.Check(stats.Errors, qt.HasLen, 0)
+			for i, d := range dests {
+				c.Check(stats.Destinations[i].RetryCount > 0, qt.Equals, true)
+				c.Check(d.entityContents(), deepEquals, test.expectContents)
+				c.Check(d.baseEntityContents(), deepEquals, test.expectBaseEntityContents)
+			}
+		})
+	}
+}
+
+func TestRetryInEachReleasesSlot(t *testing.T) {
+	c := qt.New(t)
+	waiting := make(chan struct{})
+	var once sync.Once
+	f := newFanout(ingestParams{
+		src:      newFakeCharmStore(nil, nil),
+		dest:     newFlakyCharmStore(newFakeCharmStore(nil, nil)),
+		destName: "a",
+		extraDests: []namedClient{{
+			name:   "b",
+			client: newFakeCharmStore(nil, nil),
+		}},
+		log: func(s string) {
+			c.Logf("LOG %s", s)
+			if strings.Contains(s, "retrying in") {
+				once.Do(func() { close(waiting) })
+			}
+		},
+		concurrency: 1,
+		// The retry won't happen until ctx is cancelled.
+		retryDelay: time.Hour,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Hold the only slot, as a task does when it
+	// deals with an entity in all the destinations.
+	f.src.limiter.start()
+	var group []destEntity
+	for _, d := range f.dests {
+		group = append(group, destEntity{
+			ing: d.ing,
+			e: &entityInfo{
+				id: parseURL("cs:~bob/foo-1"),
+			},
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		each(f.src.limiter, group, func(de destEntity) {
+			_, err := de.ing.params.dest.entityInfo(ctx, params.StableChannel, de.e.id)
+			c.Check(err, qt.Not(qt.IsNil))
+		})
+	}()
+	// Another operation can run while the first
+	// destination is waiting to retry.
+	<-waiting
+	started := make(chan struct{})
+	go func() {
+		f.src.limiter.start()
+		close(started)
+		f.src.limiter.stop()
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		c.Fatalf("operation blocked by a destination waiting to retry")
+	}
+	cancel()
+	<-done
+	c.Check(f.dests[0].ing.retryCount, qt.Equals, 1)
+	c.Check(f.dests[1].ing.retryCount, qt.Equals, 0)
+	f.src.limiter.stop()
+}
+
+func TestIngestWithoutRetries(t *testing.T) {
+	c := qt.New(t)
+	test := ingestTests[0]
+	stats := ingest(ingestParams{
+		src:        newFlakyCharmStore(newFakeCharmStore(test.src, test.srcBaseEntities)),
+		dest:       newFakeCharmStore(test.dest, test.destBaseEntities),
+		whitelist:  test.whitelist,
+		log:        testLogFunc(c),
+		maxRetries: -1,
+	})
+	c.Check(stats.Errors, qt.DeepEquals, []string{
+		`cannot get entity info in stable cs:~charmers/wordpress: 502 Bad Gateway`,
+	})
+	c.Check(stats.RetryCount, qt.Equals, 0)
+}
+
+func TestIngestResume(t *testing.T) {
+	c := qt.New(t)
+	srcStore := newFakeCharmStore([]entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable *edge",
+		resources: "foo",
+		content:   "some stuff",
+	}}, []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo content",
+		},
+		published: "stable,foo:0 edge,foo:0",
+	}})
+	whitelist := []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+	}}
+	journalPath := filepath.Join(c.Mkdir(), "journal")
+	destStore := newFakeCharmStore(nil, nil)
+	ingestWithJournal := func(dest *recordingCharmStore) IngestStats {
+		j, err := openJournal(journalPath)
+		c.Assert(err, qt.Equals, nil)
+		defer j.Close()
+		return ingest(ingestParams{
+			src:        srcStore,
+			dest:       dest,
+			whitelist:  whitelist,
+			log:        testLogFunc(c),
+			maxRetries: -1,
+			journal:    j,
+		})
+	}
+
+	// The first ingest is interrupted by failing to publish.
+	dest := &recordingCharmStore{
+		fakeCharmStore: destStore,
+		fail: map[string]bool{
+			"publish cs:~charmers/wordpress-4": true,
+		},
+	}
+	stats := ingestWithJournal(dest)
+	c.Check(stats.Errors, qt.HasLen, 1)
+	c.Check(dest.recordedOps(), qt.DeepEquals, []string{
+		"get entity info cs:~charmers/wordpress-4",
+		"get resource info foo/0 cs:~charmers/wordpress-4",
+		"publish cs:~charmers/wordpress-4",
+		"put archive cs:~charmers/wordpress-4",
+		"put resource foo/0 cs:~charmers/wordpress-4",
+		"set perm in edge cs:~charmers/wordpress-4",
+		"set perm in stable cs:~charmers/wordpress-4",
+	})
+
+	// The second ingest only needs to publish.
+	dest = &recordingCharmStore{
+		fakeCharmStore: destStore,
+	}
+	stats = ingestWithJournal(dest)
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(stats.FailedEntityCount, qt.Equals, 0)
+	c.Check(dest.recordedOps(), qt.DeepEquals, []string{
+		"publish cs:~charmers/wordpress-4",
+		"publish cs:~charmers/wordpress-4",
+	})
+
+	// The destination should end up the same as it would
+	// without the interruption.
+	expectStore := newFakeCharmStore(nil, nil)
+	ingest(ingestParams{
+		src:       srcStore,
+		dest:      expectStore,
+		whitelist: whitelist,
+		log:       testLogFunc(c),
+	})
+	c.Check(destStore.entityContents(), deepEquals, expectStore.entityContents())
+	c.Check(destStore.baseEntityContents(), deepEquals, expectStore.baseEntityContents())
+
+	// The third ingest has nothing left to do.
+	dest = &recordingCharmStore{
+		fakeCharmStore: destStore,
+	}
+	stats = ingestWithJournal(dest)
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(stats.ArchivesPresentCount, qt.Equals, 1)
+	c.Check(stats.ResourcesPresentCount, qt.Equals, 1)
+	c.Check(dest.recordedOps(), qt.HasLen, 0)
+}
+
+func TestOpenJournalWithIncompleteLine(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "journal")
+	err := ioutil.WriteFile(path, []byte(`{"step":"archive","id":"cs:~bob/foo-1","hash":"x"}
+{"step":"resour`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	j, err := openJournal(path)
+	c.Assert(err, qt.Equals, nil)
+	step := journalEntry{
+		Step:   stepResource,
+		Id:     "cs:~bob/foo",
+		Detail: "r/1",
+	}
+	c.Assert(j.record(step), qt.Equals, nil)
+	c.Assert(j.Close(), qt.Equals, nil)
+
+	j, err = openJournal(path)
+	c.Assert(err, qt.Equals, nil)
+	defer j.Close()
+	c.Check(j.isDone(journalEntry{
+		Step: stepArchive,
+		Id:   "cs:~bob/foo-1",
+		Hash: "x",
+	}), qt.Equals, true)
+	c.Check(j.isDone(step), qt.Equals, true)
+}
+
+func TestJournalForDest(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "journal")
+	j, err := openJournal(path)
+	c.Assert(err, qt.Equals, nil)
+	defer j.Close()
+	step := journalEntry{
+		Step: stepArchive,
+		Id:   "cs:~bob/foo-1",
+		Hash: "x",
+	}
+	a, b := j.forDest("a"), j.forDest("b")
+	c.Assert(a.record(step), qt.Equals, nil)
+	c.Check(a.isDone(step), qt.Equals, true)
+	c.Check(b.isDone(step), qt.Equals, false)
+	c.Check(j.isDone(step), qt.Equals, false)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(string(data), qt.Equals, `{"step":"archive","id":"cs:~bob/foo-1","hash":"x","dest":"a"}`+"\n")
+}
+
+func TestJournalUploadLocation(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "journal")
+	j, err := openJournal(path)
+	c.Assert(err, qt.Equals, nil)
+	a := j.forDest("a")
+	c.Check(a.uploadLocation("reg/foo", "sha256:1"), qt.Equals, "")
+	// The most recent location is used, even when
+	// it has been recorded before.
+	for _, location := range []string{"https://reg/1", "https://reg/2", "https://reg/1"} {
+		c.Assert(a.recordUpload("reg/foo", "sha256:1", location), qt.Equals, nil)
+	}
+	c.Check(a.uploadLocation("reg/foo", "sha256:1"), qt.Equals, "https://reg/1")
+	c.Check(a.uploadLocation("reg/foo", "sha256:2"), qt.Equals, "")
+	c.Check(j.forDest("b").uploadLocation("reg/foo", "sha256:1"), qt.Equals, "")
+	c.Assert(j.Close(), qt.Equals, nil)
+
+	// The locations are read back when the journal is reopened.
+	j, err = openJournal(path)
+	c.Assert(err, qt.Equals, nil)
+	defer j.Close()
+	c.Check(j.forDest("a").uploadLocation("reg/foo", "sha256:1"), qt.Equals, "https://reg/1")
+}
+
+func TestIngestWithSyncCache(t *testing.T) {
+	c := qt.New(t)
+	srcStore := newFakeCharmStore([]entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		resources: "foo",
+		content:   "some stuff",
+	}, {
+		id:      "cs:~bob/mysql-1",
+		chans:   "*stable",
+		content: "other stuff",
+	}}, []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo content",
+		},
+		published: "stable,foo:0",
+	}})
+	whitelist := []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		EntityId: "~bob/mysql",
+		Channels: []params.Channel{params.StableChannel},
+	}}
+	destStore := newFakeCharmStore(nil, nil)
+	cache := NewSyncCache()
+	ingestWithCache := func() (IngestStats, []string) {
+		dest := &recordingCharmStore{
+			fakeCharmStore: destStore,
+		}
+		stats := ingest(ingestParams{
+			src:       srcStore,
+			dest:      dest,
+			whitelist: whitelist,
+			log:       testLogFunc(c),
+			syncCache: cache,
+		})
+		c.Check(stats.Errors, qt.HasLen, 0)
+		return stats, dest.recordedOps()
+	}
+	stats, _ := ingestWithCache()
+	c.Check(stats.ArchivesCopiedCount, qt.Equals, 2)
+	c.Check(cache.Len(), qt.Equals, 2)
+
+	// Nothing has changed, so nothing is looked at in the destination.
+	stats, ops := ingestWithCache()
+	c.Check(ops, qt.HasLen, 0)
+	c.Check(stats.ArchivesPresentCount, qt.Equals, 2)
+	c.Check(stats.ResourceCount, qt.Equals, 1)
+	c.Check(stats.ResourcesPresentCount, qt.Equals, 1)
+	c.Check(stats.FailedEntityCount, qt.Equals, 0)
+	c.Check(stats.Entities, qt.DeepEquals, []EntityReport{{
+		Id:      "cs:~bob/mysql-1",
+		Outcome: OutcomeUnchanged,
+	}, {
+		Id:      "cs:~charmers/wordpress-4",
+		Outcome: OutcomeUnchanged,
+	}})
+
+	// When an entity changes in the source, only it is transferred.
+	err := srcStore.putExtraInfo(context.Background(), parseURL("cs:~bob/mysql-1"), map[string]json.RawMessage{
+		"x": json.RawMessage(`"y"`),
+	})
+	c.Assert(err, qt.Equals, nil)
+	stats, ops = ingestWithCache()
+	c.Check(ops, qt.DeepEquals, []string{
+		"get entity info cs:~bob/mysql-1",
+		"publish cs:~bob/mysql-1",
+		"publish cs:~bob/mysql-1",
+	})
+	c.Check(stats.Entities, qt.DeepEquals, []EntityReport{{
+		Id:      "cs:~bob/mysql-1",
+		Outcome: OutcomePresent,
+	}, {
+		Id:      "cs:~charmers/wordpress-4",
+		Outcome: OutcomeUnchanged,
+	}})
+	c.Check(destStore.entityContents(), deepEquals, []entitySpec{{
+		id:        "cs:~bob/mysql-1",
+		chans:     "*stable",
+		extraInfo: `{"x":"y"}`,
+		content:   "other stuff",
+	}, {
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}})
+}
+
+func TestIngestWithSyncCacheAndCopiedSourcePerms(t *testing.T) {
+	c := qt.New(t)
+	srcStore := newFakeCharmStore([]entitySpec{{
+		id:      "cs:~bob/foo-1",
+		chans:   "*stable",
+		content: "foo",
+	}}, []baseEntitySpec{{
+		id:    "cs:~bob/foo",
+		perms: []string{"stable everyone bob"},
+	}})
+	destStore := newFakeCharmStore(nil, nil)
+	cache := NewSyncCache()
+	ingestWithCache := func() (IngestStats, []string) {
+		dest := &recordingCharmStore{
+			fakeCharmStore: destStore,
+		}
+		stats := ingest(ingestParams{
+			src:  srcStore,
+			dest: dest,
+			whitelist: []WhitelistEntity{{
+				EntityId: "~bob/foo",
+			}},
+			log:       testLogFunc(c),
+			syncCache: cache,
+			aclPolicy: &ACLPolicy{
+				CopySource: true,
+			},
+		})
+		c.Check(stats.Errors, qt.HasLen, 0)
+		return stats, dest.recordedOps()
+	}
+	ingestWithCache()
+	c.Check(cache.Len(), qt.Equals, 1)
+
+	// Nothing has changed, so nothing is looked at in the destination.
+	stats, ops := ingestWithCache()
+	c.Check(ops, qt.HasLen, 0)
+	c.Check(stats.Entities, qt.DeepEquals, []EntityReport{{
+		Id:      "cs:~bob/foo-1",
+		Outcome: OutcomeUnchanged,
+	}})
+
+	// When the permissions change in the source, the
+	// entity is looked at again.
+	err := srcStore.setPerm(context.Background(), parseURL("cs:~bob/foo-1"), params.StableChannel, permission{
+		read:  []string{"devs"},
+		write: []string{"bob"},
+	})
+	c.Assert(err, qt.Equals, nil)
+	stats, ops = ingestWithCache()
+	c.Check(ops, qt.Not(qt.HasLen), 0)
+	c.Check(stats.Entities, qt.DeepEquals, []EntityReport{{
+		Id:      "cs:~bob/foo-1",
+		Outcome: OutcomePresent,
+	}})
+
+	// The new permissions are recorded in the cache.
+	stats, ops = ingestWithCache()
+	c.Check(ops, qt.HasLen, 0)
+	c.Check(stats.Entities, qt.DeepEquals, []EntityReport{{
+		Id:      "cs:~bob/foo-1",
+		Outcome: OutcomeUnchanged,
+	}})
+}
+
+func TestIngestMultipleDestinations(t *testing.T) {
+	c := qt.New(t)
+	srcStore := &downloadCountingCharmStore{
+		fakeCharmStore: newFakeCharmStore([]entitySpec{{
+			id:        "cs:~charmers/wordpress-4",
+			chans:     "*stable",
+			resources: "foo",
+			content:   "some stuff",
+		}, {
+			id:      "cs:~bob/mysql-1",
+			chans:   "*stable",
+			content: "other stuff",
+		}}, []baseEntitySpec{{
+			id: "cs:~charmers/wordpress",
+			resources: map[string]string{
+				"foo:0": "foo content",
+			},
+			published: "stable,foo:0",
+		}}),
+	}
+	destA := newFakeCharmStore(nil, nil)
+	// The second destination already has mysql, and
+	// fails to take the wordpress archive.
+	destB := &recordingCharmStore{
+		fakeCharmStore: newFakeCharmStore([]entitySpec{{
+			id:      "cs:~bob/mysql-1",
+			chans:   "*stable",
+			content: "other stuff",
+		}}, nil),
+		fail: map[string]bool{
+			"put archive cs:~charmers/wordpress-4": true,
+		},
+	}
+	destC := newFakeCharmStore(nil, nil)
+	var events []Event
+	stats := ingest(ingestParams{
+		src:      srcStore,
+		dest:     destA,
+		destName: "a",
+		extraDests: []namedClient{{
+			name:   "b",
+			client: destB,
+		}, {
+			name:   "c",
+			client: destC,
+		}},
+		whitelist: []WhitelistEntity{{
+			EntityId: "~charmers/wordpress",
+			Channels: []params.Channel{params.StableChannel},
+		}, {
+			EntityId: "~bob/mysql",
+			Channels: []params.Channel{params.StableChannel},
+		}},
+		log: testLogFunc(c),
+		notify: func(e Event) {
+			events = append(events, e)
+		},
+	})
+	// Each archive and resource is only read once.
+	c.Check(srcStore.downloads, qt.DeepEquals, map[string]int{
+		"archive cs:~bob/mysql-1":                 1,
+		"archive cs:~charmers/wordpress-4":        1,
+		"resource cs:~charmers/wordpress-4 foo/0": 1,
+	})
+	expectContents := []entitySpec{{
+		id:      "cs:~bob/mysql-1",
+		chans:   "*stable",
+		content: "other stuff",
+	}, {
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}}
+	c.Check(destA.entityContents(), deepEquals, expectContents)
+	c.Check(destB.entityContents(), deepEquals, expectContents[:1])
+	c.Check(destC.entityContents(), deepEquals, expectContents)
+
+	c.Assert(stats.Destinations, qt.HasLen, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		c.Check(stats.Destinations[i].Name, qt.Equals, name)
+		c.Check(stats.Destinations[i].EntityCount, qt.Equals, 2)
+	}
+	c.Check(stats.Destinations[0].ArchivesCopiedCount, qt.Equals, 2)
+	c.Check(stats.Destinations[0].ResourcesCopiedCount, qt.Equals, 1)
+	c.Check(stats.Destinations[0].Errors, qt.HasLen, 0)
+	c.Check(stats.Destinations[1].ArchivesPresentCount, qt.Equals, 1)
+	c.Check(stats.Destinations[1].FailedEntityCount, qt.Equals, 1)
+	c.Assert(stats.Destinations[1].Errors, qt.Not(qt.HasLen), 0)
+	for _, err := range stats.Destinations[1].Errors {
+		// The extra-info isn't set for an archive
+		// that failed to upload.
+		c.Check(err, qt.Not(qt.Matches), ".*extra-info.*")
+	}
+	c.Check(stats.Destinations[1].Errors[0], qt.Equals, "failed to upload archive for cs:~charmers/wordpress-4: cannot put archive cs:~charmers/wordpress-4")
+	c.Check(stats.Destinations[2].ArchivesCopiedCount, qt.Equals, 2)
+
+	c.Check(stats.EntityCount, qt.Equals, 2)
+	// The archive that failed to upload to b isn't counted.
+	c.Check(stats.Destinations[1].ArchivesCopiedCount, qt.Equals, 0)
+	c.Check(stats.ArchivesCopiedCount, qt.Equals, 4)
+	c.Check(stats.ArchivesPresentCount, qt.Equals, 1)
+	c.Check(stats.ResourcesCopiedCount, qt.Equals, 2)
+	c.Check(stats.FailedEntityCount, qt.Equals, 1)
+	c.Check(stats.Errors, qt.HasLen, len(stats.Destinations[1].Errors))
+	for i, err := range stats.Errors {
+		c.Check(err, qt.Equals, "b: "+stats.Destinations[1].Errors[i])
+	}
+
+	// Events that relate to a destination say which.
+	dests := make(map[EventKind]map[string]bool)
+	for _, e := range events {
+		if dests[e.Kind] == nil {
+			dests[e.Kind] = make(map[string]bool)
+		}
+		dests[e.Kind][e.Dest] = true
+	}
+	c.Check(dests[EventEntityResolved], qt.DeepEquals, map[string]bool{"": true})
+	c.Check(dests[EventPublished], qt.DeepEquals, map[string]bool{"a": true, "b": true, "c": true})
+	c.Check(dests[EventError], qt.DeepEquals, map[string]bool{"b": true})
+}
+
+func TestIngestSlowResourceDoesNotHoldUpBundles(t *testing.T) {
+	c := qt.New(t)
+	// Reading the resource of the wordpress charm blocks until
+	// the unrelated bundle has been published.
+	srcStore := &blockingCharmStore{
+		fakeCharmStore: newFakeCharmStore([]entitySpec{{
+			id:        "cs:~charmers/wordpress-4",
+			chans:     "*stable",
+			resources: "foo",
+			content:   "some stuff",
+		}, {
+			id:      "cs:~charmers/bundle/site-1",
+			chans:   "*stable",
+			content: "cs:~bob/mysql",
+		}, {
+			id:      "cs:~bob/mysql-1",
+			chans:   "*stable",
+			content: "other stuff",
+		}}, []baseEntitySpec{{
+			id: "cs:~charmers/wordpress",
+			resources: map[string]string{
+				"foo:0": "foo content",
+			},
+			published: "stable,foo:0",
+		}}),
+		unblock: make(chan struct{}),
+	}
+	var once sync.Once
+	var published []string
+	stats := ingest(ingestParams{
+		src:  srcStore,
+		dest: newFakeCharmStore(nil, nil),
+		whitelist: []WhitelistEntity{{
+			EntityId: "~charmers/wordpress",
+		}, {
+			EntityId: "~charmers/bundle/site",
+		}},
+		log: testLogFunc(c),
+		notify: func(e Event) {
+			if e.Kind != EventPublished {
+				return
+			}
+			published = append(published, e.Id)
+			if e.Id == "cs:~charmers/bundle/site-1" {
+				once.Do(func() {
+					close(srcStore.unblock)
+				})
+			}
+		},
+	})
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(published, qt.DeepEquals, []string{
+		"cs:~bob/mysql-1",
+		"cs:~charmers/bundle/site-1",
+		"cs:~charmers/wordpress-4",
+	})
+}
+
+func TestIngestInterrupted(t *testing.T) {
+	c := qt.New(t)
+	// Reading the resource of the wordpress charm blocks until
+	// the unrelated bundle has been published, at which point
+	// the ingest is interrupted.
+	srcStore := &blockingCharmStore{
+		fakeCharmStore: newFakeCharmStore([]entitySpec{{
+			id:        "cs:~charmers/wordpress-4",
+			chans:     "*stable",
+			resources: "foo",
+			content:   "some stuff",
+		}, {
+			id:      "cs:~charmers/bundle/site-1",
+			chans:   "*stable",
+			content: "cs:~bob/mysql",
+		}, {
+			id:      "cs:~bob/mysql-1",
+			chans:   "*stable",
+			content: "other stuff",
+		}}, []baseEntitySpec{{
+			id: "cs:~charmers/wordpress",
+			resources: map[string]string{
+				"foo:0": "foo content",
+			},
+			published: "stable,foo:0",
+		}}),
+		unblock: make(chan struct{}),
+	}
+	destStore := newFakeCharmStore([]entitySpec{{
+		id:      "cs:~charmers/old-1",
+		chans:   "*stable",
+		content: "old",
+	}}, nil)
+	tempDir := c.Mkdir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var published []string
+	stats := ingest(ingestParams{
+		ctx:  ctx,
+		src:  srcStore,
+		dest: destStore,
+		whitelist: []WhitelistEntity{{
+			EntityId: "~charmers/wordpress",
+		}, {
+			EntityId: "~charmers/bundle/site",
+		}},
+		tempDir: tempDir,
+		prune:   PruneReport,
+		log:     testLogFunc(c),
+		notify: func(e Event) {
+			if e.Kind != EventPublished {
+				return
+			}
+			published = append(published, e.Id)
+			if e.Id == "cs:~charmers/bundle/site-1" {
+				cancel()
+				close(srcStore.unblock)
+			}
+		},
+	})
+	// Only the interruption is reported, not the
+	// errors that it caused.
+	c.Check(stats.Errors, qt.DeepEquals, []string{
+		"ingest interrupted: context canceled",
+	})
+	c.Check(published, qt.DeepEquals, []string{
+		"cs:~bob/mysql-1",
+		"cs:~charmers/bundle/site-1",
+	})
+	c.Check(stats.ArchivesCopiedCount, qt.Equals, 3)
+	c.Check(stats.ResourcesCopiedCount, qt.Equals, 0)
+	// Nothing is pruned after an interruption.
+	c.Check(stats.Orphans, qt.HasLen, 0)
+	// The temporary file for the resource has been removed.
+	files, err := ioutil.ReadDir(tempDir)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(files, qt.HasLen, 0)
+}
+
+func TestIngestCancelledBeforeStart(t *testing.T) {
+	c := qt.New(t)
+	test := ingestTests[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	destStore := newFakeCharmStore(test.dest, test.destBaseEntities)
+	stats := ingest(ingestParams{
+		ctx:        ctx,
+		src:        newFlakyCharmStore(newFakeCharmStore(test.src, test.srcBaseEntities)),
+		dest:       destStore,
+		whitelist:  test.whitelist,
+		log:        testLogFunc(c),
+		retryDelay: time.Hour,
+	})
+	c.Check(stats.Errors, qt.DeepEquals, []string{
+		"ingest interrupted: context canceled",
+	})
+	c.Check(stats.RetryCount, qt.Equals, 0)
+	c.Check(destStore.entityContents(), qt.HasLen, 0)
+}
+
+func TestIngestWithBlobCache(t *testing.T) {
+	c := qt.New(t)
+	srcStore := &downloadCountingCharmStore{
+		fakeCharmStore: newFakeCharmStore([]entitySpec{{
+			id:        "cs:~charmers/wordpress-4",
+			chans:     "*stable",
+			resources: "foo",
+			content:   "some stuff",
+		}, {
+			id:      "cs:~bob/mysql-1",
+			chans:   "*stable",
+			content: "other stuff",
+		}}, []baseEntitySpec{{
+			id: "cs:~charmers/wordpress",
+			resources: map[string]string{
+				"foo:0": "foo content",
+			},
+			published: "stable,foo:0",
+		}}),
+	}
+	whitelist := []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+	}, {
+		EntityId: "~bob/mysql",
+	}}
+	cacheDir := c.Mkdir()
+	ingestWithCache := func() *fakeCharmStore {
+		cache, err := openBlobCache(cacheDir, 0)
+		c.Assert(err, qt.Equals, nil)
+		dest := newFakeCharmStore(nil, nil)
+		stats := ingest(ingestParams{
+			src:       srcStore,
+			dest:      dest,
+			whitelist: whitelist,
+			blobCache: cache,
+			log:       testLogFunc(c),
+		})
+		c.Assert(stats.Errors, qt.HasLen, 0)
+		return dest
+	}
+	dest1 := ingestWithCache()
+	expectDownloads := map[string]int{
+		"archive cs:~bob/mysql-1":                 1,
+		"archive cs:~charmers/wordpress-4":        1,
+		"resource cs:~charmers/wordpress-4 foo/0": 1,
+	}
+	c.Check(srcStore.downloads, qt.DeepEquals, expectDownloads)
+
+	// Everything is in the cache, keyed by hash.
+	files, err := ioutil.ReadDir(cacheDir)
+	c.Assert(err, qt.Equals, nil)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	c.Check(names, qt.ContentEquals, []string{
+		hashOf("some stuff"),
+		hashOf("other stuff"),
+		hashOf("foo content"),
+	})
+
+	// Ingesting into another destination reads
+	// everything from the cache.
+	dest2 := ingestWithCache()
+	c.Check(srcStore.downloads, qt.DeepEquals, expectDownloads)
+	c.Check(dest2.entityContents(), deepEquals, dest1.entityContents())
+	c.Check(dest2.baseEntityContents(), deepEquals, dest1.baseEntityContents())
+
+	// When the content in the source changes, it's read again.
+	for _, e := range srcStore.entities {
+		if e.id.String() == "cs:~bob/mysql-1" {
+			e.content = "changed stuff"
+			e.hash = hashOf(e.content)
+			e.archiveSize = int64(len(e.content))
+		}
+	}
+	ingestWithCache()
+	expectDownloads["archive cs:~bob/mysql-1"]++
+	c.Check(srcStore.downloads, qt.DeepEquals, expectDownloads)
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	cache, err := openBlobCache(dir, 10)
+	c.Assert(err, qt.Equals, nil)
+	addBlob := func(content string) {
+		r := cache.reader(ioutil.NopCloser(strings.NewReader(content)), hashOf(content))
+		_, err := ioutil.ReadAll(r)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(r.Close(), qt.Equals, nil)
+	}
+	has := func(content string) bool {
+		f, _, ok := cache.open(hashOf(content))
+		if ok {
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(string(data), qt.Equals, content)
+		}
+		return ok
+	}
+	addBlob("aaaa")
+	addBlob("bbbb")
+	// Using aaaa makes bbbb the least recently used.
+	c.Assert(has("aaaa"), qt.Equals, true)
+	addBlob("cccc")
+	c.Check(has("bbbb"), qt.Equals, false)
+	c.Check(has("aaaa"), qt.Equals, true)
+	c.Check(has("cccc"), qt.Equals, true)
+
+	// Content that's too big for the cache isn't kept.
+	addBlob("ddddddddddd")
+	c.Check(has("ddddddddddd"), qt.Equals, false)
+
+	// Content that doesn't have the expected hash isn't kept.
+	r := cache.reader(ioutil.NopCloser(strings.NewReader("eeee")), hashOf("ffff"))
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Close(), qt.Equals, nil)
+	c.Check(has("ffff"), qt.Equals, false)
+
+	// Content that isn't read to the end isn't kept.
+	r = cache.reader(ioutil.NopCloser(strings.NewReader("gggg")), hashOf("gggg"))
+	c.Assert(r.Close(), qt.Equals, nil)
+	c.Check(has("gggg"), qt.Equals, false)
+
+	// When the cache is opened again, the least recently used
+	// content is removed first, along with any partly written
+	// files that have been left behind. Partly written files
+	// that might still be being written are left alone.
+	now := time.Now()
+	err = os.Chtimes(filepath.Join(dir, hashOf("aaaa")), now, now.Add(-time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = ioutil.WriteFile(filepath.Join(dir, blobTempPrefix+"old"), []byte("partial"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	err = os.Chtimes(filepath.Join(dir, blobTempPrefix+"old"), now, now.Add(-blobTempMaxAge-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = ioutil.WriteFile(filepath.Join(dir, blobTempPrefix+"new"), []byte("partial"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	cache, err = openBlobCache(dir, 5)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(has("aaaa"), qt.Equals, false)
+	c.Check(has("cccc"), qt.Equals, true)
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, qt.Equals, nil)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	c.Check(names, qt.DeepEquals, []string{blobTempPrefix + "new", hashOf("cccc")})
+}
+
+func TestScheduler(t *testing.T) {
+	c := qt.New(t)
+	var (
+		mu      sync.Mutex
+		order   []string
+		running int
+		maxRun  int
+	)
+	step := func(name string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, name)
+			running++
+			if running > maxRun {
+				maxRun = running
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}
+	}
+	s := newScheduler(context.Background(), newLimiter(2))
+	a := s.add(step("a"))
+	b := s.add(step("b"))
+	ab := s.add(step("ab"), a, b, nil)
+	s.add(step("b2"), b, b)
+	s.add(step("ab2"), ab)
+	s.run()
+
+	c.Check(order, qt.HasLen, 5)
+	index := make(map[string]int)
+	for i, name := range order {
+		index[name] = i
+	}
+	c.Check(index["ab"] > index["a"] && index["ab"] > index["b"], qt.IsTrue)
+	c.Check(index["b2"] > index["b"], qt.IsTrue)
+	c.Check(index["ab2"] > index["ab"], qt.IsTrue)
+	c.Check(maxRun <= 2, qt.IsTrue)
+}
+
+func TestIngestMultipleSources(t *testing.T) {
+	c := qt.New(t)
+	partner := newFakeCharmStore([]entitySpec{{
+		id:      "cs:~partner/app-1",
+		chans:   "*stable",
+		content: "partner app",
+	}}, nil)
+	public := newFakeCharmStore([]entitySpec{{
+		id:      "cs:~partner/app-2",
+		chans:   "*stable",
+		content: "public app",
+	}, {
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "public wordpress",
+	}, {
+		id:      "cs:~charmers/redis-1",
+		chans:   "*stable",
+		content: "public redis",
+	}}, nil)
+	staging := newFakeCharmStore([]entitySpec{{
+		id:      "cs:~charmers/wordpress-5",
+		chans:   "*stable",
+		content: "staging wordpress",
+	}, {
+		id:      "cs:~charmers/bundle/site-1",
+		chans:   "*stable",
+		content: "cs:~charmers/redis",
+	}, {
+		id:      "cs:~charmers/redis-2",
+		chans:   "*stable",
+		content: "staging redis",
+	}}, nil)
+	dest := newFakeCharmStore(nil, nil)
+	var resolved []Event
+	stats := ingest(ingestParams{
+		sources: []namedClient{{
+			name:   "partner",
+			client: partner,
+		}, {
+			name:   "public",
+			client: public,
+		}, {
+			name:   "staging",
+			client: staging,
+		}},
+		dest: dest,
+		whitelist: []WhitelistEntity{{
+			// Found in the first source that has it.
+			EntityId: "~partner/app",
+		}, {
+			// Only looked up in the named source.
+			EntityId: "~charmers/wordpress",
+			Source:   "staging",
+		}, {
+			// The bundle's charm is looked up in
+			// the bundle's source first.
+			EntityId: "~charmers/bundle/site",
+		}, {
+			EntityId: "~charmers/other",
+			Source:   "nowhere",
+		}},
+		log: testLogFunc(c),
+		notify: func(e Event) {
+			if e.Kind == EventEntityResolved {
+				resolved = append(resolved, e)
+			}
+		},
+	})
+	c.Check(stats.Errors, qt.DeepEquals, []string{`unknown source "nowhere"`})
+	c.Check(dest.entityContents(), deepEquals, []entitySpec{{
+		id:      "cs:~charmers/bundle/site-1",
+		chans:   "*stable",
+		content: "cs:~charmers/redis",
+	}, {
+		id:      "cs:~charmers/redis-2",
+		chans:   "*stable",
+		content: "staging redis",
+	}, {
+		id:      "cs:~charmers/wordpress-5",
+		chans:   "*stable",
+		content: "staging wordpress",
+	}, {
+		id:      "cs:~partner/app-1",
+		chans:   "*stable",
+		content: "partner app",
+	}})
+	sources := make(map[string]string)
+	for _, r := range stats.Entities {
+		sources[r.Id] = r.Source
+	}
+	c.Check(sources, qt.DeepEquals, map[string]string{
+		"cs:~charmers/bundle/site-1": "staging",
+		"~charmers/other":            "",
+		"cs:~charmers/redis-2":       "staging",
+		"cs:~charmers/wordpress-5":   "staging",
+		"cs:~partner/app-1":          "partner",
+	})
+	c.Assert(resolved, qt.HasLen, 4)
+	c.Check(resolved[3].Id, qt.Equals, "cs:~partner/app-1")
+	c.Check(resolved[3].Source, qt.Equals, "partner")
+}
+
+func TestSourceClientPin(t *testing.T) {
+	c := qt.New(t)
+	src := newSourceClient([]namedClient{{
+		name:   "a",
+		client: newFakeCharmStore(nil, nil),
+	}, {
+		name:   "b",
+		client: newFakeCharmStore(nil, nil),
+	}})
+	err := src.pin("b", parseURL("cs:~bob/foo-1"))
+	c.Assert(err, qt.IsNil)
+	err = src.pin("b", parseURL("cs:~bob/trusty/foo"))
+	c.Assert(err, qt.IsNil)
+	err = src.pin("a", parseURL("cs:~bob/foo"))
+	c.Check(err, qt.ErrorMatches, `cannot take cs:~bob/foo from source "a" because it's taken from source "b" too`)
+	err = src.pin("c", parseURL("cs:~bob/foo"))
+	c.Check(err, qt.ErrorMatches, `unknown source "c"`)
+	_, err = src.entityInfo(context.Background(), params.StableChannel, parseURL("cs:~bob/foo"))
+	c.Check(errgo.Cause(err), qt.Equals, errNotFound)
+}
+
+var pruneTests = []struct {
+	testName                 string
+	prune                    PruneMode
+	pruneOwners              []string
+	protectedOwners          []string
+	protectedIds             []string
+	dryRun                   bool
+	whitelist                []WhitelistEntity
+	expectOrphans            []Orphan
+	expectErrors             []string
+	expectBaseEntityContents []baseEntitySpec
+}{{
+	testName: "report",
+	prune:    PruneReport,
+	expectOrphans: []Orphan{{
+		Id:       "cs:~bob/old",
+		Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+	}, {
+		Id:       "cs:~bob/other",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/old",
+		perms: []string{"edge everyone admin", "stable everyone admin"},
+	}},
+}, {
+	testName: "revoke",
+	prune:    PruneRevoke,
+	// cs:~bob/other has default permissions, so it's
+	// only readable by bob already.
+	expectOrphans: []Orphan{{
+		Id:       "cs:~bob/old",
+		Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+		Revoked:  true,
+	}, {
+		Id:       "cs:~bob/other",
+		Channels: []params.Channel{params.StableChannel},
+		Revoked:  true,
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/old",
+		perms: []string{"edge admin admin", "stable admin admin"},
+	}},
+}, {
+	testName:     "protected_id",
+	prune:        PruneRevoke,
+	protectedIds: []string{"~bob/ot*"},
+	expectOrphans: []Orphan{{
+		Id:       "cs:~bob/old",
+		Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+		Revoked:  true,
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/old",
+		perms: []string{"edge admin admin", "stable admin admin"},
+	}},
+}, {
+	testName:        "protected_owner",
+	prune:           PruneRevoke,
+	pruneOwners:     []string{"bob", "alice"},
+	protectedOwners: []string{"bob"},
+	expectOrphans: []Orphan{{
+		Id:       "cs:~alice/x",
+		Channels: []params.Channel{params.StableChannel},
+		Revoked:  true,
+	}},
+	// Alice's entity is only readable by alice already.
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/old",
+		perms: []string{"edge everyone admin", "stable everyone admin"},
+	}},
+}, {
+	testName: "dry_run",
+	prune:    PruneRevoke,
+	dryRun:   true,
+	expectOrphans: []Orphan{{
+		Id:       "cs:~bob/old",
+		Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+		Revoked:  true,
+	}, {
+		Id:       "cs:~bob/other",
+		Channels: []params.Channel{params.StableChannel},
+		Revoked:  true,
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/old",
+		perms: []string{"edge everyone admin", "stable everyone admin"},
+	}},
+}, {
+	testName: "unresolved_whitelist",
+	prune:    PruneRevoke,
+	whitelist: []WhitelistEntity{{
+		EntityId: "~bob/foo",
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		EntityId: "~bob/other",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectOrphans: []Orphan{{
+		Id:       "cs:~bob/old",
+		Channels: []params.Channel{params.EdgeChannel, params.StableChannel},
+	}, {
+		Id:       "cs:~bob/other",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectErrors: []string{
+		`entity "~bob/other" is not available in stable channel`,
+		`not revoking access to orphaned entities because the whitelist could not be resolved completely`,
+	},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/old",
+		perms: []string{"edge everyone admin", "stable everyone admin"},
+	}},
+}}
+
+func TestIngestPrune(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range pruneTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			srcStore := newFakeCharmStore([]entitySpec{{
+				id:      "cs:~bob/foo-1",
+				chans:   "*stable",
+				content: "foo",
+			}}, nil)
+			destStore := newFakeCharmStore([]entitySpec{{
+				id:      "cs:~bob/foo-1",
+				chans:   "*stable",
+				content: "foo",
+			}, {
+				id:      "cs:~bob/old-2",
+				chans:   "*stable *edge",
+				content: "old",
+			}, {
+				id:      "cs:~bob/other-1",
+				chans:   "*stable",
+				content: "other",
+			}, {
+				id:      "cs:~alice/x-1",
+				chans:   "*stable",
+				content: "x",
+			}}, []baseEntitySpec{{
+				id:    "cs:~bob/old",
+				perms: []string{"stable everyone admin", "edge everyone admin"},
+			}})
+			whitelist := test.whitelist
+			if whitelist == nil {
+				whitelist = []WhitelistEntity{{
+					EntityId: "~bob/foo",
+					Channels: []params.Channel{params.StableChannel},
+				}}
+			}
+			stats := ingest(ingestParams{
+				src:             srcStore,
+				dest:            destStore,
+				whitelist:       whitelist,
+				log:             testLogFunc(c),
+				dryRun:          test.dryRun,
+				prune:           test.prune,
+				pruneOwners:     test.pruneOwners,
+				protectedOwners: test.protectedOwners,
+				protectedIds:    test.protectedIds,
+			})
+			c.Check(stats.Errors, qt.DeepEquals, test.expectErrors)
+			c.Check(stats.Orphans, qt.DeepEquals, test.expectOrphans)
+			// Permissions on the whitelisted entity are set as usual,
+			// so leave it out when checking.
+			var contents []baseEntitySpec
+			for _, spec := range destStore.baseEntityContents() {
+				if spec.id != "cs:~bob/foo" {
+					contents = append(contents, spec)
+				}
+			}
+			c.Check(contents, deepEquals, test.expectBaseEntityContents)
+		})
+	}
+}
+
+func TestRevokeReadWithNoWriteACL(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range []struct {
+		testName      string
+		owner         string
+		expectRevoked bool
+		expectErrors  []string
+		expectPerms   []string
+	}{{
+		testName:      "owner",
+		owner:         "admin",
+		expectRevoked: true,
+		expectPerms:   []string{"stable admin -"},
+	}, {
+		testName: "no_owner",
+		expectErrors: []string{
+			`cannot revoke read access to cs:~bob/old (channel stable): no write ACL and no owner`,
+		},
+		expectPerms: []string{"stable everyone -"},
+	}} {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			destStore := newFakeCharmStore([]entitySpec{{
+				id:      "cs:~bob/old-1",
+				chans:   "*stable",
+				content: "old",
+			}}, []baseEntitySpec{{
+				id:    "cs:~bob/old",
+				perms: []string{"stable everyone -"},
+			}})
+			ing := &ingester{
+				params: ingestParams{
+					ctx:   context.Background(),
+					dest:  destStore,
+					log:   testLogFunc(c),
+					owner: test.owner,
+				},
+			}
+			o := &Orphan{
+				Id:       "cs:~bob/old",
+				Channels: []params.Channel{params.StableChannel},
+			}
+			revoked := ing.revokeRead(o, map[params.Channel]*charm.URL{
+				params.StableChannel: parseURL("cs:~bob/old-1"),
+			})
+			c.Check(revoked, qt.Equals, test.expectRevoked)
+			c.Check(ing.errors, qt.ContentEquals, test.expectErrors)
+			c.Check(destStore.baseEntityContents(), deepEquals, []baseEntitySpec{{
+				id:    "cs:~bob/old",
+				perms: test.expectPerms,
+			}})
+		})
+	}
+}
+
+var aclPolicyTests = []struct {
+	testName                 string
+	policy                   *ACLPolicy
+	expectBaseEntityContents []baseEntitySpec
+}{{
+	testName: "no_policy",
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/foo",
+		perms: []string{"edge everyone admin", "stable everyone admin"},
+	}, {
+		id:    "cs:~partner/bar",
+		perms: []string{"stable everyone admin"},
+	}},
+}, {
+	testName: "defaults_and_channels",
+	policy: &ACLPolicy{
+		Read:  []string{"staff"},
+		Write: []string{"ingest"},
+		Channels: map[params.Channel]ACL{
+			params.EdgeChannel: {
+				Read: []string{"devs"},
+			},
+		},
+	},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/foo",
+		perms: []string{"edge devs ingest", "stable staff ingest"},
+	}, {
+		id:    "cs:~partner/bar",
+		perms: []string{"stable staff ingest"},
+	}},
+}, {
+	testName: "rules",
+	policy: &ACLPolicy{
+		Read: []string{"staff"},
+		Rules: []ACLRule{{
+			Pattern: "~partner/*",
+			ACL: ACL{
+				Read: []string{"partners"},
+			},
+			Channels: map[params.Channel]ACL{
+				params.StableChannel: {
+					Write: []string{"partner-admin"},
+				},
+			},
+		}, {
+			Pattern: "~partner/bar",
+			ACL: ACL{
+				Read: []string{"not-used"},
+			},
+		}},
+	},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/foo",
+		perms: []string{"edge staff admin", "stable staff admin"},
+	}, {
+		id:    "cs:~partner/bar",
+		perms: []string{"stable partners partner-admin"},
+	}},
+}, {
+	testName: "copy_source",
+	policy: &ACLPolicy{
+		Write:      []string{"ingest"},
+		CopySource: true,
+		Renames: map[string]string{
+			"everyone": "staff",
+			"devs":     "staff",
+		},
+	},
+	// cs:~partner/bar has the default permissions in the source,
+	// so it has them in the destination too.
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~bob/foo",
+		perms: []string{"edge bob,staff bob", "stable staff bob"},
+	}},
+}}
+
+func TestIngestWithACLPolicy(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range aclPolicyTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			srcStore := newFakeCharmStore([]entitySpec{{
+				id:      "cs:~bob/foo-1",
+				chans:   "*stable *edge",
+				content: "foo",
+			}, {
+				id:      "cs:~partner/bar-1",
+				chans:   "*stable",
+				content: "bar",
+			}}, []baseEntitySpec{{
+				id:    "cs:~bob/foo",
+				perms: []string{"stable everyone,devs bob", "edge bob,devs bob"},
+			}})
+			destStore := newFakeCharmStore(nil, nil)
+			p := ingestParams{
+				src:  srcStore,
+				dest: destStore,
+				whitelist: []WhitelistEntity{{
+					EntityId: "~bob/foo",
+					Channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+				}, {
+					EntityId: "~partner/bar",
+				}},
+				log:       testLogFunc(c),
+				aclPolicy: test.policy,
+			}
+			stats := ingest(p)
+			c.Assert(stats.Errors, qt.HasLen, 0)
+			contents := destStore.baseEntityContents()
+			sort.Slice(contents, func(i, j int) bool {
+				return contents[i].id < contents[j].id
+			})
+			c.Check(contents, deepEquals, test.expectBaseEntityContents)
+
+			// The ACLs are what verification expects.
+			vstats := verify(p)
+			c.Check(vstats.Errors, qt.HasLen, 0)
+			c.Check(vstats.Drift, qt.HasLen, 0)
+		})
+	}
+}
+
+var rewriteTests = []struct {
+	testName                 string
+	rewrites                 []RewriteRule
+	whitelist                []WhitelistEntity
+	expectErrors             []string
+	expectContents           []entitySpec
+	expectBaseEntityContents []baseEntitySpec
+}{{
+	testName: "owner",
+	rewrites: []RewriteRule{{
+		Owner:   "upstream",
+		ToOwner: "ourteam",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~upstream/bundle/wordpress-simple",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	// The charms in the bundle have explicit revisions, so
+	// they're not made current.
+	expectContents: []entitySpec{{
+		id:      "cs:~other/xenial/memcached-1",
+		chans:   "stable",
+		content: "memcached",
+	}, {
+		id:      "cs:~ourteam/bundle/wordpress-simple-2",
+		chans:   "*stable",
+		content: "cs:~other/xenial/memcached-1 cs:~ourteam/xenial/mysql-3 cs:~ourteam/xenial/wordpress-5,r:0",
+	}, {
+		id:      "cs:~ourteam/xenial/mysql-3",
+		chans:   "stable",
+		content: "mysql",
+	}, {
+		id:      "cs:~ourteam/xenial/wordpress-5",
+		chans:   "stable",
+		content: "wordpress",
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~other/memcached",
+		perms: []string{"stable everyone admin"},
+	}, {
+		id:    "cs:~ourteam/mysql",
+		perms: []string{"stable everyone admin"},
+	}, {
+		id:    "cs:~ourteam/wordpress",
+		perms: []string{"stable everyone admin"},
+		resources: map[string]string{
+			"r:0": "wordpress resource",
+		},
+	}, {
+		id:    "cs:~ourteam/wordpress-simple",
+		perms: []string{"stable everyone admin"},
+	}},
+}, {
+	testName: "name_series_and_promulgated",
+	rewrites: []RewriteRule{{
+		Owner:           "upstream",
+		Name:            "mysql",
+		ToName:          "mariadb",
+		KeepPromulgated: true,
+	}, {
+		Series:   "xenial",
+		ToSeries: "bionic",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~upstream/xenial/mysql",
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		EntityId: "~other/xenial/memcached",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectContents: []entitySpec{{
+		id:      "cs:~other/bionic/memcached-1",
+		chans:   "*stable",
+		content: "memcached",
+	}, {
+		id:            "cs:~upstream/xenial/mariadb-3",
+		promulgatedId: "cs:xenial/mariadb-7",
+		chans:         "*stable",
+		content:       "mysql",
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~other/memcached",
+		perms: []string{"stable everyone admin"},
+	}, {
+		id:    "cs:~upstream/mariadb",
+		perms: []string{"stable everyone admin"},
+	}},
+}, {
+	testName: "promulgated_dropped",
+	rewrites: []RewriteRule{{
+		Owner:   "upstream",
+		ToOwner: "ourteam",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "xenial/mysql",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectContents: []entitySpec{{
+		id:      "cs:~ourteam/xenial/mysql-3",
+		chans:   "*stable",
+		content: "mysql",
+	}},
+	expectBaseEntityContents: []baseEntitySpec{{
+		id:    "cs:~ourteam/mysql",
+		perms: []string{"stable everyone admin"},
+	}},
+}, {
+	testName: "clash",
+	rewrites: []RewriteRule{{
+		Owner:   "other",
+		ToOwner: "upstream",
+	}, {
+		Owner:  "upstream",
+		ToName: "memcached",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~upstream/xenial/mysql",
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		EntityId: "~other/xenial/memcached",
+		Channels: []params.Channel{params.StableChannel},
+	}},
+	expectErrors: []string{
+		`cannot rewrite cs:~(other|upstream)/(memcached|mysql) to cs:~upstream/memcached because cs:~(other|upstream)/(memcached|mysql) is rewritten to it too`,
+	},
+}}
+
+var rewriteSrc = []entitySpec{{
+	id:      "cs:~upstream/bundle/wordpress-simple-2",
+	chans:   "*stable",
+	content: "cs:~other/xenial/memcached-1 cs:~upstream/xenial/mysql-3 cs:~upstream/xenial/wordpress-5,r:0",
+}, {
+	id:            "cs:~upstream/xenial/mysql-3",
+	promulgatedId: "cs:xenial/mysql-7",
+	chans:         "*stable",
+	content:       "mysql",
+}, {
+	id:        "cs:~upstream/xenial/wordpress-5",
+	chans:     "*stable",
+	resources: "r",
+	content:   "wordpress",
+}, {
+	id:      "cs:~other/xenial/memcached-1",
+	chans:   "*stable",
+	content: "memcached",
+}}
+
+var rewriteSrcBaseEntities = []baseEntitySpec{{
+	id: "cs:~upstream/wordpress",
+	resources: map[string]string{
+		"r:0": "wordpress resource",
+	},
+	published: "stable,r:0",
+}}
+
+func TestIngestWithRewrites(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range rewriteTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			srcStore := newFakeCharmStore(rewriteSrc, rewriteSrcBaseEntities)
+			destStore := newFakeCharmStore(nil, nil)
+			p := ingestParams{
+				src:           srcStore,
+				dest:          destStore,
+				whitelist:     test.whitelist,
+				log:           testLogFunc(c),
+				rewrites:      test.rewrites,
+				rewriteBundle: rewriteFakeBundle,
+			}
+			stats := ingest(p)
+			c.Assert(stats.Errors, qt.HasLen, len(test.expectErrors))
+			for i, err := range stats.Errors {
+				c.Check(err, qt.Matches, test.expectErrors[i])
+			}
+			if len(test.expectErrors) > 0 {
+				return
+			}
+			c.Check(destStore.entityContents(), deepEquals, test.expectContents)
+			contents := destStore.baseEntityContents()
+			sort.Slice(contents, func(i, j int) bool {
+				return contents[i].id < contents[j].id
+			})
+			c.Check(contents, deepEquals, test.expectBaseEntityContents)
+
+			// The destination matches the rewritten source.
+			vstats := verify(p)
+			c.Check(vstats.Errors, qt.HasLen, 0)
+			c.Check(vstats.Drift, qt.HasLen, 0)
+		})
+	}
+}
+
+// rewriteFakeBundle rewrites the charms used by a bundle
+// in the format used by entitySpec.content.
+func rewriteFakeBundle(data []byte, rewrite func(string) string) ([]byte, error) {
+	bcs, err := parseBundleCharms(string(data))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	for i, bc := range bcs {
+		fields[i] = rewrite(bc.charm) + strings.TrimPrefix(fields[i], bc.charm)
+	}
+	sort.Strings(fields)
+	return []byte(strings.Join(fields, " ")), nil
+}
+
+func TestRewriteClientOnlyRewritesChangedBundles(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srcStore := &downloadCountingCharmStore{
+		fakeCharmStore: newFakeCharmStore(rewriteSrc, rewriteSrcBaseEntities),
+	}
+	bundleId := parseURL("cs:~upstream/bundle/wordpress-simple-2")
+
+	// None of the bundle's charms are rewritten, so
+	// its archive isn't read.
+	client := newRewriteClient(srcStore, []RewriteRule{{
+		Name:   "wordpress-simple",
+		ToName: "wordpress-plain",
+	}}, rewriteFakeBundle, c.Mkdir(), c.Logf)
+	e, err := client.entityInfo(ctx, params.StableChannel, bundleId)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(e.id.String(), qt.Equals, "cs:~upstream/bundle/wordpress-plain-2")
+	c.Check(srcStore.downloads, qt.HasLen, 0)
+
+	// One of the charms is rewritten, so the archive is read
+	// once and the rewritten archive is kept in a temporary file
+	// until the client is closed.
+	tempDir := c.Mkdir()
+	client = newRewriteClient(srcStore, []RewriteRule{{
+		Owner:   "other",
+		ToOwner: "ourteam",
+	}}, rewriteFakeBundle, tempDir, c.Logf)
+	for i := 0; i < 2; i++ {
+		e, err = client.entityInfo(ctx, params.StableChannel, bundleId)
+		c.Assert(err, qt.Equals, nil)
+	}
+	c.Check(srcStore.downloads, qt.DeepEquals, map[string]int{
+		"archive cs:~upstream/bundle/wordpress-simple-2": 1,
+	})
+	r, err := client.getArchive(ctx, e.id)
+	c.Assert(err, qt.Equals, nil)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, qt.Equals, nil)
+	c.Check(string(data), qt.Equals, "cs:~ourteam/xenial/memcached-1 cs:~upstream/xenial/mysql-3 cs:~upstream/xenial/wordpress-5,r:0")
+	c.Check(e.hash, qt.Equals, hashOf(string(data)))
+	c.Check(e.archiveSize, qt.Equals, int64(len(data)))
+	infos, err := ioutil.ReadDir(tempDir)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(infos, qt.HasLen, 1)
+	client.close()
+	infos, err = ioutil.ReadDir(tempDir)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(infos, qt.HasLen, 0)
+}
+
+var rewriteCharmRefTests = []struct {
+	ref    string
+	expect string
+}{{
+	ref:    "cs:~upstream/xenial/foo-3",
+	expect: "cs:~ourteam/xenial/foo-3",
+}, {
+	ref:    "~upstream/foo",
+	expect: "cs:~ourteam/foo",
+}, {
+	ref:    "cs:~other/quux",
+	expect: "cs:~other/quux",
+}, {
+	// Promulgated references are only rewritten by rules
+	// that keep promulgated revisions.
+	ref:    "cs:xenial/foo-3",
+	expect: "cs:xenial/foo-3",
+}, {
+	ref:    "cs:xenial/bar-3",
+	expect: "cs:xenial/baz-3",
+}, {
+	ref:    "local:xenial/foo",
+	expect: "local:xenial/foo",
+}, {
+	ref:    "./foo",
+	expect: "./foo",
+}}
+
+func TestRewriteCharmRef(t *testing.T) {
+	c := qt.New(t)
+	rules := []RewriteRule{{
+		Owner:   "upstream",
+		ToOwner: "ourteam",
+	}, {
+		Name:   "foo",
+		ToName: "bar",
+	}, {
+		Name:            "bar",
+		ToName:          "baz",
+		KeepPromulgated: true,
+	}}
+	for _, test := range rewriteCharmRefTests {
+		c.Check(rewriteCharmRef(rules, test.ref), qt.Equals, test.expect, qt.Commentf("%s", test.ref))
+	}
+}
+
+func TestRewriteBundleArchive(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name, content string
+	}{{
+		name:    "README.md",
+		content: "A bundle.\n",
+	}, {
+		name: "bundle.yaml",
+		content: `
+# A comment.
+applications:
+  wordpress:
+    charm: cs:~upstream/xenial/wordpress-5
+    num_units: 1
+  mysql:
+    charm: cs:~other/xenial/mysql-3
+relations:
+- [wordpress, mysql]
+`,
+	}} {
+		w, err := zw.Create(f.name)
+		c.Assert(err, qt.IsNil)
+		_, err = w.Write([]byte(f.content))
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(zw.Close(), qt.IsNil)
+	rewrite := func(ref string) string {
+		return strings.Replace(ref, "~upstream/", "~ourteam/", 1)
+	}
+	data, err := rewriteBundleArchive(buf.Bytes(), rewrite)
+	c.Assert(err, qt.IsNil)
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, qt.IsNil)
+	c.Assert(zr.File, qt.HasLen, 2)
+	c.Check(zr.File[0].Name, qt.Equals, "README.md")
+	readme, err := readZipFile(zr.File[0])
+	c.Assert(err, qt.IsNil)
+	c.Check(string(readme), qt.Equals, "A bundle.\n")
+	c.Check(zr.File[1].Name, qt.Equals, "bundle.yaml")
+	bundleYAML, err := readZipFile(zr.File[1])
+	c.Assert(err, qt.IsNil)
+	c.Check(string(bundleYAML), qt.Equals, `applications:
+  wordpress:
+    charm: cs:~ourteam/xenial/wordpress-5
+    num_units: 1
+  mysql:
+    charm: cs:~other/xenial/mysql-3
+relations:
+- - wordpress
+  - mysql
+`)
+
+	// An archive that doesn't change is returned as is.
+	data1, err := rewriteBundleArchive(data, rewrite)
+	c.Assert(err, qt.IsNil)
+	c.Check(&data1[0], qt.Equals, &data[0])
+}
+
+var historyTests = []struct {
+	testName       string
+	whitelist      WhitelistEntity
+	expectContents []entitySpec
+}{{
+	testName: "current_only",
+	whitelist: WhitelistEntity{
+		EntityId: "~bob/foo",
+		Channels: []params.Channel{params.StableChannel},
+	},
+	expectContents: []entitySpec{
+		historySpec("cs:~bob/foo-4", "*stable", "foo-4"),
+	},
+}, {
+	testName: "history",
+	whitelist: WhitelistEntity{
+		EntityId: "~bob/foo",
+		Channels: []params.Channel{params.StableChannel},
+		History:  3,
+	},
+	expectContents: []entitySpec{
+		historySpec("cs:~bob/foo-2", "stable", "foo-2"),
+		historySpec("cs:~bob/foo-3", "stable", "foo-3"),
+		historySpec("cs:~bob/foo-4", "*stable", "foo-4"),
+	},
+}, {
+	testName: "history_in_each_channel",
+	whitelist: WhitelistEntity{
+		EntityId: "~bob/foo",
+		Channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+		History:  2,
+	},
+	expectContents: []entitySpec{
+		historySpec("cs:~bob/foo-3", "stable", "foo-3"),
+		historySpec("cs:~bob/foo-4", "edge *stable", "foo-4"),
+		historySpec("cs:~bob/foo-5", "*edge", "foo-5"),
+	},
+}, {
+	testName: "since",
+	whitelist: WhitelistEntity{
+		EntityId: "~bob/foo",
+		Channels: []params.Channel{params.StableChannel},
+		History:  10,
+		Since:    time.Date(2020, 2, 15, 0, 0, 0, 0, time.UTC),
+	},
+	expectContents: []entitySpec{
+		historySpec("cs:~bob/foo-3", "stable", "foo-3"),
+		historySpec("cs:~bob/foo-4", "*stable", "foo-4"),
+	},
+}, {
+	testName: "since_without_history",
+	whitelist: WhitelistEntity{
+		EntityId: "~bob/foo",
+		Channels: []params.Channel{params.StableChannel},
+		Since:    time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC),
+	},
+	expectContents: []entitySpec{
+		historySpec("cs:~bob/foo-2", "stable", "foo-2"),
+		historySpec("cs:~bob/foo-3", "stable", "foo-3"),
+		historySpec("cs:~bob/foo-4", "*stable", "foo-4"),
+	},
+}, {
+	testName: "max_history_size",
+	whitelist: WhitelistEntity{
+		EntityId:       "~bob/foo",
+		Channels:       []params.Channel{params.StableChannel},
+		History:        10,
+		MaxHistorySize: 50,
+	},
+	// foo-3 has a 100 byte resource, so neither it nor
+	// anything earlier is copied.
+	expectContents: []entitySpec{
+		historySpec("cs:~bob/foo-4", "*stable", "foo-4"),
+	},
+}, {
+	testName: "max_history_size_without_resources",
+	whitelist: WhitelistEntity{
+		EntityId:       "~bob/foo",
+		Channels:       []params.Channel{params.StableChannel},
+		History:        10,
+		MaxHistorySize: 10,
+		SkipResources:  true,
+	},
+	expectContents: []entitySpec{
+		historySpec("cs:~bob/foo-2", "stable", "foo-2"),
+		historySpec("cs:~bob/foo-3", "stable", "foo-3"),
+		historySpec("cs:~bob/foo-4", "*stable", "foo-4"),
+	},
+}}
+
+func historySpec(id, chans, content string) entitySpec {
+	return entitySpec{
+		id:      id,
+		chans:   chans,
+		content: content,
+	}
+}
+
+func TestIngestHistory(t *testing.T) {
+	c := qt.New(t)
+	src := []entitySpec{{
+		id:         "cs:~bob/foo-1",
+		chans:      "stable",
+		content:    "foo-1",
+		uploadTime: "2020-01-01",
+	}, {
+		id:         "cs:~bob/foo-2",
+		chans:      "stable",
+		content:    "foo-2",
+		uploadTime: "2020-02-01",
+	}, {
+		id:         "cs:~bob/foo-3",
+		chans:      "stable",
+		resources:  "r",
+		content:    "foo-3",
+		uploadTime: "2020-03-01",
+	}, {
+		id:         "cs:~bob/foo-4",
+		chans:      "*stable edge",
+		content:    "foo-4",
+		uploadTime: "2020-04-01",
+	}, {
+		id:         "cs:~bob/foo-5",
+		chans:      "*edge",
+		content:    "foo-5",
+		uploadTime: "2020-05-01",
+	}}
+	srcBaseEntities := []baseEntitySpec{{
+		id: "cs:~bob/foo",
+		resources: map[string]string{
+			"r:0": strings.Repeat("x", 100),
+		},
+		published: "stable,r:0",
+	}}
+	for _, test := range historyTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			srcStore := newFakeCharmStore(src, srcBaseEntities)
+			destStore := newFakeCharmStore(nil, nil)
+			p := ingestParams{
+				src:       srcStore,
+				dest:      destStore,
+				whitelist: []WhitelistEntity{test.whitelist},
+				log:       testLogFunc(c),
+			}
+			stats := ingest(p)
+			c.Assert(stats.Errors, qt.HasLen, 0)
+			c.Check(destStore.entityContents(), deepEquals, test.expectContents)
+
+			vstats := verify(p)
+			c.Check(vstats.Errors, qt.HasLen, 0)
+			c.Check(vstats.Drift, qt.HasLen, 0)
+
+			if test.whitelist.Since.IsZero() {
+				return
+			}
+			// The upload times are kept when the revisions are
+			// exported, so the same revisions are copied from a
+			// directory that all of them have been exported to.
+			dir, err := openDirClient(c.Mkdir())
+			c.Assert(err, qt.Equals, nil)
+			stats = ingest(ingestParams{
+				src:  srcStore,
+				dest: dir,
+				whitelist: []WhitelistEntity{{
+					EntityId: "~bob/foo",
+					Channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+					History:  10,
+				}},
+				log: testLogFunc(c),
+			})
+			c.Assert(stats.Errors, qt.HasLen, 0)
+			destStore = newFakeCharmStore(nil, nil)
+			stats = ingest(ingestParams{
+				src:       dir,
+				dest:      destStore,
+				whitelist: []WhitelistEntity{test.whitelist},
+				log:       testLogFunc(c),
+			})
+			c.Assert(stats.Errors, qt.HasLen, 0)
+			c.Check(destStore.entityContents(), deepEquals, test.expectContents)
+		})
+	}
+}
+
+func TestIngestWithSeparateConcurrency(t *testing.T) {
+	c := qt.New(t)
+	var entities []entitySpec
+	var baseEntities []baseEntitySpec
+	var whitelist []WhitelistEntity
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("cs:~bob/charm%d", i)
+		entities = append(entities, entitySpec{
+			id:        id + "-1",
+			chans:     "*stable",
+			resources: "r",
+			content:   id,
+		})
+		baseEntities = append(baseEntities, baseEntitySpec{
+			id: id,
+			resources: map[string]string{
+				"r:0": "resource " + id,
+			},
+			published: "stable,r:0",
+		})
+		whitelist = append(whitelist, WhitelistEntity{
+			EntityId: id,
+			Channels: []params.Channel{params.StableChannel},
+		})
+	}
+	srcStore := &concurrencyCheckingCharmStore{
+		fakeCharmStore: newFakeCharmStore(entities, baseEntities),
+	}
+	destStore := &concurrencyCheckingCharmStore{
+		fakeCharmStore: newFakeCharmStore(nil, nil),
+	}
+	stats := ingest(ingestParams{
+		src:             srcStore,
+		dest:            destStore,
+		whitelist:       whitelist,
+		log:             testLogFunc(c),
+		srcConcurrency:  2,
+		destConcurrency: 3,
+	})
+	c.Assert(stats.Errors, qt.HasLen, 0)
+	c.Check(stats.ArchivesCopiedCount, qt.Equals, 10)
+	c.Check(stats.ResourcesCopiedCount, qt.Equals, 10)
+	c.Check(srcStore.max(), qt.Equals, 2)
+	c.Check(destStore.max(), qt.Equals, 3)
+}
+
+func TestRateLimiter(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(newRateLimiter(0), qt.IsNil)
+	r := strings.NewReader("x")
+	c.Assert(limitReader(context.Background(), r, nil, nil), qt.Equals, io.Reader(r))
+
+	// Two readers sharing a limiter of 1000 bytes a second
+	// take at least 200ms to read 300 bytes between them.
+	l := newRateLimiter(1000)
+	c.Assert(l.maxChunk(), qt.Equals, 100)
+	data := strings.Repeat("x", 150)
+	t0 := time.Now()
+	done := make(chan string)
+	for i := 0; i < 2; i++ {
+		go func() {
+			data, err := ioutil.ReadAll(l.reader(context.Background(), strings.NewReader(data)))
+			c.Check(err, qt.Equals, nil)
+			done <- string(data)
+		}()
+	}
+	c.Check(<-done, qt.Equals, data)
+	c.Check(<-done, qt.Equals, data)
+	c.Check(time.Since(t0) >= 200*time.Millisecond, qt.Equals, true)
+
+	// ReadAt is limited too.
+	l = newRateLimiter(1000)
+	buf := make([]byte, 250)
+	t0 = time.Now()
+	n, err := l.readerAt(context.Background(), strings.NewReader(strings.Repeat("y", 300))).ReadAt(buf, 50)
+	c.Assert(err, qt.Equals, nil)
+	c.Check(n, qt.Equals, 250)
+	c.Check(string(buf), qt.Equals, strings.Repeat("y", 250))
+	c.Check(time.Since(t0) >= 150*time.Millisecond, qt.Equals, true)
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	c := qt.New(t)
+	// Use up the next minute's allowance so that
+	// reads have to wait.
+	l := newRateLimiter(10)
+	l.reserve(600)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	t0 := time.Now()
+	n, err := l.reader(ctx, strings.NewReader("xx")).Read(make([]byte, 2))
+	c.Check(err, qt.Equals, context.Canceled)
+	c.Check(n, qt.Equals, 1)
+	n, err = l.readerAt(ctx, strings.NewReader("yy")).ReadAt(make([]byte, 2), 0)
+	c.Check(err, qt.Equals, context.Canceled)
+	c.Check(n, qt.Equals, 1)
+	c.Check(time.Since(t0) < 10*time.Second, qt.Equals, true)
+}
+
+func TestIngestContainerImages(t *testing.T) {
+	c := qt.New(t)
+	reg := newFakeRegistry()
+	defer reg.Close()
+	image := reg.addImage("cs/charmers/wordpress/image", "layer one", "layer two")
+	_, digest := splitDigest(image)
+	external := "docker.io/library/mysql@sha256:0123456789abcdef"
+
+	srcStore := newFakeCharmStore([]entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		resources: "image db",
+		content:   "some stuff",
+	}}, []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"image:0": "oci-image:" + image,
+			"db:3":    "oci-image:external::" + external,
+		},
+		published: "stable,image:0,db:3",
+	}})
+	whitelist := []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+		Channels: []params.Channel{params.StableChannel},
+	}}
+
+	// A dry run doesn't touch either registry.
+	destStore := newFakeCharmStore(nil, nil)
+	destStore.registry = reg.host()
+	stats := ingest(ingestParams{
+		src:       srcStore,
+		dest:      destStore,
+		whitelist: whitelist,
+		log:       testLogFunc(c),
+		registry:  reg.client(),
+		dryRun:    true,
+	})
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(stats.Plan, qt.HasLen, 1)
+	c.Check(stats.Plan[0].Resources, qt.DeepEquals, map[string][]int{
+		"image": {0},
+		"db":    {3},
+	})
+	c.Check(reg.manifest("charmers/wordpress/image", "latest"), qt.Equals, "")
+
+	stats = ingest(ingestParams{
+		src:       srcStore,
+		dest:      destStore,
+		whitelist: whitelist,
+		log:       testLogFunc(c),
+		registry:  reg.client(),
+	})
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(stats.ResourcesCopiedCount, qt.Equals, 2)
+	c.Check(destStore.baseEntityContents(), deepEquals, []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			// The image has been copied to the destination registry.
+			"image:0": "oci-image:" + reg.host() + "/charmers/wordpress/image@" + digest,
+			// The external image is referred to directly.
+			"db:3": "oci-image:external::" + external,
+		},
+		published: "stable,db:3,image:0",
+		perms:     []string{"stable everyone admin"},
+	}})
+	c.Check(reg.manifest("charmers/wordpress/image", "latest"), qt.Equals, reg.manifest("cs/charmers/wordpress/image", digest))
+	c.Check(reg.copiedCount(), qt.Equals, 3)
+
+	// Ingesting again copies nothing.
+	stats = ingest(ingestParams{
+		src:       srcStore,
+		dest:      destStore,
+		whitelist: whitelist,
+		log:       testLogFunc(c),
+		registry:  reg.client(),
+	})
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(stats.ResourcesPresentCount, qt.Equals, 2)
+	c.Check(reg.copiedCount(), qt.Equals, 3)
+
+	// The images are verified by digest even though the
+	// copied image has a different name.
+	vstats := verify(ingestParams{
+		src:       srcStore,
+		dest:      destStore,
+		whitelist: whitelist,
+		log:       testLogFunc(c),
+		registry:  reg.client(),
+	})
+	c.Check(vstats.Errors, qt.HasLen, 0)
+	c.Check(vstats.Drift, qt.HasLen, 0)
+	c.Check(vstats.ResourceCount, qt.Equals, 2)
+}
+
+func TestIngestResumesImageUploads(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(&blobChunkSize, int64(4))
+	reg := newFakeRegistry()
+	defer reg.Close()
+	layers := []string{"layer one", "layer two"}
+	image := reg.addImage("cs/charmers/wordpress/image", layers...)
+	_, digest := splitDigest(image)
+	config := `{"architecture":"amd64"}`
+
+	srcStore := newFakeCharmStore([]entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		resources: "image",
+		content:   "some stuff",
+	}}, []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"image:0": "oci-image:" + image,
+		},
+		published: "stable,image:0",
+	}})
+	destStore := newFakeCharmStore(nil, nil)
+	destStore.registry = reg.host()
+	journalPath := filepath.Join(c.Mkdir(), "journal")
+	ingestWithJournal := func() IngestStats {
+		j, err := openJournal(journalPath)
+		c.Assert(err, qt.Equals, nil)
+		defer j.Close()
+		return ingest(ingestParams{
+			src:  srcStore,
+			dest: destStore,
+			whitelist: []WhitelistEntity{{
+				EntityId: "~charmers/wordpress",
+				Channels: []params.Channel{params.StableChannel},
+			}},
+			log:        testLogFunc(c),
+			registry:   reg.client(),
+			maxRetries: -1,
+			journal:    j,
+		})
+	}
+
+	// The upload of the config blob is interrupted
+	// after its first chunk.
+	reg.setMaxPatches(1)
+	stats := ingestWithJournal()
+	c.Check(stats.Errors, qt.HasLen, 1)
+	c.Check(reg.uploadedBytes(), qt.Equals, 4)
+
+	// When the ingest is resumed, the upload continues
+	// where it stopped, so no content is sent twice.
+	reg.setMaxPatches(0)
+	stats = ingestWithJournal()
+	c.Check(stats.Errors, qt.HasLen, 0)
+	c.Check(stats.ResourcesCopiedCount, qt.Equals, 1)
+	c.Check(reg.copiedCount(), qt.Equals, 3)
+	c.Check(reg.uploadedBytes(), qt.Equals, len(config)+len(layers[0])+len(layers[1]))
+	c.Check(reg.manifest("charmers/wordpress/image", "latest"), qt.Equals, reg.manifest("cs/charmers/wordpress/image", digest))
+}
+
+var verifySrc = []entitySpec{{
+	id:        "cs:~charmers/wordpress-4",
+	chans:     "*stable",
+	content:   "some stuff",
+	resources: "foo bar",
+	extraInfo: `{"x":45,"y":"hello"}`,
+}}
+
+var verifySrcBaseEntities = []baseEntitySpec{{
+	id: "cs:~charmers/wordpress",
+	resources: map[string]string{
+		"foo:0": "foo:0 content",
+		"bar:2": "bar:2 content",
+	},
+	published: "stable,foo:0,bar:2",
+}}
+
+var verifyTests = []struct {
+	testName         string
+	dest             []entitySpec
+	destBaseEntities []baseEntitySpec
+	expectDrift      []EntityDrift
+}{{
+	testName: "match",
+	dest:     verifySrc,
+	destBaseEntities: []baseEntitySpec{{
+		id:        "cs:~charmers/wordpress",
+		resources: verifySrcBaseEntities[0].resources,
+		published: verifySrcBaseEntities[0].published,
+		perms:     []string{"stable everyone admin"},
+	}},
+}, {
+	testName: "missing",
+	expectDrift: []EntityDrift{{
+		Id: "cs:~charmers/wordpress",
+		Differences: []Difference{{
+			What: "base entity",
+			Want: "cs:~charmers/wordpress",
+		}},
+	}},
+}, {
+	testName: "changed",
+	dest: []entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "stable",
+		content:   "other stuff",
+		resources: "foo bar",
+		extraInfo: `{"x":46}`,
+	}, {
+		id:      "cs:~charmers/wordpress-5",
+		chans:   "*stable",
+		content: "new stuff",
+	}},
+	destBaseEntities: []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo:0 content",
+		},
+		perms: []string{"stable bob admin"},
+	}},
+	expectDrift: []EntityDrift{{
+		Id: "cs:~charmers/wordpress",
+		Differences: []Difference{{
+			What: "read ACL in stable",
+			Want: "everyone",
+			Got:  "bob",
+		}},
+	}, {
+		Id: "cs:~charmers/wordpress-4",
+		Differences: []Difference{{
+			What: "archive size",
+			Want: "10",
+			Got:  "11",
+		}, {
+			What: "archive hash",
+			Want: hashOf("some stuff"),
+			Got:  hashOf("other stuff"),
+		}, {
+			What: "extra-info x",
+			Want: "45",
+			Got:  "46",
+		}, {
+			What: "extra-info y",
+			Want: `"hello"`,
+		}, {
+			What: "revision published in stable",
+			Want: "cs:~charmers/wordpress-4",
+			Got:  "cs:~charmers/wordpress-5",
+		}, {
+			What: "resource bar/2",
+			Want: "file, 13 bytes, hash " + hashOf("bar:2 content"),
+		}},
+	}},
+}, {
+	testName: "different_resources",
+	dest:     verifySrc,
+	destBaseEntities: []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo:0 changed",
+			"bar:1": "bar:1 content",
+			"bar:2": "bar:2 content",
+		},
+		published: "stable,foo:0,bar:1",
+		perms:     []string{"stable everyone admin"},
+	}},
+	expectDrift: []EntityDrift{{
+		Id: "cs:~charmers/wordpress-4",
+		Differences: []Difference{{
+			What: "resources published in stable",
+			Want: "bar/2 foo/0",
+			Got:  "bar/1 foo/0",
+		}, {
+			What: "resource foo/0",
+			Want: "file, 13 bytes, hash " + hashOf("foo:0 content"),
+			Got:  "file, 13 bytes, hash " + hashOf("foo:0 changed"),
+		}},
+	}},
+}}
+
+func TestVerify(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range verifyTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			stats := verify(ingestParams{
+				src:  newFakeCharmStore(verifySrc, verifySrcBaseEntities),
+				dest: newFakeCharmStore(test.dest, test.destBaseEntities),
+				whitelist: []WhitelistEntity{{
+					EntityId: "~charmers/wordpress",
+					Channels: []params.Channel{params.StableChannel},
+				}},
+				log: testLogFunc(c),
+			})
+			c.Check(stats.Errors, qt.HasLen, 0)
+			c.Check(stats.Drift, qt.DeepEquals, test.expectDrift)
+			c.Check(stats.OK(), qt.Equals, len(test.expectDrift) == 0)
+			c.Check(stats.BaseEntityCount, qt.Equals, 1)
+			c.Check(stats.EntityCount, qt.Equals, 1)
+		})
+	}
+}
+
+func TestVerifyAfterIngest(t *testing.T) {
+	c := qt.New(t)
+	srcStore := newFakeCharmStore(verifySrc, verifySrcBaseEntities)
+	destStore := newFakeCharmStore(nil, nil)
+	p := ingestParams{
+		src:  srcStore,
+		dest: destStore,
+		whitelist: []WhitelistEntity{{
+			EntityId: "~charmers/wordpress",
+			Channels: []params.Channel{params.StableChannel},
+		}},
+		log: testLogFunc(c),
+	}
+	stats := ingest(p)
+	c.Assert(stats.Errors, qt.HasLen, 0)
+	vstats := verify(p)
+	c.Check(vstats.Errors, qt.HasLen, 0)
+	c.Check(vstats.Drift, qt.HasLen, 0)
+	c.Check(vstats.ResourceCount, qt.Equals, 2)
+}
+
+var parseImageRefTests = []struct {
+	name        string
+	expectRef   imageRef
+	expectError string
+}{{
+	name: "registry.example.com/foo/bar:tag",
+	expectRef: imageRef{
+		host: "registry.example.com",
+		repo: "foo/bar",
+		tag:  "tag",
+	},
+}, {
+	name: "localhost:5000/foo@sha256:1234",
+	expectRef: imageRef{
+		host:   "localhost:5000",
+		repo:   "foo",
+		digest: "sha256:1234",
+	},
+}, {
+	name: "mysql",
+	expectRef: imageRef{
+		host: "registry-1.docker.io",
+		repo: "library/mysql",
+	},
+}, {
+	name: "docker.io/bob/mysql:5.7",
+	expectRef: imageRef{
+		host: "registry-1.docker.io",
+		repo: "bob/mysql",
+		tag:  "5.7",
+	},
+}, {
+	name:        "foo@md5:1234",
+	expectError: `unsupported digest in image name "foo@md5:1234"`,
+}}
+
+func TestParseImageRef(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range parseImageRefTests {
+		c.Run(test.name, func(c *qt.C) {
+			ref, err := parseImageRef(test.name)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(ref, qt.Equals, test.expectRef)
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	c := qt.New(t)
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo:pull"`)
+	c.Assert(scheme, qt.Equals, "bearer")
+	c.Assert(params, qt.DeepEquals, map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:foo:pull",
+	})
+	scheme, params = parseChallenge(`Basic realm="registry"`)
+	c.Assert(scheme, qt.Equals, "basic")
+	c.Assert(params, qt.DeepEquals, map[string]string{
+		"realm": "registry",
+	})
+}
+
+func TestIngestEvents(t *testing.T) {
+	c := qt.New(t)
+	srcStore := newFakeCharmStore([]entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		resources: "foo",
+		content:   "some stuff",
+	}}, []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo content",
+		},
+		published: "stable,foo:0",
+	}})
+	var events []Event
+	stats := ingest(ingestParams{
+		src:  srcStore,
+		dest: newFakeCharmStore(nil, nil),
+		whitelist: []WhitelistEntity{{
+			EntityId: "~charmers/wordpress",
+		}, {
+			EntityId: "~charmers/nothing",
+		}},
+		log: testLogFunc(c),
+		notify: func(e Event) {
+			c.Check(e.Time.IsZero(), qt.Equals, false)
+			e.Time = time.Time{}
+			events = append(events, e)
+		},
+	})
+	c.Check(stats.Errors, qt.DeepEquals, []string{
+		`entity "~charmers/nothing" is not available in stable channel`,
+	})
+	c.Check(events, qt.DeepEquals, []Event{{
+		Kind:  EventError,
+		Id:    "~charmers/nothing",
+		Error: `entity "~charmers/nothing" is not available in stable channel`,
+	}, {
+		Kind:     EventEntityResolved,
+		Id:       "cs:~charmers/wordpress-4",
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		Kind: EventArchiveDownloadStarted,
+		Id:   "cs:~charmers/wordpress-4",
+	}, {
+		Kind:  EventArchiveDownloadFinished,
+		Id:    "cs:~charmers/wordpress-4",
+		Bytes: int64(len("some stuff")),
+	}, {
+		Kind:      EventResourceTransferred,
+		Id:        "cs:~charmers/wordpress-4",
+		Resources: map[string]int{"foo": 0},
+		Bytes:     int64(len("foo content")),
+	}, {
+		Kind:      EventPublished,
+		Id:        "cs:~charmers/wordpress-4",
+		Channel:   params.StableChannel,
+		Resources: map[string]int{"foo": 0},
+	}, {
+		Kind:    EventPermissionsSet,
+		Id:      "cs:~charmers/wordpress-4",
+		Channel: params.StableChannel,
+		Read:    []string{"everyone"},
+		Write:   []string{"admin"},
+	}})
+}
+
+var reportTests = []struct {
+	testName        string
+	src             []entitySpec
+	srcBaseEntities []baseEntitySpec
+	dest            []entitySpec
+	whitelist       []WhitelistEntity
+	maxDisk         int64
+	expectEntities  []EntityReport
+}{{
+	testName: "not_found",
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/nothing",
+	}},
+	expectEntities: []EntityReport{{
+		Id:      "~charmers/nothing",
+		Outcome: OutcomeFailed,
+		Errors: []IngestError{{
+			Id:      "~charmers/nothing",
+			Kind:    ErrorNotFound,
+			Message: `entity "~charmers/nothing" is not available in stable channel`,
+		}},
+	}},
+}, {
+	testName: "hash_mismatch",
+	src: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "some stuff",
+	}},
+	dest: []entitySpec{{
+		id:      "cs:~charmers/wordpress-4",
+		chans:   "*stable",
+		content: "other stuff",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+	}},
+	expectEntities: []EntityReport{{
+		Id:      "cs:~charmers/wordpress-4",
+		Outcome: OutcomeFailed,
+		Errors: []IngestError{{
+			Id:      "cs:~charmers/wordpress-4",
+			Kind:    ErrorHashMismatch,
+			Message: `"cs:~charmers/wordpress-4" already exists with different size (want 10 got 11)`,
+		}},
+	}},
+}, {
+	testName: "disk_limit",
+	src: []entitySpec{{
+		id:        "cs:~charmers/wordpress-4",
+		chans:     "*stable",
+		resources: "foo",
+		content:   "some stuff",
+	}},
+	srcBaseEntities: []baseEntitySpec{{
+		id: "cs:~charmers/wordpress",
+		resources: map[string]string{
+			"foo:0": "foo content",
+		},
+		published: "stable,foo:0",
+	}},
+	whitelist: []WhitelistEntity{{
+		EntityId: "~charmers/wordpress",
+	}},
+	maxDisk: 5,
+	expectEntities: []EntityReport{{
+		Id:          "cs:~charmers/wordpress-4",
+		Outcome:     OutcomeFailed,
+		BytesCopied: 10,
+		Errors: []IngestError{{
+			Id:      "cs:~charmers/wordpress-4",
+			Kind:    ErrorDiskLimit,
+			Message: `cannot make temp file for resource cs:~charmers/wordpress-4/foo/0: too much space required (need 11, max 5)`,
+		}},
+	}},
+}}
+
+func TestIngestReport(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range reportTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			stats := ingest(ingestParams{
+				src:       newFakeCharmStore(test.src, test.srcBaseEntities),
+				dest:      newFakeCharmStore(test.dest, nil),
+				whitelist: test.whitelist,
+				maxDisk:   test.maxDisk,
+				log:       testLogFunc(c),
+			})
+			c.Check(stats.Entities, qt.DeepEquals, test.expectEntities)
+		})
+	}
+}
+
+var errorKindTests = []struct {
+	testName   string
+	err        error
+	expectKind ErrorKind
+}{{
+	testName:   "not_found",
+	err:        errgo.WithCausef(nil, errNotFound, ""),
+	expectKind: ErrorNotFound,
+}, {
+	testName:   "charmstore_not_found",
+	err:        errgo.Notef(errgo.Mask(params.ErrNotFound), "cannot get archive"),
+	expectKind: ErrorNotFound,
+}, {
+	testName:   "unauthorized",
+	err:        errgo.Notef(errgo.Mask(params.ErrUnauthorized), "cannot get archive"),
+	expectKind: ErrorPermissionDenied,
+}, {
+	testName:   "forbidden",
+	err:        errgo.Mask(params.ErrForbidden),
+	expectKind: ErrorPermissionDenied,
+}, {
+	testName:   "hash_mismatch",
+	err:        errgo.Notef(errgo.WithCausef(nil, errHashMismatch, "bad hash"), "cannot put archive"),
+	expectKind: ErrorHashMismatch,
+}, {
+	testName:   "disk_limit",
+	err:        errgo.WithCausef(nil, errDiskLimit, "too big"),
+	expectKind: ErrorDiskLimit,
+}, {
+	testName:   "other",
+	err:        errgo.New("something went wrong"),
+	expectKind: ErrorOther,
+}, {
+	testName:   "nil",
+	expectKind: ErrorOther,
+}}
+
+func TestErrorKind(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range errorKindTests {
+		test := test
+		c.Run(test.testName, func(c *qt.C) {
+			c.Assert(errorKind(test.err), qt.Equals, test.expectKind)
+		})
+	}
+}
+
+var isRetryableTests = []struct {
+	testName         string
+	err              error
+	expectRetry      bool
+	expectRetryAfter time.Duration
+}{{
+	testName: "not_found",
+	err:      errgo.WithCausef(nil, errNotFound, ""),
+}, {
+	testName: "charmstore_error",
+	err:      errgo.Notef(params.ErrForbidden, "cannot get archive"),
+}, {
+	testName:    "http_status",
+	err:         errgo.Notef(&httpStatusError{status: "502 Bad Gateway"}, "cannot get archive"),
+	expectRetry: true,
+}, {
+	testName: "http_status_with_retry_after",
+	err: &url.Error{
+		Op:  "Get",
+		URL: "http://0.1.2.3",
+		Err: &httpStatusError{status: "429 Too Many Requests", retryAfter: 5 * time.Second},
+	},
+	expectRetry:      true,
+	expectRetryAfter: 5 * time.Second,
+}, {
+	testName: "connection_reset",
+	err: errgo.Mask(&url.Error{
+		Op:  "Get",
+		URL: "http://0.1.2.3",
+		Err: &net.OpError{
+			Op:  "read",
+			Err: os.NewSyscallError("read", syscall.ECONNRESET),
+		},
+	}),
+	expectRetry: true,
+}, {
+	testName:    "unexpected_eof",
+	err:         errgo.Notef(io.ErrUnexpectedEOF, "cannot read"),
+	expectRetry: true,
+}}
+
+func TestIsRetryable(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range isRetryableTests {
+		c.Run(test.testName, func(c *qt.C) {
+			retry, retryAfter := isRetryable(test.err)
+			c.Check(retry, qt.Equals, test.expectRetry)
+			c.Check(retryAfter, qt.Equals, test.expectRetryAfter)
+		})
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/unavailable":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"Message":"overloaded"}`))
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/bad-gateway":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/internal-error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/not-implemented":
+			w.WriteHeader(http.StatusNotImplemented)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+	client := &http.Client{
+		Transport: NewTransport(nil),
+	}
+
+	_, err := client.Get(srv.URL + "/unavailable")
+	c.Assert(err, qt.ErrorMatches, `.*: 503 Service Unavailable: overloaded`)
+	retry, retryAfter := isRetryable(err)
+	c.Assert(retry, qt.Equals, true)
+	c.Assert(retryAfter, qt.Equals, 7*time.Second)
+
+	_, err = client.Get(srv.URL + "/bad-gateway")
+	c.Assert(err, qt.ErrorMatches, `.*: 502 Bad Gateway`)
+	retry, _ = isRetryable(err)
+	c.Assert(retry, qt.Equals, true)
+
+	// Other errors, including server errors that won't go away
+	// if the request is repeated, are returned as responses.
+	for _, test := range []struct {
+		path string
+		code int
+	}{
+		{"/forbidden", http.StatusForbidden},
+		{"/internal-error", http.StatusInternalServerError},
+		{"/not-implemented", http.StatusNotImplemented},
+	} {
+		resp, err := client.Get(srv.URL + test.path)
+		c.Assert(err, qt.Equals, nil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, test.code)
+	}
+
+	resp, err := client.Get(srv.URL + "/ok")
+	c.Assert(err, qt.Equals, nil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+}
+
 func testLogFunc(c *qt.C) func(s string) {
 	return func(s string) {
 		c.Logf("LOG %s", s)
@@ -0,0 +1,297 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// journalStep identifies the kind of step recorded in a journal.
+type journalStep string
+
+const (
+	// stepArchive records that an entity's archive and extra-info
+	// have been uploaded or were found to be present.
+	stepArchive journalStep = "archive"
+
+	// stepResource records that a resource revision has been
+	// uploaded or was found to be present.
+	stepResource journalStep = "resource"
+
+	// stepPublish records that an entity has been published
+	// to a channel with a set of resources.
+	stepPublish journalStep = "publish"
+
+	// stepPerms records that the permissions on a channel
+	// of a base entity have been set.
+	stepPerms journalStep = "perms"
+
+	// stepBlobUpload records the location of an upload of a
+	// container image blob to a registry, after each chunk of
+	// the blob has been sent, so that an interrupted upload
+	// can be continued rather than started again.
+	stepBlobUpload journalStep = "blob-upload"
+)
+
+// journalEntry holds a completed step in a journal.
+type journalEntry struct {
+	Step journalStep `json:"step"`
+
+	// Id holds the canonical id of the entity for archive
+	// and publish steps, the base entity id for resource
+	// and perms steps, and the registry host and repository
+	// for blob upload steps.
+	Id string `json:"id"`
+
+	// Hash holds the hash of the entity's archive, or the
+	// digest of the blob for blob upload steps.
+	Hash string `json:"hash,omitempty"`
+
+	// Channel holds the channel for publish and perms steps.
+	Channel params.Channel `json:"channel,omitempty"`
+
+	// Detail holds the resource name and revision for
+	// resource steps, the published resources for publish
+	// steps, the permissions for perms steps and the upload
+	// location for blob upload steps.
+	Detail string `json:"detail,omitempty"`
+
+	// Dest holds the name of the destination that the step
+	// was done in, when an ingest has several.
+	Dest string `json:"dest,omitempty"`
+}
+
+// journal records the steps of an ingest that have been
+// completed, so that an interrupted ingest can be resumed
+// without repeating them. It is stored in a file holding
+// one JSON-encoded journalEntry per line.
+//
+// A nil *journal records nothing.
+type journal struct {
+	// dest holds the name of the destination that the
+	// journal records steps for, if it has one.
+	dest string
+	*journalFile
+}
+
+// journalFile holds the steps recorded for all
+// the destinations of an ingest.
+type journalFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[journalEntry]bool
+
+	// uploads holds the most recently recorded location of
+	// each blob upload, keyed by its entry without the Detail.
+	uploads map[journalEntry]string
+}
+
+// openJournal opens the journal stored in the given file,
+// creating it if it doesn't exist.
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	j := &journal{
+		journalFile: &journalFile{
+			f:       f,
+			done:    make(map[journalEntry]bool),
+			uploads: make(map[journalEntry]string),
+		},
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line can be incomplete if the
+			// ingest was killed while writing it.
+			continue
+		}
+		j.add(e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, errgo.Notef(err, "cannot read journal")
+	}
+	// Terminate any incomplete last line so that
+	// new entries start on a line of their own.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := f.Write([]byte("\n")); err != nil {
+				f.Close()
+				return nil, errgo.Notef(err, "cannot write journal")
+			}
+		}
+	}
+	return j, nil
+}
+
+// forDest returns a journal that records the steps for the
+// destination with the given name in the same file as j.
+func (j *journal) forDest(name string) *journal {
+	if j == nil || name == "" {
+		return j
+	}
+	return &journal{
+		dest:        name,
+		journalFile: j.journalFile,
+	}
+}
+
+// isDone reports whether the given step has been recorded.
+func (j *journal) isDone(e journalEntry) bool {
+	if j == nil {
+		return false
+	}
+	e.Dest = j.dest
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done[e]
+}
+
+// record records that the given step has been completed.
+func (j *journal) record(e journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	e.Dest = j.dest
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// An upload can return to an earlier location, which
+	// must be recorded again to be the most recent one.
+	if j.done[e] && e.Step != stepBlobUpload {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return errgo.Notef(err, "cannot write journal")
+	}
+	j.add(e)
+	return nil
+}
+
+// add adds e to the steps held in memory.
+// It must be called with j.mu held.
+func (j *journalFile) add(e journalEntry) {
+	j.done[e] = true
+	if e.Step == stepBlobUpload {
+		location := e.Detail
+		e.Detail = ""
+		j.uploads[e] = location
+	}
+}
+
+// uploadLocation returns the location most recently recorded
+// by recordUpload for the upload of the blob with the given
+// digest to the given repository, or "" if there is none.
+func (j *journal) uploadLocation(repo, digest string) string {
+	if j == nil {
+		return ""
+	}
+	e := blobUploadStep(repo, digest, "")
+	e.Dest = j.dest
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.uploads[e]
+}
+
+// recordUpload records the location at which to continue
+// the upload of the blob with the given digest to the
+// given repository.
+func (j *journal) recordUpload(repo, digest, location string) error {
+	return j.record(blobUploadStep(repo, digest, location))
+}
+
+// Close closes the journal file.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// archiveStep returns the journal entry recording that
+// the archive for e has been transferred.
+func archiveStep(e *entityInfo) journalEntry {
+	return journalEntry{
+		Step: stepArchive,
+		Id:   e.id.String(),
+		Hash: e.hash,
+	}
+}
+
+// resourceStep returns the journal entry recording that
+// the given resource revision for id has been transferred.
+func resourceStep(id *charm.URL, name string, rev int) journalEntry {
+	return journalEntry{
+		Step:   stepResource,
+		Id:     baseEntityId(id).String(),
+		Detail: fmt.Sprintf("%s/%d", name, rev),
+	}
+}
+
+// publishStep returns the journal entry recording that e
+// has been published to the given channel with the given resources.
+func publishStep(e *entityInfo, ch params.Channel, resources map[string]int) journalEntry {
+	revs := make([]string, 0, len(resources))
+	for name, rev := range resources {
+		revs = append(revs, fmt.Sprintf("%s/%d", name, rev))
+	}
+	sort.Strings(revs)
+	return journalEntry{
+		Step:    stepPublish,
+		Id:      e.id.String(),
+		Hash:    e.hash,
+		Channel: ch,
+		Detail:  strings.Join(revs, ","),
+	}
+}
+
+// permsStep returns the journal entry recording that the
+// permissions on the given channel of the base entity with
+// the given id have been set to perm.
+func permsStep(baseId *charm.URL, ch params.Channel, perm permission) journalEntry {
+	return journalEntry{
+		Step:    stepPerms,
+		Id:      baseId.String(),
+		Channel: ch,
+		Detail:  "read=" + strings.Join(perm.read, ",") + ";write=" + strings.Join(perm.write, ","),
+	}
+}
+
+// blobUploadStep returns the journal entry recording that the
+// upload of the blob with the given digest to the given
+// repository can be continued at the given location.
+func blobUploadStep(repo, digest, location string) journalEntry {
+	return journalEntry{
+		Step:   stepBlobUpload,
+		Id:     repo,
+		Hash:   digest,
+		Detail: location,
+	}
+}
+
+// stepDone records that the given step has been completed.
+// Nothing is recorded in a dry run.
+func (ing *ingester) stepDone(e journalEntry) {
+	if ing.params.dryRun {
+		return
+	}
+	if err := ing.params.journal.record(e); err != nil {
+		ing.errorf("%v", err)
+	}
+}
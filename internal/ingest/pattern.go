@@ -0,0 +1,176 @@
+package ingest
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// entityPattern holds a parsed whitelist entry that
+// matches many entities.
+type entityPattern struct {
+	owner  string
+	series string
+	name   string
+}
+
+// isPattern reports whether the given whitelist entity id
+// is a pattern that can match more than one entity.
+func isPattern(id string) bool {
+	return strings.ContainsAny(id, "*?[")
+}
+
+// parsePattern parses a whitelist entity id that is a pattern,
+// such as cs:~partner/* or cs:~partner/xenial/k8s-*.
+// Only the name part may contain wildcards, which are
+// interpreted as by path.Match.
+func parsePattern(id string) (*entityPattern, error) {
+	s := strings.TrimPrefix(id, "cs:")
+	if !strings.HasPrefix(s, "~") {
+		return nil, errgo.Newf("pattern %q must specify an owner", id)
+	}
+	parts := strings.Split(s[1:], "/")
+	var p entityPattern
+	switch len(parts) {
+	case 2:
+		p.owner, p.name = parts[0], parts[1]
+	case 3:
+		p.owner, p.series, p.name = parts[0], parts[1], parts[2]
+	default:
+		return nil, errgo.Newf("invalid pattern %q", id)
+	}
+	if p.owner == "" || p.name == "" || isPattern(p.owner) || isPattern(p.series) {
+		return nil, errgo.Newf("invalid pattern %q", id)
+	}
+	if _, err := path.Match(p.name, ""); err != nil {
+		return nil, errgo.Newf("invalid pattern %q", id)
+	}
+	return &p, nil
+}
+
+// expandPattern returns a whitelist entry for each of the entities
+// in the source charmstore matched by the pattern in e.EntityId
+// and by its series filter and not by its exclusions. Each entry
+// holds the channels from e in which the entity was found. When
+// e names a source, only the entities in that source are matched.
+func (ing *ingester) expandPattern(e WhitelistEntity) ([]WhitelistEntity, error) {
+	p, err := parsePattern(e.EntityId)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	series := e.Series
+	if p.series != "" {
+		series = []string{p.series}
+	}
+	lister := ing.params.src
+	if e.Source != "" {
+		if ing.sources == nil {
+			return nil, errgo.Newf("unknown source %q", e.Source)
+		}
+		lister, err = ing.sources.named(e.Source)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	found := make(map[string][]params.Channel)
+	for _, ch := range e.Channels {
+		ing.limiter.start()
+		ids, err := lister.listEntities(ing.params.ctx, ch, p.owner)
+		ing.limiter.stop()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot list entities owned by %q", p.owner)
+		}
+		for _, id := range ids {
+			if !p.matches(id, e.Exclude) {
+				continue
+			}
+			if len(series) > 0 {
+				ok, err := ing.hasSeries(lister, ch, id, series)
+				if err != nil {
+					return nil, errgo.Mask(err)
+				}
+				if !ok {
+					continue
+				}
+			}
+			// Several revisions of an entity can be
+			// published in the same channel.
+			key := id.WithRevision(-1).String()
+			if chans := found[key]; len(chans) == 0 || chans[len(chans)-1] != ch {
+				found[key] = append(chans, ch)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil, errgo.WithCausef(nil, errNotFound, "no entities match %q", e.EntityId)
+	}
+	entities := make([]WhitelistEntity, 0, len(found))
+	for id, chans := range found {
+		entities = append(entities, WhitelistEntity{
+			EntityId:       id,
+			Channels:       chans,
+			SkipResources:  e.SkipResources,
+			History:        e.History,
+			Since:          e.Since,
+			MaxHistorySize: e.MaxHistorySize,
+			Source:         e.Source,
+		})
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].EntityId < entities[j].EntityId
+	})
+	return entities, nil
+}
+
+// hasSeries reports whether the entity with the given id in the
+// given channel has one of the given series. The id of a
+// multi-series charm holds no series, so the series supported
+// by the charm are fetched from the source.
+func (ing *ingester) hasSeries(src csClient, ch params.Channel, id *charm.URL, series []string) (bool, error) {
+	if id.Series != "" {
+		return containsString(series, id.Series), nil
+	}
+	ing.limiter.start()
+	info, err := src.entityInfo(ing.params.ctx, ch, id)
+	ing.limiter.stop()
+	if err != nil {
+		return false, errgo.Notef(err, "cannot get supported series of %v", id)
+	}
+	for _, s := range info.supportedSeries {
+		if containsString(series, s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matches reports whether the given entity id is matched by p
+// and is not matched by any of the exclude patterns.
+func (p *entityPattern) matches(id *charm.URL, exclude []string) bool {
+	if id.User != p.owner {
+		return false
+	}
+	if ok, _ := path.Match(p.name, id.Name); !ok {
+		return false
+	}
+	for _, x := range exclude {
+		if ok, _ := path.Match(x, id.Name); ok {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// EntityPlan describes the changes that an ingest would make
+// to the destination charmstore for a single entity.
+type EntityPlan struct {
+	// Id holds the canonical id of the entity.
+	Id string
+
+	// UploadArchive holds whether the entity's archive
+	// would be uploaded.
+	UploadArchive bool
+
+	// Resources holds a map from resource name to the
+	// revisions of that resource that would be uploaded.
+	Resources map[string][]int
+
+	// Publish holds the channels that the entity would be
+	// published to, with the resource revisions published
+	// alongside it.
+	Publish []PublishPlan
+
+	// ExtraInfo holds the extra-info keys that would be
+	// changed. Keys that would be removed are included too.
+	ExtraInfo []string
+
+	// CommonInfo holds the common-info keys that would be
+	// changed on the entity's base entity.
+	CommonInfo []string
+
+	// Perms holds the permissions that would be set.
+	Perms []PermPlan
+}
+
+// IsEmpty reports whether the plan holds no changes.
+func (p *EntityPlan) IsEmpty() bool {
+	return !p.UploadArchive &&
+		len(p.Resources) == 0 &&
+		len(p.Publish) == 0 &&
+		len(p.ExtraInfo) == 0 &&
+		len(p.CommonInfo) == 0 &&
+		len(p.Perms) == 0
+}
+
+// PublishPlan describes a publish operation.
+type PublishPlan struct {
+	Channel   params.Channel
+	Resources map[string]int
+}
+
+// PermPlan describes a permission change on a channel.
+type PermPlan struct {
+	Channel params.Channel
+	Read    []string
+	Write   []string
+}
+
+// planClient is a csClient that passes read operations through to
+// another client and records mutating operations instead of
+// performing them.
+type planClient struct {
+	csClient
+
+	mu    sync.Mutex
+	plans map[string]*EntityPlan
+	// uploaded holds the base ids of all entities that
+	// would have had their archive uploaded.
+	uploaded map[charm.URL]bool
+}
+
+var _ csClient = (*planClient)(nil)
+
+func newPlanClient(dest csClient) *planClient {
+	return &planClient{
+		csClient: dest,
+		plans:    make(map[string]*EntityPlan),
+		uploaded: make(map[charm.URL]bool),
+	}
+}
+
+// plan returns the plan for the given id, creating it if needed.
+// It must be called with c.mu held.
+func (c *planClient) plan(id *charm.URL) *EntityPlan {
+	p := c.plans[id.String()]
+	if p == nil {
+		p = &EntityPlan{
+			Id: id.String(),
+		}
+		c.plans[id.String()] = p
+	}
+	return p
+}
+
+// getBaseEntity implements csClient.getBaseEntity. When the base entity
+// doesn't exist in the destination but one of its archives would
+// have been uploaded, it returns the permissions that the
+// charmstore gives to a newly uploaded entity.
+func (c *planClient) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
+	be, err := c.csClient.getBaseEntity(ctx, id)
+	if err == nil || errgo.Cause(err) != errNotFound {
+		return be, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.uploaded[*baseEntityId(id)] {
+		return nil, err
+	}
+	perms := make(map[params.Channel]permission)
+	for ch := range params.ValidChannels {
+		perms[ch] = permission{
+			read:  []string{id.User},
+			write: []string{id.User},
+		}
+	}
+	return &baseEntityInfo{
+		perms: perms,
+	}, nil
+}
+
+// putArchive implements csClient.putArchive by recording
+// that the archive would be uploaded.
+func (c *planClient) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plan(id).UploadArchive = true
+	c.uploaded[*baseEntityId(id)] = true
+	return nil
+}
+
+// putExtraInfo implements csClient.putExtraInfo by recording
+// the keys that would be changed.
+func (c *planClient) putExtraInfo(ctx context.Context, id *charm.URL, extraInfo map[string]json.RawMessage) error {
+	if len(extraInfo) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.plan(id)
+	for k := range extraInfo {
+		p.ExtraInfo = append(p.ExtraInfo, k)
+	}
+	sort.Strings(p.ExtraInfo)
+	return nil
+}
+
+// putCommonInfo implements csClient.putCommonInfo by recording
+// the keys that would be changed.
+func (c *planClient) putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error {
+	if len(commonInfo) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.plan(id)
+	for k := range commonInfo {
+		p.CommonInfo = append(p.CommonInfo, k)
+	}
+	sort.Strings(p.CommonInfo)
+	return nil
+}
+
+// setPerm implements csClient.setPerm by recording the permissions
+// that would be set if they differ from the current ones.
+func (c *planClient) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
+	be, err := c.getBaseEntity(ctx, id)
+	if err != nil && errgo.Cause(err) != errNotFound {
+		return errgo.Mask(err)
+	}
+	if be != nil {
+		if current, ok := be.perms[ch]; ok && stringsEqual(current.read, perm.read) && stringsEqual(current.write, perm.write) {
+			return nil
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.plan(id)
+	p.Perms = append(p.Perms, PermPlan{
+		Channel: ch,
+		Read:    perm.read,
+		Write:   perm.write,
+	})
+	sort.Slice(p.Perms, func(i, j int) bool {
+		return p.Perms[i].Channel < p.Perms[j].Channel
+	})
+	return nil
+}
+
+// publish implements csClient.publish by recording the channels
+// that the entity would be published to. Channels in which
+// the entity is already current with the same resources are omitted.
+func (c *planClient) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	var publish []PublishPlan
+	for _, ch := range channels {
+		current, err := c.csClient.entityInfo(ctx, ch, id.WithRevision(-1))
+		if err != nil && errgo.Cause(err) != errNotFound {
+			return errgo.Mask(err)
+		}
+		if current != nil && *current.id == *id && resourcesEqual(current.resources, resources) {
+			continue
+		}
+		publish = append(publish, PublishPlan{
+			Channel:   ch,
+			Resources: resources,
+		})
+	}
+	if len(publish) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.plan(id)
+	p.Publish = append(p.Publish, publish...)
+	sort.Slice(p.Publish, func(i, j int) bool {
+		return p.Publish[i].Channel < p.Publish[j].Channel
+	})
+	return nil
+}
+
+// putResource implements csClient.putResource by recording
+// the resource revision that would be uploaded.
+func (c *planClient) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.plan(id)
+	if p.Resources == nil {
+		p.Resources = make(map[string][]int)
+	}
+	p.Resources[name] = append(p.Resources[name], rev)
+	sort.Ints(p.Resources[name])
+	return nil
+}
+
+// putDockerResource implements csClient.putDockerResource by
+// recording the resource revision that would be added.
+func (c *planClient) putDockerResource(ctx context.Context, id *charm.URL, name string, rev int, imageName, digest string) error {
+	return c.putResource(ctx, id, name, rev, nil, 0)
+}
+
+// entityPlans returns the recorded plans for all the given
+// entities, sorted by id. Entities with no changes are included
+// with an empty plan.
+func (c *planClient) entityPlans(es map[string]*whitelistBaseEntity) []EntityPlan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var plans []EntityPlan
+	for _, be := range es {
+		for _, e := range be.entities {
+			plans = append(plans, *c.plan(e.id))
+		}
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].Id < plans[j].Id
+	})
+	return plans
+}
+
+// resourcesEqual reports whether the resources returned by
+// csClient.entityInfo match the given published resource revisions.
+func resourcesEqual(current map[string][]int, resources map[string]int) bool {
+	if len(current) != len(resources) {
+		return false
+	}
+	for name, rev := range resources {
+		if revs := current[name]; len(revs) != 1 || revs[0] != rev {
+			return false
+		}
+	}
+	return true
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
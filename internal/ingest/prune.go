@@ -0,0 +1,223 @@
+package ingest
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// PruneMode specifies what an ingest does with base entities in
+// the destination that are not included by the whitelist.
+type PruneMode string
+
+const (
+	// PruneNone specifies that the destination is not
+	// checked for entities that aren't whitelisted.
+	PruneNone PruneMode = ""
+
+	// PruneReport specifies that entities that aren't
+	// whitelisted are reported in IngestStats.Orphans
+	// but otherwise left alone.
+	PruneReport PruneMode = "report"
+
+	// PruneRevoke specifies that entities that aren't
+	// whitelisted are reported and that read access to
+	// them is revoked from everyone who can't write them,
+	// so that they're no longer visible.
+	PruneRevoke PruneMode = "revoke"
+)
+
+// Orphan describes a base entity in the destination that
+// is not included by the whitelist.
+type Orphan struct {
+	// Id holds the base entity id (for example cs:~bob/wordpress).
+	Id string
+
+	// Channels holds the channels that the base entity
+	// is published to in the destination.
+	Channels []params.Channel
+
+	// Revoked holds whether read access was revoked. In a dry
+	// run, it holds whether read access would have been revoked.
+	Revoked bool
+}
+
+// orphanChannels holds the channels that are searched for orphans.
+var orphanChannels = append(append([]params.Channel(nil), params.OrderedChannels...), params.UnpublishedChannel)
+
+// prune looks for base entities in the destination owned by the
+// owners in ing.params.pruneOwners that aren't in the resolved
+// entities, and reports them or revokes read access to them
+// depending on the prune mode. Protected entities are never touched.
+func (ing *ingester) prune(resolvedEntities map[string]*whitelistBaseEntity, resolveFailed bool) []Orphan {
+	mode := ing.params.prune
+	if mode == PruneNone {
+		return nil
+	}
+	if mode == PruneRevoke && resolveFailed {
+		// If some of the whitelist couldn't be resolved, some
+		// whitelisted entities could look like orphans.
+		ing.errorf("not revoking access to orphaned entities because the whitelist could not be resolved completely")
+		mode = PruneReport
+	}
+	owners := ing.params.pruneOwners
+	if len(owners) == 0 {
+		owners = resolvedOwners(resolvedEntities)
+	}
+	ing.logf("looking for orphaned entities owned by %s", strings.Join(owners, ", "))
+	// found maps from base id to the channels it's published
+	// in, to an id that can be used to set its permissions.
+	found := make(map[string]map[params.Channel]*charm.URL)
+	for _, owner := range owners {
+		if ing.isProtectedOwner(owner) {
+			continue
+		}
+		for _, ch := range orphanChannels {
+			ing.limiter.start()
+			ids, err := ing.params.dest.listEntities(ing.params.ctx, ch, owner)
+			ing.limiter.stop()
+			if err != nil {
+				ing.errorf("cannot list entities owned by %q in %s in destination: %v", owner, ch, err)
+				continue
+			}
+			for _, id := range ids {
+				baseId := baseEntityId(id)
+				if resolvedEntities[baseId.String()] != nil || ing.isProtected(baseId) {
+					continue
+				}
+				if found[baseId.String()] == nil {
+					found[baseId.String()] = make(map[params.Channel]*charm.URL)
+				}
+				found[baseId.String()][ch] = id
+			}
+		}
+	}
+	orphans := make([]Orphan, 0, len(found))
+	for baseId, chans := range found {
+		o := Orphan{
+			Id: baseId,
+		}
+		for ch := range chans {
+			o.Channels = append(o.Channels, ch)
+		}
+		o.Channels = sortedChannels(o.Channels)
+		ing.logf("%s is not whitelisted", baseId)
+		ing.notify(Event{
+			Kind:     EventOrphanFound,
+			Id:       baseId,
+			Channels: o.Channels,
+		})
+		orphans = append(orphans, o)
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Id < orphans[j].Id
+	})
+	if mode != PruneRevoke {
+		return orphans
+	}
+	for i := range orphans {
+		o := &orphans[i]
+		ing.limiter.do(func() {
+			o.Revoked = ing.revokeRead(o, found[o.Id])
+		})
+	}
+	ing.limiter.wait()
+	return orphans
+}
+
+// revokeRead revokes read access to the given orphan in all
+// the given channels from everyone that can't write to it,
+// and reports whether that succeeded. When nobody can write
+// to it in a channel, only the owner is given read access; if
+// there's no owner either, access isn't revoked, as that would
+// leave the entity unreadable by anyone.
+func (ing *ingester) revokeRead(o *Orphan, chans map[params.Channel]*charm.URL) bool {
+	be, err := ing.params.dest.getBaseEntity(ing.params.ctx, chans[o.Channels[0]])
+	if err != nil {
+		ing.entityErrorf(o.Id, err, "cannot get base entity for %q: %v", o.Id, err)
+		return false
+	}
+	ok := true
+	for _, ch := range o.Channels {
+		id := chans[ch]
+		perm := be.perms[ch]
+		read := perm.write
+		if len(read) == 0 {
+			if ing.params.owner == "" {
+				ing.entityErrorf(o.Id, nil, "cannot revoke read access to %v (channel %s): no write ACL and no owner", o.Id, ch)
+				ok = false
+				continue
+			}
+			read = []string{ing.params.owner}
+		}
+		if stringsEqual(perm.read, read) {
+			// Access has already been revoked.
+			continue
+		}
+		newPerm := permission{
+			read:  read,
+			write: perm.write,
+		}
+		ing.logf("revoking read access to %s (channel %s); read: %s", o.Id, ch, read)
+		if err := ing.params.dest.setPerm(ing.params.ctx, id, ch, newPerm); err != nil {
+			ing.entityErrorf(o.Id, err, "cannot revoke read access to %v (channel %s): %v", o.Id, ch, err)
+			ok = false
+			continue
+		}
+		ing.notify(Event{
+			Kind:    EventPermissionsSet,
+			Id:      id.String(),
+			Channel: ch,
+			Read:    newPerm.read,
+			Write:   newPerm.write,
+		})
+	}
+	return ok
+}
+
+// isProtected reports whether the base entity with the given
+// id must not be pruned.
+func (ing *ingester) isProtected(baseId *charm.URL) bool {
+	if ing.isProtectedOwner(baseId.User) {
+		return true
+	}
+	for _, p := range ing.params.protectedIds {
+		if matchIdPattern(p, baseId) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIdPattern reports whether the given base entity id matches
+// the pattern, which may contain wildcards as interpreted by
+// path.Match. The "cs:" prefix is optional in the pattern.
+func matchIdPattern(pattern string, baseId *charm.URL) bool {
+	if !strings.HasPrefix(pattern, "cs:") {
+		pattern = "cs:" + pattern
+	}
+	ok, _ := path.Match(pattern, baseId.String())
+	return ok
+}
+
+func (ing *ingester) isProtectedOwner(owner string) bool {
+	return containsString(ing.params.protectedOwners, owner)
+}
+
+// resolvedOwners returns the owners of all the given base entities.
+func resolvedOwners(es map[string]*whitelistBaseEntity) []string {
+	found := make(map[string]bool)
+	var owners []string
+	for _, be := range es {
+		if !found[be.baseId.User] {
+			found[be.baseId.User] = true
+			owners = append(owners, be.baseId.User)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
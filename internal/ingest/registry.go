@@ -0,0 +1,648 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// imageInfo holds information on where to find a container image
+// resource, as returned by csClient.dockerResourceDownloadInfo
+// and csClient.dockerResourceUploadInfo.
+type imageInfo struct {
+	// imageName holds the name of the image in its registry.
+	// When downloading, it includes the digest of the image
+	// (for example registry.example.com/foo@sha256:1234...).
+	imageName string
+
+	// username and password hold credentials for the
+	// registry, if any.
+	username string
+	password string
+
+	// external holds whether the image is held in a
+	// registry that isn't associated with the charmstore.
+	// External images are not copied; the destination
+	// charmstore is given a reference to the same image.
+	external bool
+}
+
+// Media types of the manifests that can be copied.
+const (
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+var manifestMediaTypes = strings.Join([]string{
+	mediaTypeManifest,
+	mediaTypeManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+}, ", ")
+
+// imageRef holds a parsed image name.
+type imageRef struct {
+	// host holds the registry host name and optional port.
+	host string
+	// repo holds the path of the repository within the registry.
+	repo string
+	// tag holds the image tag, if any.
+	tag string
+	// digest holds the image digest, if any.
+	digest string
+}
+
+// parseImageRef parses an image name such as
+// registry.example.com/foo/bar:tag or docker.io/foo@sha256:1234.
+// Names without a registry host refer to Docker Hub.
+func parseImageRef(name string) (imageRef, error) {
+	var ref imageRef
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.digest = name[:i], name[i+1:]
+		if !strings.HasPrefix(ref.digest, "sha256:") {
+			return imageRef{}, errgo.Newf("unsupported digest in image name %q", name+"@"+ref.digest)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		name, ref.tag = name[:i], name[i+1:]
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.host, ref.repo = parts[0], parts[1]
+	} else {
+		ref.host, ref.repo = "docker.io", name
+	}
+	if ref.host == "docker.io" {
+		ref.host = "registry-1.docker.io"
+		if !strings.Contains(ref.repo, "/") {
+			ref.repo = "library/" + ref.repo
+		}
+	}
+	if ref.repo == "" {
+		return imageRef{}, errgo.Newf("invalid image name %q", name)
+	}
+	return ref, nil
+}
+
+// splitDigest splits an image name into the name
+// and the digest that follows its "@".
+func splitDigest(name string) (string, string) {
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// registryClient copies container images between Docker registries
+// using the registry HTTP API (version 2), so no local Docker
+// daemon is needed. Blobs are streamed directly from the source
+// registry to the destination registry.
+type registryClient struct {
+	client *http.Client
+
+	// download and upload limit the rate at which blobs are
+	// copied. Either may be nil.
+	download *rateLimiter
+	upload   *rateLimiter
+
+	// journal, if not nil, records the progress of blob uploads,
+	// which are then sent in chunks of blobChunkSize bytes so
+	// that an interrupted upload can be resumed.
+	journal *journal
+}
+
+// blobChunkSize holds the size of the chunks in which
+// blobs are uploaded when uploads can be resumed.
+var blobChunkSize int64 = 32 * 1024 * 1024
+
+// copyImage copies the image described by src, which must include
+// a digest, to the repository described by dest. It returns the
+// digest of the image and the number of bytes of blob data copied.
+// Blobs that are already present in the destination are not copied.
+// The copy is abandoned if ctx is done.
+func (c *registryClient) copyImage(ctx context.Context, src, dest *imageInfo) (string, int64, error) {
+	srcRef, err := parseImageRef(src.imageName)
+	if err != nil {
+		return "", 0, errgo.Mask(err)
+	}
+	if srcRef.digest == "" {
+		return "", 0, errgo.Newf("no digest in source image name %q", src.imageName)
+	}
+	destRef, err := parseImageRef(dest.imageName)
+	if err != nil {
+		return "", 0, errgo.Mask(err)
+	}
+	srcRepo, err := c.openRepo(ctx, srcRef, src, "pull")
+	if err != nil {
+		return "", 0, errgo.Notef(err, "cannot access source registry")
+	}
+	destRepo, err := c.openRepo(ctx, destRef, dest, "pull,push")
+	if err != nil {
+		return "", 0, errgo.Notef(err, "cannot access destination registry")
+	}
+	tag := destRef.tag
+	if tag == "" {
+		tag = "latest"
+	}
+	var n int64
+	if err := c.copyManifest(srcRepo, destRepo, srcRef.digest, tag, &n); err != nil {
+		return "", n, errgo.Mask(err)
+	}
+	return srcRef.digest, n, nil
+}
+
+// copyManifest copies the manifest with the given digest and everything
+// that it refers to from src to dest, where it will be stored under the
+// given reference. The number of blob bytes copied is added to *n.
+func (c *registryClient) copyManifest(src, dest *registryRepo, digest, ref string, n *int64) error {
+	data, mediaType, err := src.getManifest(digest)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var m struct {
+		Config    *descriptor  `json:"config"`
+		Layers    []descriptor `json:"layers"`
+		Manifests []descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return errgo.Notef(err, "cannot parse manifest %s", digest)
+	}
+	// The manifests in a manifest list must be in the
+	// destination before the list itself.
+	for _, d := range m.Manifests {
+		if err := c.copyManifest(src, dest, d.Digest, d.Digest, n); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append([]descriptor{*m.Config}, blobs...)
+	}
+	for _, d := range blobs {
+		size, err := c.copyBlob(src, dest, d.Digest, d.Size)
+		if err != nil {
+			return errgo.Notef(err, "cannot copy blob %s", d.Digest)
+		}
+		*n += size
+	}
+	if err := dest.putManifest(ref, mediaType, data, digest); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// descriptor holds a reference to a blob or
+// manifest within a manifest.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// copyBlob copies the blob with the given digest and size from
+// src to dest unless it's already there, and returns the number
+// of bytes copied. When c has a journal and the size is known,
+// the blob is uploaded in chunks, and an upload interrupted by
+// an earlier copy is continued from where it stopped.
+func (c *registryClient) copyBlob(src, dest *registryRepo, digest string, size int64) (int64, error) {
+	resp, err := dest.do("HEAD", "blobs/"+digest, nil, -1, nil)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return 0, nil
+	}
+	resumable := c.journal != nil && size > 0
+	var location *url.URL
+	var offset int64
+	if resumable {
+		location, offset = c.resumeUpload(dest, digest, size)
+	}
+	var h http.Header
+	if offset > 0 {
+		h = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err = src.do("GET", "blobs/"+digest, nil, -1, h)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+	case resp.StatusCode == http.StatusOK:
+		// The source registry might ignore the range.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return 0, errgo.Notef(err, "cannot skip uploaded part of blob")
+		}
+	default:
+		return 0, registryError(resp)
+	}
+	if location == nil {
+		location, err = dest.startUpload()
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+	}
+	// The blob is downloaded and uploaded at the same time,
+	// so both limits apply.
+	r := &countingReader{r: limitReader(src.ctx, resp.Body, c.download, c.upload)}
+	if !resumable {
+		if err := dest.finishUpload(location, digest, r, resp.ContentLength); err != nil {
+			return r.n, errgo.Mask(err)
+		}
+		return r.n, nil
+	}
+	for offset < size {
+		n := size - offset
+		if n > blobChunkSize {
+			n = blobChunkSize
+		}
+		location, err = dest.patchUpload(location, io.LimitReader(r, n), offset, n)
+		if err != nil {
+			return r.n, errgo.Mask(err)
+		}
+		offset += n
+		if err := c.journal.recordUpload(dest.name(), digest, location.String()); err != nil {
+			return r.n, errgo.Mask(err)
+		}
+	}
+	if err := dest.finishUpload(location, digest, nil, 0); err != nil {
+		return r.n, errgo.Mask(err)
+	}
+	return r.n, nil
+}
+
+// resumeUpload returns the location and offset at which to
+// continue the upload of the blob with the given digest and
+// size to dest that was recorded in the journal. It returns
+// a nil location if there's no upload that can be continued,
+// for example because the registry has discarded it.
+func (c *registryClient) resumeUpload(dest *registryRepo, digest string, size int64) (*url.URL, int64) {
+	recorded := c.journal.uploadLocation(dest.name(), digest)
+	if recorded == "" {
+		return nil, 0
+	}
+	u, err := url.Parse(recorded)
+	if err != nil {
+		return nil, 0
+	}
+	offset, location, err := dest.uploadStatus(u)
+	if err != nil || offset <= 0 || offset > size {
+		return nil, 0
+	}
+	return location, offset
+}
+
+// registryRepo holds a repository in a registry.
+type registryRepo struct {
+	// ctx is used for all requests to the repository.
+	ctx    context.Context
+	client *http.Client
+	host   string
+	repo   string
+
+	// auth holds the value of the Authorization header
+	// to send with requests, if any.
+	auth string
+}
+
+// openRepo returns a registryRepo for the repository in ref,
+// authenticated with the credentials in info for the given actions.
+// All requests to the repository are made with the given context.
+func (c *registryClient) openRepo(ctx context.Context, ref imageRef, info *imageInfo, actions string) (*registryRepo, error) {
+	r := &registryRepo{
+		ctx:    ctx,
+		client: c.client,
+		host:   ref.host,
+		repo:   ref.repo,
+	}
+	// Find out how the registry wants us to authenticate.
+	req, err := http.NewRequestWithContext(r.ctx, "GET", "https://"+r.host+"/v2/", nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return r, nil
+	case http.StatusUnauthorized:
+	default:
+		return nil, registryError(resp)
+	}
+	scheme, challenge := parseChallenge(resp.Header.Get("Www-Authenticate"))
+	switch scheme {
+	case "basic":
+		req, _ := http.NewRequest("GET", "", nil)
+		req.SetBasicAuth(info.username, info.password)
+		r.auth = req.Header.Get("Authorization")
+		return r, nil
+	case "bearer":
+		token, err := r.getToken(challenge, info, "repository:"+ref.repo+":"+actions)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		r.auth = "Bearer " + token
+		return r, nil
+	}
+	return nil, errgo.Newf("unsupported registry authentication scheme %q", scheme)
+}
+
+// getToken gets a token from the token server described
+// by the given bearer challenge.
+func (r *registryRepo) getToken(challenge map[string]string, info *imageInfo, scope string) (string, error) {
+	u, err := url.Parse(challenge["realm"])
+	if err != nil || u.Scheme == "" {
+		return "", errgo.Newf("invalid token realm %q", challenge["realm"])
+	}
+	q := u.Query()
+	if service := challenge["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(r.ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if info.username != "" || info.password != "" {
+		req.SetBasicAuth(info.username, info.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errgo.Notef(registryError(resp), "cannot get registry token")
+	}
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", errgo.Notef(err, "cannot decode registry token")
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", errgo.New("no token in registry token response")
+}
+
+// getManifest returns the manifest with the given digest
+// along with its media type, checking that its content
+// matches the digest.
+func (r *registryRepo) getManifest(digest string) ([]byte, string, error) {
+	resp, err := r.do("GET", "manifests/"+digest, nil, -1, http.Header{
+		"Accept": {manifestMediaTypes},
+	})
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errgo.Notef(registryError(resp), "cannot get manifest %s", digest)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot read manifest %s", digest)
+	}
+	if got := digestOf(data); got != digest {
+		return nil, "", errgo.WithCausef(nil, errHashMismatch, "manifest has digest %s, expected %s", got, digest)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// putManifest stores the given manifest, which has
+// the given digest, under the given reference.
+func (r *registryRepo) putManifest(ref, mediaType string, data []byte, digest string) error {
+	resp, err := r.do("PUT", "manifests/"+ref, bytes.NewReader(data), int64(len(data)), http.Header{
+		"Content-Type": {mediaType},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errgo.Notef(registryError(resp), "cannot put manifest %s", digest)
+	}
+	if got := resp.Header.Get("Docker-Content-Digest"); got != "" && got != digest {
+		return errgo.WithCausef(nil, errHashMismatch, "destination registry stored manifest with digest %s, expected %s", got, digest)
+	}
+	return nil
+}
+
+// name returns the registry host and repository of r.
+func (r *registryRepo) name() string {
+	return r.host + "/" + r.repo
+}
+
+// startUpload starts a blob upload and returns
+// the URL to upload the blob content to.
+func (r *registryRepo) startUpload() (*url.URL, error) {
+	resp, err := r.do("POST", "blobs/uploads/", nil, 0, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, errgo.Notef(registryError(resp), "cannot start blob upload")
+	}
+	return uploadLocation(resp)
+}
+
+// patchUpload sends size bytes read from body as the part of
+// the blob starting at the given offset to the upload at the
+// given location, and returns the location at which to
+// continue the upload.
+func (r *registryRepo) patchUpload(location *url.URL, body io.Reader, offset, size int64) (*url.URL, error) {
+	resp, err := r.doURL("PATCH", location, body, size, http.Header{
+		"Content-Type":  {"application/octet-stream"},
+		"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+size-1)},
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, errgo.Notef(registryError(resp), "cannot upload blob chunk")
+	}
+	return uploadLocation(resp)
+}
+
+// uploadStatus returns the number of bytes of the blob that the
+// registry has received for the upload at the given location,
+// and the location at which to continue the upload.
+func (r *registryRepo) uploadStatus(location *url.URL) (int64, *url.URL, error) {
+	resp, err := r.doURL("GET", location, nil, -1, nil)
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, nil, errgo.Notef(registryError(resp), "cannot get blob upload status")
+	}
+	// The range is inclusive, so an upload that has received
+	// nothing reports 0-0, like one that has received a single
+	// byte; both are treated as empty.
+	var start, end int64
+	rangeHeader := strings.TrimPrefix(resp.Header.Get("Range"), "bytes=")
+	if _, err := fmt.Sscanf(rangeHeader, "%d-%d", &start, &end); err != nil || start != 0 {
+		return 0, nil, errgo.Newf("invalid blob upload range %q", rangeHeader)
+	}
+	if end == 0 {
+		return 0, location, nil
+	}
+	if resp.Header.Get("Location") == "" {
+		return end + 1, location, nil
+	}
+	next, err := uploadLocation(resp)
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	return end + 1, next, nil
+}
+
+// finishUpload completes the upload at the given location of
+// the blob with the given digest, sending size bytes read from
+// body as its final part.
+func (r *registryRepo) finishUpload(location *url.URL, digest string, body io.Reader, size int64) error {
+	u := *location
+	// The registry checks that the content matches the digest.
+	u.RawQuery = addQuery(u.RawQuery, "digest", digest)
+	resp, err := r.doURL("PUT", &u, body, size, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return registryError(resp)
+	}
+	return nil
+}
+
+// uploadLocation returns the location at which to continue
+// the blob upload that resp was a response to.
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid blob upload location")
+	}
+	return location, nil
+}
+
+// do sends a request to the given path within the repository.
+func (r *registryRepo) do(method, path string, body io.Reader, size int64, h http.Header) (*http.Response, error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   r.host,
+		Path:   "/v2/" + r.repo + "/" + path,
+	}
+	return r.doURL(method, u, body, size, h)
+}
+
+// doURL sends a request to the given URL, which should
+// be within the repository.
+func (r *registryRepo) doURL(method string, u *url.URL, body io.Reader, size int64, h http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if r.auth != "" {
+		req.Header.Set("Authorization", r.auth)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return resp, nil
+}
+
+// registryError returns an error describing an
+// unexpected response from a registry.
+func registryError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	var errResp struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && len(errResp.Errors) > 0 {
+		return errgo.Newf("registry error: %s: %s", errResp.Errors[0].Code, errResp.Errors[0].Message)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errgo.WithCausef(nil, errNotFound, "registry error: %s", resp.Status)
+	}
+	return errgo.Newf("registry error: %s", resp.Status)
+}
+
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// parseChallenge parses the value of a WWW-Authenticate header,
+// returning the lower-cased authentication scheme and its parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	h = strings.TrimSpace(h)
+	scheme := h
+	if i := strings.Index(h, " "); i >= 0 {
+		scheme = h[:i]
+	}
+	params := make(map[string]string)
+	for _, m := range challengeParamPattern.FindAllStringSubmatch(h[len(scheme):], -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	return strings.ToLower(scheme), params
+}
+
+// addQuery adds the given key and value to a URL query string.
+func addQuery(rawQuery, key, value string) string {
+	q := url.Values{key: {value}}.Encode()
+	if rawQuery == "" {
+		return q
+	}
+	return rawQuery + "&" + q
+}
+
+// digestOf returns the registry digest of the given content.
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
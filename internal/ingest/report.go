@@ -0,0 +1,206 @@
+package ingest
+
+import (
+	"sort"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+)
+
+var (
+	// errHashMismatch is used as the cause of errors
+	// that are caused by archive or resource content
+	// that doesn't match its expected size or hash.
+	errHashMismatch = errgo.New("content mismatch")
+
+	// errDiskLimit is used as the cause of errors caused by
+	// content that is too large for the disk limit.
+	errDiskLimit = errgo.New("disk limit exceeded")
+)
+
+// ErrorKind classifies an IngestError.
+type ErrorKind string
+
+const (
+	// ErrorNotFound is used when an entity or resource
+	// could not be found.
+	ErrorNotFound ErrorKind = "not-found"
+
+	// ErrorPermissionDenied is used when a charmstore
+	// refused access to an entity or resource.
+	ErrorPermissionDenied ErrorKind = "permission-denied"
+
+	// ErrorHashMismatch is used when content does not
+	// match its expected hash or size, including when an
+	// entity already exists in the destination with
+	// different content.
+	ErrorHashMismatch ErrorKind = "hash-mismatch"
+
+	// ErrorDiskLimit is used when a resource is too
+	// large for the disk limit.
+	ErrorDiskLimit ErrorKind = "disk-limit"
+
+	// ErrorOther is used for all other errors.
+	ErrorOther ErrorKind = "other"
+)
+
+// IngestError describes an error encountered during an ingest.
+type IngestError struct {
+	// Id holds the id that the error relates to. This is usually
+	// the canonical id of an entity, but it can also be a base
+	// entity id or an id from the whitelist that could not be
+	// resolved. It is empty if the error does not relate to
+	// any particular entity.
+	Id string
+
+	// Kind holds the kind of the error.
+	Kind ErrorKind
+
+	// Message holds the error message, as also found
+	// in IngestStats.Errors.
+	Message string
+}
+
+// EntityOutcome describes what happened to an entity.
+type EntityOutcome string
+
+const (
+	// OutcomeCopied is used when the entity's archive was copied.
+	OutcomeCopied EntityOutcome = "copied"
+
+	// OutcomePresent is used when the entity already existed
+	// in the destination. Its metadata may still have been updated.
+	OutcomePresent EntityOutcome = "present"
+
+	// OutcomeUnchanged is used when the entity was not
+	// checked in the destination because it has not changed
+	// since it was last synced. See IngestParams.SyncCache.
+	OutcomeUnchanged EntityOutcome = "unchanged"
+
+	// OutcomeFailed is used when the entity could not
+	// be transferred completely.
+	OutcomeFailed EntityOutcome = "failed"
+)
+
+// EntityReport holds the outcome of transferring
+// a single entity.
+type EntityReport struct {
+	// Id holds the id of the entity. See IngestError.Id
+	// for the kinds of id that can be found here.
+	Id string
+
+	// Outcome holds what happened to the entity.
+	Outcome EntityOutcome
+
+	// ResourcesCopied holds the number of resource revisions
+	// copied for the entity. As resources are shared between
+	// all revisions of a charm, each resource revision is only
+	// counted against one of them.
+	ResourcesCopied int
+
+	// BytesCopied holds the total size of the archive
+	// and resources copied for the entity.
+	BytesCopied int64
+
+	// Errors holds any errors encountered when
+	// transferring the entity.
+	Errors []IngestError
+
+	// RequiredBy holds the bundles that required the
+	// entity, if it was included because of a bundle.
+	RequiredBy []BundleDependency `json:",omitempty"`
+
+	// Source holds the name of the source that the entity
+	// was taken from, when there are several sources.
+	Source string `json:",omitempty"`
+}
+
+// BundleDependency describes a bundle that requires a charm.
+type BundleDependency struct {
+	// Bundle holds the canonical id of the bundle.
+	Bundle string
+
+	// BundleChannel holds the channel that the bundle
+	// was found in.
+	BundleChannel params.Channel
+
+	// Channel holds the source channel that the charm was found
+	// in. This is BundleChannel if the charm is published there,
+	// and otherwise the first channel in params.OrderedChannels
+	// that it's published in.
+	Channel params.Channel
+}
+
+func sortBundleDependencies(deps []BundleDependency) {
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].Bundle != deps[j].Bundle {
+			return deps[i].Bundle < deps[j].Bundle
+		}
+		return deps[i].BundleChannel < deps[j].BundleChannel
+	})
+}
+
+// errorKind returns the kind of the given error, determined
+// from the causes of the errors that it wraps.
+func errorKind(err error) ErrorKind {
+	for ; err != nil; err = underlyingError(err) {
+		switch errgo.Cause(err) {
+		case errNotFound, params.ErrNotFound, params.ErrMetadataNotFound:
+			return ErrorNotFound
+		case params.ErrUnauthorized, params.ErrForbidden:
+			return ErrorPermissionDenied
+		case errHashMismatch:
+			return ErrorHashMismatch
+		case errDiskLimit:
+			return ErrorDiskLimit
+		}
+	}
+	return ErrorOther
+}
+
+// entityReports returns a report for each resolved entity, and for
+// any other ids that errors have been recorded against, sorted by id.
+func (ing *ingester) entityReports(es map[string]*whitelistBaseEntity) []EntityReport {
+	ing.mu.Lock()
+	defer ing.mu.Unlock()
+	var reports []EntityReport
+	reported := make(map[string]bool)
+	for _, baseEntity := range es {
+		for _, e := range baseEntity.entities {
+			id := e.id.String()
+			reported[id] = true
+			r := EntityReport{
+				Id:              id,
+				Outcome:         OutcomePresent,
+				ResourcesCopied: e.resourcesCopied,
+				BytesCopied:     e.bytesCopied,
+				Errors:          ing.entityErrors[id],
+				RequiredBy:      e.requiredBy,
+				Source:          e.source,
+			}
+			switch {
+			case !e.synced || len(r.Errors) > 0:
+				r.Outcome = OutcomeFailed
+			case e.archiveCopied:
+				r.Outcome = OutcomeCopied
+			case e.unchanged:
+				r.Outcome = OutcomeUnchanged
+			}
+			reports = append(reports, r)
+		}
+	}
+	for id, errs := range ing.entityErrors {
+		if reported[id] || id == "" {
+			continue
+		}
+		reports = append(reports, EntityReport{
+			Id:      id,
+			Outcome: OutcomeFailed,
+			Errors:  errs,
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Id < reports[j].Id
+	})
+	return reports
+}
@@ -0,0 +1,401 @@
+package ingest
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// DefaultMaxRetries holds the default number of times that
+// a remote operation will be retried after a temporary failure.
+const DefaultMaxRetries = 3
+
+const (
+	// defaultRetryDelay holds the delay before the first retry.
+	// Each subsequent retry doubles the delay.
+	defaultRetryDelay = time.Second
+
+	// maxRetryDelay holds the maximum delay between retries,
+	// unless the server asks for a longer delay.
+	maxRetryDelay = time.Minute
+)
+
+// NewTransport returns an HTTP transport that can be used for the
+// charmstore clients passed to Ingest. It returns an error for
+// any response with a 502 (Bad Gateway), 503 (Service Unavailable),
+// 504 (Gateway Timeout) or 429 (Too Many Requests) status,
+// allowing Ingest to recognise that the request can be retried,
+// and honouring any Retry-After header in the response. Other
+// responses are returned unchanged.
+//
+// If t is nil, http.DefaultTransport will be used.
+func NewTransport(t http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	return statusTransport{t}
+}
+
+type statusTransport struct {
+	t http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if !isTemporaryStatus(resp.StatusCode) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &httpStatusError{
+		code:       resp.StatusCode,
+		status:     resp.Status,
+		message:    errorMessage(body),
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// httpStatusError is the error returned by statusTransport
+// for responses that indicate a temporary failure.
+type httpStatusError struct {
+	code       int
+	status     string
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	if e.message == "" {
+		return e.status
+	}
+	return fmt.Sprintf("%s: %s", e.status, e.message)
+}
+
+// isTemporaryStatus reports whether an HTTP response with the
+// given status code indicates a failure that might go away if
+// the request is made again. Other server errors (for example
+// 500 or 501) are unlikely to do so.
+func isTemporaryStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// errorMessage returns the message from an HTTP error
+// response body.
+func errorMessage(body []byte) string {
+	var perr params.Error
+	if err := json.Unmarshal(body, &perr); err == nil && perr.Message != "" {
+		return perr.Message
+	}
+	return string(body)
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// which can hold either a number of seconds or a date.
+// It returns zero if the value is empty or invalid.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(s); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// isRetryable reports whether err looks like a temporary failure
+// that might succeed if the operation is tried again. If the
+// server specified how long to wait before retrying, that's
+// returned too.
+func isRetryable(err error) (bool, time.Duration) {
+	for err != nil {
+		switch err1 := err.(type) {
+		case *httpStatusError:
+			return true, err1.retryAfter
+		case net.Error:
+			if err1.Timeout() {
+				return true, 0
+			}
+		}
+		switch err {
+		case io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE:
+			return true, 0
+		}
+		err = underlyingError(err)
+	}
+	return false, 0
+}
+
+// underlyingError returns the error wrapped by err,
+// or nil if there is none.
+func underlyingError(err error) error {
+	switch err := err.(type) {
+	case errgo.Wrapper:
+		return err.Underlying()
+	case interface{ Unwrap() error }:
+		return err.Unwrap()
+	}
+	return nil
+}
+
+// retry calls f until it succeeds, it returns an error that is
+// not retryable, it has been retried the maximum number of
+// times, or ctx is done. It must be called while holding a limiter
+// slot, which is released while waiting to retry so that other
+// operations can proceed.
+func (ing *ingester) retry(ctx context.Context, what string, f func() error) error {
+	delay := ing.params.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		ok, retryAfter := isRetryable(err)
+		if !ok || attempt >= ing.params.maxRetries || ctx.Err() != nil {
+			return err
+		}
+		// Use a random delay between delay/2 and delay so that
+		// failed operations don't all retry at the same moment.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if wait < retryAfter {
+			wait = retryAfter
+		}
+		ing.mu.Lock()
+		ing.retryCount++
+		ing.mu.Unlock()
+		ing.logf("%s failed (attempt %d): %v; retrying in %v", what, attempt+1, err, wait)
+		ing.limiter.stop()
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+		ing.limiter.start()
+		if ctx.Err() != nil {
+			return err
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// retryClient implements csClient by retrying operations
+// on another client when they fail with temporary errors.
+type retryClient struct {
+	c   csClient
+	ing *ingester
+}
+
+var _ csClient = retryClient{}
+
+func (c retryClient) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	var info *entityInfo
+	err := c.ing.retry(ctx, fmt.Sprintf("get info on %v", id), func() error {
+		var err error
+		info, err = c.c.entityInfo(ctx, ch, id)
+		return err
+	})
+	return info, err
+}
+
+func (c retryClient) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
+	var be *baseEntityInfo
+	err := c.ing.retry(ctx, fmt.Sprintf("get base entity for %v", id), func() error {
+		var err error
+		be, err = c.c.getBaseEntity(ctx, id)
+		return err
+	})
+	return be, err
+}
+
+func (c retryClient) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := c.ing.retry(ctx, fmt.Sprintf("get archive for %v", id), func() error {
+		var err error
+		r, err = c.c.getArchive(ctx, id)
+		return err
+	})
+	return r, err
+}
+
+// putArchive implements csClient.putArchive. Uploads can't be
+// repeated, and a failed attempt (for example one that timed out
+// at a proxy) might actually have succeeded, so before trying
+// again it checks whether the destination already has the archive.
+func (c retryClient) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	attempt := 0
+	return c.ing.retry(ctx, fmt.Sprintf("put archive for %v", id), func() error {
+		if attempt++; attempt > 1 {
+			info, err := c.c.entityInfo(ctx, params.NoChannel, id)
+			if err == nil && info.hash == hash {
+				c.ing.logf("archive for %v was uploaded by a failed attempt", id)
+				return nil
+			}
+			if err != nil && errgo.Cause(err) != errNotFound {
+				return errgo.Mask(err, errgo.Any)
+			}
+			if _, err := r.Seek(0, io.SeekStart); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return c.c.putArchive(ctx, id, r, hash, size, promulgatedRevision, channels, uploadTime)
+	})
+}
+
+func (c retryClient) putExtraInfo(ctx context.Context, id *charm.URL, extraInfo map[string]json.RawMessage) error {
+	return c.ing.retry(ctx, fmt.Sprintf("put extra-info for %v", id), func() error {
+		return c.c.putExtraInfo(ctx, id, extraInfo)
+	})
+}
+
+func (c retryClient) putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error {
+	return c.ing.retry(ctx, fmt.Sprintf("put common-info for %v", id), func() error {
+		return c.c.putCommonInfo(ctx, id, commonInfo)
+	})
+}
+
+func (c retryClient) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
+	return c.ing.retry(ctx, fmt.Sprintf("set permissions on %v", id), func() error {
+		return c.c.setPerm(ctx, id, ch, perm)
+	})
+}
+
+func (c retryClient) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	return c.ing.retry(ctx, fmt.Sprintf("publish %v", id), func() error {
+		return c.c.publish(ctx, id, channels, resources)
+	})
+}
+
+func (c retryClient) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	var info *resourceInfo
+	err := c.ing.retry(ctx, fmt.Sprintf("get info on resource %v/%s/%d", id, name, rev), func() error {
+		var err error
+		info, err = c.c.resourceInfo(ctx, id, name, rev)
+		return err
+	})
+	return info, err
+}
+
+func (c retryClient) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	var r io.ReadCloser
+	var size int64
+	err := c.ing.retry(ctx, fmt.Sprintf("get resource %v/%s/%d", id, name, rev), func() error {
+		var err error
+		r, size, err = c.c.getResource(ctx, id, name, rev)
+		return err
+	})
+	return r, size, err
+}
+
+func (c retryClient) dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error) {
+	var info *imageInfo
+	err := c.ing.retry(ctx, fmt.Sprintf("get download info for resource %v/%s/%d", id, name, rev), func() error {
+		var err error
+		info, err = c.c.dockerResourceDownloadInfo(ctx, id, name, rev)
+		return err
+	})
+	return info, err
+}
+
+func (c retryClient) dockerResourceUploadInfo(ctx context.Context, id *charm.URL, name string) (*imageInfo, error) {
+	var info *imageInfo
+	err := c.ing.retry(ctx, fmt.Sprintf("get upload info for resource %v/%s", id, name), func() error {
+		var err error
+		info, err = c.c.dockerResourceUploadInfo(ctx, id, name)
+		return err
+	})
+	return info, err
+}
+
+func (c retryClient) putDockerResource(ctx context.Context, id *charm.URL, name string, rev int, imageName, digest string) error {
+	return c.ing.retry(ctx, fmt.Sprintf("put resource %v/%s/%d", id, name, rev), func() error {
+		return c.c.putDockerResource(ctx, id, name, rev, imageName, digest)
+	})
+}
+
+func (c retryClient) listEntities(ctx context.Context, ch params.Channel, owner string) ([]*charm.URL, error) {
+	var ids []*charm.URL
+	err := c.ing.retry(ctx, fmt.Sprintf("list entities owned by %s in %s channel", owner, ch), func() error {
+		var err error
+		ids, err = c.c.listEntities(ctx, ch, owner)
+		return err
+	})
+	return ids, err
+}
+
+func (c retryClient) revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error) {
+	var ids []*charm.URL
+	err := c.ing.retry(ctx, fmt.Sprintf("get revisions of %v in %s channel", id, ch), func() error {
+		var err error
+		ids, err = c.c.revisions(ctx, ch, id)
+		return err
+	})
+	return ids, err
+}
+
+// putResource implements csClient.putResource. Like putArchive,
+// it checks whether a failed attempt actually uploaded the
+// resource before trying again.
+func (c retryClient) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+	attempt := 0
+	return c.ing.retry(ctx, fmt.Sprintf("put resource %v/%s/%d", id, name, rev), func() error {
+		if attempt++; attempt > 1 && r != nil {
+			info, err := c.c.resourceInfo(ctx, id, name, rev)
+			if err != nil && errgo.Cause(err) != errNotFound {
+				return errgo.Mask(err, errgo.Any)
+			}
+			if err == nil && info.size == size {
+				hash, err := readerAtHash(r, size)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				if info.hash == hash {
+					c.ing.logf("resource %v/%s/%d was uploaded by a failed attempt", id, name, rev)
+					return nil
+				}
+			}
+		}
+		return c.c.putResource(ctx, id, name, rev, r, size)
+	})
+}
+
+// readerAtHash returns the hex-encoded SHA-384 hash of the
+// first size bytes of r.
+func readerAtHash(r io.ReaderAt, size int64) (string, error) {
+	h := sha512.New384()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return "", errgo.Notef(err, "cannot read resource")
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
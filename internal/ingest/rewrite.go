@@ -0,0 +1,451 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// RewriteRule specifies how the ids of some of the entities in the
+// source are changed when they're put into the destination, for
+// example from cs:~upstream/foo to cs:~ourteam/foo.
+//
+// The charms used by a rewritten bundle are rewritten with the
+// same rules, and the bundle's archive is changed so that it refers
+// to them by their new ids. References to promulgated charms in
+// bundles, such as cs:wordpress, have no owner, so they're only
+// rewritten by rules with no Owner that keep promulgated revisions.
+type RewriteRule struct {
+	// Owner, Name and Series select the entities that the rule
+	// applies to. An entity matches if each of them is either
+	// empty or equal to the corresponding part of its id.
+	Owner  string
+	Name   string
+	Series string
+
+	// ToOwner, ToName and ToSeries hold the replacements for
+	// the owner, name and series of matching entities. Parts for
+	// which they're empty are left unchanged. ToSeries is not
+	// applied to bundles or multi-series charms.
+	ToOwner  string
+	ToName   string
+	ToSeries string
+
+	// KeepPromulgated specifies that the promulgated revisions
+	// of matching entities are kept. By default, rewritten
+	// entities are not promulgated in the destination.
+	KeepPromulgated bool
+}
+
+// matches reports whether the rule applies to the given id.
+func (r *RewriteRule) matches(id *charm.URL) bool {
+	return (r.Owner == "" || r.Owner == id.User) &&
+		(r.Name == "" || r.Name == id.Name) &&
+		(r.Series == "" || r.Series == id.Series)
+}
+
+// apply returns id rewritten according to the rule.
+func (r *RewriteRule) apply(id *charm.URL) *charm.URL {
+	newId := *id
+	if r.ToOwner != "" && id.User != "" {
+		newId.User = r.ToOwner
+	}
+	if r.ToName != "" {
+		newId.Name = r.ToName
+	}
+	if r.ToSeries != "" && id.Series != "" && id.Series != "bundle" {
+		newId.Series = r.ToSeries
+	}
+	return &newId
+}
+
+// rewriteId returns the id that the entity with the given id
+// has in the destination, and the first of the given rules that
+// applies to it, or nil if none do.
+func rewriteId(rules []RewriteRule, id *charm.URL) (*charm.URL, *RewriteRule) {
+	for i := range rules {
+		if r := &rules[i]; r.matches(id) {
+			return r.apply(id), r
+		}
+	}
+	return id, nil
+}
+
+// rewriteCharmRef returns the charm reference ref from a bundle
+// rewritten according to the given rules.
+func rewriteCharmRef(rules []RewriteRule, ref string) string {
+	id, err := charm.ParseURL(ref)
+	if err != nil || id.Schema != "cs" {
+		// Leave local charms and anything else
+		// we don't understand alone.
+		return ref
+	}
+	newId, rule := rewriteId(rules, id)
+	if rule == nil || (id.User == "" && (rule.Owner != "" || !rule.KeepPromulgated)) {
+		return ref
+	}
+	if *newId == *id {
+		return ref
+	}
+	return newId.String()
+}
+
+// rewriteBundleArchive returns a copy of the given bundle archive with
+// the charm of each application in its bundle.yaml file replaced
+// by the result of calling rewrite. If nothing is changed, it returns
+// data itself. Comments in bundle.yaml are not preserved.
+func rewriteBundleArchive(data []byte, rewrite func(string) string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read bundle archive")
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	changed := false
+	for _, f := range zr.File {
+		content, err := readZipFile(f)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if f.Name == "bundle.yaml" {
+			var fileChanged bool
+			content, fileChanged, err = rewriteBundleYAML(content, rewrite)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			changed = changed || fileChanged
+		}
+		hdr := f.FileHeader
+		w, err := zw.CreateHeader(&hdr)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open %q in bundle archive", f.Name)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read %q in bundle archive", f.Name)
+	}
+	return content, nil
+}
+
+// rewriteBundleYAML rewrites the charms in the given bundle.yaml
+// contents, and reports whether any of them were changed.
+func rewriteBundleYAML(data []byte, rewrite func(string) string) ([]byte, bool, error) {
+	var bundle yaml.MapSlice
+	if err := yaml.Unmarshal(data, &bundle); err != nil {
+		return nil, false, errgo.Notef(err, "cannot parse bundle.yaml")
+	}
+	changed := false
+	for _, item := range bundle {
+		if item.Key != "applications" && item.Key != "services" {
+			continue
+		}
+		apps, _ := item.Value.(yaml.MapSlice)
+		for _, app := range apps {
+			fields, _ := app.Value.(yaml.MapSlice)
+			for i, field := range fields {
+				ref, ok := field.Value.(string)
+				if field.Key != "charm" || !ok {
+					continue
+				}
+				if newRef := rewrite(ref); newRef != ref {
+					fields[i].Value = newRef
+					changed = true
+				}
+			}
+		}
+	}
+	if !changed {
+		return data, false, nil
+	}
+	data, err := yaml.Marshal(bundle)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	return data, true, nil
+}
+
+// rewriteClient is a csClient that presents the entities in another
+// client as if their ids had been rewritten according to a set of
+// rules. It's used for the source, so that the rest of the ingest
+// only deals with destination ids.
+//
+// The ids passed to entityInfo are looked up unchanged, as they come
+// from the whitelist or from bundles. The ids passed to other methods
+// should be ones returned by entityInfo, and are mapped back to the
+// ids in the underlying client.
+//
+// The rewritten bundle archives are kept in temporary files in
+// tempDir until close is called.
+type rewriteClient struct {
+	csClient
+	rules         []RewriteRule
+	rewriteBundle func(data []byte, rewrite func(string) string) ([]byte, error)
+	tempDir       string
+	logf          func(string, ...interface{})
+
+	mu sync.Mutex
+	// srcIds and srcBaseIds map from rewritten ids and base ids
+	// to the ids in the underlying client.
+	srcIds     map[charm.URL]*charm.URL
+	srcBaseIds map[charm.URL]*charm.URL
+	// archives holds the rewritten archives of bundles, keyed
+	// by rewritten id. It holds a nil entry for bundles that were
+	// not changed.
+	archives map[charm.URL]*rewrittenArchive
+}
+
+// rewrittenArchive holds a bundle archive rewritten by a rewriteClient.
+type rewrittenArchive struct {
+	// path holds the name of the temporary file holding the archive.
+	path string
+	hash string
+	size int64
+}
+
+func newRewriteClient(c csClient, rules []RewriteRule, rewriteBundle func([]byte, func(string) string) ([]byte, error), tempDir string, logf func(string, ...interface{})) *rewriteClient {
+	if rewriteBundle == nil {
+		rewriteBundle = rewriteBundleArchive
+	}
+	return &rewriteClient{
+		csClient:      c,
+		rules:         rules,
+		rewriteBundle: rewriteBundle,
+		tempDir:       tempDir,
+		logf:          logf,
+		srcIds:        make(map[charm.URL]*charm.URL),
+		srcBaseIds:    make(map[charm.URL]*charm.URL),
+		archives:      make(map[charm.URL]*rewrittenArchive),
+	}
+}
+
+// close removes the temporary files holding the
+// rewritten bundle archives.
+func (c *rewriteClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, a := range c.archives {
+		if a != nil {
+			os.Remove(a.path)
+		}
+		delete(c.archives, id)
+	}
+}
+
+func (c *rewriteClient) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	e, err := c.csClient.entityInfo(ctx, ch, id)
+	if err != nil {
+		return nil, err
+	}
+	srcId := e.id
+	newId, rule := rewriteId(c.rules, srcId)
+	if rule != nil {
+		e.id = newId
+		if e.promulgatedId != nil {
+			if rule.KeepPromulgated {
+				e.promulgatedId = rule.apply(e.promulgatedId)
+			} else {
+				e.promulgatedId = nil
+			}
+		}
+	}
+	if err := c.record(srcId, e.id); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if e.id.Series == "bundle" && c.changesCharms(e) {
+		if err := c.rewriteArchive(ctx, srcId, e); err != nil {
+			return nil, errgo.Notef(err, "cannot rewrite %v", srcId)
+		}
+	}
+	return e, nil
+}
+
+// record records that the entity with the given id in the underlying
+// client is rewritten to newId. It returns an error if another entity
+// has already been rewritten to it.
+func (c *rewriteClient) record(srcId, newId *charm.URL) error {
+	srcBaseId, newBaseId := baseEntityId(srcId), baseEntityId(newId)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.srcBaseIds[*newBaseId]; ok && *prev != *srcBaseId {
+		return errgo.Newf("cannot rewrite %v to %v because %v is rewritten to it too", srcBaseId, newBaseId, prev)
+	}
+	if _, ok := c.srcIds[*newId]; !ok && *srcId != *newId {
+		c.logf("rewriting %v to %v", srcId, newId)
+	}
+	c.srcIds[*newId] = srcId
+	c.srcBaseIds[*newBaseId] = srcBaseId
+	return nil
+}
+
+// changesCharms reports whether the rules change any of the charms
+// used by the bundle e, so that its archive needs to be rewritten.
+// Bundles whose charms aren't known, such as those read from a
+// directory, are assumed to need it.
+func (c *rewriteClient) changesCharms(e *entityInfo) bool {
+	if e.bundleCharms == nil {
+		return true
+	}
+	for _, bc := range e.bundleCharms {
+		if rewriteCharmRef(c.rules, bc.charm) != bc.charm {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteArchive rewrites the charms in the archive of the bundle
+// with the given id in the underlying client, and changes the hash
+// and size in e to match.
+func (c *rewriteClient) rewriteArchive(ctx context.Context, srcId *charm.URL, e *entityInfo) error {
+	c.mu.Lock()
+	a, ok := c.archives[*e.id]
+	c.mu.Unlock()
+	if !ok {
+		var err error
+		a, err = c.newArchive(ctx, srcId)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		c.mu.Lock()
+		if prev, ok := c.archives[*e.id]; ok {
+			// The same bundle has been rewritten concurrently.
+			if a != nil {
+				os.Remove(a.path)
+			}
+			a = prev
+		} else {
+			c.archives[*e.id] = a
+		}
+		c.mu.Unlock()
+	}
+	if a != nil {
+		e.hash = a.hash
+		e.archiveSize = a.size
+	}
+	return nil
+}
+
+// newArchive rewrites the charms in the archive of the bundle with
+// the given id in the underlying client, and writes the result to
+// a temporary file. It returns nil if nothing was changed.
+func (c *rewriteClient) newArchive(ctx context.Context, srcId *charm.URL) (*rewrittenArchive, error) {
+	r, err := c.csClient.getArchive(ctx, srcId)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer r.Close()
+	orig, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	data, err := c.rewriteBundle(orig, func(ref string) string {
+		return rewriteCharmRef(c.rules, ref)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if bytes.Equal(data, orig) {
+		return nil, nil
+	}
+	f, err := ioutil.TempFile(c.tempDir, "")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, errgo.Notef(err, "cannot write rewritten archive")
+	}
+	return &rewrittenArchive{
+		path: f.Name(),
+		hash: fmt.Sprintf("%x", sha512.Sum384(data)),
+		size: int64(len(data)),
+	}, nil
+}
+
+// srcId returns the id in the underlying client of the
+// entity with the given rewritten id.
+func (c *rewriteClient) srcId(id *charm.URL) *charm.URL {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if srcId, ok := c.srcIds[*id]; ok {
+		return srcId
+	}
+	return id
+}
+
+// revisions returns ids in the underlying client, because
+// they're used to call entityInfo.
+func (c *rewriteClient) revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error) {
+	return c.csClient.revisions(ctx, ch, c.srcId(id))
+}
+
+func (c *rewriteClient) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
+	c.mu.Lock()
+	srcId, ok := c.srcBaseIds[*baseEntityId(id)]
+	c.mu.Unlock()
+	if !ok {
+		srcId = id
+	}
+	return c.csClient.getBaseEntity(ctx, srcId)
+}
+
+func (c *rewriteClient) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	c.mu.Lock()
+	a := c.archives[*id]
+	c.mu.Unlock()
+	if a != nil {
+		f, err := os.Open(a.path)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return f, nil
+	}
+	return c.csClient.getArchive(ctx, c.srcId(id))
+}
+
+func (c *rewriteClient) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	return c.csClient.resourceInfo(ctx, c.srcId(id), name, rev)
+}
+
+func (c *rewriteClient) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	return c.csClient.getResource(ctx, c.srcId(id), name, rev)
+}
+
+func (c *rewriteClient) dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error) {
+	return c.csClient.dockerResourceDownloadInfo(ctx, c.srcId(id), name, rev)
+}
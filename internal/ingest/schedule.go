@@ -0,0 +1,88 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+)
+
+// scheduler runs a set of tasks, each of which may depend on others,
+// within the limits of a limiter. Each task is started as soon as all
+// the tasks that it depends on have finished, whether or not they
+// succeeded, so a slow task only holds up the tasks that depend on it.
+// Once the context is done, the tasks that haven't started are
+// skipped.
+type scheduler struct {
+	ctx     context.Context
+	limiter *limiter
+
+	// mu guards the waiting field of the tasks
+	// once they're running.
+	mu    sync.Mutex
+	tasks []*task
+}
+
+// task holds a unit of work added to a scheduler.
+type task struct {
+	run func()
+
+	// waiting holds the number of tasks that this
+	// task depends on that have not yet finished.
+	waiting int
+
+	// dependents holds the tasks that depend on this one.
+	dependents []*task
+}
+
+func newScheduler(ctx context.Context, l *limiter) *scheduler {
+	return &scheduler{
+		ctx:     ctx,
+		limiter: l,
+	}
+}
+
+// add adds a task that calls run once all of the given tasks have
+// finished, and returns it. Nil dependencies are ignored. All the
+// tasks must be added before s.run is called. As a task can only
+// depend on tasks that have already been added, there can be no
+// dependency cycles.
+func (s *scheduler) add(run func(), deps ...*task) *task {
+	t := &task{
+		run: run,
+	}
+	for _, dep := range deps {
+		if dep != nil {
+			t.waiting++
+			dep.dependents = append(dep.dependents, t)
+		}
+	}
+	s.tasks = append(s.tasks, t)
+	return t
+}
+
+// run runs all the tasks and returns when they have all finished.
+func (s *scheduler) run() {
+	// There can never be more ready tasks than there
+	// are tasks, so sending to ready never blocks.
+	ready := make(chan *task, len(s.tasks))
+	for _, t := range s.tasks {
+		if t.waiting == 0 {
+			ready <- t
+		}
+	}
+	for i := 0; i < len(s.tasks); i++ {
+		t := <-ready
+		s.limiter.do(func() {
+			if s.ctx.Err() == nil {
+				t.run()
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, d := range t.dependents {
+				if d.waiting--; d.waiting == 0 {
+					ready <- d
+				}
+			}
+		})
+	}
+	s.limiter.wait()
+}
@@ -1,11 +1,15 @@
 package ingest
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"sort"
+	"time"
 
+	"github.com/juju/charm/v8/resource"
 	"github.com/juju/charmrepo/v6/csclient"
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"gopkg.in/errgo.v1"
@@ -13,23 +17,29 @@ import (
 	"github.com/juju/charmstore-client/internal/charm"
 )
 
+// charmstoreShim implements csClient using a charmstore client.
+// The client has no way of cancelling a request, so the context is
+// ignored; throttleClient abandons archive and resource transfers
+// in progress when it's done.
 type charmstoreShim struct {
 	*csclient.Client
 }
 
 var _ csClient = charmstoreShim{}
 
-func (cs charmstoreShim) entityInfo(ch params.Channel, id *charm.URL) (*entityInfo, error) {
+func (cs charmstoreShim) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
 	var meta struct {
-		Id             params.IdResponse `csclient:"unpromulgated-id"`
-		PromulgatedId  params.IdResponse
-		Published      params.PublishedResponse
-		BundleMetadata *charm.BundleData
-		ArchiveSize    params.ArchiveSizeResponse
-		Hash           params.HashResponse
-		ExtraInfo      map[string]json.RawMessage
-		CommonInfo     map[string]json.RawMessage
-		Resources      []params.Resource
+		Id                params.IdResponse `csclient:"unpromulgated-id"`
+		PromulgatedId     params.IdResponse
+		Published         params.PublishedResponse
+		BundleMetadata    *charm.BundleData
+		ArchiveSize       params.ArchiveSizeResponse
+		ArchiveUploadTime params.ArchiveUploadTimeResponse
+		Hash              params.HashResponse
+		SupportedSeries   params.SupportedSeriesResponse
+		ExtraInfo         map[string]json.RawMessage
+		CommonInfo        map[string]json.RawMessage
+		Resources         []params.Resource
 	}
 	_, err := cs.WithChannel(ch).Meta(id, &meta)
 	if err != nil {
@@ -44,9 +54,13 @@ func (cs charmstoreShim) entityInfo(ch params.Channel, id *charm.URL) (*entityIn
 		channels:      make(map[params.Channel]bool),
 		archiveSize:   meta.ArchiveSize.Size,
 		hash:          meta.Hash.Sum,
+		uploadTime:    meta.ArchiveUploadTime.UploadTime,
 		extraInfo:     meta.ExtraInfo,
 		commonInfo:    meta.CommonInfo,
 	}
+	if e.id.Series == "" {
+		e.supportedSeries = meta.SupportedSeries.SupportedSeries
+	}
 	for _, p := range meta.Published.Info {
 		e.channels[p.Channel] = p.Current
 	}
@@ -85,13 +99,23 @@ func (cs charmstoreShim) entityInfo(ch params.Channel, id *charm.URL) (*entityIn
 	return e, nil
 }
 
-func (cs charmstoreShim) getBaseEntity(id *charm.URL) (*baseEntityInfo, error) {
+func (cs charmstoreShim) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
 	var perms params.AllPermsResponse
 	if err := cs.WithChannel(params.UnpublishedChannel).Get("/"+baseEntityId(id).Path()+"/allperms", &perms); err != nil {
 		if errgo.Cause(err) == params.ErrNotFound {
 			return nil, errgo.WithCausef(nil, errNotFound, "")
 		}
 	}
+	var commonInfo map[string]json.RawMessage
+	if err := cs.WithChannel(params.UnpublishedChannel).Get("/"+baseEntityId(id).Path()+"/meta/common-info", &commonInfo); err != nil {
+		switch errgo.Cause(err) {
+		case params.ErrNotFound:
+			return nil, errgo.WithCausef(nil, errNotFound, "")
+		case params.ErrMetadataNotFound:
+		default:
+			return nil, errgo.Mask(err)
+		}
+	}
 	m := make(map[params.Channel]permission)
 	for ch, p := range perms.Perms {
 		m[ch] = permission{
@@ -100,11 +124,12 @@ func (cs charmstoreShim) getBaseEntity(id *charm.URL) (*baseEntityInfo, error) {
 		}
 	}
 	return &baseEntityInfo{
-		perms: m,
+		perms:      m,
+		commonInfo: commonInfo,
 	}, nil
 }
 
-func (cs charmstoreShim) setPerm(id *charm.URL, ch params.Channel, perm permission) error {
+func (cs charmstoreShim) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
 	if err := cs.WithChannel(ch).Put("/"+id.Path()+"/meta/perm", params.PermRequest{
 		Read:  perm.read,
 		Write: perm.write,
@@ -120,7 +145,7 @@ func sortBundleCharms(bcs []bundleCharm) {
 	})
 }
 
-func (cs charmstoreShim) getArchive(id *charm.URL) (io.ReadCloser, error) {
+func (cs charmstoreShim) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
 	r, _, _, _, err := cs.GetArchive(id)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -128,7 +153,7 @@ func (cs charmstoreShim) getArchive(id *charm.URL) (io.ReadCloser, error) {
 	return r, nil
 }
 
-func (cs charmstoreShim) putArchive(id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel) error {
+func (cs charmstoreShim) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
 	_, err := cs.UploadArchive(id, r, hash, size, promulgatedRevision, channels)
 	if err != nil {
 		return errgo.Mask(err)
@@ -136,7 +161,7 @@ func (cs charmstoreShim) putArchive(id *charm.URL, r io.ReadSeeker, hash string,
 	return nil
 }
 
-func (cs charmstoreShim) putExtraInfo(id *charm.URL, extraInfo map[string]json.RawMessage) error {
+func (cs charmstoreShim) putExtraInfo(ctx context.Context, id *charm.URL, extraInfo map[string]json.RawMessage) error {
 	err := cs.Put("/"+id.Path()+"/meta/extra-info", extraInfo)
 	if err != nil {
 		return errgo.Mask(err)
@@ -144,7 +169,15 @@ func (cs charmstoreShim) putExtraInfo(id *charm.URL, extraInfo map[string]json.R
 	return nil
 }
 
-func (cs charmstoreShim) publish(id *charm.URL, channels []params.Channel, resources map[string]int) error {
+func (cs charmstoreShim) putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error {
+	err := cs.Put("/"+baseEntityId(id).Path()+"/meta/common-info", commonInfo)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+func (cs charmstoreShim) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
 	err := cs.Publish(id, channels, resources)
 	if err != nil {
 		return errgo.Mask(err)
@@ -152,20 +185,26 @@ func (cs charmstoreShim) publish(id *charm.URL, channels []params.Channel, resou
 	return nil
 }
 
-func (cs charmstoreShim) resourceInfo(id *charm.URL, name string, rev int) (*resourceInfo, error) {
+func (cs charmstoreShim) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
 	var r params.Resource
 	if err := cs.Get(fmt.Sprintf("/%s/meta/resources/%s/%d", id.Path(), name, rev), &r); err != nil {
 		if cause := errgo.Cause(err); cause == params.ErrMetadataNotFound || cause == params.ErrNotFound {
 			return nil, errgo.WithCausef(nil, errNotFound, "")
 		}
+		return nil, errgo.Mask(err)
+	}
+	kind, err := resource.ParseType(r.Type)
+	if err != nil {
+		return nil, errgo.Notef(err, "bad type for resource %s/%d of %v", name, rev, id)
 	}
 	return &resourceInfo{
+		kind: kind,
 		size: r.Size,
 		hash: fmt.Sprintf("%x", r.Fingerprint),
 	}, nil
 }
 
-func (cs charmstoreShim) getResource(id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+func (cs charmstoreShim) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
 	r, err := cs.GetResource(id, name, rev)
 	if err != nil {
 		return nil, 0, errgo.Mask(err)
@@ -173,7 +212,79 @@ func (cs charmstoreShim) getResource(id *charm.URL, name string, rev int) (io.Re
 	return r.ReadCloser, r.Size, nil
 }
 
-func (cs charmstoreShim) putResource(id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+func (cs charmstoreShim) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
 	_, err := cs.UploadResourceWithRevision(id, name, rev, "", r, size, nil)
 	return errgo.Mask(err)
 }
+
+func (cs charmstoreShim) dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error) {
+	info, err := cs.DockerResourceDownloadInfo(id, name, rev)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &imageInfo{
+		imageName: info.ImageName,
+		username:  info.Username,
+		password:  info.Password,
+		// The charmstore only provides credentials for
+		// images held in its own registry.
+		external: info.Username == "" && info.Password == "",
+	}, nil
+}
+
+func (cs charmstoreShim) dockerResourceUploadInfo(ctx context.Context, id *charm.URL, name string) (*imageInfo, error) {
+	info, err := cs.DockerResourceUploadInfo(id, name)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &imageInfo{
+		imageName: info.ImageName,
+		username:  info.Username,
+		password:  info.Password,
+	}, nil
+}
+
+func (cs charmstoreShim) putDockerResource(ctx context.Context, id *charm.URL, name string, rev int, imageName, digest string) error {
+	// Note: csclient.AddDockerResource doesn't allow the
+	// revision to be specified, so make the request directly,
+	// in the same way that UploadResourceWithRevision does
+	// for file resources.
+	var resp params.ResourceUploadResponse
+	err := cs.DoWithResponse("POST", fmt.Sprintf("/%s/resource/%s?revision=%d", id.Path(), name, rev), params.DockerResourceUploadRequest{
+		ImageName: imageName,
+		Digest:    digest,
+	}, &resp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if resp.Revision != rev {
+		return errgo.Newf("resource %s/%d of %v was added as revision %d", name, rev, id, resp.Revision)
+	}
+	return nil
+}
+
+func (cs charmstoreShim) revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error) {
+	var resp params.RevisionInfoResponse
+	if err := cs.WithChannel(ch).Get("/"+id.WithRevision(-1).Path()+"/meta/revision-info", &resp); err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return nil, errgo.WithCausef(nil, errNotFound, "")
+		}
+		return nil, errgo.Mask(err)
+	}
+	return resp.Revisions, nil
+}
+
+func (cs charmstoreShim) listEntities(ctx context.Context, ch params.Channel, owner string) ([]*charm.URL, error) {
+	var resp params.ListResponse
+	v := url.Values{
+		"owner": {owner},
+	}
+	if err := cs.WithChannel(ch).Get("/list?"+v.Encode(), &resp); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ids := make([]*charm.URL, len(resp.Results))
+	for i, r := range resp.Results {
+		ids[i] = r.Id
+	}
+	return ids, nil
+}
@@ -0,0 +1,248 @@
+package ingest
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/juju/charmrepo/v6/csclient"
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// Source holds one of several sources to ingest from.
+type Source struct {
+	// Name identifies the source in reports, events and
+	// whitelist entries. Each source must have a different name.
+	Name string
+
+	// Client holds the charmstore client for the source.
+	Client *csclient.Client
+
+	// Dir holds a directory to ingest from instead of Client.
+	// See IngestParams.SrcDir. The whitelist is never read
+	// from source directories when IngestParams.Sources
+	// is used.
+	Dir string
+}
+
+// pinSources pins the base entities of the given whitelist entries
+// that name a source to that source, and returns the entries that
+// don't name an unknown source. Patterns are pinned when they're
+// expanded.
+func (ing *ingester) pinSources(entities []WhitelistEntity) []WhitelistEntity {
+	var result []WhitelistEntity
+	for _, e := range entities {
+		if e.Source != "" && !isPattern(e.EntityId) {
+			if id, err := charm.ParseURL(e.EntityId); err == nil {
+				if err := ing.pinSource(e.Source, id); err != nil {
+					ing.entityErrorf(e.EntityId, err, "%v", err)
+					continue
+				}
+			}
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// pinSource specifies that the base entity of the given id is
+// only taken from the source with the given name.
+func (ing *ingester) pinSource(name string, id *charm.URL) error {
+	if ing.sources == nil {
+		return errgo.Newf("unknown source %q", name)
+	}
+	return errgo.Mask(ing.sources.pin(name, id))
+}
+
+// sourceClient is a csClient that reads from several sources in
+// priority order. Entities are looked up in each source in turn
+// until one of them has the entity, unless the base entity has been
+// pinned to a single source. The source that an entity was found
+// in is recorded, and is used for everything else that's read for
+// the entity or for its base entity.
+//
+// Revisions of an entity that has already been found, and the
+// charms of a bundle that has already been found, are looked
+// up first in the source that it was found in.
+type sourceClient struct {
+	// The embedded client is the first source. It's only
+	// used for the methods that write, which are never
+	// called on the source.
+	csClient
+
+	sources []namedClient
+
+	mu sync.Mutex
+	// pinned maps base entity ids to the index of the only
+	// source that they're looked up in.
+	pinned map[charm.URL]int
+	// found maps the ids and base ids of the entities returned
+	// by entityInfo, and the base ids of the charms in bundles,
+	// to the index of the source that they were found in.
+	found map[charm.URL]int
+}
+
+func newSourceClient(sources []namedClient) *sourceClient {
+	return &sourceClient{
+		csClient: sources[0].client,
+		sources:  sources,
+		pinned:   make(map[charm.URL]int),
+		found:    make(map[charm.URL]int),
+	}
+}
+
+// sourceIndex returns the index of the source with the given name.
+func (c *sourceClient) sourceIndex(name string) (int, error) {
+	for i, s := range c.sources {
+		if s.name == name {
+			return i, nil
+		}
+	}
+	return 0, errgo.Newf("unknown source %q", name)
+}
+
+// named returns the client for the source with the given name.
+func (c *sourceClient) named(name string) (csClient, error) {
+	i, err := c.sourceIndex(name)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return c.sources[i].client, nil
+}
+
+// pin specifies that the base entity of the given id is only
+// looked up in the source with the given name.
+func (c *sourceClient) pin(name string, id *charm.URL) error {
+	i, err := c.sourceIndex(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	baseId := baseEntityId(id)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.pinned[*baseId]; ok && prev != i {
+		return errgo.Newf("cannot take %v from source %q because it's taken from source %q too", baseId, name, c.sources[prev].name)
+	}
+	c.pinned[*baseId] = i
+	return nil
+}
+
+// order returns the indexes of the sources to look up
+// the given id in, in order.
+func (c *sourceClient) order(id *charm.URL) []int {
+	baseId := baseEntityId(id)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.pinned[*baseId]; ok {
+		return []int{i}
+	}
+	first, ok := c.found[*baseId]
+	if !ok {
+		first = 0
+	}
+	order := []int{first}
+	for i := range c.sources {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (c *sourceClient) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	order := c.order(id)
+	for _, i := range order {
+		e, err := c.sources[i].client.entityInfo(ctx, ch, id)
+		if errgo.Cause(err) == errNotFound && len(order) > 1 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.record(i, e)
+		e.source = c.sources[i].name
+		return e, nil
+	}
+	return nil, errgo.WithCausef(nil, errNotFound, "%v not found in any source", id)
+}
+
+// record records that e was found in the source with the given index.
+// The first source that an id is found in is kept.
+func (c *sourceClient) record(i int, e *entityInfo) {
+	ids := []*charm.URL{e.id, baseEntityId(e.id)}
+	for _, bc := range e.bundleCharms {
+		if id, err := charm.ParseURL(bc.charm); err == nil {
+			ids = append(ids, baseEntityId(id))
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := c.found[*id]; !ok {
+			c.found[*id] = i
+		}
+	}
+}
+
+// source returns the client for the source that the entity
+// with the given id, or its base entity, was found in.
+func (c *sourceClient) source(id *charm.URL) csClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.found[*id]
+	if !ok {
+		i = c.found[*baseEntityId(id)]
+	}
+	return c.sources[i].client
+}
+
+func (c *sourceClient) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
+	return c.source(id).getBaseEntity(ctx, id)
+}
+
+func (c *sourceClient) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	return c.source(id).getArchive(ctx, id)
+}
+
+func (c *sourceClient) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	return c.source(id).resourceInfo(ctx, id, name, rev)
+}
+
+func (c *sourceClient) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	return c.source(id).getResource(ctx, id, name, rev)
+}
+
+func (c *sourceClient) dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error) {
+	return c.source(id).dockerResourceDownloadInfo(ctx, id, name, rev)
+}
+
+func (c *sourceClient) revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error) {
+	return c.source(id).revisions(ctx, ch, id)
+}
+
+// listEntities returns the entities listed by all the sources,
+// sorted by id, with any duplicates removed.
+func (c *sourceClient) listEntities(ctx context.Context, ch params.Channel, owner string) ([]*charm.URL, error) {
+	var ids []*charm.URL
+	seen := make(map[charm.URL]bool)
+	for _, s := range c.sources {
+		sids, err := s.client.listEntities(ctx, ch, owner)
+		if err != nil {
+			return nil, errgo.Notef(err, "source %q", s.name)
+		}
+		for _, id := range sids {
+			if !seen[*id] {
+				seen[*id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	return ids, nil
+}
@@ -0,0 +1,208 @@
+package ingest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+)
+
+// SyncCache records the source metadata of entities that have been
+// synced successfully, so that repeated ingests into the same
+// destination can skip entities that haven't changed since.
+// It is safe to use concurrently.
+//
+// A SyncCache assumes that the destination isn't changed other than
+// by the ingests that use it; to check everything in the destination
+// again, use a new SyncCache.
+type SyncCache struct {
+	mu sync.Mutex
+	// synced maps from entity id to the fingerprint of
+	// the source metadata it was last synced with.
+	synced map[string]string
+}
+
+// NewSyncCache returns a new empty SyncCache.
+func NewSyncCache() *SyncCache {
+	return &SyncCache{
+		synced: make(map[string]string),
+	}
+}
+
+// Len returns the number of entities recorded in the cache.
+func (c *SyncCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.synced)
+}
+
+func (c *SyncCache) get(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.synced[id]
+}
+
+func (c *SyncCache) set(id, fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.synced[id] = fingerprint
+}
+
+// fingerprint returns a summary of everything about e that
+// determines what's transferred to the destination for it,
+// so that two entities with the same fingerprint
+// need the same changes to be made. The srcPerms parameter
+// holds the permissions of its base entity in the source,
+// as returned by sourcePerms.
+func (ing *ingester) fingerprint(e *entityInfo, srcPerms map[params.Channel]permission) string {
+	var promulgatedId string
+	if e.promulgatedId != nil {
+		promulgatedId = e.promulgatedId.String()
+	}
+	var perms map[params.Channel]ACL
+	if len(srcPerms) > 0 {
+		perms = make(map[params.Channel]ACL)
+		for ch, perm := range srcPerms {
+			perms[ch] = ACL{Read: perm.read, Write: perm.write}
+		}
+	}
+	data, err := json.Marshal(struct {
+		Id                 string
+		PromulgatedId      string
+		Owner              string
+		Hash               string
+		Size               int64
+		Channels           map[params.Channel]bool
+		ExtraInfo          map[string]json.RawMessage
+		CommonInfo         map[string]json.RawMessage
+		Resources          map[string][]int
+		PublishedResources map[params.Channel]map[string]int
+		SkipResources      bool
+		SourcePerms        map[params.Channel]ACL
+	}{
+		Id:                 e.id.String(),
+		PromulgatedId:      promulgatedId,
+		Owner:              ing.params.owner,
+		Hash:               e.hash,
+		Size:               e.archiveSize,
+		Channels:           e.channels,
+		ExtraInfo:          e.extraInfo,
+		CommonInfo:         e.commonInfo,
+		Resources:          e.resources,
+		PublishedResources: e.publishedResources,
+		SkipResources:      e.skipResources,
+		SourcePerms:        perms,
+	})
+	if err != nil {
+		// Can't happen, as all the fields marshal.
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// syncKey returns the key for e in the sync cache. The
+// destinations of an ingest with several each have their
+// own entries.
+func (ing *ingester) syncKey(e *entityInfo) string {
+	if ing.params.destName == "" {
+		return e.id.String()
+	}
+	return ing.params.destName + " " + e.id.String()
+}
+
+// skipUnchanged returns the base entities in es that need to be
+// transferred. Base entities whose entities all have the same
+// source metadata as when they were last synced are left out, and
+// their entities and resources are counted as already present.
+// It also returns the number of resources in the base entities
+// left out.
+func (ing *ingester) skipUnchanged(es map[string]*whitelistBaseEntity) (map[string]*whitelistBaseEntity, int) {
+	cache := ing.params.syncCache
+	if cache == nil {
+		return es, 0
+	}
+	changed := make(map[string]*whitelistBaseEntity)
+	resourceCount := 0
+	for key, be := range es {
+		if !ing.isUnchanged(be) {
+			changed[key] = be
+			continue
+		}
+		ing.logf("%v has not changed since it was last synced", be.baseId)
+		resources := make(map[string]bool)
+		for _, e := range be.entities {
+			e.synced = true
+			e.unchanged = true
+			e.archivePresent = true
+			if e.skipResources {
+				continue
+			}
+			for name, revs := range e.resources {
+				for _, rev := range revs {
+					resources[fmt.Sprintf("%s/%d", name, rev)] = true
+				}
+			}
+		}
+		resourceCount += len(resources)
+	}
+	ing.mu.Lock()
+	ing.resourcesPresent += resourceCount
+	ing.mu.Unlock()
+	return changed, resourceCount
+}
+
+// isUnchanged reports whether all the entities in be have
+// been synced before with the same source metadata.
+// When the ACL policy copies the source permissions,
+// they must be unchanged too.
+func (ing *ingester) isUnchanged(be *whitelistBaseEntity) bool {
+	for _, e := range be.entities {
+		if ing.params.syncCache.get(ing.syncKey(e)) == "" {
+			return false
+		}
+	}
+	ing.limiter.start()
+	srcPerms, err := ing.sourcePerms(be.baseId)
+	ing.limiter.stop()
+	if err != nil {
+		// Transfer the base entity, so that the
+		// error is reported when the permissions
+		// are set.
+		return false
+	}
+	be.srcPerms = srcPerms
+	for _, e := range be.entities {
+		if ing.params.syncCache.get(ing.syncKey(e)) != ing.fingerprint(e, srcPerms) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordSynced records the entities in es in the sync cache
+// if everything in their base entity was synced without error.
+// Nothing is recorded in a dry run.
+func (ing *ingester) recordSynced(es map[string]*whitelistBaseEntity) {
+	cache := ing.params.syncCache
+	if cache == nil || ing.params.dryRun {
+		return
+	}
+	ing.mu.Lock()
+	defer ing.mu.Unlock()
+outer:
+	for _, be := range es {
+		if len(ing.entityErrors[be.baseId.String()]) > 0 {
+			continue
+		}
+		for _, e := range be.entities {
+			if !e.synced || len(ing.entityErrors[e.id.String()]) > 0 {
+				continue outer
+			}
+		}
+		for _, e := range be.entities {
+			cache.set(ing.syncKey(e), ing.fingerprint(e, be.srcPerms))
+		}
+	}
+}
@@ -126,7 +126,7 @@ func (cs0 *testCharmstore) assertContents(c *qt.C, entities []entitySpec, baseEn
 	specs := make([]entitySpec, len(entities))
 	for i, e := range entities {
 		id := charm.MustParseURL(e.id)
-		info, err := cs.entityInfo(params.NoChannel, id)
+		info, err := cs.entityInfo(context.Background(), params.NoChannel, id)
 		c.Assert(err, qt.Equals, nil, qt.Commentf("cannot get info on %v: %v", e.id, err))
 		specs[i] = entityInfoToSpec(info)
 		specs[i].content = specContent(c, cs0.client, info)
@@ -146,7 +146,7 @@ func (cs0 *testCharmstore) assertContents(c *qt.C, entities []entitySpec, baseEn
 	baseSpecs := make([]baseEntitySpec, len(baseEntities))
 	for i, e := range baseEntities1 {
 		id := charm.MustParseURL(e.id)
-		info, err := cs.getBaseEntity(id)
+		info, err := cs.getBaseEntity(context.Background(), id)
 		c.Assert(err, qt.Equals, nil, qt.Commentf("cannot get base info on %v: %v", e.id, err))
 		baseSpecs[i] = baseEntityInfoToSpec(id, info)
 	}
@@ -175,7 +175,7 @@ func (cs *testCharmstore) addEntity(c *qt.C, spec entitySpec) {
 	)
 	c.Assert(err, qt.Equals, nil)
 	if len(e.extraInfo) > 0 {
-		err := charmstoreShim{cs.client}.putExtraInfo(e.id, e.extraInfo)
+		err := charmstoreShim{cs.client}.putExtraInfo(context.Background(), e.id, e.extraInfo)
 		c.Assert(err, qt.Equals, nil)
 	}
 }
@@ -214,7 +214,7 @@ func (cs *testCharmstore) setPerms(c *qt.C, be baseEntitySpec, entities []*fakeE
 		panic(fmt.Sprintf("no entity found for base entity %v", be.id))
 	}
 	for ch, perm := range fakebe.perms {
-		err := csShim.setPerm(id, ch, perm)
+		err := csShim.setPerm(context.Background(), id, ch, perm)
 		c.Assert(err, qt.Equals, nil)
 	}
 }
@@ -239,7 +239,7 @@ func (cs *testCharmstore) addBaseEntity(c *qt.C, be baseEntitySpec, entities []*
 	}
 	csShim := charmstoreShim{cs.client}
 	for ch, perm := range fakebe.perms {
-		err := csShim.setPerm(baseEntityId(fakebe.id), ch, perm)
+		err := csShim.setPerm(context.Background(), baseEntityId(fakebe.id), ch, perm)
 		c.Assert(err, qt.Equals, nil)
 	}
 }
@@ -0,0 +1,471 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+
+	"github.com/juju/charmstore-client/internal/charm"
+)
+
+// throttleClient is a csClient that limits the number of concurrent
+// operations on another client, and the rate at which data is
+// read from it or written to it.
+type throttleClient struct {
+	client csClient
+
+	// slots holds a token for each operation in progress.
+	// It is nil if there's no limit.
+	slots chan struct{}
+
+	// download limits the rate at which archive and resource
+	// content is read from the client; upload limits the rate at
+	// which archive and resource content is written to it.
+	// Either may be nil.
+	download *rateLimiter
+	upload   *rateLimiter
+}
+
+var _ csClient = throttleClient{}
+
+// newThrottleClient returns a client that allows at most
+// concurrency operations at once on c, or any number
+// of operations if concurrency is zero.
+func newThrottleClient(c csClient, concurrency int, download, upload *rateLimiter) throttleClient {
+	tc := throttleClient{
+		client:   c,
+		download: download,
+		upload:   upload,
+	}
+	if concurrency > 0 {
+		tc.slots = make(chan struct{}, concurrency)
+	}
+	return tc
+}
+
+// start waits for a free slot and returns a function
+// that releases it. It returns an error without waiting
+// if ctx is done.
+func (c throttleClient) start(ctx context.Context) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-c.slots
+		})
+	}, nil
+}
+
+func (c throttleClient) entityInfo(ctx context.Context, ch params.Channel, id *charm.URL) (*entityInfo, error) {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return c.client.entityInfo(ctx, ch, id)
+}
+
+func (c throttleClient) getBaseEntity(ctx context.Context, id *charm.URL) (*baseEntityInfo, error) {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return c.client.getBaseEntity(ctx, id)
+}
+
+func (c throttleClient) getArchive(ctx context.Context, id *charm.URL) (io.ReadCloser, error) {
+	// The slot is held until the archive has been read.
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.client.getArchive(ctx, id)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return &throttledReadCloser{
+		Reader: c.download.reader(ctx, contextReader(ctx, r)),
+		c:      r,
+		stop:   stop,
+	}, nil
+}
+
+func (c throttleClient) putArchive(ctx context.Context, id *charm.URL, r io.ReadSeeker, hash string, size int64, promulgatedRevision int, channels []params.Channel, uploadTime time.Time) error {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return c.client.putArchive(ctx, id, c.upload.readSeeker(ctx, contextReadSeeker(ctx, r)), hash, size, promulgatedRevision, channels, uploadTime)
+}
+
+func (c throttleClient) putExtraInfo(ctx context.Context, id *charm.URL, extraInfo map[string]json.RawMessage) error {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return c.client.putExtraInfo(ctx, id, extraInfo)
+}
+
+func (c throttleClient) putCommonInfo(ctx context.Context, id *charm.URL, commonInfo map[string]json.RawMessage) error {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return c.client.putCommonInfo(ctx, id, commonInfo)
+}
+
+func (c throttleClient) setPerm(ctx context.Context, id *charm.URL, ch params.Channel, perm permission) error {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return c.client.setPerm(ctx, id, ch, perm)
+}
+
+func (c throttleClient) publish(ctx context.Context, id *charm.URL, channels []params.Channel, resources map[string]int) error {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return c.client.publish(ctx, id, channels, resources)
+}
+
+func (c throttleClient) resourceInfo(ctx context.Context, id *charm.URL, name string, rev int) (*resourceInfo, error) {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return c.client.resourceInfo(ctx, id, name, rev)
+}
+
+func (c throttleClient) getResource(ctx context.Context, id *charm.URL, name string, rev int) (io.ReadCloser, int64, error) {
+	// The slot is held until the resource has been read.
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, size, err := c.client.getResource(ctx, id, name, rev)
+	if err != nil {
+		stop()
+		return nil, 0, err
+	}
+	return &throttledReadCloser{
+		Reader: c.download.reader(ctx, contextReader(ctx, r)),
+		c:      r,
+		stop:   stop,
+	}, size, nil
+}
+
+func (c throttleClient) putResource(ctx context.Context, id *charm.URL, name string, rev int, r io.ReaderAt, size int64) error {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return c.client.putResource(ctx, id, name, rev, c.upload.readerAt(ctx, contextReaderAt(ctx, r)), size)
+}
+
+func (c throttleClient) dockerResourceDownloadInfo(ctx context.Context, id *charm.URL, name string, rev int) (*imageInfo, error) {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return c.client.dockerResourceDownloadInfo(ctx, id, name, rev)
+}
+
+func (c throttleClient) dockerResourceUploadInfo(ctx context.Context, id *charm.URL, name string) (*imageInfo, error) {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return c.client.dockerResourceUploadInfo(ctx, id, name)
+}
+
+func (c throttleClient) putDockerResource(ctx context.Context, id *charm.URL, name string, rev int, imageName, digest string) error {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return c.client.putDockerResource(ctx, id, name, rev, imageName, digest)
+}
+
+func (c throttleClient) listEntities(ctx context.Context, ch params.Channel, owner string) ([]*charm.URL, error) {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return c.client.listEntities(ctx, ch, owner)
+}
+
+func (c throttleClient) revisions(ctx context.Context, ch params.Channel, id *charm.URL) ([]*charm.URL, error) {
+	stop, err := c.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return c.client.revisions(ctx, ch, id)
+}
+
+// throttledReadCloser releases an operation slot when it's closed.
+type throttledReadCloser struct {
+	io.Reader
+	c    io.Closer
+	stop func()
+}
+
+func (r *throttledReadCloser) Close() error {
+	defer r.stop()
+	return r.c.Close()
+}
+
+// rateLimiter limits the rate at which data is transferred,
+// shared between all the readers that use it. A nil
+// *rateLimiter imposes no limit.
+type rateLimiter struct {
+	// rate holds the maximum number of bytes per second.
+	rate int64
+
+	mu sync.Mutex
+	// next holds the time at which the next
+	// transfer may start.
+	next time.Time
+}
+
+// newRateLimiter returns a rateLimiter that allows the given number
+// of bytes per second, or nil if rate is zero.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate: rate,
+	}
+}
+
+// maxChunk returns the maximum number of bytes that should be
+// transferred at once, so that transfers are spread out evenly.
+func (l *rateLimiter) maxChunk() int {
+	const max = 64 * 1024
+	switch {
+	case l.rate >= 10*max:
+		return max
+	case l.rate < 10:
+		return 1
+	}
+	return int(l.rate / 10)
+}
+
+// reserve reserves the transfer of n more bytes and returns
+// how long to wait before transferring them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return start.Sub(now)
+}
+
+// reader returns a reader that reads from r at no more than the
+// allowed rate. A read that's waiting for its turn returns
+// early with an error when ctx is done.
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	return limitReader(ctx, r, l)
+}
+
+// readSeeker is like reader but for an io.ReadSeeker.
+func (l *rateLimiter) readSeeker(ctx context.Context, r io.ReadSeeker) io.ReadSeeker {
+	if l == nil {
+		return r
+	}
+	return &rateReadSeeker{
+		rateReader: rateReader{ctx: ctx, r: r, ls: []*rateLimiter{l}},
+		s:          r,
+	}
+}
+
+// readerAt is like reader but for an io.ReaderAt.
+func (l *rateLimiter) readerAt(ctx context.Context, r io.ReaderAt) io.ReaderAt {
+	if l == nil || r == nil {
+		return r
+	}
+	return &rateReaderAt{ctx: ctx, r: r, l: l}
+}
+
+// limitReader returns a reader that reads from r at no more than the
+// rate allowed by all the given limiters, any of which may be nil.
+// As for rateLimiter.reader, waits are abandoned when ctx is done.
+func limitReader(ctx context.Context, r io.Reader, ls ...*rateLimiter) io.Reader {
+	var limiters []*rateLimiter
+	for _, l := range ls {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	if len(limiters) == 0 {
+		return r
+	}
+	return &rateReader{ctx: ctx, r: r, ls: limiters}
+}
+
+// sleep waits for the given duration, returning early
+// with an error if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type rateReader struct {
+	ctx context.Context
+	r   io.Reader
+	ls  []*rateLimiter
+}
+
+func (r *rateReader) Read(buf []byte) (int, error) {
+	for _, l := range r.ls {
+		if max := l.maxChunk(); len(buf) > max {
+			buf = buf[:max]
+		}
+	}
+	n, err := r.r.Read(buf)
+	if n > 0 {
+		// Wait for the slowest limiter; the others
+		// have reserved their share meanwhile.
+		var d time.Duration
+		for _, l := range r.ls {
+			if ld := l.reserve(n); ld > d {
+				d = ld
+			}
+		}
+		if err1 := sleep(r.ctx, d); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return n, err
+}
+
+type rateReadSeeker struct {
+	rateReader
+	s io.Seeker
+}
+
+func (r *rateReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.s.Seek(offset, whence)
+}
+
+type rateReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+	l   *rateLimiter
+}
+
+func (r *rateReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	total := 0
+	for len(buf) > 0 {
+		chunk := buf
+		if max := r.l.maxChunk(); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		n, err := r.r.ReadAt(chunk, off)
+		if err1 := sleep(r.ctx, r.l.reserve(n)); err1 != nil && err == nil {
+			err = err1
+		}
+		total += n
+		if err != nil {
+			return total, err
+		}
+		buf, off = buf[n:], off+int64(n)
+	}
+	return total, nil
+}
+
+// contextReader returns a reader that reads from r until ctx is done,
+// so that a transfer in progress is abandoned when the ingest is
+// cancelled, even by clients that don't use the context themselves.
+func contextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &ctxReader{ctx: ctx, r: r}
+}
+
+// contextReadSeeker is like contextReader but for an io.ReadSeeker.
+func contextReadSeeker(ctx context.Context, r io.ReadSeeker) io.ReadSeeker {
+	return &ctxReadSeeker{ctxReader{ctx: ctx, r: r}, r}
+}
+
+// contextReaderAt is like contextReader but for an io.ReaderAt.
+func contextReaderAt(ctx context.Context, r io.ReaderAt) io.ReaderAt {
+	if r == nil {
+		return nil
+	}
+	return &ctxReaderAt{ctx: ctx, r: r}
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(buf []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(buf)
+}
+
+type ctxReadSeeker struct {
+	ctxReader
+	s io.Seeker
+}
+
+func (r *ctxReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.s.Seek(offset, whence)
+}
+
+type ctxReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+}
+
+func (r *ctxReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.ReadAt(buf, off)
+}
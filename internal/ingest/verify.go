@@ -0,0 +1,445 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm/v8/resource"
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+)
+
+// VerifyStats holds the result of comparing the whitelisted
+// entities in the destination with those in the source.
+type VerifyStats struct {
+	BaseEntityCount int
+	EntityCount     int
+
+	// ResourceCount holds the number of resource
+	// revisions compared.
+	ResourceCount int
+
+	// Drift holds the differences found for each entity or base
+	// entity, sorted by id. Entities that match the source are
+	// not included.
+	Drift []EntityDrift
+
+	// Errors holds errors that prevented parts of the
+	// destination from being compared with the source.
+	Errors []string
+}
+
+// OK reports whether the destination matched the source
+// and everything could be compared.
+func (s VerifyStats) OK() bool {
+	return len(s.Drift) == 0 && len(s.Errors) == 0
+}
+
+// EntityDrift holds the differences found for an entity.
+type EntityDrift struct {
+	// Id holds the canonical id of the entity, or the
+	// base entity id for differences that relate to the
+	// base entity (common-info and ACLs).
+	Id string
+
+	// Differences holds the differences found.
+	Differences []Difference
+}
+
+// Difference describes something that differs between the
+// source and the destination.
+type Difference struct {
+	// What describes what differs, for example "archive hash"
+	// or "extra-info bugs-url".
+	What string
+
+	// Want holds what the destination should hold,
+	// and Got holds what it actually holds. Either is empty
+	// if there's nothing there. For ACLs, Want holds the ACL
+	// that an ingest sets according to IngestParams.ACLPolicy.
+	Want string
+	Got  string
+}
+
+// Verify resolves the whitelist in params against the source as
+// Ingest does and checks that the destination holds the same archives,
+// resources, extra-info, common-info and published channel revisions,
+// and that the ACLs are those set by Ingest. Nothing in the source or
+// destination is changed.
+//
+// Only the fields of params that specify the source, destination and
+// whitelist, and the Concurrency, SrcConcurrency, DestConcurrency,
+// Owner, ACLPolicy, Rewrites, Log, Notify, MaxRetries and
+// RegistryClient fields are used. Only one destination can be verified at once.
+// If ctx is done before the verification is complete, the
+// result includes an error saying that it was interrupted.
+func Verify(ctx context.Context, params IngestParams) VerifyStats {
+	srcs, dests, _, whitelist, err := params.clients()
+	if err == nil && len(dests) > 1 {
+		err = errgo.Newf("cannot verify more than one destination at once")
+	}
+	if err != nil {
+		return VerifyStats{
+			Errors: errorStats(params.Notify, "%v", err).Errors,
+		}
+	}
+	p := ingestParams{
+		ctx:             ctx,
+		dest:            dests[0].client,
+		whitelist:       whitelist,
+		concurrency:     params.Concurrency,
+		srcConcurrency:  params.SrcConcurrency,
+		destConcurrency: params.DestConcurrency,
+		owner:           params.Owner,
+		aclPolicy:       params.ACLPolicy,
+		rewrites:        params.Rewrites,
+		log:             params.Log,
+		notify:          params.Notify,
+		maxRetries:      params.MaxRetries,
+		registry:        params.RegistryClient,
+	}
+	p.setSources(srcs)
+	return verify(p)
+}
+
+// verify is the internal version of Verify.
+func verify(p ingestParams) VerifyStats {
+	f := newFanout(p)
+	defer f.close()
+	ing := f.dests[0].ing
+	resolvedEntities := ing.resolveWhitelist(p.whitelist)
+	var (
+		mu    sync.Mutex
+		stats VerifyStats
+	)
+	for _, be := range resolvedEntities {
+		be := be
+		stats.BaseEntityCount++
+		stats.EntityCount += len(be.entities)
+		ing.limiter.do(func() {
+			drift, resourceCount := ing.verifyBaseEntity(be)
+			mu.Lock()
+			defer mu.Unlock()
+			stats.Drift = append(stats.Drift, drift...)
+			stats.ResourceCount += resourceCount
+		})
+	}
+	ing.limiter.wait()
+	if err := ing.params.ctx.Err(); err != nil {
+		ing.addError("", nil, fmt.Sprintf("verification interrupted: %v", err))
+	}
+	sort.Slice(stats.Drift, func(i, j int) bool {
+		return stats.Drift[i].Id < stats.Drift[j].Id
+	})
+	stats.Errors = ing.errors
+	return stats
+}
+
+// verifyBaseEntity compares the base entity and all its entities in
+// the destination with the source. It returns the differences found
+// and the number of resource revisions compared.
+func (ing *ingester) verifyBaseEntity(be *whitelistBaseEntity) ([]EntityDrift, int) {
+	ing.logf("verifying %v", be.baseId)
+	var drift []EntityDrift
+	destBaseEntity, err := ing.params.dest.getBaseEntity(ing.params.ctx, be.baseId)
+	if err != nil {
+		if errgo.Cause(err) != errNotFound {
+			ing.entityErrorf(be.baseId.String(), err, "cannot get base entity for %q in destination: %v", be.baseId, err)
+			return nil, 0
+		}
+		// Nothing else can be there either.
+		return []EntityDrift{{
+			Id: be.baseId.String(),
+			Differences: []Difference{{
+				What: "base entity",
+				Want: be.baseId.String(),
+			}},
+		}}, 0
+	}
+	if diffs := ing.verifyBaseEntityInfo(be, destBaseEntity); len(diffs) > 0 {
+		drift = append(drift, EntityDrift{
+			Id:          be.baseId.String(),
+			Differences: diffs,
+		})
+	}
+	entities := make([]*entityInfo, 0, len(be.entities))
+	for _, e := range be.entities {
+		entities = append(entities, e)
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].id.String() < entities[j].id.String()
+	})
+	// Resource revisions are shared by all the entities
+	// of the base entity, so only compare each once.
+	resourcesDone := make(map[string]bool)
+	for _, e := range entities {
+		diffs := ing.verifyEntity(e)
+		if !e.skipResources {
+			for _, name := range sortedResourceNames(e.resources) {
+				for _, rev := range e.resources[name] {
+					key := fmt.Sprintf("%s/%d", name, rev)
+					if resourcesDone[key] {
+						continue
+					}
+					resourcesDone[key] = true
+					diffs = append(diffs, ing.verifyResource(e, name, rev)...)
+				}
+			}
+		}
+		if len(diffs) > 0 {
+			drift = append(drift, EntityDrift{
+				Id:          e.id.String(),
+				Differences: diffs,
+			})
+		}
+	}
+	return drift, len(resourcesDone)
+}
+
+// verifyBaseEntityInfo compares the common-info and ACLs of the
+// base entity in the destination, destBaseEntity, with what they
+// should be.
+func (ing *ingester) verifyBaseEntityInfo(be *whitelistBaseEntity, destBaseEntity *baseEntityInfo) []Difference {
+	var diffs []Difference
+	if e := be.firstEntity(); e != nil {
+		diffs = append(diffs, metadataDifferences("common-info", e.commonInfo, destBaseEntity.commonInfo)...)
+	}
+	srcPerms, err := ing.sourcePerms(be.baseId)
+	if err != nil {
+		ing.entityErrorf(be.baseId.String(), err, "cannot get base entity for %q from source: %v", be.baseId, err)
+		return diffs
+	}
+	var chans []params.Channel
+	found := make(map[params.Channel]bool)
+	for _, e := range be.entities {
+		for ch := range e.channels {
+			if !found[ch] {
+				found[ch] = true
+				chans = append(chans, ch)
+			}
+		}
+	}
+	for _, ch := range sortedChannels(chans) {
+		want := ing.perm(be.baseId, ch, srcPerms)
+		got := destBaseEntity.perms[ch]
+		if !aclEqual(want.read, got.read) {
+			diffs = append(diffs, Difference{
+				What: fmt.Sprintf("read ACL in %s", ch),
+				Want: strings.Join(want.read, ","),
+				Got:  strings.Join(got.read, ","),
+			})
+		}
+		if !aclEqual(want.write, got.write) {
+			diffs = append(diffs, Difference{
+				What: fmt.Sprintf("write ACL in %s", ch),
+				Want: strings.Join(want.write, ","),
+				Got:  strings.Join(got.write, ","),
+			})
+		}
+	}
+	return diffs
+}
+
+// verifyEntity compares the archive, extra-info and published
+// channels of the given entity in the destination with the source.
+func (ing *ingester) verifyEntity(e *entityInfo) []Difference {
+	destEntity, err := ing.params.dest.entityInfo(ing.params.ctx, params.NoChannel, e.id)
+	if err != nil {
+		if errgo.Cause(err) != errNotFound {
+			ing.entityErrorf(e.id.String(), err, "cannot get %q from destination: %v", e.id, err)
+			return nil
+		}
+		return []Difference{{
+			What: "archive hash",
+			Want: e.hash,
+		}}
+	}
+	var diffs []Difference
+	if destEntity.archiveSize != e.archiveSize {
+		diffs = append(diffs, Difference{
+			What: "archive size",
+			Want: fmt.Sprint(e.archiveSize),
+			Got:  fmt.Sprint(destEntity.archiveSize),
+		})
+	}
+	if destEntity.hash != e.hash {
+		diffs = append(diffs, Difference{
+			What: "archive hash",
+			Want: e.hash,
+			Got:  destEntity.hash,
+		})
+	}
+	diffs = append(diffs, metadataDifferences("extra-info", e.extraInfo, destEntity.extraInfo)...)
+	for _, ch := range sortedChannels(channelsOf(e)) {
+		if !e.channels[ch] {
+			continue
+		}
+		published, err := ing.params.dest.entityInfo(ing.params.ctx, ch, e.id.WithRevision(-1))
+		if err != nil && errgo.Cause(err) != errNotFound {
+			ing.entityErrorf(e.id.String(), err, "cannot get %q in %s from destination: %v", e.id.WithRevision(-1), ch, err)
+			continue
+		}
+		if published == nil || *published.id != *e.id {
+			d := Difference{
+				What: fmt.Sprintf("revision published in %s", ch),
+				Want: e.id.String(),
+			}
+			if published != nil {
+				d.Got = published.id.String()
+			}
+			diffs = append(diffs, d)
+			continue
+		}
+		if !resourcesEqual(published.resources, e.publishedResources[ch]) {
+			current := make(map[string]int)
+			for name, revs := range published.resources {
+				if len(revs) > 0 {
+					current[name] = revs[0]
+				}
+			}
+			diffs = append(diffs, Difference{
+				What: fmt.Sprintf("resources published in %s", ch),
+				Want: formatResources(e.publishedResources[ch]),
+				Got:  formatResources(current),
+			})
+		}
+	}
+	return diffs
+}
+
+// verifyResource compares the given resource revision
+// in the destination with the source.
+func (ing *ingester) verifyResource(e *entityInfo, name string, rev int) []Difference {
+	what := fmt.Sprintf("resource %s/%d", name, rev)
+	srcInfo, err := ing.params.src.resourceInfo(ing.params.ctx, e.id, name, rev)
+	if err != nil {
+		ing.entityErrorf(e.id.String(), err, "cannot get info on resource %s/%d for %q from source: %v", name, rev, e.id, err)
+		return nil
+	}
+	destInfo, err := ing.params.dest.resourceInfo(ing.params.ctx, e.id, name, rev)
+	if err != nil {
+		if errgo.Cause(err) != errNotFound {
+			ing.entityErrorf(e.id.String(), err, "cannot get info on resource %s/%d for %q from destination: %v", name, rev, e.id, err)
+			return nil
+		}
+		return []Difference{{
+			What: what,
+			Want: formatResourceInfo(srcInfo),
+		}}
+	}
+	if srcInfo.kind != destInfo.kind {
+		return []Difference{{
+			What: what + " type",
+			Want: srcInfo.kind.String(),
+			Got:  destInfo.kind.String(),
+		}}
+	}
+	if srcInfo.kind == resource.TypeContainerImage {
+		return ing.verifyImageResource(e, name, rev)
+	}
+	if srcInfo.size != destInfo.size || srcInfo.hash != destInfo.hash {
+		return []Difference{{
+			What: what,
+			Want: formatResourceInfo(srcInfo),
+			Got:  formatResourceInfo(destInfo),
+		}}
+	}
+	return nil
+}
+
+// verifyImageResource compares the image digests of the given container
+// image resource revision in the source and the destination. Images
+// that were copied to the destination registry have a different name,
+// so only external images are expected to have the same name too.
+func (ing *ingester) verifyImageResource(e *entityInfo, name string, rev int) []Difference {
+	srcImage, err := ing.params.src.dockerResourceDownloadInfo(ing.params.ctx, e.id, name, rev)
+	if err != nil {
+		ing.entityErrorf(e.id.String(), err, "cannot get download info for resource %s/%d for %q from source: %v", name, rev, e.id, err)
+		return nil
+	}
+	destImage, err := ing.params.dest.dockerResourceDownloadInfo(ing.params.ctx, e.id, name, rev)
+	if err != nil {
+		ing.entityErrorf(e.id.String(), err, "cannot get download info for resource %s/%d for %q from destination: %v", name, rev, e.id, err)
+		return nil
+	}
+	want, got := srcImage.imageName, destImage.imageName
+	if !srcImage.external {
+		_, want = splitDigest(want)
+		_, got = splitDigest(got)
+	}
+	if want == got {
+		return nil
+	}
+	return []Difference{{
+		What: fmt.Sprintf("resource %s/%d image", name, rev),
+		Want: want,
+		Got:  got,
+	}}
+}
+
+// metadataDifferences returns the differences between the metadata
+// in src and dest, labelled with the given kind of metadata.
+func metadataDifferences(kind string, src, dest map[string]json.RawMessage) []Difference {
+	changes := metadataChanges(src, dest)
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	diffs := make([]Difference, len(keys))
+	for i, k := range keys {
+		diffs[i] = Difference{
+			What: kind + " " + k,
+			Want: string(src[k]),
+			Got:  string(dest[k]),
+		}
+	}
+	return diffs
+}
+
+// aclEqual reports whether the two ACLs hold the same users,
+// ignoring order.
+func aclEqual(a, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return stringsEqual(a, b)
+}
+
+// channelsOf returns all the channels that e is to be published to.
+func channelsOf(e *entityInfo) []params.Channel {
+	chans := make([]params.Channel, 0, len(e.channels))
+	for ch := range e.channels {
+		chans = append(chans, ch)
+	}
+	return chans
+}
+
+func sortedResourceNames(resources map[string][]int) []string {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatResources returns the given resource revisions
+// in a readable form, for example "data/2 image/0".
+func formatResources(resources map[string]int) string {
+	revs := make([]string, 0, len(resources))
+	for name, rev := range resources {
+		revs = append(revs, fmt.Sprintf("%s/%d", name, rev))
+	}
+	sort.Strings(revs)
+	return strings.Join(revs, " ")
+}
+
+func formatResourceInfo(info *resourceInfo) string {
+	return fmt.Sprintf("%s, %d bytes, hash %s", info.kind, info.size, info.hash)
+}